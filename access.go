@@ -0,0 +1,213 @@
+package vrata
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// accessCheck decides whether a visitor's request may reach the local
+// server. It returns nil to let the request through, or the response to
+// reject it with.
+type accessCheck func(req *http.Request) *rejection
+
+// rejection is the response sent in place of forwarding a request
+type rejection struct {
+	status int
+	header http.Header
+}
+
+// accessChecks returns the checks configured in options, in the order
+// they run
+func accessChecks(options *TunnelOptions) []accessCheck {
+	var checks []accessCheck
+	if len(options.AllowIPs) > 0 || len(options.DenyIPs) > 0 {
+		checks = append(checks, ipRules(options.AllowIPs, options.DenyIPs))
+	}
+	if options.GeoIP != nil && (len(options.AllowCountries) > 0 || len(options.DenyCountries) > 0) {
+		checks = append(checks, countryRules(options.GeoIP, options.AllowCountries, options.DenyCountries))
+	}
+	if len(options.AllowPaths) > 0 || len(options.DenyPaths) > 0 {
+		checks = append(checks, pathRules(options.AllowPaths, options.DenyPaths))
+	}
+	if options.BasicAuth != nil {
+		checks = append(checks, options.BasicAuth.check)
+	}
+	if options.JWTAuth != nil {
+		checks = append(checks, options.JWTAuth.check)
+	}
+	if options.OIDCAuth != nil {
+		checks = append(checks, options.OIDCAuth.check)
+	}
+	if options.ShareLinks != nil {
+		checks = append(checks, options.ShareLinks.check)
+	}
+	return checks
+}
+
+// checkAccess runs the access checks against a request head and returns
+// the first rejection, or nil when the request may be forwarded
+func (tc *TunnelCluster) checkAccess(head []byte) *rejection {
+	if len(tc.checks) == 0 {
+		return nil
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		return &rejection{status: http.StatusBadRequest}
+	}
+	return tc.checkRequest(req)
+}
+
+// checkRequest runs the access checks against a request
+func (tc *TunnelCluster) checkRequest(req *http.Request) *rejection {
+	req.RemoteAddr = forwardedFor(req.Header)
+	for _, check := range tc.checks {
+		if denied := check(req); denied != nil {
+			return denied
+		}
+	}
+	return nil
+}
+
+// deny answers a request that failed the access checks
+func (conn *TunnelConnection) deny(remote io.Writer, denied *rejection) {
+	conn.log().Debug("denying request", "status", denied.status)
+	conn.cluster.rejected.Add(1)
+	writeRejection(remote, denied.status, denied.header)
+}
+
+// denyHTTP answers a request served by net/http that failed the access
+// checks
+func (conn *TunnelConnection) denyHTTP(w http.ResponseWriter, denied *rejection) {
+	conn.log().Debug("denying request", "status", denied.status)
+	conn.cluster.rejected.Add(1)
+	for name, values := range denied.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Connection", "close")
+	http.Error(w, http.StatusText(denied.status), denied.status)
+}
+
+// errRequestRejected is returned by forwardRequests after it answered a
+// request itself
+var errRequestRejected = errors.New("request rejected")
+
+// forwardRequests copies requests from the visitor to the local server one
+// at a time, so that every request on a kept-alive connection is
+// validated, passes the access checks and has its headers rewritten; the
+// first one was checked before the local server was dialed. It stops at
+// the first request that is rejected, after answering it. The method of every
+// forwarded request is sent to methods, when not nil, which is closed on
+// return. It returns io.EOF when the visitor is done sending.
+func (conn *TunnelConnection) forwardRequests(upstream *bufferedConn, local io.Writer, transformer *HeaderHostTransformer, methods chan<- string) error {
+	if methods != nil {
+		defer close(methods)
+	}
+
+	reader := upstream.reader
+	for first := true; ; first = false {
+		// Wait for the next request; the visitor may be done
+		if _, err := reader.Peek(1); err != nil {
+			return err
+		}
+
+		head, status := checkRequestHead(reader)
+		if status != 0 {
+			conn.deny(upstream, &rejection{status: status})
+			return errRequestRejected
+		}
+		if !first {
+			if denied := conn.cluster.checkAccess(head); denied != nil {
+				conn.deny(upstream, denied)
+				return errRequestRejected
+			}
+		}
+		head = bytes.Clone(head)
+		reader.Discard(len(head))
+
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+		if err != nil {
+			return err
+		}
+		if methods != nil {
+			methods <- req.Method
+		}
+
+		if err := transformer.rewriteHead(head, local); err != nil {
+			return err
+		}
+		if req.Method == http.MethodConnect || isUpgrade(req.Header) {
+			// The rest of the connection is another protocol
+			if _, err := spliceCopy(local, upstream, reader, -1); err != nil {
+				return err
+			}
+			return io.EOF
+		}
+		if err := copyRequestBody(local, reader, upstream, req); err != nil {
+			return err
+		}
+	}
+}
+
+// errBadChunk is returned for a malformed chunked request body
+var errBadChunk = errors.New("malformed chunked body")
+
+// copyRequestBody copies the body of req, framed as its head says, from
+// src to dst without decoding it. conn, when not nil, is the connection src
+// reads from, so large bodies can be spliced.
+func copyRequestBody(dst io.Writer, src *bufio.Reader, conn io.Reader, req *http.Request) error {
+	if len(req.TransferEncoding) > 0 && req.TransferEncoding[0] == "chunked" {
+		return copyChunked(dst, src, conn)
+	}
+	if req.ContentLength > 0 {
+		_, err := spliceCopy(dst, conn, src, req.ContentLength)
+		return err
+	}
+	return nil
+}
+
+// copyChunked copies a chunked body, trailers included, as is. conn is
+// the connection src reads from, or nil, like for copyRequestBody.
+func copyChunked(dst io.Writer, src *bufio.Reader, conn io.Reader) error {
+	for {
+		line, err := src.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write(line); err != nil {
+			return err
+		}
+
+		sizeText, _, _ := strings.Cut(string(bytes.TrimSpace(line)), ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeText), 16, 64)
+		if err != nil || size < 0 {
+			return errBadChunk
+		}
+
+		if size == 0 {
+			// Trailers end with an empty line
+			for {
+				line, err := src.ReadSlice('\n')
+				if err != nil {
+					return err
+				}
+				if _, err := dst.Write(line); err != nil {
+					return err
+				}
+				if len(bytes.TrimRight(line, "\r\n")) == 0 {
+					return nil
+				}
+			}
+		}
+
+		// Chunk data and its CRLF
+		if _, err := spliceCopy(dst, conn, src, size+2); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package vrata
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCopyRequestBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		body    string
+	}{
+		{
+			name:    "content length",
+			request: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\n",
+			body:    "hello",
+		},
+		{
+			name:    "chunked with trailer",
+			request: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n",
+			body:    "5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\nX-Sum: 1\r\n\r\n",
+		},
+		{
+			name:    "no body",
+			request: "GET / HTTP/1.1\r\nHost: a\r\n\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(tt.request)))
+			if err != nil {
+				t.Fatalf("ReadRequest() failed: %v", err)
+			}
+
+			// The next request must be left unread
+			next := "GET /next HTTP/1.1\r\n"
+			src := bufio.NewReader(strings.NewReader(tt.body + next))
+
+			var dst bytes.Buffer
+			if err := copyRequestBody(&dst, src, nil, req); err != nil {
+				t.Fatalf("copyRequestBody() failed: %v", err)
+			}
+			if dst.String() != tt.body {
+				t.Errorf("Copied %q, expected %q", dst.String(), tt.body)
+			}
+			if rest, _ := src.Peek(len(next)); string(rest) != next {
+				t.Errorf("Body copy consumed the next request, left %q", rest)
+			}
+		})
+	}
+}
+
+func TestCopyChunkedRejectsBadSize(t *testing.T) {
+	src := bufio.NewReader(strings.NewReader("zz\r\nhello\r\n0\r\n\r\n"))
+	if err := copyChunked(&bytes.Buffer{}, src, nil); err != errBadChunk {
+		t.Errorf("Expected errBadChunk, got %v", err)
+	}
+}
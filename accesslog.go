@@ -0,0 +1,63 @@
+package vrata
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// accessLogTime is the timestamp layout of the Apache log formats
+const accessLogTime = "02/Jan/2006:15:04:05 -0700"
+
+// accessLog writes one line per completed request in Apache combined log
+// format, followed by the request duration in microseconds (%D)
+type accessLog struct {
+	writer io.Writer
+	mutex  sync.Mutex
+}
+
+func newAccessLog(writer io.Writer) *accessLog {
+	if writer == nil {
+		return nil
+	}
+	return &accessLog{writer: writer}
+}
+
+// log writes the line for a completed exchange
+func (l *accessLog) log(info RequestInfo) {
+	if l == nil {
+		return
+	}
+
+	line := fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s \"%s\" \"%s\" %d\n",
+		orDash(info.RemoteAddr),
+		info.start.Format(accessLogTime),
+		info.Method, info.URL, orDash(info.proto),
+		info.StatusCode,
+		accessLogBytes(info.BytesOut),
+		orDash(info.Header.Get("Referer")),
+		orDash(info.Header.Get("User-Agent")),
+		info.Duration.Microseconds(),
+	)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	io.WriteString(l.writer, line)
+}
+
+// orDash returns "-" for empty log fields
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// accessLogBytes formats a size like %b: "-" when nothing was sent
+func accessLogBytes(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
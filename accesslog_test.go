@@ -0,0 +1,48 @@
+package vrata
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAccessLogCombinedFormat(t *testing.T) {
+	var out bytes.Buffer
+	log := newAccessLog(&out)
+
+	log.log(RequestInfo{
+		Method:     "GET",
+		URL:        "/search?q=go",
+		RemoteAddr: "192.0.2.1",
+		Header: http.Header{
+			"Referer":    {"https://example.com/"},
+			"User-Agent": {"curl/8.0"},
+		},
+		StatusCode: 200,
+		BytesOut:   512,
+		Duration:   1500 * time.Microsecond,
+		start:      time.Date(2024, 3, 5, 14, 7, 9, 0, time.UTC),
+		proto:      "HTTP/1.1",
+	})
+
+	want := `192.0.2.1 - - [05/Mar/2024:14:07:09 +0000] "GET /search?q=go HTTP/1.1" 200 512 "https://example.com/" "curl/8.0" 1500` + "\n"
+	if out.String() != want {
+		t.Errorf("Expected %q, got %q", want, out.String())
+	}
+}
+
+func TestAccessLogMissingFields(t *testing.T) {
+	var out bytes.Buffer
+	newAccessLog(&out).log(RequestInfo{Method: "HEAD", URL: "/", StatusCode: 204, start: time.Unix(0, 0).UTC()})
+
+	want := `- - - [01/Jan/1970:00:00:00 +0000] "HEAD / -" 204 - "-" "-" 0` + "\n"
+	if out.String() != want {
+		t.Errorf("Expected %q, got %q", want, out.String())
+	}
+}
+
+func TestAccessLogDisabled(t *testing.T) {
+	// A nil access log is a no-op
+	newAccessLog(nil).log(RequestInfo{})
+}
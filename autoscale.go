@@ -0,0 +1,122 @@
+package vrata
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// autoscaleInterval is how often an autoscaled pool checks how busy it is;
+// scaleDownAfter is how long it must have spare connections before one is
+// dropped
+var (
+	autoscaleInterval = time.Second
+	scaleDownAfter    = 30 * time.Second
+)
+
+// poolScale tracks the size of an autoscaled connection pool
+type poolScale struct {
+	size       int       // connections to keep, 0 = all
+	quietSince time.Time // since when the pool has had more than it needs
+	mutex      sync.Mutex
+
+	// wake makes the pool rescale right away, as a visitor arrives
+	wake chan struct{}
+}
+
+// minConnections returns the size an autoscaled pool starts with, or 0
+// when the pool doesn't autoscale
+func (o *TunnelOptions) minConnections() int {
+	if o.MinConnections == 0 && o.Lazy {
+		return 1
+	}
+	return o.MinConnections
+}
+
+// allowed returns how many of total connections the pool keeps
+func (s *poolScale) allowed(total int) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.size == 0 || s.size > total {
+		return total
+	}
+	return s.size
+}
+
+// autoscale resizes the pool to the visitors it serves until ctx is done
+func (tc *TunnelCluster) autoscale(ctx context.Context, host string, port int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			tc.rescale(ctx, host, port, now)
+		case <-tc.scale.wake:
+			tc.rescale(ctx, host, port, time.Now())
+		}
+	}
+}
+
+// visitorArrived lets an autoscaled pool dial a spare connection as soon
+// as its connections are all busy
+func (tc *TunnelCluster) visitorArrived() {
+	select {
+	case tc.scale.wake <- struct{}{}:
+	default:
+	}
+}
+
+// rescale keeps one spare connection beside the busy ones, between
+// MinConnections and the pool's limit. Busy connections include visitors
+// waiting in the admission queue. The pool grows at once and shrinks by
+// one connection per scaleDownAfter.
+func (tc *TunnelCluster) rescale(ctx context.Context, host string, port int, now time.Time) {
+	tc.mutex.RLock()
+	defer tc.mutex.RUnlock()
+
+	if tc.closed || tc.draining.Load() {
+		return
+	}
+
+	busy := 0
+	for _, conn := range tc.connections {
+		if conn.session.Load() == sessionServing {
+			busy++
+		}
+	}
+	total := len(tc.connections)
+	wanted := min(max(busy+1, tc.options.minConnections()), total)
+
+	tc.scale.mutex.Lock()
+	defer tc.scale.mutex.Unlock()
+
+	size := tc.scale.size
+	switch {
+	case wanted > size:
+		tc.scale.size = wanted
+		tc.scale.quietSince = time.Time{}
+		tc.log().Info("scaling connection pool up", "connections", wanted, "busy", busy)
+		// A throttled pool leaves the redials to maintenance
+		if !tc.throttle.limited() {
+			for _, conn := range tc.connections[size:wanted] {
+				tc.spawn(func() { conn.connect(ctx, host, port) })
+			}
+		}
+	case wanted < size && tc.scale.quietSince.IsZero():
+		tc.scale.quietSince = now
+	case wanted < size && now.Sub(tc.scale.quietSince) >= scaleDownAfter:
+		tc.scale.size = size - 1
+		tc.scale.quietSince = now
+		tc.log().Info("scaling connection pool down", "connections", size-1, "busy", busy)
+		// A busy connection is not redialed once its visitor is done
+		if conn := tc.connections[size-1]; conn.session.CompareAndSwap(sessionIdle, sessionDraining) {
+			conn.close()
+		}
+	case wanted == size:
+		tc.scale.quietSince = time.Time{}
+	}
+}
@@ -0,0 +1,118 @@
+package vrata
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPoolAutoscales(t *testing.T) {
+	defer func(interval, after time.Duration) {
+		autoscaleInterval, scaleDownAfter = interval, after
+	}(autoscaleInterval, scaleDownAfter)
+	autoscaleInterval, scaleDownAfter = 10*time.Millisecond, 50*time.Millisecond
+
+	relay := newMockRelay(t, 4)
+
+	handling := make(chan struct{}, 1)
+	release := make(chan struct{})
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handling <- struct{}{}
+		<-release
+		io.WriteString(w, "done")
+	}))
+	defer local.Close()
+
+	tunnel, err := ConnectAndOpen(local.Listener.Addr().(*net.TCPAddr).Port, &TunnelOptions{
+		Host:           relay.server.URL,
+		LocalHost:      "127.0.0.1",
+		MinConnections: 1,
+	})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	<-tunnel.Ready()
+	time.Sleep(50 * time.Millisecond)
+	if n := len(relay.conns); n != 1 {
+		t.Errorf("Expected the pool to start with 1 connection, relay got %d", n)
+	}
+
+	conn := startSlowRequest(t, relay, handling)
+	defer conn.Close()
+
+	// The only connection is busy, so a spare one is dialed
+	select {
+	case spare := <-relay.conns:
+		defer spare.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the pool to scale up")
+	}
+
+	close(release)
+	if _, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+
+	// Once quiet, the pool drops back to its minimum
+	waitFor(t, func() bool { return tunnel.cluster.scale.allowed(4) == 1 })
+}
+
+func TestPoolScaleAllowed(t *testing.T) {
+	var scale poolScale
+	if got := scale.allowed(10); got != 10 {
+		t.Errorf("Expected a fixed pool to keep all 10, got %d", got)
+	}
+	scale.size = 3
+	if got := scale.allowed(10); got != 3 {
+		t.Errorf("Expected 3, got %d", got)
+	}
+	if got := scale.allowed(2); got != 2 {
+		t.Errorf("Expected the size capped at the total, got %d", got)
+	}
+}
+
+func TestLazyPoolDialsOnDemand(t *testing.T) {
+	// Only a visitor arriving can make the pool grow
+	defer func(interval time.Duration) { autoscaleInterval = interval }(autoscaleInterval)
+	autoscaleInterval = time.Hour
+
+	relay := newMockRelay(t, 4)
+
+	handling := make(chan struct{}, 1)
+	release := make(chan struct{})
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handling <- struct{}{}
+		<-release
+	}))
+	defer local.Close()
+	defer close(release)
+
+	tunnel, err := ConnectAndOpen(local.Listener.Addr().(*net.TCPAddr).Port, &TunnelOptions{
+		Host:      relay.server.URL,
+		LocalHost: "127.0.0.1",
+		Lazy:      true,
+	})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	conn := startSlowRequest(t, relay, handling)
+	defer conn.Close()
+
+	select {
+	case spare := <-relay.conns:
+		defer spare.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a spare connection as the visitor arrived")
+	}
+	if n := len(relay.conns); n != 0 {
+		t.Errorf("Expected only one spare, relay got %d more", n)
+	}
+}
@@ -0,0 +1,79 @@
+package vrata
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by all connections of a tunnel. It
+// allows bursts of up to one second worth of traffic.
+type rateLimiter struct {
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+// newRateLimiter returns a limiter for bytesPerSecond, or nil (unlimited)
+// when it isn't positive
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), last: time.Now()}
+}
+
+// wait takes n bytes from the bucket, sleeping until they are available or
+// ctx is done
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	l.mutex.Lock()
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mutex.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(deficit / l.rate * float64(time.Second)))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitedConn paces traffic to and from the local server through a
+// tunnel-wide rate limiter
+type limitedConn struct {
+	net.Conn
+	ctx     context.Context
+	limiter *rateLimiter
+}
+
+func (lc *limitedConn) Write(p []byte) (int, error) {
+	if err := lc.limiter.wait(lc.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return lc.Conn.Write(p)
+}
+
+func (lc *limitedConn) Read(p []byte) (int, error) {
+	n, err := lc.Conn.Read(p)
+	if waitErr := lc.limiter.wait(lc.ctx, n); waitErr != nil && err == nil {
+		err = waitErr
+	}
+	return n, err
+}
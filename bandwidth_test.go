@@ -0,0 +1,44 @@
+package vrata
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterPaces(t *testing.T) {
+	limiter := newRateLimiter(1000)
+	ctx := context.Background()
+
+	// The first second worth of bytes is a free burst
+	start := time.Now()
+	limiter.wait(ctx, 1000)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Burst should not wait, took %s", elapsed)
+	}
+
+	start = time.Now()
+	limiter.wait(ctx, 200)
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Expected about 200ms wait, took %s", elapsed)
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	limiter := newRateLimiter(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := limiter.wait(ctx, 1000); err == nil {
+		t.Error("Expected cancellation error")
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	if newRateLimiter(0) != nil {
+		t.Error("Expected nil limiter for no limit")
+	}
+	if err := (*rateLimiter)(nil).wait(context.Background(), 1<<30); err != nil {
+		t.Errorf("Nil limiter should never wait, got %v", err)
+	}
+}
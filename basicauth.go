@@ -0,0 +1,37 @@
+package vrata
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+)
+
+// BasicAuth protects a tunnel with HTTP Basic credentials. Visitors
+// without them are answered with 401 Unauthorized and never reach the
+// local server.
+type BasicAuth struct {
+	Username string
+	Password string
+
+	// Realm is shown in the browser's login prompt; defaults to "vrata"
+	Realm string
+}
+
+// check admits requests carrying the configured credentials
+func (a *BasicAuth) check(req *http.Request) *rejection {
+	username, password, ok := req.BasicAuth()
+
+	// Compare both in constant time so neither leaks through timing
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(a.Username))
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(a.Password))
+	if ok && userOK&passOK == 1 {
+		return nil
+	}
+
+	challenge := fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, cmp.Or(a.Realm, "vrata"))
+	return &rejection{
+		status: http.StatusUnauthorized,
+		header: http.Header{"Www-Authenticate": {challenge}},
+	}
+}
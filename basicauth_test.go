@@ -0,0 +1,121 @@
+package vrata
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBasicAuthCheck(t *testing.T) {
+	auth := &BasicAuth{Username: "alice", Password: "s3cret"}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		send     bool
+		allowed  bool
+	}{
+		{name: "valid", username: "alice", password: "s3cret", send: true, allowed: true},
+		{name: "wrong password", username: "alice", password: "guess", send: true},
+		{name: "wrong user", username: "bob", password: "s3cret", send: true},
+		{name: "missing"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.send {
+				req.SetBasicAuth(tt.username, tt.password)
+			}
+
+			denied := auth.check(req)
+			if tt.allowed {
+				if denied != nil {
+					t.Errorf("Expected request to be allowed, got %d", denied.status)
+				}
+				return
+			}
+			if denied == nil || denied.status != http.StatusUnauthorized {
+				t.Fatalf("Expected 401, got %+v", denied)
+			}
+			if got := denied.header.Get("WWW-Authenticate"); got != `Basic realm="vrata", charset="UTF-8"` {
+				t.Errorf("Unexpected challenge %q", got)
+			}
+		})
+	}
+}
+
+func TestTunnelBasicAuth(t *testing.T) {
+	relay := newMockRelay(t, 1)
+
+	defer func(interval time.Duration) { maintenanceInterval = interval }(maintenanceInterval)
+	maintenanceInterval = 10 * time.Millisecond
+
+	var hits atomic.Int64
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.WriteString(w, "private")
+	}))
+	defer local.Close()
+	localPort := local.Listener.Addr().(*net.TCPAddr).Port
+
+	tunnel, err := ConnectAndOpen(localPort, &TunnelOptions{
+		Host:      relay.server.URL,
+		LocalHost: "127.0.0.1",
+		BasicAuth: &BasicAuth{Username: "alice", Password: "s3cret", Realm: "dev box"},
+	})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	resp := relay.roundTrip(t, "GET / HTTP/1.1\r\nHost: public.example\r\nConnection: close\r\n\r\n")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without credentials, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("WWW-Authenticate"); got != `Basic realm="dev box", charset="UTF-8"` {
+		t.Errorf("Unexpected challenge %q", got)
+	}
+	if hits.Load() != 0 {
+		t.Error("Unauthenticated request reached the local server")
+	}
+
+	// A kept-alive connection must not let later requests skip the check
+	var conn net.Conn
+	select {
+	case conn = <-relay.conns:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Tunnel client never reconnected to the relay")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: public.example\r\nAuthorization: Basic YWxpY2U6czNjcmV0\r\n\r\n")
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "private" {
+		t.Errorf("Expected the local response with credentials, got %d '%s'", resp.StatusCode, body)
+	}
+
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: public.example\r\n\r\n")
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for the second request on the connection, got %d", resp.StatusCode)
+	}
+	if hits.Load() != 1 {
+		t.Errorf("Expected 1 request at the local server, got %d", hits.Load())
+	}
+}
@@ -0,0 +1,347 @@
+package vrata
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Cassette holds recorded request/response interactions for record and
+// replay (VCR) mode
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+
+	path   string
+	size   int64 // of the file written so far
+	played map[int]bool
+	mutex  sync.Mutex
+}
+
+// Interaction is a single recorded request and the local server's response
+type Interaction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+// RecordedRequest is the request as it was forwarded to the local server
+type RecordedRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// RecordedResponse is the response the local server produced
+type RecordedResponse struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       []byte      `json:"body,omitempty"`
+}
+
+// NewCassette creates an empty cassette that is saved to path
+func NewCassette(path string) *Cassette {
+	return &Cassette{path: path}
+}
+
+// LoadCassette reads a previously recorded cassette from path
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cassette := &Cassette{path: path}
+	if err := json.Unmarshal(data, cassette); err != nil {
+		return nil, fmt.Errorf("invalid cassette %s: %w", path, err)
+	}
+
+	return cassette, nil
+}
+
+// cassetteEnd closes the interactions and the cassette in its file. Each
+// interaction after the first is written over it, followed by it again, so
+// the file stays valid without being rewritten.
+const cassetteEnd = "\n  ]\n}"
+
+// Add appends an interaction and persists it to disk
+func (c *Cassette) Add(interaction Interaction) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.Interactions = append(c.Interactions, interaction)
+	if c.path == "" {
+		return nil
+	}
+
+	if c.size == 0 {
+		data, err := json.MarshalIndent(c, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(c.path, data, 0o644); err != nil {
+			return err
+		}
+		c.size = int64(len(data))
+		return nil
+	}
+
+	data, err := json.MarshalIndent(interaction, "    ", "  ")
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(c.path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	data = slices.Concat([]byte(",\n    "), data, []byte(cassetteEnd))
+	_, err = file.WriteAt(data, c.size-int64(len(cassetteEnd)))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	c.size += int64(len(data) - len(cassetteEnd))
+	return nil
+}
+
+// Match finds the recorded interaction for a request. Interactions are
+// replayed in recording order; once all matches were played the last one
+// is repeated.
+func (c *Cassette) Match(method, url string) (*Interaction, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.played == nil {
+		c.played = make(map[int]bool)
+	}
+
+	last := -1
+	for i := range c.Interactions {
+		req := &c.Interactions[i].Request
+		if req.Method != method || req.URL != url {
+			continue
+		}
+		if !c.played[i] {
+			c.played[i] = true
+			return &c.Interactions[i], true
+		}
+		last = i
+	}
+
+	if last < 0 {
+		return nil, false
+	}
+	return &c.Interactions[last], true
+}
+
+// maxRecordedBody bounds how much of each request and response body is
+// recorded; the rest is left out of the cassette
+const maxRecordedBody = 1 << 20
+
+// recordingConn follows the traffic with the local server and records
+// every request/response pair once the response is complete. Like the
+// exchange monitor it parses copies of the streams, so only what the
+// parsers haven't caught up with and the current bodies are held.
+type recordingConn struct {
+	net.Conn
+	requests  *streamTap
+	responses *streamTap
+	pending   chan RecordedRequest
+	record    func(Interaction)
+	wg        sync.WaitGroup
+}
+
+// newRecordingConn returns conn, recording its exchanges with record
+func newRecordingConn(conn net.Conn, record func(Interaction)) *recordingConn {
+	rc := &recordingConn{
+		Conn:      conn,
+		requests:  newStreamTap(maxTapBuffer, nil),
+		responses: newStreamTap(maxTapBuffer, nil),
+		pending:   make(chan RecordedRequest, 64),
+		record:    record,
+	}
+	rc.wg.Add(2)
+	go rc.parseRequests()
+	go rc.parseResponses()
+	return rc
+}
+
+func (rc *recordingConn) Read(p []byte) (int, error) {
+	n, err := rc.Conn.Read(p)
+	if n > 0 {
+		rc.responses.Write(p[:n])
+	}
+	return n, err
+}
+
+func (rc *recordingConn) Write(p []byte) (int, error) {
+	n, err := rc.Conn.Write(p)
+	if n > 0 {
+		rc.requests.Write(p[:n])
+	}
+	return n, err
+}
+
+// close stops the parsers once they have recorded what they got
+func (rc *recordingConn) close() {
+	rc.requests.Close()
+	rc.responses.Close()
+	rc.wg.Wait()
+}
+
+// parseRequests reads the requests sent to the local server
+func (rc *recordingConn) parseRequests() {
+	defer rc.wg.Done()
+	reader := bufio.NewReader(rc.requests)
+	defer func() {
+		close(rc.pending)
+		io.Copy(io.Discard, reader)
+	}()
+
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		rc.pending <- RecordedRequest{
+			Method: req.Method,
+			URL:    req.URL.RequestURI(),
+			Header: req.Header,
+			Body:   recordedBody(req.Body),
+		}
+		// What follows an upgrade isn't HTTP
+		if isUpgrade(req.Header) {
+			return
+		}
+	}
+}
+
+// parseResponses reads the local server's responses and records them with
+// the requests they answer
+func (rc *recordingConn) parseResponses() {
+	defer rc.wg.Done()
+	reader := bufio.NewReader(rc.responses)
+	defer io.Copy(io.Discard, reader)
+
+	for recorded := range rc.pending {
+		req := &http.Request{Method: recorded.Method}
+		resp, err := http.ReadResponse(reader, req)
+		// Skip interim responses such as 100 Continue
+		for err == nil && resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+			resp, err = http.ReadResponse(reader, req)
+		}
+		if err != nil {
+			return
+		}
+		rc.record(Interaction{
+			Request: recorded,
+			Response: RecordedResponse{
+				StatusCode: resp.StatusCode,
+				Header:     resp.Header,
+				Body:       recordedBody(resp.Body),
+			},
+		})
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			return
+		}
+	}
+}
+
+// recordedBody reads body whole, keeping its first maxRecordedBody bytes
+func recordedBody(body io.ReadCloser) []byte {
+	defer body.Close()
+	data, _ := io.ReadAll(io.LimitReader(body, maxRecordedBody))
+	io.Copy(io.Discard, body)
+	return data
+}
+
+// serveCassette answers requests arriving on upstream from the cassette
+// without contacting the local server
+func serveCassette(cassette *Cassette, upstream io.ReadWriter, reader *bufio.Reader, onRequest, onResponse func(RequestInfo)) error {
+	return serveCanned(upstream, reader, onRequest, onResponse, func(req *http.Request) (int, http.Header, []byte) {
+		interaction, ok := cassette.Match(req.Method, req.URL.RequestURI())
+		if !ok {
+			return notFound(fmt.Sprintf("no recorded response for %s %s\n", req.Method, req.URL.RequestURI()))
+		}
+		return interaction.Response.StatusCode, interaction.Response.Header.Clone(), interaction.Response.Body
+	})
+}
+
+// serveCanned answers requests arriving on upstream with the responses
+// answer returns, until the visitor closes the connection. onRequest and
+// onResponse, when set, are told of every exchange like those forwarded
+// to the local server.
+func serveCanned(upstream io.ReadWriter, reader *bufio.Reader, onRequest, onResponse func(RequestInfo), answer func(req *http.Request) (int, http.Header, []byte)) error {
+	counter := &countingReader{reader: reader}
+	reader = bufio.NewReader(counter)
+	for {
+		before := counter.n - int64(reader.Buffered())
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+
+		info := RequestInfo{
+			Method:     req.Method,
+			Path:       req.URL.Path,
+			URL:        req.URL.RequestURI(),
+			RemoteAddr: forwardedFor(req.Header),
+			Header:     req.Header,
+			BytesIn:    counter.n - int64(reader.Buffered()) - before,
+			start:      time.Now(),
+			proto:      req.Proto,
+		}
+		if onRequest != nil {
+			onRequest(info)
+		}
+
+		status, header, body := answer(req)
+		if header == nil {
+			header = http.Header{}
+		}
+		resp := &http.Response{
+			StatusCode:    status,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+			Close:         req.Close,
+		}
+
+		written := &countingWriter{writer: upstream}
+		if err := resp.Write(written); err != nil {
+			return err
+		}
+		if onResponse != nil {
+			info.StatusCode = status
+			info.ResponseHeader = header
+			info.BytesOut = written.n
+			info.Duration = time.Since(info.start)
+			onResponse(info)
+		}
+		if resp.Close {
+			return nil
+		}
+	}
+}
+
+// notFound is the canned answer to requests nothing was prepared for
+func notFound(message string) (int, http.Header, []byte) {
+	return http.StatusNotFound, http.Header{"Content-Type": {"text/plain; charset=utf-8"}}, []byte(message)
+}
@@ -0,0 +1,234 @@
+package vrata
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCassetteSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+
+	cassette := NewCassette(path)
+	err := cassette.Add(Interaction{
+		Request:  RecordedRequest{Method: "POST", URL: "/hook?x=1", Body: []byte(`{"a":1}`)},
+		Response: RecordedResponse{StatusCode: 201, Header: http.Header{"X-Test": {"yes"}}, Body: []byte("created")},
+	})
+	if err != nil {
+		t.Fatalf("Add() failed: %v", err)
+	}
+
+	loaded, err := LoadCassette(path)
+	if err != nil {
+		t.Fatalf("LoadCassette() failed: %v", err)
+	}
+
+	if len(loaded.Interactions) != 1 {
+		t.Fatalf("Expected 1 interaction, got %d", len(loaded.Interactions))
+	}
+	got := loaded.Interactions[0]
+	if got.Request.URL != "/hook?x=1" {
+		t.Errorf("Expected URL '/hook?x=1', got '%s'", got.Request.URL)
+	}
+	if string(got.Response.Body) != "created" {
+		t.Errorf("Expected body 'created', got '%s'", got.Response.Body)
+	}
+	if got.Response.Header.Get("X-Test") != "yes" {
+		t.Errorf("Expected X-Test header to survive, got %v", got.Response.Header)
+	}
+}
+
+func TestCassetteMatchOrder(t *testing.T) {
+	cassette := NewCassette("")
+	cassette.Add(Interaction{Request: RecordedRequest{Method: "GET", URL: "/"}, Response: RecordedResponse{StatusCode: 200, Body: []byte("first")}})
+	cassette.Add(Interaction{Request: RecordedRequest{Method: "GET", URL: "/"}, Response: RecordedResponse{StatusCode: 200, Body: []byte("second")}})
+
+	for _, want := range []string{"first", "second", "second"} {
+		interaction, ok := cassette.Match("GET", "/")
+		if !ok {
+			t.Fatal("Expected a match")
+		}
+		if string(interaction.Response.Body) != want {
+			t.Errorf("Expected '%s', got '%s'", want, interaction.Response.Body)
+		}
+	}
+
+	if _, ok := cassette.Match("POST", "/"); ok {
+		t.Error("Expected no match for a different method")
+	}
+}
+
+func TestRecordingConnInteractions(t *testing.T) {
+	var interactions []Interaction
+	rc := newRecordingConn(nil, func(interaction Interaction) {
+		interactions = append(interactions, interaction)
+	})
+	rc.requests.Write([]byte("GET /a HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	rc.requests.Write([]byte("POST /b HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello"))
+	rc.responses.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	rc.responses.Write([]byte("HTTP/1.1 500 Internal Server Error\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nfail\r\n0\r\n\r\n"))
+	rc.close()
+
+	if len(interactions) != 2 {
+		t.Fatalf("Expected 2 interactions, got %d", len(interactions))
+	}
+	if interactions[1].Request.Method != "POST" || string(interactions[1].Request.Body) != "hello" {
+		t.Errorf("Unexpected second request: %+v", interactions[1].Request)
+	}
+	if interactions[1].Response.StatusCode != 500 || string(interactions[1].Response.Body) != "fail" {
+		t.Errorf("Unexpected second response: %+v", interactions[1].Response)
+	}
+}
+
+func TestRecordingConnCutsLargeBodies(t *testing.T) {
+	var interactions []Interaction
+	rc := newRecordingConn(nil, func(interaction Interaction) {
+		interactions = append(interactions, interaction)
+	})
+	large := maxRecordedBody + 1000
+	rc.requests.Write([]byte("GET /large HTTP/1.1\r\nHost: localhost\r\n\r\nGET /next HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	rc.responses.Write([]byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n", large)))
+	// Written in parts, as the parser keeps up with the connection
+	chunk := bytes.Repeat([]byte("x"), 64<<10)
+	for written := 0; written < large; written += len(chunk) {
+		rc.responses.Write(chunk[:min(len(chunk), large-written)])
+		waitForTap(t, rc.responses)
+	}
+	rc.responses.Write([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+	rc.close()
+
+	if len(interactions) != 2 {
+		t.Fatalf("Expected 2 interactions, got %d", len(interactions))
+	}
+	if n := len(interactions[0].Response.Body); n != maxRecordedBody {
+		t.Errorf("Recorded %d bytes of the large body, want %d", n, maxRecordedBody)
+	}
+	if interactions[1].Request.URL != "/next" || interactions[1].Response.StatusCode != http.StatusNoContent {
+		t.Errorf("Unexpected interaction after the large one: %+v", interactions[1])
+	}
+}
+
+// waitForTap waits until the parser reading tap has caught up
+func waitForTap(t *testing.T, tap *streamTap) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		tap.mutex.Lock()
+		buffered := tap.buf.Len()
+		tap.mutex.Unlock()
+		if buffered == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The parser didn't catch up")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCassetteAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	cassette := NewCassette(path)
+	for i := range 3 {
+		err := cassette.Add(Interaction{
+			Request:  RecordedRequest{Method: "GET", URL: fmt.Sprintf("/%d", i)},
+			Response: RecordedResponse{StatusCode: 200, Body: []byte("ok")},
+		})
+		if err != nil {
+			t.Fatalf("Add() failed: %v", err)
+		}
+
+		// The file is a whole cassette after every interaction, as if
+		// written at once
+		data, _ := os.ReadFile(path)
+		want, _ := json.MarshalIndent(cassette, "", "  ")
+		if !bytes.Equal(data, want) {
+			t.Fatalf("After %d interactions the file is\n%s\nwant\n%s", i+1, data, want)
+		}
+	}
+}
+
+func TestServeCassette(t *testing.T) {
+	cassette := NewCassette("")
+	cassette.Add(Interaction{
+		Request:  RecordedRequest{Method: "GET", URL: "/hello"},
+		Response: RecordedResponse{StatusCode: 200, Body: []byte("recorded")},
+	})
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		defer server.Close()
+		serveCassette(cassette, server, bufio.NewReader(server), nil, nil)
+	}()
+
+	go io.WriteString(client, "GET /hello HTTP/1.1\r\nHost: x\r\n\r\nGET /missing HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+
+	reader := bufio.NewReader(client)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(body) != "recorded" {
+		t.Errorf("Expected recorded response, got %d '%s'", resp.StatusCode, body)
+	}
+
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusNotFound || !strings.Contains(string(body), "/missing") {
+		t.Errorf("Expected 404 for unrecorded request, got %d '%s'", resp.StatusCode, body)
+	}
+}
+
+func TestTunnelRecords(t *testing.T) {
+	relay := newMockRelay(t, 1)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "recorded")
+	}))
+	defer local.Close()
+
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	tunnel, err := ConnectAndOpen(local.Listener.Addr().(*net.TCPAddr).Port, &TunnelOptions{
+		Host:       relay.server.URL,
+		LocalHost:  "127.0.0.1",
+		RecordFile: path,
+	})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	resp := relay.roundTrip(t, "GET /hello HTTP/1.1\r\nHost: public.example\r\nConnection: close\r\n\r\n")
+	resp.Body.Close()
+
+	// Interactions are saved as they complete
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		cassette, err := LoadCassette(path)
+		if err == nil && len(cassette.Interactions) == 1 {
+			got := cassette.Interactions[0]
+			if got.Request.URL != "/hello" || string(got.Response.Body) != "recorded" {
+				t.Errorf("Unexpected interaction: %+v", got)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("No interaction recorded: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
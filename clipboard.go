@@ -0,0 +1,57 @@
+package vrata
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// ErrNoClipboard is returned by CopyToClipboard when no clipboard tool is
+// installed
+var ErrNoClipboard = errors.New("no clipboard tool found (install wl-clipboard, xclip or xsel)")
+
+// CopyToClipboard places text on the system clipboard, with pbcopy on
+// macOS, clip on Windows, and wl-copy, xclip or xsel elsewhere
+func CopyToClipboard(text string) error {
+	args, err := clipboardCommand()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if message := strings.TrimSpace(string(output)); message != "" {
+			return errors.New(args[0] + ": " + message)
+		}
+		return err
+	}
+	return nil
+}
+
+// clipboardCommand returns the command that copies its input to the
+// clipboard
+func clipboardCommand() ([]string, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		return []string{"pbcopy"}, nil
+	case "windows":
+		return []string{"clip"}, nil
+	}
+
+	var candidates [][]string
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		candidates = append(candidates, []string{"wl-copy"})
+	}
+	candidates = append(candidates,
+		[]string{"xclip", "-selection", "clipboard"},
+		[]string{"xsel", "--clipboard", "--input"},
+	)
+	for _, args := range candidates {
+		if _, err := exec.LookPath(args[0]); err == nil {
+			return args, nil
+		}
+	}
+	return nil, ErrNoClipboard
+}
@@ -0,0 +1,37 @@
+package vrata
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCopyToClipboard(t *testing.T) {
+	if runtime.GOOS == "darwin" || runtime.GOOS == "windows" {
+		t.Skip("The clipboard tool is built in")
+	}
+
+	// A fake xclip keeps what it was given
+	dir := t.TempDir()
+	copied := filepath.Join(dir, "copied")
+	script := "#!/bin/sh\n[ \"$*\" = \"-selection clipboard\" ] || exit 1\nIFS= read -r line\nprintf %s \"$line\" > " + copied + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "xclip"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	t.Setenv("WAYLAND_DISPLAY", "")
+
+	if err := CopyToClipboard("https://abc123.loca.lt"); err != nil {
+		t.Fatalf("CopyToClipboard() failed: %v", err)
+	}
+	if data, _ := os.ReadFile(copied); string(data) != "https://abc123.loca.lt" {
+		t.Errorf("Clipboard holds %q", data)
+	}
+
+	t.Setenv("PATH", t.TempDir())
+	if err := CopyToClipboard("x"); !errors.Is(err, ErrNoClipboard) {
+		t.Errorf("Without tools: got %v, want ErrNoClipboard", err)
+	}
+}
@@ -1,50 +1,197 @@
 package vrata
 
 import (
+	"bufio"
+	"bytes"
 	"context"
-	"crypto/tls"
+	"errors"
 	"fmt"
+	"html/template"
 	"io"
+	"log/slog"
 	"net"
+	"net/http"
 	"net/url"
-	"strings"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+// maintenanceInterval is how often dropped connections are redialed,
+// unless Timeouts.Maintenance is set
+var maintenanceInterval = 30 * time.Second
+
 // TunnelCluster manages multiple connections to the localtunnel server
 type TunnelCluster struct {
 	info        *TunnelInfo
 	options     *TunnelOptions
 	events      *TunnelEvents
 	connections []*TunnelConnection
+	cassette    *Cassette
+	queue       *admissionQueue
+	accessLog   *accessLog
+	latencies   *routeLatencies
+	bandwidth   *rateLimiter
+	capture     *captureBudget
+	checks      []accessCheck
+	logger      *slog.Logger
 	mutex       sync.RWMutex
 	closed      bool
+	cancel      context.CancelFunc // stops the pool's goroutines
+	goroutines  sync.WaitGroup     // the pool's goroutines, which Close waits for
+	draining    atomic.Bool        // no new visitors, no redials
+
+	// responseInterceptors are the options' interceptors, after the
+	// built-in ones the options enable
+	responseInterceptors []ResponseInterceptor
+	// forwarding applies ForwardedHeaders with the tunnel URL
+	forwarding forwarding
+	// e2e answers sealed requests when E2EKey is set
+	e2e *e2eServer
+
+	// errorPage answers visitors when the local server is down
+	errorPage *template.Template
+	health    healthState
+	targets   *targetBalancer
+	failover  failoverState
+	restart   restartState
+	http2     http2Targets
+
+	// requests counts completed exchanges, reconnects redials of dropped
+	// connections
+	requests   atomic.Int64
+	reconnects atomic.Int64
+	rejected   atomic.Int64
+	lastError  lastError
+
+	// rtt is the smoothed TCP handshake time to the relay, in nanoseconds
+	rtt atomic.Int64
+
+	// throttle limits redials while the relay is throttling the tunnel,
+	// stop closes the whole tunnel when it should give up
+	throttle throttleState
+	stop     func()
+
+	// scale is the pool size while it autoscales
+	scale poolScale
+
+	// ready is called once, when the first data connection is up
+	ready     func()
+	readyOnce sync.Once
+
+	// state receives the pool's state as connections come and go
+	state func(TunnelState)
+	pool  poolState
+
+	// stream receives a copy of every event for SSE subscribers
+	stream *EventStream
 }
 
 // TunnelConnection represents a single connection to the tunnel server
 type TunnelConnection struct {
+	id      int
 	cluster *TunnelCluster
+	logger  *slog.Logger
 	conn    net.Conn
 	active  bool
+	dialing bool
+	failing bool // the last dial failed
 	mutex   sync.RWMutex
+
+	// bytesIn and bytesOut count request and response bytes proxied over
+	// this connection across all its sessions
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	// connectedAt is when the current session was established,
+	// lastActivity when bytes last flowed, both in Unix nanoseconds
+	connectedAt  atomic.Int64
+	lastActivity atomic.Int64
+	requests     atomic.Int64
+	current      atomic.Pointer[RequestInfo]
+
+	// session is sessionIdle, sessionServing or sessionDraining
+	session atomic.Int32
+	// drop is why the connection last went away while idle
+	drop *connectionDrop
 }
 
 // NewTunnelCluster creates a new tunnel cluster
 func NewTunnelCluster(info *TunnelInfo, options *TunnelOptions, events *TunnelEvents) (*TunnelCluster, error) {
-	return &TunnelCluster{
-		info:    info,
-		options: options,
-		events:  events,
-	}, nil
+	tc := &TunnelCluster{
+		info:      info,
+		options:   options,
+		events:    events,
+		queue:     newAdmissionQueue(options.MaxConcurrentRequests, options.MaxRequestsPerClient),
+		accessLog: newAccessLog(options.AccessLog),
+		latencies: newRouteLatencies(),
+		bandwidth: newRateLimiter(options.BandwidthLimit),
+		capture:   newCaptureBudget(options.MaxCaptureBytes),
+		checks:    accessChecks(options),
+		logger:    options.logger().With("tunnel", info.ID),
+
+		responseInterceptors: options.responseInterceptors(info.URL),
+		forwarding:           options.forwarding(info.URL),
+		targets:              newTargetBalancer(options.LocalTargets, options.Balance),
+	}
+
+	errorPage, err := options.parseErrorPage()
+	if err != nil {
+		return nil, err
+	}
+	tc.errorPage = errorPage
+	tc.scale.wake = make(chan struct{}, 1)
+
+	switch {
+	case options.ReplayFile != "":
+		cassette, err := LoadCassette(options.ReplayFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load cassette: %w", err)
+		}
+		tc.cassette = cassette
+	case options.RecordFile != "":
+		tc.cassette = NewCassette(options.RecordFile)
+	}
+
+	if options.E2EKey != nil {
+		// Sealed requests pass the access checks once decrypted
+		check := func(req *http.Request) *rejection {
+			denied := tc.checkRequest(req)
+			if denied != nil {
+				tc.rejected.Add(1)
+			}
+			return denied
+		}
+		if tc.e2e, err = newE2EServer(options, tc.forwarding, check); err != nil {
+			return nil, err
+		}
+	}
+
+	return tc, nil
 }
 
 // Start begins the cluster operation
 func (tc *TunnelCluster) Start(ctx context.Context) error {
+	tc.mutex.Lock()
+	if tc.closed {
+		tc.mutex.Unlock()
+		return nil
+	}
+	ctx, tc.cancel = context.WithCancel(ctx)
+	// Close waits for the goroutines started here
+	tc.goroutines.Add(1)
+	defer tc.goroutines.Done()
+	tc.mutex.Unlock()
+
 	maxConn := tc.info.MaxConn
 	if maxConn <= 0 {
 		maxConn = 10 // Default connection count
 	}
+	if tc.options.MaxConnections > 0 && maxConn > tc.options.MaxConnections {
+		maxConn = tc.options.MaxConnections
+	}
 
 	// Parse the tunnel URL to get connection details
 	tunnelURL, err := url.Parse(tc.info.URL)
@@ -57,44 +204,85 @@ func (tc *TunnelCluster) Start(ctx context.Context) error {
 		return fmt.Errorf("could not determine host from URL: %s", tc.info.URL)
 	}
 
+	// An autoscaled pool starts small and dials the rest when it's busy
+	dial := maxConn
+	if minConn := tc.options.minConnections(); minConn > 0 {
+		dial = min(minConn, maxConn)
+		tc.scale.size = dial
+	}
+
+	tc.log().Info("starting connection pool", "host", host, "port", tc.info.Port, "connections", dial, "max", maxConn)
+
 	// Create connections
 	for i := 0; i < maxConn; i++ {
 		conn := &TunnelConnection{
+			id:      i,
 			cluster: tc,
+			logger:  tc.log().With("conn", i),
 		}
 
 		tc.mutex.Lock()
 		tc.connections = append(tc.connections, conn)
 		tc.mutex.Unlock()
 
-		go conn.connect(ctx, host, tc.info.Port)
+		if i < dial {
+			tc.spawn(func() { conn.connect(ctx, host, tc.info.Port) })
+		}
 	}
 
 	// Keep connections alive
-	go tc.maintainConnections(ctx, host, tc.info.Port)
+	tc.spawn(func() { tc.maintainConnections(ctx, host, tc.info.Port, tc.options.Timeouts.maintenance()) })
+	if tc.scale.size > 0 {
+		tc.spawn(func() { tc.autoscale(ctx, host, tc.info.Port, autoscaleInterval) })
+	}
+
+	if tc.options.HealthCheck != nil {
+		tc.spawn(func() { tc.checkHealth(ctx) })
+	}
 
 	return nil
 }
 
-// Close shuts down the cluster
+// spawn runs f in a goroutine that Close waits for. It's only called from
+// the pool's own goroutines, so Close can't miss one.
+func (tc *TunnelCluster) spawn(f func()) {
+	tc.goroutines.Add(1)
+	go func() {
+		defer tc.goroutines.Done()
+		f()
+	}()
+}
+
+// Close shuts down the cluster and waits for its goroutines: dials,
+// maintenance and every visitor being served, whose connections to the
+// relay and the local server it closes
 func (tc *TunnelCluster) Close() {
 	tc.mutex.Lock()
-	defer tc.mutex.Unlock()
-
 	if tc.closed {
+		tc.mutex.Unlock()
 		return
 	}
 
 	tc.closed = true
+	tc.log().Info("closing connection pool")
+	if tc.cancel != nil {
+		tc.cancel()
+	}
 
 	for _, conn := range tc.connections {
 		conn.close()
 	}
+	tc.mutex.Unlock()
+
+	tc.goroutines.Wait()
+	if tc.e2e != nil {
+		tc.e2e.transport.CloseIdleConnections()
+	}
 }
 
 // maintainConnections keeps the connection pool healthy
-func (tc *TunnelCluster) maintainConnections(ctx context.Context, host string, port int) {
-	ticker := time.NewTicker(30 * time.Second)
+func (tc *TunnelCluster) maintainConnections(ctx context.Context, host string, port int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
@@ -103,6 +291,7 @@ func (tc *TunnelCluster) maintainConnections(ctx context.Context, host string, p
 			return
 		case <-ticker.C:
 			tc.checkConnections(ctx, host, port)
+			tc.updateState()
 		}
 	}
 }
@@ -112,13 +301,14 @@ func (tc *TunnelCluster) checkConnections(ctx context.Context, host string, port
 	tc.mutex.Lock()
 	defer tc.mutex.Unlock()
 
-	if tc.closed {
+	if tc.closed || tc.draining.Load() {
 		return
 	}
 
-	for _, conn := range tc.connections {
+	allowed := min(tc.throttle.allowed(len(tc.connections)), tc.scale.allowed(len(tc.connections)))
+	for _, conn := range tc.connections[:allowed] {
 		if !conn.isActive() {
-			go conn.connect(ctx, host, port)
+			conn.reconnect(ctx, host, port)
 		}
 	}
 }
@@ -126,122 +316,459 @@ func (tc *TunnelCluster) checkConnections(ctx context.Context, host string, port
 // connect establishes a connection to the tunnel server
 func (conn *TunnelConnection) connect(ctx context.Context, host string, port int) {
 	conn.mutex.Lock()
-	defer conn.mutex.Unlock()
-
-	if conn.active {
+	if conn.active || conn.dialing {
+		conn.mutex.Unlock()
 		return
 	}
+	conn.dialing = true
+	conn.mutex.Unlock()
 
-	address := fmt.Sprintf("%s:%d", host, port)
+	address := net.JoinHostPort(host, strconv.Itoa(port))
 
-	// Connect to the tunnel server
-	netConn, err := net.DialTimeout("tcp", address, 10*time.Second)
+	// Connect to the tunnel server without holding the lock, so state
+	// queries don't stall behind a slow dial
+	dialStart := time.Now()
+	netConn, err := conn.cluster.dialRelay(ctx, address)
+
+	// Runs once the connection is unlocked
+	defer conn.cluster.updateState()
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.dialing = false
+	conn.failing = err != nil
 	if err != nil {
-		select {
-		case conn.cluster.events.Error <- fmt.Errorf("failed to connect to %s: %w", address, err):
-		case <-ctx.Done():
-		}
+		conn.log().Warn("failed to connect to tunnel server", "address", address, "error", err)
+		conn.reportError(fmt.Errorf("failed to connect to %s: %w", address, err))
+		return
+	}
+	if ctx.Err() != nil {
+		// The tunnel was closed while dialing
+		netConn.Close()
 		return
 	}
 
+	conn.cluster.options.TCP.apply(netConn)
 	conn.conn = netConn
 	conn.active = true
+	conn.session.Store(sessionIdle)
+	conn.cluster.observeRTT(time.Since(dialStart))
+	conn.connectedAt.Store(time.Now().UnixNano())
+	conn.touch()
+	conn.log().Debug("connected to tunnel server", "address", address)
+	if ready := conn.cluster.ready; ready != nil {
+		conn.cluster.readyOnce.Do(ready)
+	}
 
-	// Handle the connection
-	go conn.handleConnection(ctx)
+	// Handle the connection, and replace it at once if it drops while idle
+	conn.cluster.spawn(func() {
+		conn.handleConnection(ctx, netConn)
+		conn.cluster.redialDropped(ctx, conn, host, port)
+	})
 }
 
-// handleConnection processes incoming requests on this connection
-func (conn *TunnelConnection) handleConnection(ctx context.Context) {
+// handleConnection waits for the server to hand a visitor to this
+// connection and then serves it from the local server or the cassette
+func (conn *TunnelConnection) handleConnection(ctx context.Context, remote net.Conn) {
 	defer conn.close()
 
-	for {
-		select {
-		case <-ctx.Done():
+	// Everything started for the visitor stops with ctx: closing the
+	// connections unblocks whatever is copying between them
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer closeWhenDone(ctx, remote)()
+
+	// Wait for the first bytes of a request before touching the local side
+	connected := time.Now()
+	if idle := conn.cluster.options.Timeouts.idle(); idle > 0 {
+		remote.SetReadDeadline(connected.Add(idle))
+	}
+	reader := bufio.NewReaderSize(remote, maxRequestHead)
+	if _, err := reader.Peek(1); err != nil {
+		if errors.Is(err, syscall.ECONNRESET) && time.Since(connected) < quickReset {
+			conn.cluster.throttled("connection reset right after connecting", 0)
 			return
-		default:
 		}
+		conn.log().Debug("connection closed while idle", "error", err)
+		conn.dropped(dropReason(err))
+		return
+	}
+	// WebSockets and event streams may stay open for as long as the
+	// visitor likes
+	streaming := func() {}
+	if timeout := conn.cluster.options.Timeouts.Request; timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			conn.log().Warn("request timed out", "timeout", timeout)
+			cancel()
+		})
+		defer timer.Stop()
+		streaming = func() { timer.Stop() }
+	}
+	if !conn.session.CompareAndSwap(sessionIdle, sessionServing) {
+		// The pool is draining
+		return
+	}
+	defer conn.session.CompareAndSwap(sessionServing, sessionIdle)
+	conn.cluster.visitorArrived()
+
+	// The rest of the request head gets a short deadline, so slow or
+	// garbage clients can't hold on to the pool connection
+	remote.SetReadDeadline(time.Now().Add(requestHeadTimeout))
+	if reason, retryAfter, ok := throttlePreamble(reader); ok {
+		conn.cluster.throttled(reason, retryAfter)
+		return
+	}
+	head, status := checkRequestHead(reader)
+	if status != 0 {
+		conn.log().Debug("rejecting malformed request", "status", status)
+		conn.cluster.rejected.Add(1)
+		writeRejection(remote, status, nil)
+		return
+	}
+	remote.SetReadDeadline(time.Time{})
 
-		// Set read deadline
-		conn.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	// End-to-end requests are checked by the e2e server, as the head
+	// here is only the envelope
+	if conn.cluster.e2e == nil {
+		if denied := conn.cluster.checkAccess(head); denied != nil {
+			conn.deny(remote, denied)
+			return
+		}
+	}
 
-		// Create connection to local server
-		localConn, err := conn.connectToLocal()
-		if err != nil {
-			select {
-			case conn.cluster.events.Error <- err:
-			case <-ctx.Done():
-			}
-			continue
+	upstream := &bufferedConn{Conn: remote, reader: reader}
+
+	// Wait for a free slot before forwarding the visitor
+	client := headClientIP(head)
+	release, err := conn.cluster.queue.acquire(ctx, client)
+	if err != nil {
+		conn.log().Debug("gave up waiting for admission", "client", client, "error", err)
+		return
+	}
+	defer release()
+
+	if conn.cluster.options.ReplayFile != "" {
+		if err := serveCassette(conn.cluster.cassette, upstream, reader, conn.exchangeStarted, conn.exchangeDone); err != nil {
+			conn.reportError(fmt.Errorf("replay failed: %w", err))
 		}
+		return
+	}
+	if len(conn.cluster.options.Stubs) > 0 {
+		if err := serveStubs(conn.cluster.options.Stubs, upstream, reader, conn.exchangeStarted, conn.exchangeDone); err != nil {
+			conn.reportError(fmt.Errorf("stub failed: %w", err))
+		}
+		return
+	}
 
-		// Create header transformer
-		transformer := NewHeaderHostTransformer(conn.cluster.options.LocalHost + fmt.Sprintf(":%d", conn.cluster.options.Port))
+	if err := conn.cluster.awaitHealthy(ctx); err != nil {
+		conn.writeErrorPage(remote, head, conn.cluster.options.localAddress(), err)
+		return
+	}
 
-		// Handle the request/response cycle
-		go conn.proxyConnection(localConn, transformer)
+	if conn.cluster.e2e != nil {
+		if err := conn.cluster.e2e.serve(ctx, upstream, reader, conn.exchangeStarted, conn.exchangeDone); err != nil {
+			conn.reportError(fmt.Errorf("end-to-end exchange failed: %w", err))
+		}
+		return
 	}
+
+	// Create connection to local server
+	localConn, target, err := conn.connectToLocal(ctx, head)
+	if err != nil {
+		err = fmt.Errorf("%w at %s: %w", ErrLocalUnreachable, target.address, err)
+		conn.log().Warn("failed to connect to local server", "address", target.address, "error", err)
+		conn.reportError(err)
+		conn.writeErrorPage(remote, head, target.address, err)
+		return
+	}
+	defer closeWhenDone(ctx, localConn)()
+
+	if conn.cluster.options.RecordFile != "" {
+		recorder := newRecordingConn(localConn, func(interaction Interaction) {
+			if err := conn.cluster.cassette.Add(conn.cluster.options.redactInteraction(interaction)); err != nil {
+				conn.reportError(fmt.Errorf("failed to save cassette: %w", err))
+			}
+		})
+		defer recorder.close()
+		localConn = recorder
+	}
+
+	if conn.cluster.bandwidth != nil {
+		localConn = &limitedConn{Conn: localConn, ctx: ctx, limiter: conn.cluster.bandwidth}
+	}
+
+	defer conn.current.Store(nil)
+
+	if conn.cluster.options.ProxyMode == ProxyStructured {
+		conn.serveStructured(ctx, upstream, localConn, target, streaming)
+		return
+	}
+
+	monitor := newExchangeMonitor(conn.cluster.capture, conn.exchangeStarted, conn.exchangeDone, streaming)
+	defer monitor.close()
+	localConn = monitor.wrap(localConn, conn)
+
+	// Create header transformer
+	transformer := conn.cluster.options.headerTransformer(target.address)
+	conn.cluster.forwarding.prepare(transformer)
+
+	// Handle the request/response cycle
+	conn.proxyConnection(upstream, localConn, transformer, target.header)
 }
 
-// connectToLocal creates a connection to the local server
-func (conn *TunnelConnection) connectToLocal() (net.Conn, error) {
-	address := fmt.Sprintf("%s:%d", conn.cluster.options.LocalHost, conn.cluster.options.Port)
+// observeRTT folds a handshake time into the smoothed RTT, weighting new
+// samples by 1/8 like TCP does
+func (tc *TunnelCluster) observeRTT(sample time.Duration) {
+	for {
+		old := tc.rtt.Load()
+		smoothed := int64(sample)
+		if old > 0 {
+			smoothed = old + (int64(sample)-old)/8
+		}
+		if tc.rtt.CompareAndSwap(old, smoothed) {
+			return
+		}
+	}
+}
 
-	if conn.cluster.options.LocalHTTPS {
-		// Use TLS for HTTPS
-		config := &tls.Config{
-			InsecureSkipVerify: true, // For local development
+// poolSize returns the number of live and configured connections
+func (tc *TunnelCluster) poolSize() (active, total int) {
+	tc.mutex.RLock()
+	defer tc.mutex.RUnlock()
+
+	for _, conn := range tc.connections {
+		if conn.isActive() {
+			active++
 		}
-		return tls.Dial("tcp", address, config)
 	}
+	return active, len(tc.connections)
+}
 
-	return net.Dial("tcp", address)
+// bytesTransferred sums proxied bytes over all connections
+func (tc *TunnelCluster) bytesTransferred() (in, out int64) {
+	tc.mutex.RLock()
+	defer tc.mutex.RUnlock()
+
+	for _, conn := range tc.connections {
+		in += conn.bytesIn.Load()
+		out += conn.bytesOut.Load()
+	}
+	return in, out
 }
 
-// proxyConnection handles bidirectional data transfer
-func (conn *TunnelConnection) proxyConnection(localConn net.Conn, transformer *HeaderHostTransformer) {
-	defer localConn.Close()
+// log returns the cluster logger
+func (tc *TunnelCluster) log() *slog.Logger {
+	if tc.logger == nil {
+		return tc.options.logger()
+	}
+	return tc.logger
+}
 
-	// Create pipes for bidirectional communication
-	done := make(chan struct{}, 2)
+// log returns the connection logger
+func (conn *TunnelConnection) log() *slog.Logger {
+	if conn.logger == nil {
+		return conn.cluster.log().With("conn", conn.id)
+	}
+	return conn.logger
+}
 
-	// Remote -> Local (with header transformation)
-	go func() {
-		defer func() { done <- struct{}{} }()
+// emitRequest publishes a forwarded request without ever blocking the
+// proxy; events are dropped when nobody keeps up with the channel
+func (tc *TunnelCluster) emitRequest(info RequestInfo) {
+	tc.stream.publish("request", newStreamRequest(info))
+
+	select {
+	case tc.events.Request <- info:
+	default:
+	}
+}
+
+// exchangeStarted reports a request forwarded on the connection
+func (conn *TunnelConnection) exchangeStarted(info RequestInfo) {
+	info = conn.cluster.options.redactInfo(info)
+	conn.current.Store(&info)
+	conn.cluster.emitRequest(info)
+}
+
+// exchangeDone reports a request the local server finished answering
+func (conn *TunnelConnection) exchangeDone(info RequestInfo) {
+	info = conn.cluster.options.redactInfo(info)
+	conn.current.Store(nil)
+	conn.requests.Add(1)
+	conn.cluster.emitResponse(info)
+}
+
+// emitResponse publishes a completed exchange, like emitRequest
+func (tc *TunnelCluster) emitResponse(info RequestInfo) {
+	tc.requests.Add(1)
+	tc.accessLog.log(info)
+	tc.latencies.record(info)
+	tc.stream.publish("response", newStreamRequest(info))
+
+	select {
+	case tc.events.Response <- info:
+	default:
+	}
+}
+
+// reportError delivers an error to the events channel. It never blocks:
+// errors are dropped when nobody keeps up with the channel, so a tunnel
+// whose errors aren't consumed doesn't pile up stuck goroutines.
+func (conn *TunnelConnection) reportError(err error) {
+	conn.log().Error("proxy error", "error", err)
+	conn.cluster.lastError.store(err)
+	conn.cluster.stream.publish("error", map[string]string{"error": err.Error()})
+
+	select {
+	case conn.cluster.events.Error <- err:
+	default:
+	}
+}
+
+// localTarget is the local server a visitor connection was sent to
+type localTarget struct {
+	address string
+	// header is added to every response, e.g. a sticky session cookie
+	header http.Header
+}
+
+// connectToLocal creates a connection to the local server, or to one of
+// the LocalTargets chosen for the request with head, failing over to
+// LocalFallback when it is down
+func (conn *TunnelConnection) connectToLocal(ctx context.Context, head []byte) (net.Conn, localTarget, error) {
+	targets := conn.cluster.targets
+	if targets == nil {
+		local, address, err := conn.cluster.dialWithFallback(ctx, conn.cluster.options.localAddress())
+		return local, localTarget{address: address}, err
+	}
+
+	preferred := conn.cluster.preferredTarget(head)
+	i := targets.pick(preferred)
+	local, address, err := conn.cluster.dialWithFallback(ctx, targets.addresses[i])
+	if err != nil || address != targets.addresses[i] {
+		// The fallback isn't a balanced target, nor one to stick to
+		targets.done(i)
+		return local, localTarget{address: address}, err
+	}
+	target := localTarget{address: address, header: conn.cluster.stickyHeader(i, preferred)}
+	return &targetConn{Conn: local, release: func() { targets.done(i) }}, target, nil
+}
+
+// proxyConnection handles bidirectional data transfer; added is added to
+// every response. When the visitor half-closes, so does the connection to
+// the local server, and its responses are still forwarded in full. It
+// returns once both directions have stopped.
+func (conn *TunnelConnection) proxyConnection(upstream *bufferedConn, localConn net.Conn, transformer *HeaderHostTransformer, added http.Header) {
+	defer localConn.Close()
+
+	if conn.cluster.options.intercepts() {
+		conn.interceptExchanges(upstream, localConn, transformer.host, added)
+		return
+	}
 
-		// For the first request, transform headers
-		transformer.Transform(conn.conn, localConn)
+	// Responses are framed, so their bodies can be spliced and their
+	// headers set, which takes the methods of the requests they answer
+	methods := make(chan string, 64)
 
-		// Then copy the rest directly
-		io.Copy(localConn, conn.conn)
+	// Remote -> Local, one request at a time
+	var requestsErr error
+	requestsDone := make(chan struct{})
+	go func() {
+		defer close(requestsDone)
+		requestsErr = conn.forwardRequests(upstream, localConn, transformer, methods)
 	}()
 
 	// Local -> Remote
+	responsesDone := make(chan struct{})
 	go func() {
-		defer func() { done <- struct{}{} }()
-		io.Copy(conn.conn, localConn)
+		conn.forwardResponses(upstream, localConn, methods, added)
+		close(responsesDone)
+		// Keep the requests from blocking on methods nobody reads; they
+		// stop once the requests do
+		for range methods {
+		}
 	}()
 
-	// Wait for either direction to complete
-	<-done
-}
+	// Whichever direction is still going is interrupted, then waited for
+	defer func() {
+		interrupt(upstream, localConn)
+		<-requestsDone
+		<-responsesDone
+	}()
 
-// extractRequestInfo parses HTTP request for logging
-func extractRequestInfo(data []byte) *RequestInfo {
-	lines := strings.Split(string(data), "\r\n")
-	if len(lines) == 0 {
-		return nil
+	select {
+	case <-responsesDone:
+	case <-requestsDone:
+		if requestsErr != io.EOF {
+			// The visitor is gone or was turned away
+			return
+		}
+		if err := closeWrite(localConn); err != nil {
+			conn.log().Debug("local connection can't be half-closed", "error", err)
+			return
+		}
+		<-responsesDone
 	}
+}
 
-	parts := strings.Fields(lines[0])
-	if len(parts) < 3 {
-		return nil
+// interrupt stops the copies between a visitor and the local server: the
+// visitor's connection stops reading and writing at once, and the local
+// one is closed. The visitor's connection is closed by its owner.
+func interrupt(upstream, local net.Conn) {
+	upstream.SetDeadline(time.Now())
+	local.Close()
+}
+
+// closeWhenDone closes conn once ctx is done. The function it returns
+// cancels that, or waits for the close when it has already begun.
+func closeWhenDone(ctx context.Context, conn io.Closer) func() {
+	closed := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(closed)
+		conn.Close()
+	})
+	return func() {
+		if !stop() {
+			<-closed
+		}
 	}
+}
 
-	return &RequestInfo{
-		Method: parts[0],
-		Path:   parts[1],
-		URL:    parts[1],
+// bufferedConn is a net.Conn whose reads are served from a bufio.Reader
+// that may already hold peeked data
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(p []byte) (int, error) {
+	return bc.reader.Read(p)
+}
+
+// maxRequestHead bounds how much of a request is buffered to inspect headers
+const maxRequestHead = 16 << 10
+
+// peekRequestHead returns the buffered request line and headers without
+// consuming them. The head ends at the first empty line, which may be
+// terminated by a bare LF.
+func peekRequestHead(reader *bufio.Reader) ([]byte, error) {
+	for {
+		buffered, _ := reader.Peek(reader.Buffered())
+		if i := bytes.Index(buffered, []byte("\n\r\n")); i >= 0 {
+			if j := bytes.Index(buffered[:i], []byte("\n\n")); j >= 0 {
+				return buffered[:j+2], nil
+			}
+			return buffered[:i+3], nil
+		}
+		if i := bytes.Index(buffered, []byte("\n\n")); i >= 0 {
+			return buffered[:i+2], nil
+		}
+		if len(buffered) >= maxRequestHead || len(buffered) >= reader.Size() {
+			return buffered, bufio.ErrBufferFull
+		}
+		if _, err := reader.Peek(len(buffered) + 1); err != nil {
+			return buffered, err
+		}
 	}
 }
 
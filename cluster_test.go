@@ -1,10 +1,20 @@
 package vrata
 
 import (
+	"bufio"
 	"context"
+	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
+
+	"go.uber.org/goleak"
 )
 
 func TestNewTunnelCluster(t *testing.T) {
@@ -75,6 +85,119 @@ func TestTunnelClusterClose(t *testing.T) {
 	cluster.Close()
 }
 
+func TestTunnelCloseStopsGoroutines(t *testing.T) {
+	passResponses := []ResponseInterceptor{
+		ResponseInterceptorFunc(func(resp *http.Response) error { return nil }),
+	}
+	tests := []struct {
+		name    string
+		options TunnelOptions
+		http2   bool
+		path    string
+	}{
+		{"idle", TunnelOptions{}, false, ""},
+		{"request in flight", TunnelOptions{}, false, "/wait"},
+		{"open websocket", TunnelOptions{}, false, "/ws"},
+		{"response headers", TunnelOptions{ResponseHeaders: http.Header{"X-Tunnel": {"1"}}}, false, "/wait"},
+		{"interceptors", TunnelOptions{ResponseInterceptors: passResponses}, false, "/wait"},
+		{"interceptors websocket", TunnelOptions{ResponseInterceptors: passResponses}, false, "/ws"},
+		{"structured", TunnelOptions{ProxyMode: ProxyStructured}, false, "/wait"},
+		{"http2", TunnelOptions{LocalHTTP2: true}, true, "/wait"},
+		{"http2 websocket", TunnelOptions{LocalHTTP2: true}, true, "/ws"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Runs last, once the relay and the local server are gone
+			ignore := goleak.IgnoreCurrent()
+			t.Cleanup(func() { goleak.VerifyNone(t, ignore) })
+
+			relay := newMockRelay(t, 2)
+			waiting := make(chan struct{}, 1)
+			mux := http.NewServeMux()
+			mux.Handle("/ws", echoUpgradeHandler(t))
+			mux.HandleFunc("/wait", func(w http.ResponseWriter, r *http.Request) {
+				waiting <- struct{}{}
+				<-r.Context().Done()
+			})
+			local := httptest.NewServer(mux)
+			if tt.http2 {
+				local.Close()
+				local = newH2CServer(mux)
+			}
+			defer local.Close()
+
+			options := tt.options
+			options.Host = relay.server.URL
+			options.LocalHost = "127.0.0.1"
+			tunnel, err := ConnectAndOpen(local.Listener.Addr().(*net.TCPAddr).Port, &options)
+			if err != nil {
+				t.Fatalf("ConnectAndOpen() failed: %v", err)
+			}
+
+			conn := <-relay.conns
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			switch tt.path {
+			case "/ws":
+				openWebSocket(t, conn)
+			case "/wait":
+				io.WriteString(conn, "GET /wait HTTP/1.1\r\nHost: public.example\r\n\r\n")
+				select {
+				case <-waiting:
+				case <-time.After(2 * time.Second):
+					t.Fatal("Request never reached the local server")
+				}
+			}
+
+			// Close stops what the pool started, however busy, before it
+			// returns
+			closed := make(chan struct{})
+			go func() {
+				tunnel.Close()
+				close(closed)
+			}()
+			select {
+			case <-closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Close() did not return")
+			}
+			if left := poolGoroutines(); len(left) > 0 {
+				t.Errorf("Goroutines left running after Close():\n%s", strings.Join(left, "\n\n"))
+			}
+		})
+	}
+}
+
+// poolGoroutines returns the stacks of the goroutines running the package's
+// code, other than the tests' own
+func poolGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	_, file, _, _ := runtime.Caller(0)
+	dir := filepath.Dir(file) + "/"
+
+	var stacks []string
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		ours, test := false, false
+		for _, line := range strings.Split(stack, "\n") {
+			path, _, found := strings.Cut(strings.TrimSpace(line), ":")
+			if !found || !strings.HasPrefix(path, dir) || strings.Contains(path[len(dir):], "/") {
+				continue
+			}
+			if strings.HasSuffix(path, "_test.go") {
+				test = true
+			} else {
+				ours = true
+			}
+		}
+		if ours && !test {
+			stacks = append(stacks, stack)
+		}
+	}
+	return stacks
+}
+
 func TestTunnelConnection(t *testing.T) {
 	cluster := &TunnelCluster{
 		info: &TunnelInfo{
@@ -108,76 +231,6 @@ func TestTunnelConnection(t *testing.T) {
 	conn.close()
 }
 
-func TestExtractRequestInfo(t *testing.T) {
-	tests := []struct {
-		name     string
-		data     []byte
-		expected *RequestInfo
-	}{
-		{
-			name: "valid GET request",
-			data: []byte("GET /api/users HTTP/1.1\r\nHost: localhost\r\n\r\n"),
-			expected: &RequestInfo{
-				Method: "GET",
-				Path:   "/api/users",
-				URL:    "/api/users",
-			},
-		},
-		{
-			name: "valid POST request",
-			data: []byte("POST /api/users HTTP/1.1\r\nHost: localhost\r\nContent-Type: application/json\r\n\r\n"),
-			expected: &RequestInfo{
-				Method: "POST",
-				Path:   "/api/users",
-				URL:    "/api/users",
-			},
-		},
-		{
-			name:     "empty data",
-			data:     []byte(""),
-			expected: nil,
-		},
-		{
-			name:     "invalid request line",
-			data:     []byte("INVALID\r\n"),
-			expected: nil,
-		},
-		{
-			name:     "incomplete request line",
-			data:     []byte("GET\r\n"),
-			expected: nil,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			result := extractRequestInfo(tt.data)
-
-			if tt.expected == nil {
-				if result != nil {
-					t.Errorf("Expected nil, got %+v", result)
-				}
-				return
-			}
-
-			if result == nil {
-				t.Errorf("Expected %+v, got nil", tt.expected)
-				return
-			}
-
-			if result.Method != tt.expected.Method {
-				t.Errorf("Expected method %s, got %s", tt.expected.Method, result.Method)
-			}
-			if result.Path != tt.expected.Path {
-				t.Errorf("Expected path %s, got %s", tt.expected.Path, result.Path)
-			}
-			if result.URL != tt.expected.URL {
-				t.Errorf("Expected URL %s, got %s", tt.expected.URL, result.URL)
-			}
-		})
-	}
-}
-
 func TestTunnelConnectionConnect(t *testing.T) {
 	// Start a local TCP server for testing
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
@@ -216,13 +269,21 @@ func TestTunnelConnectionConnect(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
-	// Accept one connection
+	// Accept one connection and keep it open until the test ends
+	accepted := make(chan net.Conn, 1)
 	go func() {
 		testConn, err := listener.Accept()
 		if err != nil {
 			return
 		}
-		testConn.Close()
+		accepted <- testConn
+	}()
+	defer func() {
+		select {
+		case testConn := <-accepted:
+			testConn.Close()
+		default:
+		}
 	}()
 
 	// This should connect successfully
@@ -241,3 +302,143 @@ func TestTunnelConnectionConnect(t *testing.T) {
 		t.Error("Connection should not be active after close")
 	}
 }
+
+func TestTunnelMaxConnections(t *testing.T) {
+	relay := newMockRelay(t, 4)
+
+	tunnel, err := ConnectAndOpen(8080, &TunnelOptions{Host: relay.server.URL, MaxConnections: 1})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	waitFor(t, func() bool { return len(relay.conns) == 1 })
+	time.Sleep(100 * time.Millisecond)
+	if n := len(relay.conns); n != 1 {
+		t.Errorf("Expected 1 data connection, relay got %d", n)
+	}
+	tunnel.cluster.mutex.Lock()
+	n := len(tunnel.cluster.connections)
+	tunnel.cluster.mutex.Unlock()
+	if n != 1 {
+		t.Errorf("Expected a pool of 1, got %d", n)
+	}
+}
+
+// mockRelay imitates a localtunnel server: it registers tunnels over HTTP
+// and accepts the client's data connections on a TCP listener
+type mockRelay struct {
+	server   *httptest.Server
+	listener net.Listener
+	conns    chan net.Conn
+}
+
+func newMockRelay(t *testing.T, maxConn int) *mockRelay {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start relay listener: %v", err)
+	}
+
+	relay := &mockRelay{listener: listener, conns: make(chan net.Conn, 100)}
+	relay.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":"mock","url":"http://127.0.0.1","port":%d,"max_conn_count":%d}`,
+			listener.Addr().(*net.TCPAddr).Port, maxConn)
+	}))
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			relay.conns <- conn
+		}
+	}()
+
+	t.Cleanup(func() {
+		listener.Close()
+		relay.server.Close()
+		for {
+			select {
+			case conn := <-relay.conns:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	})
+
+	return relay
+}
+
+// roundTrip sends a raw request over the next idle tunnel connection and
+// returns the response
+func (r *mockRelay) roundTrip(t *testing.T, rawRequest string) *http.Response {
+	t.Helper()
+
+	var conn net.Conn
+	select {
+	case conn = <-r.conns:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Tunnel client never connected to the relay")
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if _, err := io.WriteString(conn, rawRequest); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	return resp
+}
+
+func TestTunnelEmitsRequestEvents(t *testing.T) {
+	relay := newMockRelay(t, 2)
+
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		io.WriteString(w, "short and stout")
+	}))
+	defer local.Close()
+	localPort := local.Listener.Addr().(*net.TCPAddr).Port
+
+	tunnel, err := ConnectAndOpen(localPort, &TunnelOptions{Host: relay.server.URL, LocalHost: "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	resp := relay.roundTrip(t, "GET /tea HTTP/1.1\r\nHost: public.example\r\nX-Forwarded-For: 192.0.2.1\r\nConnection: close\r\n\r\n")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusTeapot || string(body) != "short and stout" {
+		t.Errorf("Unexpected response through tunnel: %d '%s'", resp.StatusCode, body)
+	}
+
+	select {
+	case info := <-tunnel.Events().Request:
+		if info.Path != "/tea" || info.StatusCode != 0 {
+			t.Errorf("Unexpected request event: %+v", info)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("No request event emitted")
+	}
+
+	select {
+	case info := <-tunnel.Events().Response:
+		if info.Path != "/tea" || info.StatusCode != http.StatusTeapot || info.RemoteAddr != "192.0.2.1" {
+			t.Errorf("Unexpected request event: %+v", info)
+		}
+		if info.BytesOut == 0 || info.Duration <= 0 {
+			t.Errorf("Expected byte counts and duration, got %+v", info)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("No response event emitted")
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// completionFlag is an option the completion scripts offer
+type completionFlag struct {
+	name  string // with its dashes, e.g. --port or -p
+	usage string
+	value bool // takes a value, so fish waits for one
+}
+
+// completionCommand is a subcommand the completion scripts offer
+type completionCommand struct {
+	name  string
+	usage string
+	// args are completed right after the command, e.g. service install
+	args []string
+	// flags are its own options; tunnel commands also take the tunnel's
+	flags  []completionFlag
+	tunnel bool
+}
+
+// completionCommands are the subcommands of varta, in usage order
+var completionCommands = []completionCommand{
+	{name: "start", usage: "Open a tunnel (the default)", tunnel: true},
+	{name: "status", usage: "Show the tunnels of a running varta", flags: controlFlags},
+	{name: "stop", usage: "Close a running tunnel", flags: controlFlags},
+	{name: "service", usage: "Keep the tunnel running across reboots", args: []string{"install", "uninstall"}, tunnel: true, flags: []completionFlag{
+		{"--name", "Service name (default: varta-PORT)", true},
+		{"--system", "Install a system-wide service instead of a per-user one", false},
+	}},
+	{name: "debug-bundle", usage: "Write a sanitized zip to attach to bug reports", tunnel: true},
+	{name: "exec", usage: "Run a command and tunnel the port it listens on", tunnel: true},
+	{name: "view", usage: "Open an --e2e tunnel through a decrypting proxy", flags: []completionFlag{
+		{"--key", "Key printed by the tunnel started with --e2e", true},
+		{"--listen", "Address the viewer listens on", true},
+	}},
+	{name: "completion", usage: "Print a shell completion script", args: completionShells},
+}
+
+var controlFlags = []completionFlag{{"--control", "Control socket of the running tunnel", true}}
+
+// completionShells are the shells varta completion writes scripts for
+var completionShells = []string{"bash", "zsh", "fish", "powershell"}
+
+// runCompletion prints the completion script of a shell
+func runCompletion(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s completion %s\n", os.Args[0], strings.Join(completionShells, "|"))
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "bash":
+		writeBashCompletion(os.Stdout)
+	case "zsh":
+		writeZshCompletion(os.Stdout)
+	case "fish":
+		writeFishCompletion(os.Stdout)
+	case "powershell":
+		writePowerShellCompletion(os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "Error: no completion for %q, use one of %s\n", args[0], strings.Join(completionShells, ", "))
+		os.Exit(1)
+	}
+}
+
+// tunnelFlags returns the options of the tunnel, single letters with one
+// dash and names with two as the usage shows them
+func tunnelFlags() []completionFlag {
+	var flags []completionFlag
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		name := "--" + f.Name
+		if len(f.Name) == 1 {
+			name = "-" + f.Name
+		}
+		flags = append(flags, completionFlag{name, f.Usage, !isBoolFlag(f)})
+	})
+	return flags
+}
+
+// completionFlagNames returns the options of a command as a list of words
+func completionFlagNames(command completionCommand, tunnel []completionFlag) string {
+	flags := command.flags
+	if command.tunnel {
+		flags = slices.Concat(tunnel, flags)
+	}
+	names := make([]string, len(flags))
+	for i, f := range flags {
+		names[i] = f.name
+	}
+	return strings.Join(names, " ")
+}
+
+// completionWords returns what can follow varta: subcommands and, as
+// varta alone opens a tunnel, the tunnel's options
+func completionWords(tunnel []completionFlag) (commands, flags string) {
+	names := make([]string, len(completionCommands))
+	for i, command := range completionCommands {
+		names[i] = command.name
+	}
+	return strings.Join(names, " "), completionFlagNames(completionCommand{tunnel: true}, tunnel)
+}
+
+// The bash, zsh and PowerShell scripts work alike: options complete once a
+// dash is typed, otherwise subcommands and then their arguments, and
+// files when nothing else fits
+
+func writeBashCompletion(w io.Writer) {
+	tunnel := tunnelFlags()
+	commands, flags := completionWords(tunnel)
+	fmt.Fprintf(w, "# bash completion for varta; load it with: source <(varta completion bash)\n\n")
+	fmt.Fprintf(w, "_varta() {\n")
+	fmt.Fprintf(w, "\tlocal cur=${COMP_WORDS[COMP_CWORD]} words=\n")
+	fmt.Fprintf(w, "\tif [[ $cur == -* ]]; then\n")
+	fmt.Fprintf(w, "\t\tcase ${COMP_WORDS[1]} in\n")
+	for _, command := range completionCommands {
+		fmt.Fprintf(w, "\t\t%s) words=%q ;;\n", command.name, completionFlagNames(command, tunnel))
+	}
+	fmt.Fprintf(w, "\t\t*) words=%q ;;\n", flags)
+	fmt.Fprintf(w, "\t\tesac\n")
+	fmt.Fprintf(w, "\telif ((COMP_CWORD == 1)); then\n")
+	fmt.Fprintf(w, "\t\twords=%q\n", commands)
+	fmt.Fprintf(w, "\telif ((COMP_CWORD == 2)); then\n")
+	fmt.Fprintf(w, "\t\tcase ${COMP_WORDS[1]} in\n")
+	for _, command := range completionCommands {
+		if command.args != nil {
+			fmt.Fprintf(w, "\t\t%s) words=%q ;;\n", command.name, strings.Join(command.args, " "))
+		}
+	}
+	fmt.Fprintf(w, "\t\tesac\n")
+	fmt.Fprintf(w, "\tfi\n")
+	fmt.Fprintf(w, "\tCOMPREPLY=($(compgen -W \"$words\" -- \"$cur\"))\n")
+	fmt.Fprintf(w, "}\n\n")
+	fmt.Fprintf(w, "complete -o default -F _varta varta\n")
+}
+
+func writeZshCompletion(w io.Writer) {
+	tunnel := tunnelFlags()
+	commands, flags := completionWords(tunnel)
+	fmt.Fprintf(w, "#compdef varta\n")
+	fmt.Fprintf(w, "# zsh completion for varta; load it with: source <(varta completion zsh)\n\n")
+	fmt.Fprintf(w, "_varta() {\n")
+	fmt.Fprintf(w, "\tlocal -a candidates\n")
+	fmt.Fprintf(w, "\tif [[ $PREFIX == -* ]]; then\n")
+	fmt.Fprintf(w, "\t\tcase ${words[2]} in\n")
+	for _, command := range completionCommands {
+		fmt.Fprintf(w, "\t\t(%s) candidates=(%s) ;;\n", command.name, completionFlagNames(command, tunnel))
+	}
+	fmt.Fprintf(w, "\t\t(*) candidates=(%s) ;;\n", flags)
+	fmt.Fprintf(w, "\t\tesac\n")
+	fmt.Fprintf(w, "\telif ((CURRENT == 2)); then\n")
+	fmt.Fprintf(w, "\t\tcandidates=(%s)\n", commands)
+	fmt.Fprintf(w, "\telif ((CURRENT == 3)); then\n")
+	fmt.Fprintf(w, "\t\tcase ${words[2]} in\n")
+	for _, command := range completionCommands {
+		if command.args != nil {
+			fmt.Fprintf(w, "\t\t(%s) candidates=(%s) ;;\n", command.name, strings.Join(command.args, " "))
+		}
+	}
+	fmt.Fprintf(w, "\t\tesac\n")
+	fmt.Fprintf(w, "\tfi\n")
+	fmt.Fprintf(w, "\tif ((${#candidates})); then\n")
+	fmt.Fprintf(w, "\t\tcompadd -- $candidates\n")
+	fmt.Fprintf(w, "\telse\n")
+	fmt.Fprintf(w, "\t\t_files\n")
+	fmt.Fprintf(w, "\tfi\n")
+	fmt.Fprintf(w, "}\n\n")
+	// As a file in $fpath zsh autoloads the function and calls it; sourced,
+	// it has to be registered
+	fmt.Fprintf(w, "if [[ $zsh_eval_context[-1] == loadautofunc ]]; then\n")
+	fmt.Fprintf(w, "\t_varta \"$@\"\n")
+	fmt.Fprintf(w, "else\n")
+	fmt.Fprintf(w, "\tcompdef _varta varta\n")
+	fmt.Fprintf(w, "fi\n")
+}
+
+func writePowerShellCompletion(w io.Writer) {
+	tunnel := tunnelFlags()
+	commands, flags := completionWords(tunnel)
+	fmt.Fprintf(w, "# PowerShell completion for varta; load it with:\n")
+	fmt.Fprintf(w, "# varta completion powershell | Out-String | Invoke-Expression\n\n")
+	fmt.Fprintf(w, "Register-ArgumentCompleter -Native -CommandName varta, varta.exe -ScriptBlock {\n")
+	fmt.Fprintf(w, "\tparam($wordToComplete, $commandAst, $cursorPosition)\n")
+	fmt.Fprintf(w, "\t$position = $commandAst.CommandElements.Count\n")
+	fmt.Fprintf(w, "\tif ($wordToComplete -ne '') { $position-- }\n")
+	fmt.Fprintf(w, "\t$command = if ($commandAst.CommandElements.Count -gt 1) { $commandAst.CommandElements[1].ToString() } else { '' }\n")
+	fmt.Fprintf(w, "\t$words = ''\n")
+	fmt.Fprintf(w, "\tif ($wordToComplete -like '-*') {\n")
+	fmt.Fprintf(w, "\t\t$words = switch ($command) {\n")
+	for _, command := range completionCommands {
+		fmt.Fprintf(w, "\t\t\t'%s' { '%s' }\n", command.name, completionFlagNames(command, tunnel))
+	}
+	fmt.Fprintf(w, "\t\t\tdefault { '%s' }\n", flags)
+	fmt.Fprintf(w, "\t\t}\n")
+	fmt.Fprintf(w, "\t} elseif ($position -eq 1) {\n")
+	fmt.Fprintf(w, "\t\t$words = '%s'\n", commands)
+	fmt.Fprintf(w, "\t} elseif ($position -eq 2) {\n")
+	fmt.Fprintf(w, "\t\t$words = switch ($command) {\n")
+	for _, command := range completionCommands {
+		if command.args != nil {
+			fmt.Fprintf(w, "\t\t\t'%s' { '%s' }\n", command.name, strings.Join(command.args, " "))
+		}
+	}
+	fmt.Fprintf(w, "\t\t\tdefault { '' }\n")
+	fmt.Fprintf(w, "\t\t}\n")
+	fmt.Fprintf(w, "\t}\n")
+	fmt.Fprintf(w, "\t$words -split ' ' | Where-Object { $_ -ne '' -and $_ -like \"$wordToComplete*\" } | ForEach-Object {\n")
+	fmt.Fprintf(w, "\t\t[System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)\n")
+	fmt.Fprintf(w, "\t}\n")
+	fmt.Fprintf(w, "}\n")
+}
+
+// writeFishCompletion writes fish's declarative completions, which show
+// what each subcommand and option does
+func writeFishCompletion(w io.Writer) {
+	fmt.Fprintf(w, "# fish completion for varta; load it with: varta completion fish | source\n\n")
+	fmt.Fprintf(w, "complete -c varta -e\n")
+
+	var others []string
+	for _, command := range completionCommands {
+		fmt.Fprintf(w, "complete -c varta -n __fish_use_subcommand -f -a %s -d %s\n", command.name, fishQuote(command.usage))
+		if !command.tunnel {
+			others = append(others, command.name)
+		}
+	}
+
+	// Tunnel options go everywhere but after the commands that don't take
+	// them
+	condition := "not __fish_seen_subcommand_from " + strings.Join(others, " ")
+	for _, f := range tunnelFlags() {
+		writeFishFlag(w, condition, f)
+	}
+
+	for _, command := range completionCommands {
+		seen := "__fish_seen_subcommand_from " + command.name
+		if command.args != nil {
+			args := strings.Join(command.args, " ")
+			fmt.Fprintf(w, "complete -c varta -n %s -f -a %s\n",
+				fishQuote(seen+"; and not __fish_seen_subcommand_from "+args), fishQuote(args))
+		}
+		for _, f := range command.flags {
+			writeFishFlag(w, seen, f)
+		}
+	}
+}
+
+// writeFishFlag writes the completion of an option where condition holds
+func writeFishFlag(w io.Writer, condition string, f completionFlag) {
+	name := "-l " + strings.TrimPrefix(f.name, "--")
+	if !strings.HasPrefix(f.name, "--") {
+		name = "-s " + strings.TrimPrefix(f.name, "-")
+	}
+	if f.value {
+		name += " -r"
+	}
+	fmt.Fprintf(w, "complete -c varta -n %s %s -d %s\n", fishQuote(condition), name, fishQuote(f.usage))
+}
+
+// fishQuote quotes s as a single-quoted fish string
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// completionWriters write the script of each shell
+var completionWriters = map[string]func(io.Writer){
+	"bash":       writeBashCompletion,
+	"zsh":        writeZshCompletion,
+	"fish":       writeFishCompletion,
+	"powershell": writePowerShellCompletion,
+}
+
+func TestCompletionListsEveryFlag(t *testing.T) {
+	var names []string
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		names = append(names, f.Name)
+	})
+	for alias := range aliases {
+		if !slices.Contains(names, alias) {
+			t.Errorf("The alias -%s is not a registered flag", alias)
+		}
+	}
+	var commandFlags []string
+	for _, command := range completionCommands {
+		for _, f := range command.flags {
+			commandFlags = append(commandFlags, strings.TrimLeft(f.name, "-"))
+		}
+	}
+
+	for _, shell := range completionShells {
+		write := completionWriters[shell]
+		if write == nil {
+			t.Errorf("No test writer for %s", shell)
+			continue
+		}
+		var buf bytes.Buffer
+		write(&buf)
+		script := buf.String()
+
+		// Words, with the quotes and parentheses of each shell taken off
+		words := strings.FieldsFunc(script, func(r rune) bool {
+			return strings.ContainsRune(" \t\n\"'()", r)
+		})
+		listed := func(name string) bool {
+			if shell == "fish" {
+				option := "-l " + name
+				if len(name) == 1 {
+					option = "-s " + name
+				}
+				return strings.Contains(script, " "+option+" ")
+			}
+			option := "--" + name
+			if len(name) == 1 {
+				option = "-" + name
+			}
+			return slices.Contains(words, option)
+		}
+		for _, name := range slices.Concat(names, commandFlags) {
+			if !listed(name) {
+				t.Errorf("The %s completion doesn't list %s", shell, name)
+			}
+		}
+		for _, command := range completionCommands {
+			if !slices.Contains(words, command.name) {
+				t.Errorf("The %s completion doesn't list the %s command", shell, command.name)
+			}
+		}
+	}
+}
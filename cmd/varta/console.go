@@ -0,0 +1,137 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/korya/vrata"
+)
+
+// console reports the tunnel's lifecycle and requests, as text for people
+// or, with --log-format json, as one JSON object per line for log
+// collectors
+type console struct {
+	// logger writes JSON lines, and is nil for text
+	logger *slog.Logger
+	// requests formats answered requests, and is nil when they aren't
+	// printed
+	requests *vrata.RequestFormat
+	// prefix starts every text line, e.g. with the port of the tunnel
+	// reported on when several are open
+	prefix string
+}
+
+// out is where the CLI reports to, text on stdout until the flags say
+// otherwise
+var out = &console{}
+
+// consoleFromFlags returns the console the flags ask for. JSON consoles
+// also take over the log package, so fatal errors come out as JSON too.
+func consoleFromFlags() *console {
+	c := &console{}
+	switch *logFormat {
+	case "text":
+	case "json":
+		c.logger = slog.New(slog.NewJSONHandler(stdout{}, nil))
+		slog.SetDefault(slog.New(slog.NewJSONHandler(stderr{}, nil)))
+		// The CLI only logs through the log package to give up
+		slog.SetLogLoggerLevel(slog.LevelError)
+	default:
+		fmt.Fprintf(os.Stderr, "Error: --log-format must be text or json\n")
+		os.Exit(1)
+	}
+
+	if *printReqs || *printFmt != "" {
+		format, err := vrata.ParseRequestFormat(cmp.Or(*printFmt, vrata.DefaultRequestFormat))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid --print-requests-format: %v\n", err)
+			os.Exit(1)
+		}
+		c.requests = format
+	}
+	return c
+}
+
+// forPort returns the console reporting on the tunnel of port, one of
+// several: text lines start with the port, and JSON objects have it
+func (c *console) forPort(port int) *console {
+	tagged := *c
+	tagged.prefix = fmt.Sprintf("[%d] ", port)
+	if c.logger != nil {
+		tagged.logger = c.logger.With("port", port)
+	}
+	return &tagged
+}
+
+// handler returns the slog handler for the tunnel's own logs, written to w
+func (c *console) handler(w io.Writer, options *slog.HandlerOptions) slog.Handler {
+	if c.logger != nil {
+		return slog.NewJSONHandler(w, options)
+	}
+	return slog.NewTextHandler(w, options)
+}
+
+// print reports something that happened: text as is, or msg with attrs as
+// JSON
+func (c *console) print(level slog.Level, msg, text string, attrs ...any) {
+	if c.logger == nil {
+		fmt.Print(c.prefixed(text))
+		return
+	}
+	c.logger.Log(context.Background(), level, msg, attrs...)
+}
+
+// request reports an answered request, with the --print-requests-format
+// line as text, or its fields as JSON
+func (c *console) request(info vrata.RequestInfo) {
+	if c.requests == nil {
+		return
+	}
+	if c.logger != nil {
+		c.logger.Info("request",
+			"client", info.RemoteAddr,
+			"method", info.Method,
+			"url", info.URL,
+			"status", info.StatusCode,
+			"duration_ms", info.Duration.Milliseconds(),
+			"bytes_in", info.BytesIn,
+			"bytes_out", info.BytesOut)
+		return
+	}
+
+	line, err := c.requests.Format(info)
+	if err != nil {
+		line = fmt.Sprintf("%s %s (format failed: %v)", info.Method, info.URL, err)
+	}
+	fmt.Println(c.prefixed(line))
+}
+
+// prefixed returns text with the prefix at the start of every line that
+// isn't blank
+func (c *console) prefixed(text string) string {
+	if c.prefix == "" {
+		return text
+	}
+	lines := strings.SplitAfter(text, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			lines[i] = c.prefix + line
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// stdout and stderr write to os.Stdout and os.Stderr as they are when
+// written to, which --log-file may have replaced
+type (
+	stdout struct{}
+	stderr struct{}
+)
+
+func (stdout) Write(p []byte) (int, error) { return os.Stdout.Write(p) }
+func (stderr) Write(p []byte) (int, error) { return os.Stderr.Write(p) }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/korya/vrata"
+)
+
+// detachTimeout bounds how long start --detach waits for the tunnel URL
+const detachTimeout = 30 * time.Second
+
+// runDetached starts the tunnel in a background process with the same
+// arguments and waits until it reports its URL over the control socket
+func runDetached(args []string) {
+	if *control == "" {
+		fmt.Fprintf(os.Stderr, "Error: --detach needs the control socket, --control cannot be empty\n")
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	resp, err := vrata.ControlCall(ctx, *control, vrata.ControlRequest{Command: vrata.ControlStatus})
+	cancel()
+	if err == nil {
+		fmt.Fprintf(os.Stderr, "Error: varta is already running (pid %d); stop it with: varta stop\n", resp.PID)
+		os.Exit(1)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: cannot find the varta executable: %v\n", err)
+		os.Exit(1)
+	}
+
+	// The background process has no terminal, so its output goes to the log
+	// file, and its PID to a file scripts can signal it through
+	base := strings.TrimSuffix(*control, filepath.Ext(*control))
+	logPath, pidPath := cmp.Or(*logFile, base+".log"), cmp.Or(*pidFile, base+".pid")
+	if logPath, err = filepath.Abs(logPath); err == nil {
+		pidPath, err = filepath.Abs(pidPath)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	logWriter, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to open log file: %v\n", err)
+		os.Exit(1)
+	}
+	defer logWriter.Close()
+
+	childArgs := append([]string{"start"}, withoutFlags(args, "detach", "log-file", "pid-file")...)
+	cmd := exec.Command(executable, append(childArgs, "--pid-file", pidPath)...)
+	cmd.Stdout, cmd.Stderr = logWriter, logWriter
+	cmd.SysProcAttr = detachedProcess()
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to start background tunnel: %v\n", err)
+		os.Exit(1)
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	deadline := time.Now().Add(detachTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-exited:
+			fmt.Fprintf(os.Stderr, "Error: background tunnel exited before it was ready (%v)\n", exitReason(err))
+			fmt.Fprintf(os.Stderr, "See %s for details.\n", logPath)
+			os.Exit(1)
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		resp, err := vrata.ControlCall(ctx, *control, vrata.ControlRequest{Command: vrata.ControlURL})
+		cancel()
+		if err == nil && resp.URL != "" {
+			fmt.Printf("Your tunnel is available at: %s\n", resp.URL)
+			fmt.Printf("Running in the background (pid %d); stop it with: varta stop\n", cmd.Process.Pid)
+			fmt.Printf("PID file: %s\nLog file: %s\n", pidPath, logPath)
+			return
+		}
+	}
+
+	cmd.Process.Kill()
+	fmt.Fprintf(os.Stderr, "Error: background tunnel did not report its URL within %s; see %s\n", detachTimeout, logPath)
+	os.Exit(1)
+}
+
+// exitReason describes how a background process ended
+func exitReason(err error) string {
+	if err == nil {
+		return "exit status 0"
+	}
+	return err.Error()
+}
+
+// runStatus prints the tunnels served by a running varta process
+func runStatus(args []string) {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	socket := flags.String("control", vrata.DefaultControlSocket(), "Control socket of the running tunnel")
+	parseArgs(flags, args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := vrata.ControlCall(ctx, *socket, vrata.ControlRequest{Command: vrata.ControlStatus})
+	if err != nil {
+		notRunning(*socket, err)
+	}
+
+	fmt.Printf("varta %s running (pid %d)\n\n", resp.Version, resp.PID)
+	if len(resp.Tunnels) == 0 {
+		fmt.Println("No tunnels open")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tURL\tLOCAL\tCONNECTIONS\tREQUESTS\tRTT\tUPTIME")
+	for _, t := range resp.Tunnels {
+		url := t.URL
+		if url == "" {
+			url = "(connecting)"
+		}
+		connections := fmt.Sprint(t.ActiveConnections)
+		if t.MaxConnections > 0 {
+			connections = fmt.Sprintf("%d/%d", t.ActiveConnections, t.MaxConnections)
+		}
+		rtt := "-"
+		if t.RTTMillis > 0 {
+			rtt = fmt.Sprintf("%.0fms", t.RTTMillis)
+		}
+		uptime := (time.Duration(t.UptimeSeconds) * time.Second).String()
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\t%s\t%s\n", t.Name, url, t.LocalPort, connections, t.Requests, rtt, uptime)
+	}
+	w.Flush()
+
+	for _, t := range resp.Tunnels {
+		if t.LastError != "" {
+			fmt.Printf("\n%s: last error: %s\n", t.Name, t.LastError)
+		}
+	}
+}
+
+// runStop closes a tunnel of a running varta process, which exits once
+// its last tunnel is closed
+func runStop(args []string) {
+	flags := flag.NewFlagSet("stop", flag.ExitOnError)
+	socket := flags.String("control", vrata.DefaultControlSocket(), "Control socket of the running tunnel")
+	var name string
+	if rest := parseArgs(flags, args); len(rest) > 0 {
+		name = rest[0]
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := os.Stat(*socket); err != nil {
+		notRunning(*socket, err)
+	}
+
+	req := vrata.ControlRequest{Command: vrata.ControlClose, Tunnel: name}
+	if _, err := vrata.ControlCall(ctx, *socket, req); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Wait for the process to release the socket
+	for ctx.Err() == nil {
+		if _, err := os.Stat(*socket); err != nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	fmt.Println("Tunnel stopped")
+}
+
+// notRunning reports that no varta process answers on the socket and exits
+func notRunning(socket string, err error) {
+	fmt.Fprintf(os.Stderr, "varta is not running (no control socket at %s: %v)\n", socket, err)
+	os.Exit(1)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/korya/vrata"
+)
+
+// debugSessionDuration is how long the diagnostic tunnel is kept open
+const debugSessionDuration = 5 * time.Second
+
+// maxBundleLog bounds the captured log size
+const maxBundleLog = 1 << 20
+
+// runDebugBundle runs a short diagnostic session with the given flags and
+// writes a sanitized zip that users can attach to bug reports
+func runDebugBundle(args []string) {
+	parseCommandLine(args)
+
+	options := optionsFromFlags()
+
+	var logs boundedBuffer
+	options.Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	fmt.Fprintf(os.Stderr, "Collecting diagnostics for %s (about %s)...\n", options.Host, debugSessionDuration)
+
+	files := map[string][]byte{
+		"version.txt":     versionReport(),
+		"config.json":     configReport(),
+		"diagnostics.txt": diagnosticsReport(options),
+	}
+
+	stats, err := tunnelSession(options)
+	if err != nil {
+		fmt.Fprintf(&logs, "session error: %v\n", err)
+	}
+	files["stats.json"] = stats
+	files["logs.txt"] = logs.Bytes()
+
+	name := fmt.Sprintf("varta-debug-%s.zip", time.Now().Format("20060102-150405"))
+	if err := writeZip(name, files); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to write debug bundle: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Debug bundle written to %s\n", name)
+	fmt.Println("Please review it before attaching it to a bug report.")
+}
+
+// versionReport describes the binary and platform
+func versionReport() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "varta %s\n", VERSION)
+	fmt.Fprintf(&b, "go %s\n", runtime.Version())
+	fmt.Fprintf(&b, "platform %s/%s\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(&b, "cpus %d\n", runtime.NumCPU())
+	return b.Bytes()
+}
+
+// configReport lists every flag with secrets redacted
+func configReport() []byte {
+	config := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		if _, ok := aliases[f.Name]; ok {
+			return
+		}
+		config[f.Name] = redactFlag(f.Name, f.Value.String())
+	})
+
+	data, _ := json.MarshalIndent(config, "", "  ")
+	return data
+}
+
+// redactFlag hides values of flags that may carry secrets, and all of a
+// URL but its scheme and host: credentials, tokens in queries and webhook
+// paths alike
+func redactFlag(name, value string) string {
+	if value == "" {
+		return value
+	}
+
+	lower := strings.ToLower(name)
+	for _, secret := range []string{"auth", "token", "secret", "password", "key", "credential", "cookie", "header"} {
+		if strings.Contains(lower, secret) {
+			return "REDACTED"
+		}
+	}
+
+	if u, err := url.Parse(value); err == nil && u.Scheme != "" && u.Host != "" {
+		redacted := &url.URL{Scheme: u.Scheme, Host: u.Host}
+		if u.User != nil {
+			redacted.User = url.User("REDACTED")
+		}
+		if strings.Trim(u.Path, "/") != "" || u.RawQuery != "" || u.Fragment != "" || u.Opaque != "" {
+			redacted.Path = "/REDACTED"
+		}
+		return redacted.String()
+	}
+
+	return value
+}
+
+// diagnosticsReport checks name resolution, the local target and the
+// tunnel server's reachability
+func diagnosticsReport(options *vrata.TunnelOptions) []byte {
+	var b bytes.Buffer
+
+	if u, err := url.Parse(options.Host); err == nil {
+		start := time.Now()
+		addrs, err := net.LookupHost(u.Hostname())
+		fmt.Fprintf(&b, "dns %s: %v (err=%v, %s)\n", u.Hostname(), addrs, err, time.Since(start).Round(time.Millisecond))
+
+		port := u.Port()
+		if port == "" {
+			port = "443"
+			if u.Scheme == "http" {
+				port = "80"
+			}
+		}
+		// The relay is reached through the same proxy as the tunnel
+		start = time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, err := vrata.DialRelay(ctx, options, net.JoinHostPort(u.Hostname(), port))
+		cancel()
+		if err == nil {
+			conn.Close()
+		}
+		fmt.Fprintf(&b, "tcp %s:%s: err=%v (%s)\n", u.Hostname(), port, err, time.Since(start).Round(time.Millisecond))
+	}
+
+	for _, probe := range vrata.ScanLocalPorts(options.LocalHost, []int{options.Port}, time.Second) {
+		fmt.Fprintf(&b, "local %s:%d: listening=%v http=%v server=%q\n",
+			options.LocalHost, probe.Port, probe.Listening, probe.HTTP, probe.Server)
+	}
+
+	return b.Bytes()
+}
+
+// tunnelSession opens a tunnel briefly and reports what happened
+func tunnelSession(options *vrata.TunnelOptions) ([]byte, error) {
+	report := map[string]any{"collected_at": time.Now().UTC().Format(time.RFC3339)}
+
+	tunnel, err := vrata.NewTunnel(options.Port, options)
+	if err != nil {
+		report["error"] = err.Error()
+		data, _ := json.MarshalIndent(report, "", "  ")
+		return data, err
+	}
+	defer tunnel.Close()
+
+	start := time.Now()
+	err = tunnel.Open()
+	report["registration_time"] = time.Since(start).String()
+	if err != nil {
+		report["error"] = err.Error()
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), debugSessionDuration)
+		defer cancel()
+
+		var errs []string
+		events := tunnel.Events()
+	collect:
+		for {
+			select {
+			case err := <-events.Error:
+				errs = append(errs, err.Error())
+			case <-ctx.Done():
+				break collect
+			}
+		}
+		report["errors"] = errs
+		report["queue"] = tunnel.QueueStats()
+
+		info := tunnel.Info()
+		report["session"] = map[string]any{
+			"max_connections":  info.MaxConn,
+			"data_port":        info.Port,
+			"features":         info.Features,
+			"rtt":              info.RTT.String(),
+			"registration_age": time.Since(info.RegisteredAt).Round(time.Millisecond).String(),
+		}
+	}
+
+	data, _ := json.MarshalIndent(report, "", "  ")
+	return data, err
+}
+
+// writeZip stores files in a new zip archive
+func writeZip(name string, files map[string][]byte) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	archive := zip.NewWriter(f)
+	for fileName, data := range files {
+		w, err := archive.Create(fileName)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// boundedBuffer is a concurrency-safe buffer that keeps at most
+// maxBundleLog bytes
+type boundedBuffer struct {
+	buf   bytes.Buffer
+	mutex sync.Mutex
+}
+
+func (b *boundedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.buf.Len()+len(p) > maxBundleLog {
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *boundedBuffer) Bytes() []byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return bytes.Clone(b.buf.Bytes())
+}
@@ -0,0 +1,14 @@
+//go:build windows
+
+package main
+
+import "syscall"
+
+// detachedProcessFlag is DETACHED_PROCESS, which syscall doesn't export
+const detachedProcessFlag = 0x00000008
+
+// detachedProcess starts the background tunnel without a console so it
+// survives the terminal that started it
+func detachedProcess() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: detachedProcessFlag | syscall.CREATE_NEW_PROCESS_GROUP}
+}
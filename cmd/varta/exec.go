@@ -0,0 +1,150 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/korya/vrata"
+)
+
+// urlEnv names the variable holding the tunnel URL in the environment of
+// the command run by exec
+const urlEnv = "VARTA_URL"
+
+// runExec runs a command and tunnels the port it listens on. The tunnel is
+// registered first so the command starts with its URL in VARTA_URL (and
+// the port in PORT); visitors get the error page until the port listens.
+// The tunnel closes when the command exits, and varta exits with its code.
+func runExec(args []string) {
+	i := slices.Index(args, "--")
+	if i < 0 || i == len(args)-1 {
+		fmt.Fprintf(os.Stderr, "Error: exec needs a command after --, e.g. varta exec 3000 -- npm run dev\n")
+		os.Exit(1)
+	}
+	command := args[i+1:]
+	parseCommandLine(args[:i])
+
+	options := optionsFromFlags()
+	out = consoleFromFlags()
+	if options.ReplayFile != "" || len(options.Stubs) > 0 {
+		fmt.Fprintf(os.Stderr, "Error: exec cannot be used with --replay or --stubs\n")
+		os.Exit(1)
+	}
+	if *verbose {
+		options.Logger = slog.New(out.handler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+
+	checkForUpdate()
+
+	// exec does its own waiting, once the command is started
+	wait := cmp.Or(options.WaitForLocal, defaultLocalWait)
+	options.WaitForLocal = 0
+
+	tunnel, err := vrata.NewTunnel(options.Port, options)
+	if err != nil {
+		log.Fatalf("Failed to create tunnel: %v", err)
+	}
+	if err := tunnel.Open(); err != nil {
+		exitOpenFailed(err)
+	}
+	defer tunnel.Close()
+
+	tunnelURL, err := tunnel.URL()
+	if err != nil {
+		log.Fatalf("Failed to get tunnel URL: %v", err)
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), urlEnv+"="+tunnelURL, "PORT="+strconv.Itoa(options.Port))
+	if err := cmd.Start(); err != nil {
+		tunnel.Close()
+		log.Fatalf("Failed to start %s: %v", command[0], err)
+	}
+
+	// Interrupts reach the command through the terminal's process group;
+	// a TERM sent to varta alone is passed on
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGTERM {
+				cmd.Process.Signal(sig)
+			}
+		}
+	}()
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go printEvents(ctx, out, tunnel, cancel)
+
+	ready := make(chan bool, 1)
+	go func() { ready <- waitListening(ctx, options.LocalHost, options.Port, wait) }()
+
+	for {
+		select {
+		case ok := <-ready:
+			if ok {
+				out.print(slog.LevelInfo, "tunnel open", fmt.Sprintf("Your tunnel is available at: %s\n", tunnelURL), "url", tunnelURL)
+			} else if ctx.Err() == nil {
+				address := net.JoinHostPort(options.LocalHost, strconv.Itoa(options.Port))
+				if out.logger != nil {
+					out.logger.Warn("local server not listening", "address", address, "waited", wait.String())
+				} else {
+					fmt.Fprintf(os.Stderr, "Warning: nothing listens on %s after %s\n", address, wait)
+				}
+			}
+			ready = nil
+		case err := <-exited:
+			tunnel.Close()
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				os.Exit(exitErr.ExitCode())
+			}
+			if err != nil {
+				log.Fatalf("%s failed: %v", command[0], err)
+			}
+			return
+		case <-ctx.Done():
+			// The tunnel closed under the command
+			cmd.Process.Signal(syscall.SIGTERM)
+			ctx = context.Background()
+		}
+	}
+}
+
+// waitListening polls host:port until it listens, for up to timeout
+func waitListening(ctx context.Context, host string, port int, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	out.print(slog.LevelInfo, "waiting for local server", fmt.Sprintf("Waiting for %s to listen...\n", address), "address", address)
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if vrata.IsListening(host, port, time.Second) {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+// aliases maps other names of options, mostly one-letter ones, to the
+// options they stand for. Both set the same value, so whichever comes last
+// on the command line wins, and repeatable options collect both.
+var aliases = map[string]string{
+	"p":      "port",
+	"s":      "subdomain",
+	"l":      "local-host",
+	"o":      "open",
+	"h":      "help",
+	"H":      "request-header",
+	"header": "request-header",
+}
+
+// registerAliases defines the aliases, once the options they stand for are
+// defined
+func registerAliases() {
+	for alias, name := range aliases {
+		f := flag.Lookup(name)
+		flag.Var(f.Value, alias, f.Usage)
+	}
+}
+
+// parseCommandLine parses flags that may be mixed with positional arguments,
+// as in "varta start 8080 --detach", and collects the latter in positional
+func parseCommandLine(args []string) {
+	positional = append(positional, parseArgs(flag.CommandLine, args)...)
+}
+
+// parseArgs parses GNU-style arguments into flags and returns the
+// positional ones. Options may come before, between or after positional
+// arguments, up to a "--" after which everything is positional.
+func parseArgs(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	args = gnuArgs(flags, args)
+	for {
+		flags.Parse(args)
+		rest := flags.Args()
+		if len(rest) == 0 {
+			return positional
+		}
+		if len(rest) < len(args) && args[len(args)-len(rest)-1] == "--" {
+			return append(positional, rest...)
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// gnuArgs rewrites GNU-style arguments into the ones package flag parses:
+// groups of one-letter options (-oq) are split, and values attached to one
+// (-p8080) are detached. Values of options are kept as they are, even when
+// they start with a dash.
+func gnuArgs(flags *flag.FlagSet, args []string) []string {
+	var rewritten []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return append(rewritten, args[i:]...)
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			rewritten = append(rewritten, arg)
+			continue
+		}
+
+		// Whole names, like --port and -port, are package flag's own
+		name, _, hasValue := strings.Cut(strings.TrimPrefix(arg[1:], "-"), "=")
+		if f := flags.Lookup(name); f != nil || strings.HasPrefix(arg, "--") {
+			rewritten = append(rewritten, arg)
+			if f != nil && !hasValue && !isBoolFlag(f) && i+1 < len(args) {
+				i++
+				rewritten = append(rewritten, args[i])
+			}
+			continue
+		}
+
+		letters := arg[1:]
+		for j := 0; j < len(letters); j++ {
+			f := flags.Lookup(letters[j : j+1])
+			if f == nil {
+				// Left for package flag to report
+				rewritten = append(rewritten, "-"+letters[j:])
+				break
+			}
+			rewritten = append(rewritten, "-"+f.Name)
+			if isBoolFlag(f) {
+				continue
+			}
+			if value := letters[j+1:]; value != "" {
+				rewritten = append(rewritten, strings.TrimPrefix(value, "="))
+			} else if i+1 < len(args) {
+				i++
+				rewritten = append(rewritten, args[i])
+			}
+			break
+		}
+	}
+	return rewritten
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
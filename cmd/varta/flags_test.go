@@ -0,0 +1,180 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"slices"
+	"testing"
+)
+
+// newTestFlags returns a flag set shaped like varta's: value and bool
+// options, with the aliases of those among them
+func newTestFlags() *flag.FlagSet {
+	flags := flag.NewFlagSet("varta", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.Int("port", 0, "")
+	flags.String("host", "", "")
+	flags.String("subdomain", "", "")
+	flags.Bool("open", false, "")
+	flags.Bool("detach", false, "")
+	flags.Bool("help", false, "")
+	flags.Var(new(stringList), "request-header", "")
+	for alias, name := range aliases {
+		if f := flags.Lookup(name); f != nil {
+			flags.Var(f.Value, alias, f.Usage)
+		}
+	}
+	return flags
+}
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		positional []string
+		values     map[string]string
+	}{
+		{
+			name:   "clustered bool flags",
+			args:   []string{"-oh"},
+			values: map[string]string{"open": "true", "help": "true"},
+		},
+		{
+			name:   "cluster ending with a value flag",
+			args:   []string{"-op", "8080"},
+			values: map[string]string{"open": "true", "port": "8080"},
+		},
+		{
+			name:   "cluster with an attached value",
+			args:   []string{"-op8080"},
+			values: map[string]string{"open": "true", "port": "8080"},
+		},
+		{
+			name:   "attached short value",
+			args:   []string{"-p8080"},
+			values: map[string]string{"port": "8080"},
+		},
+		{
+			name:   "short value after an equals sign",
+			args:   []string{"-p=8080"},
+			values: map[string]string{"port": "8080"},
+		},
+		{
+			name:   "long value after an equals sign",
+			args:   []string{"--port=8080"},
+			values: map[string]string{"port": "8080"},
+		},
+		{
+			name:   "long name with one dash",
+			args:   []string{"-port", "8080"},
+			values: map[string]string{"port": "8080"},
+		},
+		{
+			name:       "flags between positional arguments",
+			args:       []string{"start", "8080", "--open", "9090"},
+			positional: []string{"start", "8080", "9090"},
+			values:     map[string]string{"open": "true"},
+		},
+		{
+			name:       "double dash ends the options",
+			args:       []string{"8080", "--", "-o", "--port", "1"},
+			positional: []string{"8080", "-o", "--port", "1"},
+			values:     map[string]string{"open": "false", "port": "0"},
+		},
+		{
+			name:       "double dash first",
+			args:       []string{"--", "--help"},
+			positional: []string{"--help"},
+			values:     map[string]string{"help": "false"},
+		},
+		{
+			name:   "long value starting with a dash",
+			args:   []string{"--subdomain", "-demo"},
+			values: map[string]string{"subdomain": "-demo"},
+		},
+		{
+			name:   "short value starting with a dash",
+			args:   []string{"-s", "--demo"},
+			values: map[string]string{"subdomain": "--demo"},
+		},
+		{
+			name:   "double dash as a value",
+			args:   []string{"-s", "--", "-o"},
+			values: map[string]string{"subdomain": "--", "open": "true"},
+		},
+		{
+			name:       "bool flag before a positional argument",
+			args:       []string{"-o", "3000", "--detach"},
+			positional: []string{"3000"},
+			values:     map[string]string{"open": "true", "detach": "true"},
+		},
+		{
+			name:       "bool and value flags side by side",
+			args:       []string{"--detach", "-p", "3000", "--open", "4000"},
+			positional: []string{"4000"},
+			values:     map[string]string{"open": "true", "detach": "true", "port": "3000"},
+		},
+		{
+			name:   "-h is help, not --host",
+			args:   []string{"-h"},
+			values: map[string]string{"help": "true", "host": ""},
+		},
+		{
+			name:   "--host takes the upstream server",
+			args:   []string{"--host", "https://relay.example"},
+			values: map[string]string{"host": "https://relay.example", "help": "false"},
+		},
+		{
+			name:   "-H, --header and --request-header collect headers",
+			args:   []string{"-H", "A: 1", "--header", "B: 2", "--request-header=C: 3", "-HD: 4"},
+			values: map[string]string{"request-header": "A: 1,B: 2,C: 3,D: 4"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := newTestFlags()
+			positional := parseArgs(flags, tt.args)
+			if !slices.Equal(positional, tt.positional) {
+				t.Errorf("parseArgs(%q) positional = %q, want %q", tt.args, positional, tt.positional)
+			}
+			for name, want := range tt.values {
+				if got := flags.Lookup(name).Value.String(); got != want {
+					t.Errorf("parseArgs(%q): --%s = %q, want %q", tt.args, name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGnuArgsLeavesUnknownFlags(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"-x"}, []string{"-x"}},
+		{[]string{"-ox"}, []string{"-o", "-x"}},
+		{[]string{"-oxh"}, []string{"-o", "-xh"}},
+		{[]string{"--unknown", "8080"}, []string{"--unknown", "8080"}},
+	}
+	for _, tt := range tests {
+		if got := gnuArgs(newTestFlags(), tt.args); !slices.Equal(got, tt.want) {
+			t.Errorf("gnuArgs(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestAliases(t *testing.T) {
+	for alias, name := range aliases {
+		f, target := flag.Lookup(alias), flag.Lookup(name)
+		if f == nil || target == nil {
+			t.Errorf("-%s: alias of --%s is not defined", alias, name)
+			continue
+		}
+		if f.Value != target.Value {
+			t.Errorf("-%s doesn't set the value of --%s", alias, name)
+		}
+	}
+	if !isBoolFlag(flag.Lookup("h")) || isBoolFlag(flag.Lookup("host")) {
+		t.Error("Expected -h to be the help switch and --host to take a value")
+	}
+}
@@ -2,12 +2,21 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
+	"slices"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -17,52 +26,439 @@ import (
 // CLI options
 var (
 	port       = flag.Int("port", 0, "Internal HTTP server port")
-	portShort  = flag.Int("p", 0, "Internal HTTP server port (short)")
 	host       = flag.String("host", "https://localtunnel.me", "Upstream server")
-	hostShort  = flag.String("h", "https://localtunnel.me", "Upstream server (short)")
-	subdomain  = flag.String("subdomain", "", "Request specific subdomain")
-	subShort   = flag.String("s", "", "Request specific subdomain (short)")
+	subdomain  = flag.String("subdomain", "", "Request specific subdomain, or comma-separated fallbacks")
+	randSuffix = flag.Bool("random-suffix", false, "Append a random token to the requested subdomain")
+	retrySub   = flag.Bool("retry-subdomain", false, "Try myapp-2, myapp-3, ... when the requested subdomain is taken")
+	token      = flag.String("token", "", "Account token for relays that reserve subdomains; remembered for later runs")
+	reserveIn  = flag.String("reservation-file", vrata.DefaultReservationFile(), "Where the token and reserved subdomains are remembered (empty to disable)")
+	proxyURL   = flag.String("proxy", "", "Reach the upstream server through this http, https or socks5 proxy URL")
+	relayCert  = flag.String("relay-cert", "", "PEM client certificate presented to the upstream server")
+	relayKey   = flag.String("relay-key", "", "PEM key of the --relay-cert client certificate")
+	relayCA    = flag.String("relay-ca", "", "PEM CA the upstream server's certificates are checked against")
 	localHost  = flag.String("local-host", "localhost", "Tunnel traffic to alternative localhost")
-	localShort = flag.String("l", "localhost", "Tunnel traffic to alternative localhost (short)")
 	localHTTPS = flag.Bool("local-https", false, "Enable HTTPS tunneling")
+	localCert  = flag.String("local-cert", "", "PEM client certificate presented to a local HTTPS server")
+	localKey   = flag.String("local-key", "", "PEM key of the --local-cert client certificate")
+	localSNI   = flag.String("local-sni", "", "TLS server name sent to a local HTTPS server instead of the local host")
+	localHTTP2 = flag.Bool("local-http2", false, "Speak HTTP/2 to local servers that support it")
 	open       = flag.Bool("open", false, "Automatically open tunnel URL in browser")
-	openShort  = flag.Bool("o", false, "Automatically open tunnel URL in browser (short)")
+	qrCode     = flag.Bool("qr", false, "Print a QR code of the tunnel URL, e.g. to open it on a phone")
+	copyURL    = flag.Bool("copy", false, "Copy the tunnel URL to the clipboard")
 	printReqs  = flag.Bool("print-requests", false, "Log request information")
+	printFmt   = flag.String("print-requests-format", "", "text/template for --print-requests lines (implies --print-requests)")
+	logFormat  = flag.String("log-format", "text", "Output of lifecycle and request logs: text or json")
+	basicAuth  = flag.String("basic-auth", "", "Require visitors to log in with USER:PASS")
+	jwtSecret  = flag.String("jwt-secret", "", "Require a bearer JWT signed with SECRET (HS256)")
+	jwksURL    = flag.String("jwks-url", "", "Require a bearer JWT signed with a key from this JWKS URL (RS256)")
+	jwtIssuer  = flag.String("jwt-issuer", "", "Required iss claim of bearer JWTs")
+	jwtAud     = flag.String("jwt-audience", "", "Required aud claim of bearer JWTs")
+	oidcIssuer = flag.String("oidc-issuer", "", "Require an OpenID Connect login with this provider")
+	oidcClient = flag.String("oidc-client-id", "", "OpenID Connect client ID")
+	oidcSecret = flag.String("oidc-client-secret", "", "OpenID Connect client secret")
+	oidcAllow  = flag.String("oidc-allow", "", "Emails or @domains allowed to log in (comma-separated)")
+	hostHdr    = flag.String("host-header", "local", "Host of forwarded requests: local, preserve or a custom host")
+	stripHdrs  = flag.String("strip-headers", "", "Request headers removed before they reach the local server (comma-separated)")
+	redactHdrs = flag.String("redact-headers", "", "Headers masked in events, logs and recordings (comma-separated)")
+	fwdHeaders = flag.String("forwarded-headers", "trust", "X-Forwarded-* headers of visitors' requests: trust, replace or strip")
+	rewriteURL = flag.Bool("rewrite-urls", false, "Replace links to the local server with the tunnel URL in responses")
+	proxyMode  = flag.String("proxy-mode", "raw", "How requests reach the local server: raw or structured")
+	proxyRetry = flag.Int("proxy-retries", 0, "Retry idempotent requests the local server dropped this many times")
+	share      = flag.Int("share", 0, "Only serve visitors holding a signed link that expires after this many minutes")
+	shareKey   = flag.String("share-secret", "", "Secret signing share links (default: random)")
+	e2e        = flag.Bool("e2e", false, "Encrypt traffic end to end; visitors open the tunnel with varta view")
+	e2eKey     = flag.String("e2e-key", "", "Key for --e2e, as printed at startup (default: random)")
+	geoIPDB    = flag.String("geoip-db", "", "MaxMind database (e.g. GeoLite2-Country.mmdb) for country rules")
+	allowCC    = flag.String("allow-country", "", "Only admit clients from these countries (e.g. US,DE)")
+	denyCC     = flag.String("deny-country", "", "Block clients from these countries")
+	control    = flag.String("control", vrata.DefaultControlSocket(), "Unix socket for the JSON control API (empty to disable)")
+	eventsAddr = flag.String("events-addr", "", "Serve tunnel events as Server-Sent Events on ADDR (e.g. 127.0.0.1:4041)")
+	healthPath = flag.String("health-path", "", "Probe this path on the local server and report health changes")
+	healthIntv = flag.Duration("health-interval", 10*time.Second, "Time between health probes")
+	balance    = flag.String("balance", "round-robin", "How --local-target addresses share visitors: round-robin or least-conns")
+	sticky     = flag.String("sticky", "none", "Keep visitors on one --local-target: none, ip or cookie")
+	fallback   = flag.String("fallback", "", "Send visitors to this HOST:PORT when the local server is down")
+	retries    = flag.Int("register-retries", 3, "Retry registering with the upstream server this many times")
+	reregister = flag.Duration("reregister-after", 0, "Register again when the upstream server stays unreachable this long (default 1m, negative disables)")
+	restart    = flag.Duration("restart-grace", 0, "Hold visitors this long while the local server restarts (e.g. 10s)")
+	unhealthy  = flag.String("on-unhealthy", "forward", "Visitors while unhealthy: forward, error-page or pause")
+	errorPage  = flag.String("error-page", "", "HTML template sent with 502 when the local server is down")
+	accessLog  = flag.String("access-log", "", "Append a combined-format access log to FILE (- for stdout)")
+	maxReqs    = flag.Int("max-requests", 0, "Maximum concurrent requests forwarded to the local server")
+	maxPerIP   = flag.Int("max-requests-per-client", 0, "Maximum concurrent requests from one client")
+	maxConns   = flag.Int("max-conns", 0, "Keep at most this many connections to the upstream server (default: its limit)")
+	minConns   = flag.Int("min-conns", 0, "Autoscale the connection pool, starting with this many connections")
+	lazy       = flag.Bool("lazy", false, "Open one connection and dial more only when all are busy")
+	idleTime   = flag.Duration("idle-timeout", 0, "Replace connections to the upstream server idle this long (default 60s, negative never)")
+	dialTime   = flag.Duration("dial-timeout", 0, "Timeout for connecting to the upstream server (default 10s)")
+	regTime    = flag.Duration("register-timeout", 0, "Timeout for registering with the upstream server (default 10s)")
+	localTime  = flag.Duration("local-dial-timeout", 0, "Timeout for connecting to the local server (default 10s)")
+	reqTime    = flag.Duration("request-timeout", 0, "Cut off visitors still being served after this long (default: no limit)")
+	keepAlive  = flag.Duration("keepalive", 0, "TCP keepalive period of connections (default 15s, negative disables)")
+	nagle      = flag.Bool("nagle", false, "Turn TCP_NODELAY off, batching small writes")
+	sockBuffer = flag.Int("socket-buffer", 0, "Size of TCP send and receive buffers in bytes")
+	scanPorts  = flag.String("scan-ports", "", "Ports to scan when the local port isn't listening (e.g. 3000-3010)")
+	autoPort   = flag.Bool("auto-port", false, "Switch to a listening port automatically when the local port is down")
+	record     = flag.String("record", "", "Record requests and responses to a cassette file")
+	replay     = flag.String("replay", "", "Replay responses from a cassette file instead of the local server")
+	stubsFile  = flag.String("stubs", "", "Answer requests with the canned responses in a JSON file instead of the local server")
+	onThrottle = flag.String("on-throttle", "backoff", "Reaction to relay throttling: backoff, ignore or close")
+	detach     = flag.Bool("detach", false, "Run the tunnel in the background (start only)")
+	pidFile    = flag.String("pid-file", "", "Write the process ID to FILE while the tunnel runs")
+	logFile    = flag.String("log-file", "", "Append output to FILE instead of the terminal")
+	verbose    = flag.Bool("verbose", false, "Log connection lifecycle and proxy errors to stderr")
+	noUpdates  = flag.Bool("no-update-check", false, "Don't check for a newer release on startup")
 	help       = flag.Bool("help", false, "Show help")
 	version    = flag.Bool("version", false, "Show version")
 )
 
+// Access rules, filled by repeatable --allow-ip/--deny-ip and
+// --allow-path/--deny-path flags
+var (
+	allowIPs, denyIPs     prefixList
+	allowPaths, denyPaths stringList
+)
+
+// Local servers visitors are spread over, filled by repeatable
+// --local-target flags
+var localTargets stringList
+
+// How long to wait for the local port before opening, set by
+// --wait-for-local[=TIMEOUT]
+var waitForLocal waitFlag
+
+// Headers set on forwarded requests and their responses, filled by
+// repeatable --request-header/--response-header/--registration-header flags
+var requestHeaders, responseHeaders, registrationHeaders stringList
+
+func init() {
+	flag.Var(&localTargets, "local-target", "Spread visitors over this HOST:PORT instead of the local port (repeatable)")
+	flag.Var(&waitForLocal, "wait-for-local", "Wait up to TIMEOUT (default 2m) for the local port to listen before opening")
+	flag.Var(&allowIPs, "allow-ip", "Only admit clients in these CIDRs or IPs (comma-separated, repeatable)")
+	flag.Var(&denyIPs, "deny-ip", "Block clients in these CIDRs or IPs (comma-separated, repeatable)")
+	flag.Var(&allowPaths, "allow-path", "Only serve paths matching this pattern (repeatable)")
+	flag.Var(&denyPaths, "deny-path", "Never serve paths matching this pattern (repeatable)")
+	flag.Var(&requestHeaders, "request-header", `Set "Name: value" on every forwarded request (repeatable)`)
+	flag.Var(&responseHeaders, "response-header", `Set "Name: value" on every response to visitors (repeatable)`)
+	flag.Var(&registrationHeaders, "registration-header", `Send "Name: value" when registering with the upstream server (repeatable)`)
+	registerAliases()
+}
+
+// positional holds the non-flag arguments, which may come before flags
+var positional []string
+
 const VERSION = "1.0.0"
 
 func usage() {
 	fmt.Fprintf(os.Stderr, `localtunnel (Go port) - Expose localhost to the world
 
-Usage: %s [options]
+Usage: %s [start] [port...] [options]
+       %s status|stop [--control PATH] [tunnel]
+       %s service install|uninstall [port] [options] [--name NAME] [--system]
+       %s debug-bundle [options]
+       %s exec [port] [options] -- COMMAND [ARGS...]
+       %s view --key KEY [--listen ADDR] URL
+       %s completion bash|zsh|fish|powershell
+
+Commands:
+  start                Open a tunnel (the default); --detach runs it in the
+                       background and returns once the URL is known. Several
+                       ports or a range (8080-8083) open a tunnel each
+  status               Show the tunnels of a running varta and their URLs
+  stop                 Close a running tunnel through the control socket
+  service install      Keep the tunnel running across reboots with these
+                       options (systemd, launchd or a Windows scheduled task;
+                       per-user unless --system)
+  service uninstall    Stop and remove that service
+  debug-bundle         Run a short diagnostic session with the given options
+                       and write a sanitized zip to attach to bug reports
+  exec                 Run COMMAND with the tunnel URL in VARTA_URL and the
+                       port in PORT, tunnel the port once it listens, and
+                       close the tunnel when COMMAND exits
+  view                 Open an --e2e tunnel at URL through a local proxy
+                       that encrypts requests and decrypts responses with
+                       KEY (default address: 127.0.0.1:4080)
+  completion           Print a completion script of subcommands and options
+                       for a shell
 
 Options:
   -p, --port           Internal HTTP server port (required)
-  -h, --host           Upstream server (default: https://localtunnel.me)
-  -s, --subdomain      Request specific subdomain
+      --host           Upstream server (default: https://localtunnel.me)
+  -s, --subdomain      Request specific subdomain; a list (myapp,myapp2) is
+                       tried in order while names are taken
+      --random-suffix  Append a random token to the subdomain (myapp-x7k2)
+      --retry-subdomain
+                       When the subdomain is taken, try it with a number
+                       (myapp-2 up to myapp-10) instead of failing
+      --token TOKEN    Account token for relays that reserve subdomains. It is
+                       remembered, and later runs reclaim the same subdomain
+      --reservation-file FILE
+                       Where tokens and reserved subdomains are remembered
+                       (default: varta/reservations.json in the config dir)
+      --registration-header "NAME: VALUE"
+                       Send a header when registering with the upstream
+                       server, e.g. for a gateway in front of it (repeatable)
+      --proxy URL      Reach the upstream server through an http://, https://
+                       or socks5:// proxy (default: HTTPS_PROXY/HTTP_PROXY)
+      --relay-cert FILE, --relay-key FILE
+                       Present this PEM client certificate and key to an
+                       upstream server that requires mutual TLS; data
+                       connections then use TLS too
+      --relay-ca FILE  Trust upstream server certificates issued by this PEM
+                       CA (default: system roots)
   -l, --local-host     Tunnel traffic to alternative localhost (default: localhost)
       --local-https    Enable HTTPS tunneling
+      --local-cert FILE, --local-key FILE
+                       Present this PEM client certificate and key to a local
+                       HTTPS server that requires mutual TLS
+      --local-sni NAME Send NAME as the TLS server name to a local HTTPS
+                       server, e.g. when --local-host is an IP
+      --local-http2    Speak HTTP/2 to local servers that support it, e.g.
+                       gRPC servers (h2c, or ALPN with --local-https)
+      --local-target HOST:PORT
+                       Spread visitor connections over these local servers
+                       instead of the port (repeatable)
+      --balance MODE   How local targets share visitors: round-robin
+                       (default) or least-conns
+      --sticky MODE    Keep each visitor on one local target: none (default),
+                       ip (by client address) or cookie
+      --fallback HOST:PORT
+                       Send visitors here when the local server is down
+      --restart-grace DURATION
+                       Hold visitors while the local server refuses
+                       connections for up to DURATION, e.g. while air or
+                       nodemon rebuilds it, then forward them
   -o, --open           Automatically open tunnel URL in browser
-      --print-requests Log request information
+      --qr             Print a QR code of the tunnel URL (or the --share
+                       link), e.g. to open the app on a phone
+      --copy           Copy the tunnel URL (or the --share link) to the
+                       clipboard, with pbcopy, clip, wl-copy, xclip or xsel
+      --print-requests Print a line per request with its client, status,
+                       response time and sizes once it is answered
+      --print-requests-format TEMPLATE
+                       Print requests with this Go text/template instead,
+                       e.g. '{{.StatusCode}} {{.Method}} {{.URL}}'; fields:
+                       Time, Client, Method, Path, URL, StatusCode,
+                       Duration, BytesIn, BytesOut, Header, ResponseHeader
+  -H, --header "NAME: VALUE"
+                       Set a header on every forwarded request, replacing
+                       the visitor's (repeatable, like curl -H); Host
+                       overrides the rewrite. Also --request-header
+      --host-header HOST
+                       Host of forwarded requests: local rewrites it to the
+                       local address (default), preserve keeps the public
+                       hostname, e.g. for virtual hosts or OAuth callbacks;
+                       anything else is sent as is
+      --response-header "NAME: VALUE"
+                       Set a header on every response to visitors, replacing
+                       the local server's (repeatable), e.g. for CORS
+      --strip-headers NAMES
+                       Remove these request headers (comma-separated, e.g.
+                       Cookie,Authorization) before they reach the local server
+      --redact-headers NAMES
+                       Mask these headers in request events, logs and
+                       recordings; they are still forwarded
+      --forwarded-headers MODE
+                       trust keeps visitors' X-Forwarded-* headers, adding
+                       the tunnel's scheme and host (default); replace sets
+                       them from the client address the relay reports and
+                       the tunnel URL; strip removes them
+      --rewrite-urls   Replace http://localhost:PORT links in text responses
+                       and redirects with the tunnel URL
+      --proxy-mode MODE
+                       raw copies visitors' bytes to the local server;
+                       structured parses every request and forwards it
+                       with retries (default: raw)
+      --proxy-retries N
+                       Retry idempotent requests the local server dropped up
+                       to N times; needs --proxy-mode structured
+      --basic-auth USER:PASS
+                       Require visitors to log in; others get 401 before
+                       reaching the local server
+      --jwt-secret SECRET
+                       Require a bearer JWT signed with SECRET (HS256)
+      --jwks-url URL   Require a bearer JWT signed with a key from URL (RS256)
+      --jwt-issuer ISS, --jwt-audience AUD
+                       Also require these iss and aud claims
+      --oidc-issuer URL, --oidc-client-id ID, --oidc-client-secret SECRET
+                       Require an OpenID Connect login; register
+                       https://<tunnel>/.vrata/oidc/callback with the provider
+      --oidc-allow LIST
+                       Emails or @domains that may log in (default: anyone)
+      --share MINUTES  Only serve visitors holding a signed link that expires
+                       after MINUTES; the link is printed at startup
+      --share-secret SECRET
+                       Sign share links with SECRET so they survive restarts
+                       (default: random)
+      --e2e            Encrypt requests and responses end to end, so the
+                       upstream server never sees them; the key and the
+                       varta view command to open the tunnel are printed at
+                       startup. Bodies are buffered and WebSockets are not
+                       supported
+      --e2e-key KEY    Use this key for --e2e instead of a random one
+      --allow-ip CIDRS Only admit clients in these ranges (comma-separated,
+                       repeatable); others get 403
+      --deny-ip CIDRS  Block clients in these ranges, even if allowed
+      --allow-path PATTERN
+                       Only serve paths matching PATTERN (repeatable); a
+                       trailing /* matches a whole subtree, e.g. /webhooks/*
+      --deny-path PATTERN
+                       Never serve paths matching PATTERN, e.g. /admin/*
+      --allow-country CODES
+                       Only admit clients from these countries (e.g. US,DE);
+                       needs --geoip-db
+      --deny-country CODES
+                       Block clients from these countries
+      --geoip-db FILE  MaxMind database, e.g. GeoLite2-Country.mmdb
+      --health-path PATH
+                       Probe PATH on the local server every --health-interval
+                       (default 10s) and report health changes
+      --on-unhealthy MODE
+                       Visitors while unhealthy: forward (default),
+                       error-page, or pause until healthy again
+      --error-page FILE
+                       HTML template sent with 502 when the local server is
+                       down ({{.Port}}, {{.Address}} and {{.Error}} expand)
+      --access-log FILE
+                       Append a combined-format access log line per request (- for stdout)
+      --events-addr ADDR
+                       Serve events as Server-Sent Events at http://ADDR/events
+      --control PATH   Unix socket for the JSON control API (default: per-user
+                       socket in $XDG_RUNTIME_DIR or the temp dir; empty disables)
+      --max-requests N Queue requests beyond N concurrent ones (FIFO)
+      --max-requests-per-client N
+                       Cap concurrent requests from a single client
+      --max-conns N    Keep at most N connections to the upstream server
+                       instead of its limit (usually 10), e.g. for a
+                       low-traffic webhook tunnel
+      --min-conns N    Start with N connections and dial more, up to
+                       --max-conns, while they're busy (autoscaling)
+      --lazy           Open one connection and dial another whenever all are
+                       busy, for low-traffic tunnels (same as --min-conns 1)
+      --idle-timeout DURATION
+                       Replace connections to the upstream server that sat
+                       idle this long (default 60s, negative never)
+      --dial-timeout DURATION
+                       Give up connecting to the upstream server after
+                       DURATION (default 10s)
+      --register-timeout DURATION
+                       Give up registering with the upstream server after
+                       DURATION (default 10s)
+      --local-dial-timeout DURATION
+                       Give up connecting to the local server after DURATION
+                       (default 10s)
+      --request-timeout DURATION
+                       Cut off visitors still being served after DURATION;
+                       WebSockets and event streams are exempt once open
+                       (default: no limit)
+      --keepalive DURATION
+                       TCP keepalive period of connections to the upstream
+                       and local servers, to notice a dead one sooner
+                       (default 15s, negative disables)
+      --nagle          Batch small writes into fewer packets (TCP_NODELAY
+                       off), trading latency for throughput
+      --socket-buffer BYTES
+                       Size of TCP send and receive buffers, e.g. larger for
+                       bulk transfers over long distances
+      --wait-for-local[=TIMEOUT]
+                       Wait for the local port to listen before opening the
+                       tunnel (default timeout: 2m), so the app can start
+                       after the tunnel
+      --scan-ports SPEC
+                       Ports to scan when the local port is down (e.g. 3000-3010)
+      --auto-port      Switch to a listening port automatically
+      --record FILE    Record requests and responses to a cassette file
+      --replay FILE    Replay responses from a cassette file (no local server needed)
+      --stubs FILE     Answer matching routes with canned responses from a JSON
+                       file, and others with 404 (no local server needed)
+      --register-retries N
+                       Retry registering with the upstream server N times,
+                       backing off exponentially (default 3)
+      --reregister-after DURATION
+                       Register again, possibly under a new URL, when the
+                       upstream server stays unreachable this long (default
+                       1m, negative disables)
+      --on-throttle MODE
+                       Reaction to relay throttling: backoff (default), ignore, close
+      --detach         Run in the background (needs --control); see status, stop
+      --pid-file FILE  Write the process ID to FILE while the tunnel runs
+                       (default with --detach: next to the control socket)
+      --log-file FILE  Append output to FILE instead of the terminal
+                       (default with --detach: next to the control socket)
+      --log-format FORMAT
+                       text (default), or json for one JSON object per line
+                       (time, level, msg and fields), e.g. for CI systems and
+                       log collectors; requests printed by --print-requests
+                       carry client, method, url, status, duration_ms,
+                       bytes_in and bytes_out
+      --verbose        Log connection lifecycle and proxy errors to stderr
+      --no-update-check
+                       Don't look for a newer release on startup (also
+                       VARTA_NO_UPDATE_CHECK=1); the check runs in the
+                       background and never delays the tunnel
       --version        Show version
-      --help           Show this help
+  -h, --help           Show this help
 
 Examples:
   %s --port 8080
   %s --port 3000 --subdomain myapp
   %s --port 8080 --open --print-requests
+  %s --port 8080 --record webhooks.json
+  %s --replay webhooks.json
+  %s start 8080 --detach && %s status && %s stop
+  %s exec 3000 -- npm run dev
+  %s 8080 --e2e
+  source <(%s completion bash)
 
-`, os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0],
+		os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0],
+		os.Args[0], os.Args[0])
 }
 
 func main() {
 	flag.Usage = usage
-	flag.Parse()
+
+	args := os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "start":
+			args = args[1:]
+		case "status":
+			runStatus(args[1:])
+			return
+		case "stop":
+			runStop(args[1:])
+			return
+		case "service":
+			runService(args[1:])
+			return
+		case "debug-bundle":
+			runDebugBundle(args[1:])
+			return
+		case "exec":
+			runExec(args[1:])
+			return
+		case "view":
+			runView(args[1:])
+			return
+		case "completion":
+			runCompletion(args[1:])
+			return
+		}
+	}
+	runStart(args)
+}
+
+// runStart opens a tunnel and keeps it open until interrupted or stopped
+func runStart(args []string) {
+	parseCommandLine(args)
 
 	if *help {
+		// -h used to set the upstream server
+		if i := slices.IndexFunc(positional, func(arg string) bool { return strings.Contains(arg, "://") }); i >= 0 {
+			fmt.Fprintf(os.Stderr, "Error: -h shows help, use --host %s for the upstream server\n", positional[i])
+			os.Exit(1)
+		}
 		usage()
 		os.Exit(0)
 	}
@@ -72,62 +468,79 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Get port from either flag
-	targetPort := *port
-	if targetPort == 0 {
-		targetPort = *portShort
+	options := optionsFromFlags()
+	out = consoleFromFlags()
+	ports := positionalPorts()
+	if *port != 0 && len(ports) > 0 {
+		fmt.Fprintf(os.Stderr, "Error: give the port either with --port or as an argument, not both\n")
+		os.Exit(1)
+	}
+	severalPorts := *port == 0 && len(ports) > 1
+	if severalPorts {
+		checkPortsFlags(ports)
+	}
+	if *detach {
+		runDetached(args)
+		return
 	}
 
-	// Port is required
-	if targetPort == 0 {
-		// Check if port was provided as positional argument
-		if len(flag.Args()) > 0 {
-			if p, err := strconv.Atoi(flag.Args()[0]); err == nil {
-				targetPort = p
-			}
+	if *logFile != "" {
+		file, err := os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			log.Fatalf("Failed to open log file: %v", err)
+		}
+		defer file.Close()
+		os.Stdout, os.Stderr = file, file
+		// JSON consoles already follow os.Stderr
+		if out.logger == nil {
+			log.SetOutput(file)
 		}
 	}
 
-	if targetPort == 0 {
-		fmt.Fprintf(os.Stderr, "Error: port is required\n\n")
-		usage()
-		os.Exit(1)
+	if *pidFile != "" {
+		if err := os.WriteFile(*pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+			log.Fatalf("Failed to write PID file: %v", err)
+		}
+		defer os.Remove(*pidFile)
 	}
 
-	// Validate port range
-	if targetPort < 1 || targetPort > 65535 {
-		fmt.Fprintf(os.Stderr, "Error: port must be between 1 and 65535\n")
-		os.Exit(1)
-	}
+	checkForUpdate()
 
-	// Get other options with short flag fallbacks
-	tunnelHost := *host
-	if *hostShort != "https://localtunnel.me" {
-		tunnelHost = *hostShort
+	if *accessLog != "" {
+		writer, err := openAccessLog(*accessLog)
+		if err != nil {
+			log.Fatalf("Failed to open access log: %v", err)
+		}
+		defer writer.Close()
+		options.AccessLog = writer
 	}
 
-	tunnelSubdomain := *subdomain
-	if *subShort != "" {
-		tunnelSubdomain = *subShort
+	if *verbose {
+		options.Logger = slog.New(out.handler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
 	}
 
-	tunnelLocalHost := *localHost
-	if *localShort != "localhost" {
-		tunnelLocalHost = *localShort
+	if severalPorts {
+		runPorts(ports, options)
+		return
 	}
 
-	shouldOpen := *open || *openShort
+	targetPort := options.Port
+	shouldOpen := *open
 
-	// Create tunnel options
-	options := &vrata.TunnelOptions{
-		Port:       targetPort,
-		Host:       tunnelHost,
-		Subdomain:  tunnelSubdomain,
-		LocalHost:  tunnelLocalHost,
-		LocalHTTPS: *localHTTPS,
+	// Make sure we're not about to tunnel into nothing, unless the app is
+	// expected to start later
+	localNeeded := options.ReplayFile == "" && len(options.Stubs) == 0
+	if options.WaitForLocal > 0 && localNeeded &&
+		!vrata.IsListening(options.LocalHost, targetPort, time.Second) {
+		out.print(slog.LevelInfo, "waiting for local server", fmt.Sprintf("Waiting for %s:%d to listen...\n", options.LocalHost, targetPort),
+			"address", net.JoinHostPort(options.LocalHost, strconv.Itoa(targetPort)))
+	} else if localNeeded && len(options.LocalTargets) == 0 && options.LocalFallback == "" {
+		targetPort = checkLocalPort(options.LocalHost, targetPort, *scanPorts, *autoPort)
+		options.Port = targetPort
 	}
 
 	// Create tunnel
+	requested := options.Subdomain
 	tunnel, err := vrata.NewTunnel(targetPort, options)
 	if err != nil {
 		log.Fatalf("Failed to create tunnel: %v", err)
@@ -140,14 +553,14 @@ func main() {
 
 	go func() {
 		<-sigChan
-		fmt.Println("\nShutting down tunnel...")
+		out.print(slog.LevelInfo, "shutting down", "\nShutting down tunnel...\n")
 		tunnel.Close()
 		cancel()
 	}()
 
 	// Start the tunnel
 	if err := tunnel.Open(); err != nil {
-		log.Fatalf("Failed to open tunnel: %v", err)
+		exitOpenFailed(err)
 	}
 
 	// Get the tunnel URL
@@ -156,38 +569,662 @@ func main() {
 		log.Fatalf("Failed to get tunnel URL: %v", err)
 	}
 
-	fmt.Printf("Your tunnel is available at: %s\n", tunnelURL)
+	out.print(slog.LevelInfo, "tunnel open", fmt.Sprintf("Your tunnel is available at: %s\n", tunnelURL), "url", tunnelURL)
+	printConnectionLimit(tunnel, options.MaxConnections)
+	if info := tunnel.Info(); info != nil && info.Subdomain != "" && !strings.EqualFold(info.Subdomain, strings.TrimSpace(requested)) {
+		out.print(slog.LevelInfo, "subdomain granted", fmt.Sprintf("Granted subdomain: %s\n", info.Subdomain), "subdomain", info.Subdomain)
+	}
+
+	// Visitors open the share link when there is one
+	visitURL := tunnelURL
+	if options.ShareLinks != nil {
+		shareURL, err := options.ShareLinks.Sign(tunnelURL, time.Duration(*share)*time.Minute)
+		if err != nil {
+			log.Fatalf("Failed to sign share link: %v", err)
+		}
+		out.print(slog.LevelInfo, "share link", fmt.Sprintf("Share this link, valid for %d minutes: %s\n", *share, shareURL),
+			"url", shareURL, "minutes", *share)
+		visitURL = shareURL
+	}
+
+	// A code would garble JSON lines
+	if *qrCode && out.logger == nil {
+		if err := vrata.WriteQR(os.Stdout, visitURL); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: no QR code: %v\n", err)
+		}
+	}
+
+	if options.E2EKey != nil {
+		key := vrata.EncodeE2EKey(options.E2EKey)
+		out.print(slog.LevelInfo, "end-to-end encrypted",
+			fmt.Sprintf("Traffic is end-to-end encrypted; view the tunnel with:\n  %s view --key %s %s\n", os.Args[0], key, tunnelURL),
+			"key", key)
+	}
+
+	if *eventsAddr != "" {
+		if err := serveEvents(*eventsAddr, tunnel); err != nil {
+			log.Fatalf("Failed to serve events: %v", err)
+		}
+	}
+
+	if *control != "" {
+		server, err := listenControl(*control, strconv.Itoa(targetPort), tunnel)
+		if err != nil {
+			out.print(slog.LevelWarn, "control api disabled", fmt.Sprintf("Warning: control API disabled: %v\n", err), "error", err)
+		} else {
+			defer server.Close()
+		}
+	}
+
+	if *copyURL {
+		if err := vrata.CopyToClipboard(visitURL); err != nil {
+			out.print(slog.LevelWarn, "failed to copy url", fmt.Sprintf("Failed to copy URL to the clipboard: %v\n", err), "error", err)
+		} else {
+			out.print(slog.LevelInfo, "copied url", "URL copied to the clipboard\n", "url", visitURL)
+		}
+	}
 
 	// Open URL in browser if requested
 	if shouldOpen {
 		if err := vrata.OpenURL(tunnelURL); err != nil {
-			fmt.Printf("Failed to open URL in browser: %v\n", err)
+			out.print(slog.LevelWarn, "failed to open browser", fmt.Sprintf("Failed to open URL in browser: %v\n", err), "error", err)
+		}
+	}
+
+	go printEvents(ctx, out, tunnel, cancel)
+
+	// Wait for shutdown
+	<-ctx.Done()
+}
+
+// exitOpenFailed explains why the tunnel couldn't be opened and exits
+func exitOpenFailed(err error) {
+	var serverErr *vrata.ServerError
+	if errors.As(err, &serverErr) && serverErr.Message != "" {
+		fmt.Fprintf(os.Stderr, "Error: the tunnel server rejected the request (status %d):\n  %s\n",
+			serverErr.StatusCode, serverErr.Message)
+		if serverErr.Hint != "" {
+			fmt.Fprintf(os.Stderr, "Hint: %s\n", serverErr.Hint)
 		}
+		os.Exit(1)
 	}
+	log.Fatalf("Failed to open tunnel: %v", err)
+}
 
-	// Handle events
+// printConnectionLimit reports how many connections the server allows the
+// tunnel (its max_conn_count) and, when --max-conns is lower, how many it
+// keeps
+func printConnectionLimit(tunnel *vrata.Tunnel, maxConns int) {
+	allowed := tunnel.MaxConnections()
+	var text string
+	switch {
+	case allowed <= 0:
+		text = "The tunnel server didn't say how many connections it allows"
+	case allowed == 1:
+		text = "The tunnel server allows 1 connection"
+	default:
+		text = fmt.Sprintf("The tunnel server allows %d connections", allowed)
+	}
+	if maxConns > 0 && (allowed <= 0 || maxConns < allowed) {
+		text += fmt.Sprintf(", keeping at most %d (--max-conns)", maxConns)
+	}
+	out.print(slog.LevelInfo, "connection limit", text+"\n", "max_conn_count", allowed, "max_conns", maxConns)
+}
+
+// printEvents reports tunnel events to c until the tunnel closes, calling
+// cancel when it does
+func printEvents(ctx context.Context, c *console, tunnel *vrata.Tunnel, cancel func()) {
 	events := tunnel.Events()
-	go func() {
-		for {
-			select {
-			case req := <-events.Request:
-				if *printReqs {
-					fmt.Printf("%s %s %s\n",
-						time.Now().Format("15:04:05"),
-						req.Method,
-						req.Path)
-				}
-			case err := <-events.Error:
-				fmt.Printf("Tunnel error: %v\n", err)
-			case <-events.Close:
-				fmt.Println("Tunnel closed")
-				return
-			case <-ctx.Done():
-				return
+	for {
+		select {
+		case info := <-events.Response:
+			c.request(info)
+		case err := <-events.Error:
+			c.print(slog.LevelError, "tunnel error", fmt.Sprintf("Tunnel error: %v\n", err), "error", err)
+		case info := <-events.Throttled:
+			text := fmt.Sprintf("Tunnel throttled (%s), keeping %d connections", info.Reason, info.PoolSize)
+			if info.Backoff > 0 {
+				text += fmt.Sprintf(", retrying in %s", info.Backoff)
+			}
+			text += fmt.Sprintf("\nHint: %s\n", info.Advice)
+			c.print(slog.LevelWarn, "tunnel throttled", text,
+				"reason", info.Reason, "pool_size", info.PoolSize, "backoff", info.Backoff.String(), "advice", info.Advice)
+		case info := <-events.Health:
+			if info.Healthy {
+				c.print(slog.LevelInfo, "local server healthy", "Local server is healthy again\n")
+			} else {
+				c.print(slog.LevelWarn, "local server unhealthy", fmt.Sprintf("Local server is unhealthy: %s\n", info.Error), "error", info.Error)
 			}
+		case info := <-events.Failover:
+			if info.Active {
+				c.print(slog.LevelWarn, "failover active", fmt.Sprintf("%s is down, sending visitors to %s\n", info.Primary, info.Fallback),
+					"primary", info.Primary, "fallback", info.Fallback)
+			} else {
+				c.print(slog.LevelInfo, "failover over", fmt.Sprintf("%s is back, sending visitors to it again\n", info.Primary),
+					"primary", info.Primary)
+			}
+		case change := <-events.URLChanged:
+			c.print(slog.LevelWarn, "tunnel url changed", fmt.Sprintf("The tunnel server dropped the tunnel; your new url is: %s\n", change.URL),
+				"url", change.URL)
+		case change := <-events.State:
+			switch {
+			case change.To == vrata.StateDegraded:
+				c.print(slog.LevelWarn, "tunnel degraded", "Tunnel degraded: some connections to the tunnel server are failing\n")
+			case change.To == vrata.StateReconnecting:
+				c.print(slog.LevelWarn, "tunnel reconnecting", "Lost every connection to the tunnel server, reconnecting\n")
+			case change.To == vrata.StateConnected && change.From != vrata.StateRegistering:
+				c.print(slog.LevelInfo, "tunnel connected", "Tunnel connected again\n")
+			}
+		case <-events.Close:
+			c.print(slog.LevelInfo, "tunnel closed", "Tunnel closed\n")
+			cancel()
+			return
+		case <-ctx.Done():
+			return
 		}
-	}()
+	}
+}
 
-	// Wait for shutdown
-	<-ctx.Done()
+// optionsFromFlags validates the parsed flags and builds tunnel options,
+// exiting with a usage error when they are invalid
+func optionsFromFlags() *vrata.TunnelOptions {
+	// Port is required
+	targetPort := *port
+	if targetPort == 0 {
+		// Check if ports were provided as positional arguments, where
+		// the first one names the tunnel's port
+		if ports := positionalPorts(); len(ports) > 0 {
+			targetPort = ports[0]
+		}
+	}
+
+	if *record != "" && *replay != "" {
+		fmt.Fprintf(os.Stderr, "Error: --record and --replay cannot be used together\n")
+		os.Exit(1)
+	}
+
+	if *stubsFile != "" && (*record != "" || *replay != "") {
+		fmt.Fprintf(os.Stderr, "Error: --stubs cannot be used with --record or --replay\n")
+		os.Exit(1)
+	}
+
+	// Replay and stub modes never contact the local server, so any port
+	// will do
+	if targetPort == 0 && (*replay != "" || *stubsFile != "") {
+		targetPort = 80
+	}
+
+	// With local targets, the port only names the tunnel's main target
+	if targetPort == 0 && len(localTargets) > 0 {
+		if _, p, err := net.SplitHostPort(localTargets[0]); err == nil {
+			targetPort, _ = strconv.Atoi(p)
+		}
+	}
+
+	if targetPort == 0 {
+		fmt.Fprintf(os.Stderr, "Error: port is required\n\n")
+		usage()
+		os.Exit(1)
+	}
+
+	// Validate port range
+	if targetPort < 1 || targetPort > 65535 {
+		fmt.Fprintf(os.Stderr, "Error: port must be between 1 and 65535\n")
+		os.Exit(1)
+	}
+
+	throttleBehavior, ok := map[string]vrata.ThrottleBehavior{
+		"backoff": vrata.ThrottleBackoff,
+		"ignore":  vrata.ThrottleIgnore,
+		"close":   vrata.ThrottleClose,
+	}[*onThrottle]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: --on-throttle must be backoff, ignore or close\n")
+		os.Exit(1)
+	}
+
+	forwarded, ok := map[string]vrata.ForwardedMode{
+		"trust":   vrata.ForwardedTrust,
+		"replace": vrata.ForwardedReplace,
+		"strip":   vrata.ForwardedStrip,
+	}[*fwdHeaders]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: --forwarded-headers must be trust, replace or strip\n")
+		os.Exit(1)
+	}
+
+	balanceStrategy, ok := map[string]vrata.BalanceStrategy{
+		"round-robin": vrata.BalanceRoundRobin,
+		"least-conns": vrata.BalanceLeastConnections,
+	}[*balance]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: --balance must be round-robin or least-conns\n")
+		os.Exit(1)
+	}
+
+	mode, ok := map[string]vrata.ProxyMode{
+		"raw":        vrata.ProxyRaw,
+		"structured": vrata.ProxyStructured,
+	}[*proxyMode]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: --proxy-mode must be raw or structured\n")
+		os.Exit(1)
+	}
+
+	stickyMode, ok := map[string]vrata.StickyMode{
+		"none":   vrata.StickyNone,
+		"ip":     vrata.StickyClientIP,
+		"cookie": vrata.StickyCookie,
+	}[*sticky]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: --sticky must be none, ip or cookie\n")
+		os.Exit(1)
+	}
+
+	unhealthyBehavior, ok := map[string]vrata.UnhealthyBehavior{
+		"forward":    vrata.UnhealthyForward,
+		"error-page": vrata.UnhealthyErrorPage,
+		"pause":      vrata.UnhealthyPause,
+	}[*unhealthy]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: --on-unhealthy must be forward, error-page or pause\n")
+		os.Exit(1)
+	}
+
+	var healthCheck *vrata.HealthCheck
+	if *healthPath != "" {
+		healthCheck = &vrata.HealthCheck{
+			Path:          *healthPath,
+			Interval:      *healthIntv,
+			WhenUnhealthy: unhealthyBehavior,
+		}
+	}
+
+	var auth *vrata.BasicAuth
+	if *basicAuth != "" {
+		username, password, ok := strings.Cut(*basicAuth, ":")
+		if !ok || username == "" {
+			fmt.Fprintf(os.Stderr, "Error: --basic-auth must be USER:PASS\n")
+			os.Exit(1)
+		}
+		auth = &vrata.BasicAuth{Username: username, Password: password}
+	}
+
+	var jwtAuth *vrata.JWTAuth
+	if *jwtSecret != "" || *jwksURL != "" {
+		jwtAuth = &vrata.JWTAuth{Secret: []byte(*jwtSecret), JWKSURL: *jwksURL, Issuer: *jwtIssuer, Audience: *jwtAud}
+	} else if *jwtIssuer != "" || *jwtAud != "" {
+		fmt.Fprintf(os.Stderr, "Error: --jwt-issuer and --jwt-audience need --jwt-secret or --jwks-url\n")
+		os.Exit(1)
+	}
+
+	var oidcAuth *vrata.OIDCAuth
+	if *oidcIssuer != "" {
+		if *oidcClient == "" {
+			fmt.Fprintf(os.Stderr, "Error: --oidc-issuer needs --oidc-client-id\n")
+			os.Exit(1)
+		}
+		oidcAuth = &vrata.OIDCAuth{
+			Issuer:        *oidcIssuer,
+			ClientID:      *oidcClient,
+			ClientSecret:  *oidcSecret,
+			AllowedEmails: splitList(*oidcAllow),
+		}
+	}
+
+	var subdomainRetries int
+	if *retrySub {
+		if *subdomain == "" {
+			fmt.Fprintf(os.Stderr, "Error: --retry-subdomain needs --subdomain\n")
+			os.Exit(1)
+		}
+		subdomainRetries = retrySubdomains
+	}
+
+	if *maxConns < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --max-conns must be a positive number\n")
+		os.Exit(1)
+	}
+	if *minConns < 0 || (*maxConns > 0 && *minConns > *maxConns) {
+		fmt.Fprintf(os.Stderr, "Error: --min-conns must be a positive number up to --max-conns\n")
+		os.Exit(1)
+	}
+
+	var shareLinks *vrata.ShareLinks
+	switch {
+	case *share < 0:
+		fmt.Fprintf(os.Stderr, "Error: --share must be a positive number of minutes\n")
+		os.Exit(1)
+	case *share > 0 && *shareKey != "":
+		shareLinks = &vrata.ShareLinks{Secret: []byte(*shareKey)}
+	case *share > 0:
+		shareLinks = vrata.NewShareLinks()
+	case *shareKey != "":
+		fmt.Fprintf(os.Stderr, "Error: --share-secret needs --share\n")
+		os.Exit(1)
+	}
+
+	var e2eSecret []byte
+	switch {
+	case *e2e && *e2eKey != "":
+		key, err := vrata.ParseE2EKey(*e2eKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --e2e-key: %v\n", err)
+			os.Exit(1)
+		}
+		e2eSecret = key
+	case *e2e:
+		key, err := vrata.GenerateE2EKey()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to generate an end-to-end key: %v\n", err)
+			os.Exit(1)
+		}
+		e2eSecret = key
+	case *e2eKey != "":
+		fmt.Fprintf(os.Stderr, "Error: --e2e-key needs --e2e\n")
+		os.Exit(1)
+	}
+
+	var geoIP *vrata.GeoIPDB
+	allowCountries, denyCountries := splitList(*allowCC), splitList(*denyCC)
+	if len(allowCountries) > 0 || len(denyCountries) > 0 {
+		if *geoIPDB == "" {
+			fmt.Fprintf(os.Stderr, "Error: --allow-country and --deny-country need --geoip-db\n")
+			os.Exit(1)
+		}
+		db, err := vrata.OpenGeoIP(*geoIPDB)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to load GeoIP database: %v\n", err)
+			os.Exit(1)
+		}
+		geoIP = db
+	}
+
+	headers, err := parseHeaders(requestHeaders)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --request-header %v\n", err)
+		os.Exit(1)
+	}
+	hostMode, customHost := vrata.HostCustom, *hostHdr
+	switch *hostHdr {
+	case "local":
+		hostMode, customHost = vrata.HostLocal, ""
+	case "preserve":
+		hostMode, customHost = vrata.HostPreserve, ""
+	}
+	respHeaders, err := parseHeaders(responseHeaders)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --response-header %v\n", err)
+		os.Exit(1)
+	}
+	regHeaders, err := parseHeaders(registrationHeaders)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --registration-header %v\n", err)
+		os.Exit(1)
+	}
+
+	var errorPageHTML string
+	if *errorPage != "" {
+		page, err := os.ReadFile(*errorPage)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to read error page: %v\n", err)
+			os.Exit(1)
+		}
+		errorPageHTML = string(page)
+	}
+
+	var stubs []vrata.Stub
+	if *stubsFile != "" {
+		loaded, err := vrata.LoadStubs(*stubsFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to load stubs: %v\n", err)
+			os.Exit(1)
+		}
+		stubs = loaded
+	}
+
+	var relayTLS *tls.Config
+	if *relayCert != "" || *relayKey != "" || *relayCA != "" {
+		config, err := vrata.LoadRelayTLS(*relayCert, *relayKey, *relayCA)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		relayTLS = config
+	}
+
+	if *localSNI != "" && !*localHTTPS {
+		fmt.Fprintf(os.Stderr, "Error: --local-sni needs --local-https\n")
+		os.Exit(1)
+	}
+	var clientCert *tls.Certificate
+	if *localCert != "" || *localKey != "" {
+		if *localCert == "" || *localKey == "" {
+			fmt.Fprintf(os.Stderr, "Error: --local-cert and --local-key go together\n")
+			os.Exit(1)
+		}
+		if !*localHTTPS {
+			fmt.Fprintf(os.Stderr, "Error: --local-cert needs --local-https\n")
+			os.Exit(1)
+		}
+		cert, err := tls.LoadX509KeyPair(*localCert, *localKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to load client certificate: %v\n", err)
+			os.Exit(1)
+		}
+		clientCert = &cert
+	}
+
+	return &vrata.TunnelOptions{
+		Port:       targetPort,
+		Host:       *host,
+		Subdomain:  *subdomain,
+		LocalHost:  *localHost,
+		LocalHTTPS: *localHTTPS,
+		LocalHTTP2: *localHTTP2,
+		RecordFile: *record,
+		ReplayFile: *replay,
+		Stubs:      stubs,
+
+		MaxConcurrentRequests: *maxReqs,
+		MaxRequestsPerClient:  *maxPerIP,
+		MaxConnections:        *maxConns,
+		MinConnections:        *minConns,
+		Lazy:                  *lazy,
+		SubdomainSuffix:       *randSuffix,
+		SubdomainRetries:      subdomainRetries,
+		Token:                 *token,
+		ReservationFile:       *reserveIn,
+		RegistrationHeaders:   regHeaders,
+		RelayTLS:              relayTLS,
+		Proxy:                 *proxyURL,
+		OnThrottle:            throttleBehavior,
+		BasicAuth:             auth,
+		JWTAuth:               jwtAuth,
+		OIDCAuth:              oidcAuth,
+		ShareLinks:            shareLinks,
+		RequestHeaders:        headers,
+		ResponseHeaders:       respHeaders,
+		StripHeaders:          splitList(*stripHdrs),
+		RedactHeaders:         splitList(*redactHdrs),
+		ForwardedHeaders:      forwarded,
+		E2EKey:                e2eSecret,
+		LocalClientCert:       clientCert,
+		LocalServerName:       *localSNI,
+		HostHeaderMode:        hostMode,
+		HostHeader:            customHost,
+		RewriteLocalURLs:      *rewriteURL,
+		ProxyMode:             mode,
+		ProxyRetries:          *proxyRetry,
+		ErrorPage:             errorPageHTML,
+		HealthCheck:           healthCheck,
+		WaitForLocal:          time.Duration(waitForLocal),
+		LocalTargets:          localTargets,
+		Balance:               balanceStrategy,
+		Sticky:                stickyMode,
+		LocalFallback:         *fallback,
+		RestartGrace:          *restart,
+		RegisterRetries:       *retries,
+		ReregisterAfter:       *reregister,
+		AllowIPs:              allowIPs,
+		DenyIPs:               denyIPs,
+		AllowPaths:            allowPaths,
+		DenyPaths:             denyPaths,
+		GeoIP:                 geoIP,
+		AllowCountries:        allowCountries,
+		DenyCountries:         denyCountries,
+
+		Timeouts: vrata.Timeouts{
+			Dial:      *dialTime,
+			Register:  *regTime,
+			LocalDial: *localTime,
+			Idle:      *idleTime,
+			Request:   *reqTime,
+		},
+		TCP: vrata.TCPOptions{
+			KeepAlive:   *keepAlive,
+			Nagle:       *nagle,
+			ReadBuffer:  *sockBuffer,
+			WriteBuffer: *sockBuffer,
+		},
+	}
+}
+
+// openAccessLog opens the access log file for appending; "-" is stdout
+func openAccessLog(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+}
+
+// nopCloser keeps stdout open when the access log is closed
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// splitList splits a comma-separated flag value, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// prefixList is a flag collecting CIDR ranges; bare addresses are taken
+// as single-host ranges
+type prefixList []netip.Prefix
+
+func (l *prefixList) String() string {
+	var parts []string
+	for _, prefix := range *l {
+		parts = append(parts, prefix.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *prefixList) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(part); err == nil {
+			*l = append(*l, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(part)
+		if err != nil {
+			return fmt.Errorf("invalid IP or CIDR %q", part)
+		}
+		*l = append(*l, prefix.Masked())
+	}
+	return nil
+}
+
+// retrySubdomains is how many numbered subdomains --retry-subdomain tries
+const retrySubdomains = 9
+
+// defaultLocalWait is how long a bare --wait-for-local waits
+const defaultLocalWait = 2 * time.Minute
+
+// waitFlag is a duration flag that can also be given without a value
+type waitFlag time.Duration
+
+func (w *waitFlag) String() string { return time.Duration(*w).String() }
+
+func (w *waitFlag) IsBoolFlag() bool { return true }
+
+func (w *waitFlag) Set(value string) error {
+	if enabled, err := strconv.ParseBool(value); err == nil {
+		*w = 0
+		if enabled {
+			*w = waitFlag(defaultLocalWait)
+		}
+		return nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		return fmt.Errorf("invalid timeout %q", value)
+	}
+	*w = waitFlag(timeout)
+	return nil
+}
+
+// stringList is a repeatable flag collecting its values
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// parseHeaders parses "Name: value" flag values into a header
+func parseHeaders(lines []string) (http.Header, error) {
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	header := make(http.Header)
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("must be \"Name: value\", got %q", line)
+		}
+		header.Add(name, strings.TrimSpace(value))
+	}
+	return header, nil
+}
+
+// serveEvents exposes the tunnel's event stream at http://addr/events
+func serveEvents(addr string, tunnel *vrata.Tunnel) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /events", tunnel.EventStream())
+	go http.Serve(listener, mux)
+
+	url := fmt.Sprintf("http://%s/events", listener.Addr())
+	out.print(slog.LevelInfo, "streaming events", fmt.Sprintf("Streaming events at %s\n", url), "url", url)
+	return nil
+}
+
+// listenControl serves the control API for the tunnel, registered under
+// name, on the Unix socket at path
+func listenControl(path, name string, tunnel *vrata.Tunnel) (*vrata.ControlServer, error) {
+	manager := vrata.NewManager(vrata.Budget{})
+	if err := manager.Add(name, tunnel); err != nil {
+		return nil, err
+	}
+	return vrata.ListenControl(path, manager, VERSION)
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/korya/vrata"
+)
+
+// maxPortTunnels bounds how many tunnels a port range may open, so a typo
+// like 3000-9000 doesn't register thousands of them
+const maxPortTunnels = 32
+
+// singleTunnelFlags are the options that only make sense for one tunnel
+var singleTunnelFlags = []string{
+	"subdomain", "s", "record", "replay", "stubs", "local-target", "fallback",
+	"e2e", "e2e-key", "events-addr", "qr", "copy", "open", "o", "detach",
+	"scan-ports", "auto-port",
+}
+
+// positionalPorts returns the ports named by the positional arguments,
+// each a port or a range like 8080-8083, in order and without repeats. It
+// returns nil when they don't all name ports.
+func positionalPorts() []int {
+	if len(positional) == 0 {
+		return nil
+	}
+	ports, err := vrata.ParsePorts(strings.Join(positional, ","))
+	if err != nil {
+		return nil
+	}
+
+	seen := make(map[int]bool)
+	return slices.DeleteFunc(ports, func(port int) bool {
+		repeated := seen[port]
+		seen[port] = true
+		return repeated
+	})
+}
+
+// checkPortsFlags exits with an error when the options can't be applied
+// to a tunnel per port
+func checkPortsFlags(ports []int) {
+	if len(ports) > maxPortTunnels {
+		fmt.Fprintf(os.Stderr, "Error: %d ports given, at most %d tunnels can be opened at once\n", len(ports), maxPortTunnels)
+		os.Exit(1)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if slices.Contains(singleTunnelFlags, f.Name) {
+			dashes := "--"
+			if len(f.Name) == 1 {
+				dashes = "-"
+			}
+			fmt.Fprintf(os.Stderr, "Error: %s%s opens one tunnel and cannot be used with several ports\n", dashes, f.Name)
+			os.Exit(1)
+		}
+	})
+}
+
+// runPorts opens one tunnel per port with the same options, prints which
+// URL leads to which port, and keeps them open until interrupted or until
+// every one of them is closed
+func runPorts(ports []int, options *vrata.TunnelOptions) {
+	if options.WaitForLocal == 0 {
+		for _, port := range ports {
+			if !vrata.IsListening(options.LocalHost, port, time.Second) {
+				out.print(slog.LevelWarn, "local server not listening",
+					fmt.Sprintf("Warning: nothing is listening on %s:%d\n", options.LocalHost, port),
+					"host", options.LocalHost, "port", port)
+			}
+		}
+	}
+
+	manager := vrata.NewManager(vrata.Budget{})
+	ctx, cancel := context.WithCancel(context.Background())
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		<-sigChan
+		out.print(slog.LevelInfo, "shutting down", "\nShutting down tunnels...\n")
+		manager.CloseAll()
+		cancel()
+	}()
+
+	// Tunnels are named by their port, for status and stop
+	urls := make([]string, len(ports))
+	for i, port := range ports {
+		portOptions := *options
+		portOptions.Port = port
+		tunnel, err := manager.Open(strconv.Itoa(port), port, &portOptions)
+		if err == nil {
+			urls[i], err = tunnel.URL()
+		}
+		if err != nil {
+			manager.CloseAll()
+			exitOpenFailed(fmt.Errorf("port %d: %w", port, err))
+		}
+	}
+
+	// Text gets a table, JSON a line per tunnel
+	var table strings.Builder
+	w := tabwriter.NewWriter(&table, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  PORT\tURL\tMAX_CONN_COUNT")
+	capped := false
+	for i, port := range ports {
+		tunnel, _ := manager.Get(strconv.Itoa(port))
+		n := tunnel.MaxConnections()
+		allowed := "-"
+		if n > 0 {
+			allowed = strconv.Itoa(n)
+		}
+		fmt.Fprintf(w, "  %d\t%s\t%s\n", port, urls[i], allowed)
+		capped = capped || options.MaxConnections > 0 && (n <= 0 || options.MaxConnections < n)
+		if out.logger != nil {
+			out.print(slog.LevelInfo, "tunnel open", "", "port", port, "url", urls[i],
+				"max_conn_count", n, "max_conns", options.MaxConnections)
+		}
+	}
+	w.Flush()
+	if out.logger == nil {
+		out.print(slog.LevelInfo, "tunnels open", "Your tunnels are available at:\n"+table.String())
+	}
+	if capped {
+		out.print(slog.LevelInfo, "connection limit",
+			fmt.Sprintf("Keeping at most %d connections per tunnel (--max-conns)\n", options.MaxConnections),
+			"max_conns", options.MaxConnections)
+	}
+
+	if *control != "" {
+		server, err := vrata.ListenControl(*control, manager, VERSION)
+		if err != nil {
+			out.print(slog.LevelWarn, "control api disabled", fmt.Sprintf("Warning: control API disabled: %v\n", err), "error", err)
+		} else {
+			defer server.Close()
+		}
+	}
+
+	// The process ends with its last tunnel
+	var open sync.WaitGroup
+	for _, port := range ports {
+		tunnel, _ := manager.Get(strconv.Itoa(port))
+		open.Add(1)
+		go printEvents(ctx, out.forPort(port), tunnel, open.Done)
+	}
+	go func() {
+		open.Wait()
+		cancel()
+	}()
+
+	<-ctx.Done()
+}
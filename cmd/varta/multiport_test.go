@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"testing"
+)
+
+func TestPositionalPorts(t *testing.T) {
+	defer func(saved []string) { positional = saved }(positional)
+
+	tests := []struct {
+		name string
+		args []string
+		want []int
+	}{
+		{"none", nil, nil},
+		{"single port", []string{"8080"}, []int{8080}},
+		{"list", []string{"3000", "8080"}, []int{3000, 8080}},
+		{"comma-separated list", []string{"3000,8080"}, []int{3000, 8080}},
+		{"range", []string{"8080-8083"}, []int{8080, 8081, 8082, 8083}},
+		{"one-port range", []string{"8080-8080"}, []int{8080}},
+		{"ports and ranges", []string{"3000", "8080-8081"}, []int{3000, 8080, 8081}},
+		{"duplicates", []string{"8080", "3000", "8080"}, []int{8080, 3000}},
+		{"overlapping ranges", []string{"8080-8082", "8081-8083"}, []int{8080, 8081, 8082, 8083}},
+		{"reversed range", []string{"8083-8080"}, nil},
+		{"port out of range", []string{"70000"}, nil},
+		{"zero", []string{"0"}, nil},
+		{"not a port", []string{"start"}, nil},
+		{"a port and a command", []string{"8080", "npm"}, nil},
+	}
+	for _, tt := range tests {
+		positional = tt.args
+		if got := positionalPorts(); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: positionalPorts() with %q = %v, want %v", tt.name, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestConsoleForPort(t *testing.T) {
+	text := (&console{}).forPort(8080)
+	if got, want := text.prefixed("Tunnel open\n\nhttps://demo.example\n"), "[8080] Tunnel open\n\n[8080] https://demo.example\n"; got != want {
+		t.Errorf("prefixed() = %q, want %q", got, want)
+	}
+	if got := (&console{}).prefixed("Tunnel open\n"); got != "Tunnel open\n" {
+		t.Errorf("prefixed() of an untagged console = %q, want the text as is", got)
+	}
+
+	var buf bytes.Buffer
+	tagged := (&console{logger: slog.New(slog.NewJSONHandler(&buf, nil))}).forPort(3000)
+	tagged.print(slog.LevelInfo, "tunnel open", "Tunnel open\n", "url", "https://demo.example")
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("Invalid JSON line %q: %v", buf.String(), err)
+	}
+	if line["port"] != float64(3000) || line["url"] != "https://demo.example" {
+		t.Errorf("JSON line = %v, want port 3000 and the url", line)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/korya/vrata"
+)
+
+// checkLocalPort makes sure something listens on the target port. If not,
+// it scans candidate ports, reports what it found and either switches to a
+// listening port (--auto-port or interactive confirmation) or keeps the
+// requested one.
+func checkLocalPort(host string, port int, scanSpec string, autoPort bool) int {
+	if vrata.IsListening(host, port, time.Second) {
+		return port
+	}
+
+	out.print(slog.LevelWarn, "local server not listening",
+		fmt.Sprintf("Warning: nothing is listening on %s:%d\n", host, port),
+		"host", host, "port", port)
+
+	candidates := vrata.CommonDevPorts
+	if scanSpec != "" {
+		ports, err := vrata.ParsePorts(scanSpec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --scan-ports: %v\n", err)
+			os.Exit(1)
+		}
+		candidates = ports
+	}
+
+	var listening []vrata.PortProbe
+	for _, probe := range vrata.ScanLocalPorts(host, candidates, 500*time.Millisecond) {
+		if probe.Listening && probe.Port != port {
+			listening = append(listening, probe)
+		}
+	}
+
+	if len(listening) == 0 {
+		out.print(slog.LevelWarn, "no local servers found",
+			"No local servers found on the scanned ports; start your app or pass the right --port\n",
+			"scanned", candidates)
+		return port
+	}
+
+	var found strings.Builder
+	found.WriteString("Found listening ports:\n")
+	ports := make([]int, 0, len(listening))
+	for _, probe := range listening {
+		description := "tcp"
+		if probe.HTTP {
+			description = "http"
+			if probe.Server != "" {
+				description += " (" + probe.Server + ")"
+			}
+		}
+		fmt.Fprintf(&found, "  %5d  %s\n", probe.Port, description)
+		ports = append(ports, probe.Port)
+	}
+	out.print(slog.LevelInfo, "listening ports found", found.String(), "ports", ports)
+
+	suggested := listening[0].Port
+	if autoPort {
+		out.print(slog.LevelInfo, "using port", fmt.Sprintf("Using port %d (--auto-port)\n", suggested),
+			"port", suggested)
+		return suggested
+	}
+
+	if isTerminal(os.Stdin) {
+		fmt.Fprintf(os.Stderr, "Tunnel to port %d instead? [Y/n] ", suggested)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer == "" || answer == "y" || answer == "yes" {
+			return suggested
+		}
+	}
+
+	return port
+}
+
+// isTerminal reports whether f is an interactive terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// serviceSpec describes the tunnel a service runs
+type serviceSpec struct {
+	Name       string   // service name, e.g. varta-8080
+	Executable string   // absolute path of the varta binary
+	Args       []string // arguments after "start"
+	Dir        string   // working directory for relative paths in Args
+	System     bool     // system-wide rather than per-user
+}
+
+// runService dispatches "varta service install|uninstall"
+func runService(args []string) {
+	if len(args) == 0 || (args[0] != "install" && args[0] != "uninstall") {
+		fmt.Fprintf(os.Stderr, "Usage: %s service install [port] [options] [--name NAME] [--system]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s service uninstall [port] [--name NAME] [--system]\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	name := flag.String("name", "", "Service name (default: varta-PORT)")
+	system := flag.Bool("system", false, "Install a system-wide service instead of a per-user one")
+
+	command, args := args[0], args[1:]
+	parseCommandLine(args)
+
+	if command == "uninstall" {
+		serviceName := *name
+		if serviceName == "" {
+			serviceName = defaultServiceName(positionalPort())
+		}
+		if err := uninstallService(serviceName, *system); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to uninstall service %s: %v\n", serviceName, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Service %s removed\n", serviceName)
+		return
+	}
+
+	// Validate the tunnel options now rather than in a boot-time log
+	options := optionsFromFlags()
+
+	spec := serviceSpec{
+		Name:   *name,
+		Args:   withoutFlags(args, "name", "system", "detach", "open", "o"),
+		System: *system,
+	}
+	if spec.Name == "" {
+		spec.Name = defaultServiceName(options.Port)
+	}
+
+	executable, err := os.Executable()
+	if err == nil {
+		executable, err = filepath.EvalSymlinks(executable)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: cannot find the varta executable: %v\n", err)
+		os.Exit(1)
+	}
+	spec.Executable = executable
+	spec.Dir, _ = os.Getwd()
+
+	location, err := installService(spec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to install service %s: %v\n", spec.Name, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Service %s installed (%s) and started\n", spec.Name, location)
+	fmt.Printf("Check it with: %s status; remove it with: %s service uninstall --name %s\n",
+		os.Args[0], os.Args[0], spec.Name)
+}
+
+// defaultServiceName names a service after the local port
+func defaultServiceName(port int) string {
+	if port == 0 {
+		fmt.Fprintf(os.Stderr, "Error: port or --name is required\n")
+		os.Exit(1)
+	}
+	return "varta-" + strconv.Itoa(port)
+}
+
+// positionalPort returns the port given as first positional argument, or 0
+func positionalPort() int {
+	if len(positional) == 0 {
+		return 0
+	}
+	port, _ := strconv.Atoi(positional[0])
+	return port
+}
+
+// withoutFlags drops the named flags, and the values of non-boolean ones,
+// from args
+func withoutFlags(args []string, names ...string) []string {
+	var kept []string
+	args = gnuArgs(flag.CommandLine, args)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || !slices.Contains(names, name) {
+			kept = append(kept, arg)
+			continue
+		}
+		if f := flag.Lookup(name); f != nil && !hasValue && !isBoolFlag(f) {
+			i++
+		}
+	}
+	return kept
+}
+
+// runCommand runs an external tool, folding its output into the error
+func runCommand(name string, args ...string) error {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		if text := strings.TrimSpace(string(output)); text != "" {
+			return fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, text)
+		}
+		return fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), err)
+	}
+	return nil
+}
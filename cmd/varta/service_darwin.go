@@ -0,0 +1,92 @@
+//go:build darwin
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// installService writes a launchd property list for the tunnel and loads
+// it. Per-user agents live in ~/Library/LaunchAgents, system daemons in
+// /Library/LaunchDaemons.
+func installService(spec serviceSpec) (string, error) {
+	path, err := plistPath(spec.Name, spec.System)
+	if err != nil {
+		return "", err
+	}
+
+	var args bytes.Buffer
+	for _, arg := range append([]string{spec.Executable, "start"}, spec.Args...) {
+		args.WriteString("\t\t<string>")
+		xml.EscapeText(&args, []byte(arg))
+		args.WriteString("</string>\n")
+	}
+
+	var dir bytes.Buffer
+	xml.EscapeText(&dir, []byte(spec.Dir))
+
+	plist := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+%s	</array>
+	<key>WorkingDirectory</key>
+	<string>%s</string>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+</dict>
+</plist>
+`, launchdLabel(spec.Name), args.String(), dir.String())
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(plist), 0o644); err != nil {
+		return "", err
+	}
+	if err := runCommand("launchctl", "load", "-w", path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// uninstallService unloads and removes the tunnel's property list
+func uninstallService(name string, system bool) error {
+	path, err := plistPath(name, system)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	runCommand("launchctl", "unload", "-w", path)
+	return os.Remove(path)
+}
+
+// launchdLabel returns the launchd job label for a service name
+func launchdLabel(name string) string {
+	return "com.github.korya.vrata." + name
+}
+
+// plistPath returns where the property list for name goes
+func plistPath(name string, system bool) (string, error) {
+	if system {
+		return filepath.Join("/Library/LaunchDaemons", launchdLabel(name)+".plist"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", launchdLabel(name)+".plist"), nil
+}
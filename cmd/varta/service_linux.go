@@ -0,0 +1,108 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// installService writes a systemd unit for the tunnel, then enables and
+// starts it. Per-user units live in ~/.config/systemd/user.
+func installService(spec serviceSpec) (string, error) {
+	path, err := unitPath(spec.Name, spec.System)
+	if err != nil {
+		return "", err
+	}
+
+	target := "default.target"
+	if spec.System {
+		target = "multi-user.target"
+	}
+
+	var command []string
+	for _, arg := range append([]string{spec.Executable, "start"}, spec.Args...) {
+		command = append(command, systemdQuote(arg))
+	}
+
+	unit := fmt.Sprintf(`[Unit]
+Description=varta tunnel (%s)
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+ExecStart=%s
+WorkingDirectory=%s
+Restart=on-failure
+RestartSec=5
+
+[Install]
+WantedBy=%s
+`, spec.Name, strings.Join(command, " "), spec.Dir, target)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(unit), 0o644); err != nil {
+		return "", err
+	}
+
+	if err := systemctl(spec.System, "daemon-reload"); err != nil {
+		return "", err
+	}
+	if err := systemctl(spec.System, "enable", "--now", spec.Name+".service"); err != nil {
+		return "", err
+	}
+
+	if !spec.System {
+		fmt.Printf("Note: run 'loginctl enable-linger %s' to start it at boot without logging in\n", os.Getenv("USER"))
+	}
+	return path, nil
+}
+
+// uninstallService stops, disables and removes the tunnel's unit
+func uninstallService(name string, system bool) error {
+	path, err := unitPath(name, system)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	systemctl(system, "disable", "--now", name+".service")
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return systemctl(system, "daemon-reload")
+}
+
+// unitPath returns where the unit file for name goes
+func unitPath(name string, system bool) (string, error) {
+	if system {
+		return filepath.Join("/etc/systemd/system", name+".service"), nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "systemd", "user", name+".service"), nil
+}
+
+func systemctl(system bool, args ...string) error {
+	if !system {
+		args = append([]string{"--user"}, args...)
+	}
+	return runCommand("systemctl", args...)
+}
+
+// systemdQuote quotes an ExecStart argument when it needs it
+func systemdQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\$%;") {
+		return arg
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `$$`, `%`, `%%`)
+	return `"` + replacer.Replace(arg) + `"`
+}
@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+var errServiceUnsupported = errors.New("services are not supported on " + runtime.GOOS)
+
+func installService(spec serviceSpec) (string, error) {
+	return "", errServiceUnsupported
+}
+
+func uninstallService(name string, system bool) error {
+	return errServiceUnsupported
+}
@@ -0,0 +1,40 @@
+//go:build windows
+
+package main
+
+import (
+	"strings"
+	"syscall"
+)
+
+// installService registers the tunnel as a scheduled task that starts at
+// logon, or at boot as SYSTEM for --system, and starts it right away. A
+// task rather than a Windows service, since varta doesn't speak the
+// service control protocol.
+func installService(spec serviceSpec) (string, error) {
+	var command []string
+	for _, arg := range append([]string{spec.Executable, "start"}, spec.Args...) {
+		command = append(command, syscall.EscapeArg(arg))
+	}
+
+	args := []string{"/Create", "/F", "/TN", spec.Name, "/TR", strings.Join(command, " ")}
+	if spec.System {
+		args = append(args, "/SC", "ONSTART", "/RU", "SYSTEM")
+	} else {
+		args = append(args, "/SC", "ONLOGON")
+	}
+
+	if err := runCommand("schtasks", args...); err != nil {
+		return "", err
+	}
+	if err := runCommand("schtasks", "/Run", "/TN", spec.Name); err != nil {
+		return "", err
+	}
+	return "scheduled task " + spec.Name, nil
+}
+
+// uninstallService stops and deletes the tunnel's scheduled task
+func uninstallService(name string, system bool) error {
+	runCommand("schtasks", "/End", "/TN", name)
+	return runCommand("schtasks", "/Delete", "/F", "/TN", name)
+}
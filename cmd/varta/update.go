@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// latestReleaseURL answers with the newest release of varta
+const latestReleaseURL = "https://api.github.com/repos/korya/vrata/releases/latest"
+
+// noUpdateCheckEnv turns the new-version notice off when set, like
+// --no-update-check
+const noUpdateCheckEnv = "VARTA_NO_UPDATE_CHECK"
+
+// updateCheckTimeout bounds the check, which is given up silently
+const updateCheckTimeout = 5 * time.Second
+
+// checkForUpdate prints a notice when a newer release than VERSION is out.
+// It runs in the background, and failures are ignored: the tunnel never
+// waits for it.
+func checkForUpdate() {
+	if *noUpdates || os.Getenv(noUpdateCheckEnv) != "" {
+		return
+	}
+	go func() {
+		latest, err := latestRelease()
+		if err != nil || !newerVersion(latest, VERSION) {
+			return
+		}
+		out.print(slog.LevelInfo, "new version available",
+			fmt.Sprintf("varta %s is available (this is %s): go install github.com/korya/vrata/cmd/varta@latest\n", latest, VERSION),
+			"version", latest, "current", VERSION)
+	}()
+}
+
+// latestRelease returns the version of the newest release, e.g. 1.2.0
+func latestRelease() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), updateCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, latestReleaseURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", "varta/"+VERSION)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("latest release: %s", resp.Status)
+	}
+
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(release.TagName, "v"), nil
+}
+
+// newerVersion reports whether version a (MAJOR.MINOR.PATCH) is newer than
+// b. Versions that don't parse, e.g. pre-releases, are never newer, and
+// nothing is newer than them.
+func newerVersion(a, b string) bool {
+	va, okA := parseVersion(a)
+	vb, okB := parseVersion(b)
+	if !okA || !okB {
+		return false
+	}
+	for i := range va {
+		if va[i] != vb[i] {
+			return va[i] > vb[i]
+		}
+	}
+	return false
+}
+
+// parseVersion splits MAJOR.MINOR.PATCH, optionally prefixed with v, into
+// numbers
+func parseVersion(version string) ([3]int, bool) {
+	var numbers [3]int
+	parts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	if len(parts) != len(numbers) {
+		return numbers, false
+	}
+	for i, part := range parts {
+		// Atoi would take signs, as in 1.+2.0
+		if strings.Trim(part, "0123456789") != "" {
+			return numbers, false
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return numbers, false
+		}
+		numbers[i] = n
+	}
+	return numbers, true
+}
@@ -0,0 +1,69 @@
+package main
+
+import "testing"
+
+func TestNewerVersion(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"1.0.1", "1.0.0", true},
+		{"1.1.0", "1.0.9", true},
+		{"2.0.0", "1.9.9", true},
+		{"1.10.0", "1.9.0", true},
+		{"1.0.0", "1.0.0", false},
+		{"1.0.0", "1.0.1", false},
+		{"0.9.9", "1.0.0", false},
+
+		// Tags prefixed with v
+		{"v1.1.0", "1.0.0", true},
+		{"1.1.0", "v1.0.0", true},
+		{"v1.0.0", "1.0.0", false},
+
+		// Pre-releases never parse, so neither side of a comparison wins
+		{"1.1.0-rc1", "1.0.0", false},
+		{"1.1.0-beta.1", "1.0.0", false},
+		{"1.1.0", "1.1.0-rc1", false},
+
+		// Malformed versions
+		{"", "1.0.0", false},
+		{"1.1", "1.0.0", false},
+		{"1.1.0.1", "1.0.0", false},
+		{"a.b.c", "1.0.0", false},
+		{"1..0", "1.0.0", false},
+		{"-1.0.0", "1.0.0", false},
+		{"1.+1.0", "1.0.0", false},
+		{"2.0.0", "dev", false},
+	}
+	for _, tt := range tests {
+		if got := newerVersion(tt.a, tt.b); got != tt.want {
+			t.Errorf("newerVersion(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    [3]int
+		ok      bool
+	}{
+		{"1.2.3", [3]int{1, 2, 3}, true},
+		{"v1.2.3", [3]int{1, 2, 3}, true},
+		{"0.0.0", [3]int{0, 0, 0}, true},
+		{"10.20.30", [3]int{10, 20, 30}, true},
+		{"1.2.3-rc1", [3]int{}, false},
+		{"1.2", [3]int{}, false},
+		{"vv1.2.3", [3]int{}, false},
+		{"1.2.x", [3]int{}, false},
+		{" 1.2.3", [3]int{}, false},
+		{"1.-2.3", [3]int{}, false},
+		{"1.2.99999999999999999999", [3]int{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseVersion(tt.version)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("parseVersion(%q) = %v, %v, want %v, %v", tt.version, got, ok, tt.want, tt.ok)
+		}
+	}
+}
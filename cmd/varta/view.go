@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/korya/vrata"
+)
+
+// runView serves the viewer of an end-to-end encrypted tunnel: a local
+// proxy that seals requests for the tunnel and opens its responses
+func runView(args []string) {
+	flags := flag.NewFlagSet("view", flag.ExitOnError)
+	key := flags.String("key", "", "Key printed by the tunnel started with --e2e")
+	listen := flags.String("listen", "127.0.0.1:4080", "Address the viewer listens on")
+	rest := parseArgs(flags, args)
+
+	if len(rest) != 1 || *key == "" {
+		fmt.Fprintf(os.Stderr, "Error: view needs a key and the tunnel URL, e.g. varta view --key KEY https://abc123.loca.lt\n")
+		os.Exit(1)
+	}
+	secret, err := vrata.ParseE2EKey(*key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --key: %v\n", err)
+		os.Exit(1)
+	}
+	viewer, err := vrata.NewE2EViewer(rest[0], secret)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+	fmt.Printf("Viewing %s at http://%s\n", rest[0], listener.Addr())
+	log.Fatal(http.Serve(listener, viewer))
+}
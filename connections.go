@@ -0,0 +1,79 @@
+package vrata
+
+import "time"
+
+// ConnectionInfo describes one connection of the tunnel's pool
+type ConnectionInfo struct {
+	ID     int
+	Active bool
+	// ConnectedAt is when the current session was established; zero if
+	// the connection never connected
+	ConnectedAt time.Time
+	// LastActivity is when bytes last flowed over the connection
+	LastActivity time.Time
+
+	// Requests, BytesIn and BytesOut accumulate over all sessions
+	Requests int64
+	BytesIn  int64
+	BytesOut int64
+
+	// CurrentRequest is the request being served, nil when idle
+	CurrentRequest *RequestInfo
+}
+
+// Connections returns the state of every connection in the pool, ordered
+// by ID
+func (tc *TunnelCluster) Connections() []ConnectionInfo {
+	tc.mutex.RLock()
+	defer tc.mutex.RUnlock()
+
+	infos := make([]ConnectionInfo, 0, len(tc.connections))
+	for _, conn := range tc.connections {
+		infos = append(infos, conn.info())
+	}
+	return infos
+}
+
+// Connections returns the state of every connection in the pool, or nil
+// before the tunnel is opened
+func (t *Tunnel) Connections() []ConnectionInfo {
+	t.mutex.RLock()
+	cluster := t.cluster
+	t.mutex.RUnlock()
+
+	if cluster == nil {
+		return nil
+	}
+	return cluster.Connections()
+}
+
+// info snapshots the connection state
+func (conn *TunnelConnection) info() ConnectionInfo {
+	info := ConnectionInfo{
+		ID:           conn.id,
+		Active:       conn.isActive(),
+		ConnectedAt:  unixNano(conn.connectedAt.Load()),
+		LastActivity: unixNano(conn.lastActivity.Load()),
+		Requests:     conn.requests.Load(),
+		BytesIn:      conn.bytesIn.Load(),
+		BytesOut:     conn.bytesOut.Load(),
+	}
+	if current := conn.current.Load(); current != nil {
+		request := *current
+		info.CurrentRequest = &request
+	}
+	return info
+}
+
+// touch records activity on the connection
+func (conn *TunnelConnection) touch() {
+	conn.lastActivity.Store(time.Now().UnixNano())
+}
+
+// unixNano converts a stored timestamp, keeping zero as the zero time
+func unixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
@@ -0,0 +1,69 @@
+package vrata
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTunnelConnections(t *testing.T) {
+	relay := newMockRelay(t, 2)
+
+	release := make(chan struct{})
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		io.WriteString(w, "done")
+	}))
+	defer local.Close()
+	localPort := local.Listener.Addr().(*net.TCPAddr).Port
+
+	tunnel, err := NewTunnel(localPort, &TunnelOptions{Host: relay.server.URL, LocalHost: "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("NewTunnel() failed: %v", err)
+	}
+	if conns := tunnel.Connections(); conns != nil {
+		t.Errorf("Expected no connections before Open, got %v", conns)
+	}
+	if err := tunnel.Open(); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	waitFor(t, func() bool {
+		conns := tunnel.Connections()
+		return len(conns) == 2 && conns[0].Active && conns[1].Active
+	})
+
+	done := make(chan *http.Response)
+	go func() {
+		done <- relay.roundTrip(t, "GET /slow HTTP/1.1\r\nHost: public.example\r\nConnection: close\r\n\r\n")
+	}()
+
+	var busy ConnectionInfo
+	waitFor(t, func() bool {
+		for _, conn := range tunnel.Connections() {
+			if conn.CurrentRequest != nil {
+				busy = conn
+				return true
+			}
+		}
+		return false
+	})
+	if busy.CurrentRequest.Path != "/slow" || busy.ConnectedAt.IsZero() || busy.LastActivity.IsZero() {
+		t.Errorf("Unexpected busy connection: %+v", busy)
+	}
+
+	close(release)
+	resp := <-done
+	io.Copy(io.Discard, resp.Body)
+
+	waitFor(t, func() bool {
+		conn := tunnel.Connections()[busy.ID]
+		return conn.Requests == 1 && conn.CurrentRequest == nil
+	})
+	if conn := tunnel.Connections()[busy.ID]; conn.BytesIn == 0 || conn.BytesOut == 0 {
+		t.Errorf("Expected byte counts, got %+v", conn)
+	}
+}
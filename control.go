@@ -0,0 +1,256 @@
+package vrata
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Control commands understood by ControlServer
+const (
+	ControlStatus = "status" // process and tunnel summary
+	ControlList   = "list"   // managed tunnels
+	ControlURL    = "url"    // public URL of one tunnel
+	ControlClose  = "close"  // close one tunnel
+)
+
+// ControlRequest is one command sent to a ControlServer. Tunnel names the
+// target of url and close; it may be empty when only one tunnel runs.
+type ControlRequest struct {
+	Command string `json:"command"`
+	Tunnel  string `json:"tunnel,omitempty"`
+}
+
+// ControlResponse answers a ControlRequest
+type ControlResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+
+	PID     int             `json:"pid,omitempty"`
+	Version string          `json:"version,omitempty"`
+	URL     string          `json:"url,omitempty"`
+	Tunnels []ControlTunnel `json:"tunnels,omitempty"`
+}
+
+// ControlTunnel summarizes a tunnel for control clients
+type ControlTunnel struct {
+	Name              string  `json:"name"`
+	URL               string  `json:"url"`
+	LocalPort         int     `json:"local_port"`
+	ActiveConnections int     `json:"active_connections"`
+	TotalConnections  int     `json:"total_connections"`
+	Requests          int64   `json:"requests"`
+	UptimeSeconds     float64 `json:"uptime_seconds"`
+	LastError         string  `json:"last_error,omitempty"`
+
+	// What was learned from the relay, see TunnelInfo
+	MaxConnections int       `json:"max_connections,omitempty"`
+	DataPort       int       `json:"data_port,omitempty"`
+	Features       []string  `json:"features,omitempty"`
+	RTTMillis      float64   `json:"rtt_ms,omitempty"`
+	RegisteredAt   time.Time `json:"registered_at,omitzero"`
+}
+
+// DefaultControlSocket returns the per-user control socket path
+func DefaultControlSocket() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, fmt.Sprintf("varta-%d.sock", os.Getuid()))
+}
+
+// ErrControlInUse is returned when another live process owns the socket
+var ErrControlInUse = errors.New("control socket in use by another process")
+
+// ControlServer exposes a Manager's tunnels over a Unix socket. Clients
+// send newline-delimited JSON ControlRequests and get one ControlResponse
+// line back for each.
+type ControlServer struct {
+	manager  *Manager
+	version  string
+	listener net.Listener
+	path     string
+	wg       sync.WaitGroup
+}
+
+// ListenControl starts serving manager on the Unix socket at path. A
+// stale socket left by a dead process is replaced; one owned by a live
+// process yields ErrControlInUse.
+func ListenControl(path string, manager *Manager, version string) (*ControlServer, error) {
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return nil, ErrControlInUse
+	}
+	os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	os.Chmod(path, 0o600)
+
+	s := &ControlServer{manager: manager, version: version, listener: listener, path: path}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Path returns the socket path
+func (s *ControlServer) Path() string {
+	return s.path
+}
+
+// Close stops the server and removes the socket
+func (s *ControlServer) Close() error {
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *ControlServer) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle answers commands on one client connection
+func (s *ControlServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var req ControlRequest
+		var resp ControlResponse
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			resp.Error = "invalid request: " + err.Error()
+		} else {
+			resp = s.execute(req)
+		}
+		if err := encoder.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+// execute runs one command
+func (s *ControlServer) execute(req ControlRequest) ControlResponse {
+	switch req.Command {
+	case ControlStatus:
+		return ControlResponse{OK: true, PID: os.Getpid(), Version: s.version, Tunnels: s.tunnels()}
+	case ControlList:
+		return ControlResponse{OK: true, Tunnels: s.tunnels()}
+	case ControlURL:
+		name, tunnel, err := s.target(req.Tunnel)
+		if err != nil {
+			return ControlResponse{Error: err.Error()}
+		}
+		info := tunnel.Info()
+		if info == nil {
+			return ControlResponse{Error: fmt.Sprintf("tunnel %s is not open", name)}
+		}
+		return ControlResponse{OK: true, URL: info.URL}
+	case ControlClose:
+		name, _, err := s.target(req.Tunnel)
+		if err != nil {
+			return ControlResponse{Error: err.Error()}
+		}
+		if err := s.manager.Close(name); err != nil {
+			return ControlResponse{Error: err.Error()}
+		}
+		return ControlResponse{OK: true}
+	}
+	return ControlResponse{Error: fmt.Sprintf("unknown command %q", req.Command)}
+}
+
+// target resolves the tunnel a command applies to
+func (s *ControlServer) target(name string) (string, *Tunnel, error) {
+	if name == "" {
+		names := s.manager.Names()
+		if len(names) != 1 {
+			return "", nil, fmt.Errorf("%d tunnels running, name one", len(names))
+		}
+		name = names[0]
+	}
+
+	tunnel, ok := s.manager.Get(name)
+	if !ok {
+		return "", nil, fmt.Errorf("%w: %s", ErrTunnelNotFound, name)
+	}
+	return name, tunnel, nil
+}
+
+// tunnels summarizes every managed tunnel
+func (s *ControlServer) tunnels() []ControlTunnel {
+	var tunnels []ControlTunnel
+	for _, name := range s.manager.Names() {
+		tunnel, ok := s.manager.Get(name)
+		if !ok {
+			continue
+		}
+
+		stats := tunnel.Stats()
+		summary := ControlTunnel{
+			Name:              name,
+			LocalPort:         tunnel.options.Port,
+			ActiveConnections: stats.ActiveConnections,
+			TotalConnections:  stats.TotalConnections,
+			Requests:          stats.Requests,
+			UptimeSeconds:     stats.Uptime.Seconds(),
+		}
+		if info := tunnel.Info(); info != nil {
+			summary.URL = info.URL
+			summary.MaxConnections = info.MaxConn
+			summary.DataPort = info.Port
+			summary.Features = info.Features
+			summary.RTTMillis = info.RTT.Seconds() * 1000
+			summary.RegisteredAt = info.RegisteredAt
+		}
+		if stats.LastError != nil {
+			summary.LastError = stats.LastError.Error()
+		}
+		tunnels = append(tunnels, summary)
+	}
+	return tunnels
+}
+
+// ControlCall sends one command to the control socket at path
+func ControlCall(ctx context.Context, path string, req ControlRequest) (*ControlResponse, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+
+	var resp ControlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if !resp.OK {
+		return &resp, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
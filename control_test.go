@@ -0,0 +1,86 @@
+package vrata
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestControlServer(t *testing.T) {
+	relay := newMockRelay(t, 1)
+
+	manager := NewManager(Budget{})
+	defer manager.CloseAll()
+	if _, err := manager.Open("web", 8080, &TunnelOptions{Host: relay.server.URL}); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "control.sock")
+	server, err := ListenControl(path, manager, "1.2.3")
+	if err != nil {
+		t.Fatalf("ListenControl() failed: %v", err)
+	}
+	defer server.Close()
+
+	call := func(req ControlRequest) (*ControlResponse, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		return ControlCall(ctx, path, req)
+	}
+
+	status, err := call(ControlRequest{Command: ControlStatus})
+	if err != nil {
+		t.Fatalf("status failed: %v", err)
+	}
+	if status.PID == 0 || status.Version != "1.2.3" || len(status.Tunnels) != 1 || status.Tunnels[0].Name != "web" {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+	if summary := status.Tunnels[0]; summary.URL != "http://127.0.0.1" || summary.LocalPort != 8080 ||
+		summary.MaxConnections != 1 || summary.DataPort == 0 || summary.RegisteredAt.IsZero() {
+		t.Errorf("Unexpected tunnel summary: %+v", status.Tunnels[0])
+	}
+
+	url, err := call(ControlRequest{Command: ControlURL})
+	if err != nil || url.URL != "http://127.0.0.1" {
+		t.Errorf("url returned %+v, %v", url, err)
+	}
+
+	if _, err := call(ControlRequest{Command: ControlURL, Tunnel: "missing"}); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected not found error, got %v", err)
+	}
+	if _, err := call(ControlRequest{Command: "reboot"}); err == nil {
+		t.Error("Expected unknown command error")
+	}
+
+	if _, err := call(ControlRequest{Command: ControlClose, Tunnel: "web"}); err != nil {
+		t.Errorf("close failed: %v", err)
+	}
+	list, err := call(ControlRequest{Command: ControlList})
+	if err != nil || len(list.Tunnels) != 0 {
+		t.Errorf("Expected no tunnels after close, got %+v, %v", list, err)
+	}
+}
+
+func TestControlSocketInUse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	manager := NewManager(Budget{})
+
+	first, err := ListenControl(path, manager, "")
+	if err != nil {
+		t.Fatalf("ListenControl() failed: %v", err)
+	}
+
+	if _, err := ListenControl(path, manager, ""); !errors.Is(err, ErrControlInUse) {
+		t.Errorf("Expected ErrControlInUse, got %v", err)
+	}
+
+	first.Close()
+	second, err := ListenControl(path, manager, "")
+	if err != nil {
+		t.Fatalf("Expected the socket to be reusable after close: %v", err)
+	}
+	second.Close()
+}
@@ -0,0 +1,84 @@
+package vrata
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// drainPollInterval is how often a draining pool checks for visitors
+// still being served
+const drainPollInterval = 50 * time.Millisecond
+
+// Session states of a data connection, so draining can close idle
+// connections without racing a visitor that just arrived
+const (
+	sessionIdle int32 = iota
+	sessionServing
+	sessionDraining
+)
+
+// drain stops the pool from taking new visitors and waits until the ones
+// being served are done, or ctx ends. Idle connections are closed and not
+// redialed.
+func (tc *TunnelCluster) drain(ctx context.Context) error {
+	tc.draining.Store(true)
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		busy := 0
+		tc.mutex.RLock()
+		for _, conn := range tc.connections {
+			if conn.session.CompareAndSwap(sessionIdle, sessionDraining) {
+				conn.close()
+			} else if conn.session.Load() == sessionServing {
+				busy++
+			}
+		}
+		tc.mutex.RUnlock()
+		if busy == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d visitors still being served: %w", busy, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// CloseWithTimeout closes the tunnel gracefully: it stops taking new
+// visitors, waits up to timeout for the ones being served, then closes
+// like Close. It returns an error wrapping context.DeadlineExceeded when
+// visitors were cut off.
+func (t *Tunnel) CloseWithTimeout(timeout time.Duration) error {
+	t.mutex.Lock()
+	if t.reregistration != nil {
+		t.reregistration.Stop()
+		t.reregistration = nil
+	}
+	cluster := t.cluster
+	t.mutex.Unlock()
+
+	var err error
+	if cluster != nil {
+		t.logger.Info("draining tunnel", "timeout", timeout)
+		ctx, cancel := context.WithTimeout(t.ctx, timeout)
+		err = cluster.drain(ctx)
+		cancel()
+		if err != nil {
+			t.logger.Warn("drain timed out, closing anyway", "error", err)
+		}
+	}
+
+	t.Close()
+	return err
+}
+
+// ForceClose closes the tunnel right away, cutting off visitors being
+// served. It's the same as Close.
+func (t *Tunnel) ForceClose() error {
+	return t.Close()
+}
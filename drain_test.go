@@ -0,0 +1,117 @@
+package vrata
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// startSlowRequest sends a visitor through the tunnel and waits until the
+// local server is handling it
+func startSlowRequest(t *testing.T, relay *mockRelay, handling <-chan struct{}) net.Conn {
+	t.Helper()
+	var conn net.Conn
+	select {
+	case conn = <-relay.conns:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for a data connection")
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: public.example\r\nConnection: close\r\n\r\n")
+	select {
+	case <-handling:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the local server")
+	}
+	return conn
+}
+
+func TestCloseWithTimeoutDrains(t *testing.T) {
+	relay := newMockRelay(t, 2)
+
+	handling := make(chan struct{}, 1)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handling <- struct{}{}
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "done")
+	}))
+	defer local.Close()
+
+	tunnel, err := ConnectAndOpen(local.Listener.Addr().(*net.TCPAddr).Port, &TunnelOptions{
+		Host:      relay.server.URL,
+		LocalHost: "127.0.0.1",
+	})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.ForceClose()
+
+	conn := startSlowRequest(t, relay, handling)
+	defer conn.Close()
+
+	closed := make(chan error, 1)
+	go func() { closed <- tunnel.CloseWithTimeout(2 * time.Second) }()
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "done" {
+		t.Errorf("Expected the full response, got %q", body)
+	}
+
+	if err := <-closed; err != nil {
+		t.Errorf("Expected a clean drain, got %v", err)
+	}
+	if tunnel.State() != StateClosed {
+		t.Errorf("Expected a closed tunnel, got %s", tunnel.State())
+	}
+	if tunnel.cluster.reconnects.Load() != 0 {
+		t.Error("Expected no redials while draining")
+	}
+}
+
+func TestCloseWithTimeoutExpires(t *testing.T) {
+	relay := newMockRelay(t, 1)
+
+	handling := make(chan struct{}, 1)
+	release := make(chan struct{})
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handling <- struct{}{}
+		<-release
+	}))
+	defer local.Close()
+	defer close(release)
+
+	tunnel, err := ConnectAndOpen(local.Listener.Addr().(*net.TCPAddr).Port, &TunnelOptions{
+		Host:      relay.server.URL,
+		LocalHost: "127.0.0.1",
+	})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+
+	conn := startSlowRequest(t, relay, handling)
+	defer conn.Close()
+
+	start := time.Now()
+	err = tunnel.CloseWithTimeout(100 * time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Drain took %s", elapsed)
+	}
+	select {
+	case <-tunnel.Done():
+	default:
+		t.Error("Expected the tunnel to be closed")
+	}
+}
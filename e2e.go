@@ -0,0 +1,438 @@
+package vrata
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// End-to-end encryption hides visitors' requests and the local server's
+// responses from the relay. The viewer, a proxy on the visitor's machine,
+// seals each request with the shared key and posts it to e2ePath; the
+// tunnel opens it, forwards it to the local server and seals the response
+// in return. The relay only sees opaque POSTs.
+const (
+	e2ePath        = "/.vrata/e2e"
+	e2eContentType = "application/vnd.vrata.e2e"
+
+	// E2EKeySize is the size of E2EKey, an AES-256 key
+	E2EKeySize = 32
+	// maxE2ESealed caps sealed requests and responses, which are
+	// buffered, and maxE2EBody their bodies, leaving room for the heads
+	maxE2ESealed = 32 << 20
+	maxE2EBody   = maxE2ESealed - 1<<20
+	// e2eMaxAge is how old, or how far ahead of the tunnel's clock, a
+	// sealed request may be. Younger ones are recognized when replayed.
+	e2eMaxAge = 2 * time.Minute
+)
+
+// ErrBadE2EKey is returned for end-to-end keys that aren't E2EKeySize
+// bytes, or not base64url
+var ErrBadE2EKey = errors.New("end-to-end key must be 32 bytes, base64url encoded")
+
+// e2eRequestData is the additional data requests are sealed with, so they
+// can't pass for responses
+var e2eRequestData = []byte("vrata e2e request")
+
+// GenerateE2EKey returns a new random key for E2EKey
+func GenerateE2EKey() ([]byte, error) {
+	key := make([]byte, E2EKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// EncodeE2EKey returns key the way ParseE2EKey reads it, for sharing with
+// viewers
+func EncodeE2EKey(key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+// ParseE2EKey decodes a key written by EncodeE2EKey
+func ParseE2EKey(s string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(s), "="))
+	if err != nil || len(key) != E2EKeySize {
+		return nil, ErrBadE2EKey
+	}
+	return key, nil
+}
+
+// e2eCipher seals and opens messages with AES-256-GCM. Sealed messages
+// start with their random nonce.
+type e2eCipher struct {
+	aead cipher.AEAD
+}
+
+func newE2ECipher(key []byte) (*e2eCipher, error) {
+	if len(key) != E2EKeySize {
+		return nil, ErrBadE2EKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &e2eCipher{aead: aead}, nil
+}
+
+// seal encrypts plaintext and authenticates it with data
+func (c *e2eCipher) seal(plaintext, data []byte) []byte {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	rand.Read(nonce)
+	return c.aead.Seal(nonce, nonce, plaintext, data)
+}
+
+// open decrypts a sealed message, and returns its nonce
+func (c *e2eCipher) open(sealed, data []byte) (plaintext, nonce []byte, err error) {
+	if len(sealed) < c.aead.NonceSize() {
+		return nil, nil, errors.New("sealed message too short")
+	}
+	nonce, sealed = sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	plaintext, err = c.aead.Open(nil, nonce, sealed, data)
+	return plaintext, nonce, err
+}
+
+// e2eResponseData is the additional data the response to the request
+// sealed with nonce is sealed with, so responses can't be swapped
+func e2eResponseData(nonce []byte) []byte {
+	return append([]byte("vrata e2e response "), nonce...)
+}
+
+// e2eServer answers sealed requests on behalf of the local server
+type e2eServer struct {
+	cipher     *e2eCipher
+	transport  *localTransport
+	forwarding forwarding
+	// check runs the access checks on decrypted requests, returning the
+	// rejection to answer with
+	check func(req *http.Request) *rejection
+
+	// seen holds the nonces of the requests opened in the last e2eMaxAge,
+	// and when they expire
+	mutex sync.Mutex
+	seen  map[string]time.Time
+}
+
+func newE2EServer(options *TunnelOptions, forwarding forwarding, check func(req *http.Request) *rejection) (*e2eServer, error) {
+	c, err := newE2ECipher(options.E2EKey)
+	if err != nil {
+		return nil, err
+	}
+	return &e2eServer{
+		cipher:     c,
+		transport:  LocalTransport(options).(*localTransport),
+		forwarding: forwarding,
+		check:      check,
+		seen:       make(map[string]time.Time),
+	}, nil
+}
+
+// open decrypts a sealed request, rejecting stale and replayed ones
+func (s *e2eServer) open(sealed []byte) (*http.Request, []byte, error) {
+	plaintext, nonce, err := s.cipher.open(sealed, e2eRequestData)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(plaintext) < 8 {
+		return nil, nil, errors.New("sealed request too short")
+	}
+	now := time.Now()
+	sent := time.Unix(int64(binary.BigEndian.Uint64(plaintext)), 0)
+	if age := now.Sub(sent); age > e2eMaxAge || age < -e2eMaxAge {
+		return nil, nil, fmt.Errorf("sealed request is %v old", age.Round(time.Second))
+	}
+
+	s.mutex.Lock()
+	for n, expiry := range s.seen {
+		if now.After(expiry) {
+			delete(s.seen, n)
+		}
+	}
+	_, replayed := s.seen[string(nonce)]
+	s.seen[string(nonce)] = sent.Add(2 * e2eMaxAge)
+	s.mutex.Unlock()
+	if replayed {
+		return nil, nil, errors.New("sealed request replayed")
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(plaintext[8:])))
+	if err != nil {
+		return nil, nil, err
+	}
+	return req, nonce, nil
+}
+
+// serve answers the sealed requests arriving on upstream until the
+// visitor closes the connection. Anything else gets a 404 telling to use
+// the viewer. onRequest and onResponse are told of the decrypted
+// exchanges.
+func (s *e2eServer) serve(ctx context.Context, upstream io.ReadWriter, reader *bufio.Reader, onRequest, onResponse func(RequestInfo)) error {
+	for {
+		outer, err := http.ReadRequest(reader)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		sealed, err := io.ReadAll(io.LimitReader(outer.Body, maxE2ESealed+1))
+		outer.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		var resp *http.Response
+		switch {
+		case outer.Method != http.MethodPost || outer.URL.Path != e2ePath:
+			resp = plainResponse(http.StatusNotFound, "This tunnel is end-to-end encrypted: open it with varta view\n")
+		case len(sealed) > maxE2ESealed:
+			resp = plainResponse(http.StatusRequestEntityTooLarge, "sealed request too large\n")
+		default:
+			resp, err = s.exchange(ctx, outer, sealed, onRequest, onResponse)
+			if err != nil {
+				return err
+			}
+		}
+
+		resp.Request, resp.Close = outer, outer.Close
+		if err := resp.Write(upstream); err != nil {
+			return err
+		}
+		if resp.Close {
+			return nil
+		}
+	}
+}
+
+// exchange forwards a sealed request to the local server, and returns the
+// response to send back
+func (s *e2eServer) exchange(ctx context.Context, outer *http.Request, sealed []byte, onRequest, onResponse func(RequestInfo)) (*http.Response, error) {
+	req, nonce, err := s.open(sealed)
+	if err != nil {
+		return plainResponse(http.StatusBadRequest, "cannot open sealed request\n"), nil
+	}
+
+	// The relay's X-Forwarded-For is the only header the visitor didn't
+	// write
+	req.Header.Del("X-Forwarded-For")
+	for _, value := range outer.Header.Values("X-Forwarded-For") {
+		req.Header.Add("X-Forwarded-For", value)
+	}
+
+	// Checks see the relay's X-Forwarded-For, which forwarding may strip
+	if s.check != nil {
+		if denied := s.check(req); denied != nil {
+			resp := plainResponse(denied.status, http.StatusText(denied.status)+"\n")
+			for name, values := range denied.header {
+				resp.Header[name] = values
+			}
+			return s.sealResponse(resp, nonce)
+		}
+	}
+	s.forwarding.apply(req.Header)
+
+	info := RequestInfo{
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		URL:        req.URL.RequestURI(),
+		RemoteAddr: forwardedFor(req.Header),
+		Header:     req.Header,
+		BytesIn:    int64(len(sealed)),
+		start:      time.Now(),
+		proto:      req.Proto,
+	}
+	if onRequest != nil {
+		onRequest(info)
+	}
+
+	req.RequestURI = ""
+	req = req.WithContext(ctx)
+	resp, err := s.transport.RoundTrip(req)
+	var body []byte
+	if err == nil {
+		body, err = io.ReadAll(io.LimitReader(resp.Body, maxE2EBody+1))
+		resp.Body.Close()
+		if err == nil && len(body) > maxE2EBody {
+			err = errors.New("response too large")
+		}
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		resp = plainResponse(http.StatusBadGateway, fmt.Sprintf("local server failed: %v\n", err))
+		body, _ = io.ReadAll(resp.Body)
+	}
+
+	// The response goes whole, so its length is known
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	sealedResp, err := s.sealResponse(resp, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	if onResponse != nil {
+		info.StatusCode = resp.StatusCode
+		info.ResponseHeader = resp.Header
+		info.BytesOut = sealedResp.ContentLength
+		info.Duration = time.Since(info.start)
+		onResponse(info)
+	}
+	return sealedResp, nil
+}
+
+// sealResponse returns the response carrying resp, whose body has a known
+// length, sealed for the request sealed with nonce
+func (s *e2eServer) sealResponse(resp *http.Response, nonce []byte) (*http.Response, error) {
+	resp.TransferEncoding = nil
+	resp.Close = false
+	resp.Header.Del("Connection")
+	var plaintext bytes.Buffer
+	if err := resp.Write(&plaintext); err != nil {
+		return nil, err
+	}
+	sealedResp := s.cipher.seal(plaintext.Bytes(), e2eResponseData(nonce))
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":  {e2eContentType},
+			"Cache-Control": {"no-store"},
+		},
+		Body:          io.NopCloser(bytes.NewReader(sealedResp)),
+		ContentLength: int64(len(sealedResp)),
+	}, nil
+}
+
+// plainResponse returns a text/plain response
+func plainResponse(status int, message string) *http.Response {
+	return &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(message)),
+		ContentLength: int64(len(message)),
+	}
+}
+
+// e2eViewer is the http.Handler returned by NewE2EViewer
+type e2eViewer struct {
+	cipher   *e2eCipher
+	endpoint string
+	host     string
+	client   *http.Client
+}
+
+// NewE2EViewer returns the viewer of the end-to-end encrypted tunnel at
+// tunnelURL: an http.Handler, meant to listen on the visitor's machine,
+// that seals the requests it receives with key, sends them through the
+// tunnel, and answers with the decrypted responses. Requests reach the
+// local server with the tunnel's host. Bodies are buffered, so streamed
+// responses arrive whole and WebSockets aren't supported.
+func NewE2EViewer(tunnelURL string, key []byte) (http.Handler, error) {
+	c, err := newE2ECipher(key)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(tunnelURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid tunnel URL %q", tunnelURL)
+	}
+	return &e2eViewer{
+		cipher:   c,
+		endpoint: u.Scheme + "://" + u.Host + e2ePath,
+		host:     u.Host,
+		client:   &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+func (v *e2eViewer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isUpgrade(r.Header) {
+		http.Error(w, "upgrades aren't supported end to end", http.StatusNotImplemented)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxE2EBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	inner := &http.Request{
+		Method:        r.Method,
+		URL:           &url.URL{Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery},
+		Host:          v.host,
+		Header:        r.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	for _, name := range []string{"Connection", "Proxy-Connection", "Keep-Alive", "Te", "Trailer", "Transfer-Encoding"} {
+		inner.Header.Del(name)
+	}
+	plaintext := binary.BigEndian.AppendUint64(nil, uint64(time.Now().Unix()))
+	buf := bytes.NewBuffer(plaintext)
+	if err := inner.Write(buf); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sealed := v.cipher.seal(buf.Bytes(), e2eRequestData)
+	nonce := sealed[:v.cipher.aead.NonceSize()]
+
+	outer, err := http.NewRequestWithContext(r.Context(), http.MethodPost, v.endpoint, bytes.NewReader(sealed))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	outer.Header.Set("Content-Type", e2eContentType)
+	resp, err := v.client.Do(outer)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("tunnel unreachable: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != e2eContentType {
+		http.Error(w, fmt.Sprintf("tunnel answered %s without encryption", resp.Status), http.StatusBadGateway)
+		return
+	}
+	sealed, err = io.ReadAll(io.LimitReader(resp.Body, maxE2ESealed))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("tunnel response failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	plaintext, _, err = v.cipher.open(sealed, e2eResponseData(nonce))
+	if err != nil {
+		http.Error(w, "cannot open sealed response", http.StatusBadGateway)
+		return
+	}
+	decrypted, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(plaintext)), nil)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid sealed response: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	for name, values := range decrypted.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(decrypted.StatusCode)
+	io.Copy(w, decrypted.Body)
+}
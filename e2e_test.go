@@ -0,0 +1,312 @@
+package vrata
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseE2EKey(t *testing.T) {
+	key, err := GenerateE2EKey()
+	if err != nil {
+		t.Fatalf("GenerateE2EKey() failed: %v", err)
+	}
+	parsed, err := ParseE2EKey(EncodeE2EKey(key) + "\n")
+	if err != nil || !bytes.Equal(parsed, key) {
+		t.Errorf("ParseE2EKey(EncodeE2EKey(key)) = %x, %v, want %x", parsed, err, key)
+	}
+
+	for _, bad := range []string{"", "short", "not base64 at all, not base64 at all!!"} {
+		if _, err := ParseE2EKey(bad); !errors.Is(err, ErrBadE2EKey) {
+			t.Errorf("ParseE2EKey(%q) = %v, want ErrBadE2EKey", bad, err)
+		}
+	}
+}
+
+func TestNewTunnelRejectsBadE2E(t *testing.T) {
+	key, _ := GenerateE2EKey()
+	if _, err := NewTunnel(8080, &TunnelOptions{E2EKey: key[:16]}); !errors.Is(err, ErrBadE2EKey) {
+		t.Errorf("Short key: got %v, want ErrBadE2EKey", err)
+	}
+	if _, err := NewTunnel(8080, &TunnelOptions{E2EKey: key, Stubs: []Stub{{Path: "/"}}}); err == nil {
+		t.Error("Expected an error for end-to-end encryption with stubs")
+	}
+}
+
+func TestTunnelE2E(t *testing.T) {
+	relay := newMockRelay(t, 4)
+	received := make(chan *http.Request, 1)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		w.Header().Set("X-Secret", "header")
+		fmt.Fprintf(w, "secret answer to %s", body)
+	}))
+	defer local.Close()
+
+	key, _ := GenerateE2EKey()
+	tunnel, err := ConnectAndOpen(local.Listener.Addr().(*net.TCPAddr).Port, &TunnelOptions{
+		Host:      relay.server.URL,
+		LocalHost: "127.0.0.1",
+		E2EKey:    key,
+	})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	// The public side keeps what it saw
+	var mutex sync.Mutex
+	var seen bytes.Buffer
+	public := newE2EPublic(t, relay, func(raw string, respBody []byte) {
+		mutex.Lock()
+		seen.WriteString(raw)
+		seen.Write(respBody)
+		mutex.Unlock()
+	})
+	defer public.Close()
+
+	viewer, err := NewE2EViewer(public.URL, key)
+	if err != nil {
+		t.Fatalf("NewE2EViewer() failed: %v", err)
+	}
+	view := httptest.NewServer(viewer)
+	defer view.Close()
+
+	resp, err := http.Post(view.URL+"/account?id=7", "text/plain", strings.NewReader("secret question"))
+	if err != nil {
+		t.Fatalf("POST through the viewer failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "secret answer to secret question" || resp.Header.Get("X-Secret") != "header" {
+		t.Errorf("Viewer answered %d %q with %v", resp.StatusCode, body, resp.Header)
+	}
+
+	req := <-received
+	if req.Method != http.MethodPost || req.URL.RequestURI() != "/account?id=7" || req.Header.Get("X-Forwarded-For") != "203.0.113.9" {
+		t.Errorf("Local server got %s %s from %q", req.Method, req.URL.RequestURI(), req.Header.Get("X-Forwarded-For"))
+	}
+
+	mutex.Lock()
+	if strings.Contains(seen.String(), "secret") || strings.Contains(seen.String(), "/account") {
+		t.Errorf("The relay saw plaintext: %q", seen.String())
+	}
+	mutex.Unlock()
+
+	// Events tell of the decrypted exchange
+	select {
+	case info := <-tunnel.Events().Response:
+		if info.URL != "/account?id=7" || info.StatusCode != http.StatusOK || info.BytesOut == 0 {
+			t.Errorf("Unexpected response event: %+v", info)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("No response event emitted")
+	}
+
+	// Without the viewer, or with another key, there is nothing to see
+	resp, err = http.Get(public.URL + "/account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Plain request: status = %d, want 404", resp.StatusCode)
+	}
+
+	otherKey, _ := GenerateE2EKey()
+	other, _ := NewE2EViewer(public.URL, otherKey)
+	recorder := httptest.NewRecorder()
+	other.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/account", nil))
+	if recorder.Code != http.StatusBadGateway {
+		t.Errorf("Wrong key: status = %d, want 502", recorder.Code)
+	}
+}
+
+func TestTunnelE2EAccessRules(t *testing.T) {
+	relay := newMockRelay(t, 4)
+	var hits atomic.Int64
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.WriteString(w, "private")
+	}))
+	defer local.Close()
+
+	key, _ := GenerateE2EKey()
+	tunnel, err := ConnectAndOpen(local.Listener.Addr().(*net.TCPAddr).Port, &TunnelOptions{
+		Host:      relay.server.URL,
+		LocalHost: "127.0.0.1",
+		E2EKey:    key,
+		DenyPaths: []string{"/admin"},
+		BasicAuth: &BasicAuth{Username: "alice", Password: "s3cret"},
+	})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	public := newE2EPublic(t, relay, nil)
+	defer public.Close()
+	viewer, _ := NewE2EViewer(public.URL, key)
+	view := httptest.NewServer(viewer)
+	defer view.Close()
+
+	// The rules apply to the decrypted requests, with the credentials the
+	// visitor sent through the viewer
+	tests := []struct {
+		path     string
+		username string
+		want     int
+	}{
+		{"/", "", http.StatusUnauthorized},
+		{"/", "alice", http.StatusOK},
+		{"/admin", "alice", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, view.URL+tt.path, nil)
+		if tt.username != "" {
+			req.SetBasicAuth(tt.username, "s3cret")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s through the viewer failed: %v", tt.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("GET %s as %q: status = %d, want %d", tt.path, tt.username, resp.StatusCode, tt.want)
+		}
+		if tt.want == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("GET %s: 401 without WWW-Authenticate", tt.path)
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("Local server got %d requests, want 1", n)
+	}
+	if n := tunnel.Stats().Rejected; n != 2 {
+		t.Errorf("Stats().Rejected = %d, want 2", n)
+	}
+}
+
+func TestTunnelE2EIPRulesWithStrippedHeaders(t *testing.T) {
+	received := make(chan http.Header, 2)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+		io.WriteString(w, "private")
+	}))
+	defer local.Close()
+	key, _ := GenerateE2EKey()
+
+	// The public side forwards for 203.0.113.9
+	tests := []struct {
+		name    string
+		options TunnelOptions
+		want    int
+	}{
+		{"denied", TunnelOptions{DenyIPs: []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}}, http.StatusForbidden},
+		{"allowed", TunnelOptions{AllowIPs: []netip.Prefix{netip.MustParsePrefix("203.0.113.9/32")}}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := newMockRelay(t, 4)
+			options := tt.options
+			options.Host = relay.server.URL
+			options.LocalHost = "127.0.0.1"
+			options.E2EKey = key
+			options.ForwardedHeaders = ForwardedStrip
+			tunnel, err := ConnectAndOpen(local.Listener.Addr().(*net.TCPAddr).Port, &options)
+			if err != nil {
+				t.Fatalf("ConnectAndOpen() failed: %v", err)
+			}
+			defer tunnel.Close()
+
+			public := newE2EPublic(t, relay, nil)
+			defer public.Close()
+			viewer, _ := NewE2EViewer(public.URL, key)
+			recorder := httptest.NewRecorder()
+			viewer.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+			if recorder.Code != tt.want {
+				t.Fatalf("Status = %d, want %d", recorder.Code, tt.want)
+			}
+			if tt.want == http.StatusOK {
+				if header := <-received; header.Get("X-Forwarded-For") != "" {
+					t.Errorf("Local server got X-Forwarded-For %q, want it stripped", header.Get("X-Forwarded-For"))
+				}
+			}
+		})
+	}
+}
+
+// newE2EPublic returns a server passing requests to the tunnel the way
+// the relay does, telling seen, when not nil, of what went through it
+func newE2EPublic(t *testing.T, relay *mockRelay, seen func(raw string, respBody []byte)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		raw := fmt.Sprintf("%s %s HTTP/1.1\r\nHost: %s\r\nX-Forwarded-For: 203.0.113.9\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+			r.Method, r.URL.RequestURI(), r.Host, len(body), body)
+		resp := relay.roundTrip(t, raw)
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(resp.Body)
+
+		if seen != nil {
+			seen(raw, respBody)
+		}
+		for name, values := range resp.Header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(resp.StatusCode)
+		w.Write(respBody)
+	}))
+}
+
+func TestE2EServerRejectsReplays(t *testing.T) {
+	key, _ := GenerateE2EKey()
+	server, err := newE2EServer(&TunnelOptions{E2EKey: key}, forwarding{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewer, _ := NewE2EViewer("https://abc123.loca.lt", key)
+
+	// Capture a sealed request from the viewer
+	sealed := make(chan []byte, 1)
+	viewer.(*e2eViewer).client.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		body, _ := io.ReadAll(r.Body)
+		sealed <- body
+		return nil, errors.New("captured")
+	})
+	viewer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	request := <-sealed
+
+	req, _, err := server.open(request)
+	if err != nil {
+		t.Fatalf("open() failed: %v", err)
+	}
+	if req.Host != "abc123.loca.lt" || req.URL.Path != "/" {
+		t.Errorf("Opened request for %s%s, want abc123.loca.lt/", req.Host, req.URL.Path)
+	}
+	if _, _, err := server.open(request); err == nil {
+		t.Error("Expected a replayed request to be rejected")
+	}
+
+	tampered := bytes.Clone(request)
+	tampered[len(tampered)-1] ^= 1
+	if _, _, err := server.open(tampered); err == nil {
+		t.Error("Expected a tampered request to be rejected")
+	}
+}
+
+// roundTripFunc is an http.RoundTripper calling a function
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
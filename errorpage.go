@@ -0,0 +1,98 @@
+package vrata
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultErrorPage is sent to visitors when the local server can't be
+// reached and no ErrorPage is set
+const defaultErrorPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>502 Bad Gateway</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 36em; margin: 4em auto; padding: 0 1em; color: #222; }
+code { background: #f2f2f2; padding: 0.1em 0.3em; border-radius: 3px; }
+</style>
+</head>
+<body>
+<h1>502 Bad Gateway</h1>
+<p>The tunnel is up, but no app is running on port <code>{{.Port}}</code> behind it.</p>
+<p>If this is your tunnel, start the app and reload this page.</p>
+</body>
+</html>
+`
+
+// errorPageData is what ErrorPage templates are executed with
+type errorPageData struct {
+	// Port and Address are those of the local server
+	Port    int
+	Address string
+	// Error is why it couldn't be reached
+	Error string
+}
+
+// parseErrorPage parses ErrorPage, or the default page when it is empty
+func (o *TunnelOptions) parseErrorPage() (*template.Template, error) {
+	page := o.ErrorPage
+	if page == "" {
+		page = defaultErrorPage
+	}
+	tmpl, err := template.New("error").Parse(page)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadErrorPage, err)
+	}
+	return tmpl, nil
+}
+
+// writeErrorPage answers a visitor whose request couldn't reach the local
+// server at address with a 502 page. head is the head of the request.
+func (conn *TunnelConnection) writeErrorPage(w io.Writer, head []byte, address string, dialErr error) {
+	options := conn.cluster.options
+	port := options.Port
+	if _, p, err := net.SplitHostPort(address); err == nil {
+		port, _ = strconv.Atoi(p)
+	}
+
+	var body bytes.Buffer
+	err := conn.cluster.errorPage.Execute(&body, errorPageData{
+		Port:    port,
+		Address: address,
+		Error:   dialErr.Error(),
+	})
+	if err != nil {
+		conn.reportError(fmt.Errorf("error page failed: %w", err))
+		writeRejection(w, http.StatusBadGateway, options.ResponseHeaders)
+		return
+	}
+
+	header := http.Header{
+		"Content-Type":   {"text/html; charset=utf-8"},
+		"Content-Length": {fmt.Sprint(body.Len())},
+		"Cache-Control":  {"no-store"},
+		"Connection":     {"close"},
+	}
+	setHeaders(header, options.ResponseHeaders)
+
+	var response bytes.Buffer
+	fmt.Fprintf(&response, "HTTP/1.1 %d %s\r\n", http.StatusBadGateway, http.StatusText(http.StatusBadGateway))
+	header.Write(&response)
+	response.WriteString("\r\n")
+	if !bytes.HasPrefix(head, []byte("HEAD ")) {
+		response.Write(body.Bytes())
+	}
+
+	if c, ok := w.(net.Conn); ok {
+		c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	}
+	w.Write(response.Bytes())
+}
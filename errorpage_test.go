@@ -0,0 +1,117 @@
+package vrata
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// closedPort returns a local port nothing listens on
+func closedPort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	return port
+}
+
+func TestTunnelErrorPage(t *testing.T) {
+	tests := []struct {
+		name    string
+		page    string
+		request string
+		want    func(port int) string
+	}{
+		{
+			name:    "default",
+			request: "GET / HTTP/1.1\r\nHost: public.example\r\n\r\n",
+			want: func(port int) string {
+				return fmt.Sprintf("no app is running on port <code>%d</code>", port)
+			},
+		},
+		{
+			name:    "custom",
+			page:    "<p>{{.Address}} is down</p>",
+			request: "GET / HTTP/1.1\r\nHost: public.example\r\n\r\n",
+			want: func(port int) string {
+				return fmt.Sprintf("<p>127.0.0.1:%d is down</p>", port)
+			},
+		},
+		{
+			name:    "head",
+			request: "HEAD / HTTP/1.1\r\nHost: public.example\r\n\r\n",
+			want:    func(int) string { return "" },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := newMockRelay(t, 1)
+			port := closedPort(t)
+
+			tunnel, err := ConnectAndOpen(port, &TunnelOptions{
+				Host:            relay.server.URL,
+				LocalHost:       "127.0.0.1",
+				ErrorPage:       tt.page,
+				ResponseHeaders: http.Header{"X-Tunnel": {"vrata"}},
+			})
+			if err != nil {
+				t.Fatalf("ConnectAndOpen() failed: %v", err)
+			}
+			defer tunnel.Close()
+
+			var conn net.Conn
+			select {
+			case conn = <-relay.conns:
+			case <-time.After(2 * time.Second):
+				t.Fatal("Tunnel client never connected to the relay")
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			io.WriteString(conn, tt.request)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: strings.Fields(tt.request)[0]})
+			if err != nil {
+				t.Fatalf("Expected an error page, got %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+
+			if resp.StatusCode != http.StatusBadGateway {
+				t.Errorf("Expected 502, got %d", resp.StatusCode)
+			}
+			if got := resp.Header.Get("Content-Type"); got != "text/html; charset=utf-8" {
+				t.Errorf("Content-Type = %q", got)
+			}
+			if resp.Header.Get("X-Tunnel") != "vrata" {
+				t.Errorf("Response headers were not set: %v", resp.Header)
+			}
+			if want := tt.want(port); !strings.Contains(string(body), want) || (want == "" && len(body) > 0) {
+				t.Errorf("Body %q doesn't contain %q", body, want)
+			}
+
+			select {
+			case err := <-tunnel.Events().Error:
+				if !errors.Is(err, ErrLocalUnreachable) {
+					t.Errorf("Expected ErrLocalUnreachable, got %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Error("The failed dial wasn't reported")
+			}
+		})
+	}
+}
+
+func TestNewTunnelRejectsBadErrorPage(t *testing.T) {
+	_, err := NewTunnel(8080, &TunnelOptions{ErrorPage: "{{.Port"})
+	if !errors.Is(err, ErrBadErrorPage) {
+		t.Errorf("Expected ErrBadErrorPage, got %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package vrata
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ErrInvalidSubdomain is returned when a requested subdomain can't be used
+var ErrInvalidSubdomain = errors.New("invalid subdomain")
+
+// ErrNoGeoIP is returned when country rules are set without a GeoIP
+// database to resolve client countries
+var ErrNoGeoIP = errors.New("country rules need a GeoIP database")
+
+// ErrBadPathPattern is returned for AllowPaths and DenyPaths patterns
+// that aren't absolute paths or valid globs
+var ErrBadPathPattern = errors.New("bad path pattern")
+
+// ErrInvalidHeader is returned for configured headers whose name or value
+// can't appear in an HTTP head
+var ErrInvalidHeader = errors.New("invalid header")
+
+// ErrBadErrorPage is returned when ErrorPage isn't a valid HTML template
+var ErrBadErrorPage = errors.New("bad error page")
+
+// ErrLocalNotListening is returned by Open when nothing starts listening
+// on the local port within WaitForLocal
+var ErrLocalNotListening = errors.New("local server is not listening")
+
+// ErrBadLocalTarget is returned for LocalTargets or a LocalFallback that
+// aren't host:port addresses
+var ErrBadLocalTarget = errors.New("bad local target")
+
+// ErrBadStub is returned for Stubs that can't be served
+var ErrBadStub = errors.New("bad stub")
+
+// ErrBadProxy is returned for a Proxy that isn't an http, https or socks5
+// URL
+var ErrBadProxy = errors.New("bad proxy")
+
+// ErrSubdomainTaken is matched by ServerErrors saying that another client
+// holds the requested subdomain
+var ErrSubdomainTaken = errors.New("subdomain taken")
+
+// ErrServerUnavailable is matched by registration failures that may pass on
+// their own: the relay couldn't be reached, or answered with a 5xx or 429
+var ErrServerUnavailable = errors.New("tunnel server unavailable")
+
+// ErrLocalUnreachable wraps failures to connect to the local server, as
+// delivered on the Error channel
+var ErrLocalUnreachable = errors.New("local server unreachable")
+
+// ErrTunnelClosed is returned by Open and URL when the tunnel is closed, or
+// its context is done, before they complete
+var ErrTunnelClosed = errors.New("tunnel closed")
+
+// ErrTunnelExists is returned by Manager.Open when the name is taken
+var ErrTunnelExists = errors.New("tunnel already exists")
+
+// ErrTunnelNotFound is returned by Manager when no tunnel has the name
+var ErrTunnelNotFound = errors.New("tunnel not found")
+
+// ServerError is an error response returned by the tunnel server when
+// registering a tunnel
+type ServerError struct {
+	StatusCode int
+	// Message is the server's explanation, verbatim
+	Message string
+	// Hint suggests how to fix the problem, when one is known
+	Hint string
+}
+
+func (e *ServerError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("server responded with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("server responded with status %d: %s", e.StatusCode, e.Message)
+}
+
+// Is matches ErrSubdomainTaken and ErrServerUnavailable
+func (e *ServerError) Is(target error) bool {
+	switch target {
+	case ErrSubdomainTaken:
+		return subdomainTaken(e.StatusCode, e.Message)
+	case ErrServerUnavailable:
+		return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// subdomainTaken reports whether a registration response says that
+// another client holds the subdomain
+func subdomainTaken(status int, message string) bool {
+	lower := strings.ToLower(message)
+	switch {
+	case status == http.StatusConflict:
+		return true
+	case strings.Contains(lower, "in use"), strings.Contains(lower, "taken"):
+		return true
+	}
+	// A busy relay says unavailable too
+	return strings.Contains(lower, "unavailable") && status < 500
+}
+
+// maxErrorBody bounds how much of an error response is read
+const maxErrorBody = 64 << 10
+
+// parseServerError builds a ServerError from a non-200 registration
+// response. localtunnel servers answer with {"message": "..."}, but plain
+// text bodies are accepted too.
+func parseServerError(resp *http.Response) *ServerError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+
+	var payload struct {
+		Message string `json:"message"`
+		Error   string `json:"error"`
+	}
+
+	message := ""
+	if err := json.Unmarshal(body, &payload); err == nil {
+		message = payload.Message
+		if message == "" {
+			message = payload.Error
+		}
+	} else if !strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		message = strings.TrimSpace(string(body))
+	}
+
+	return &ServerError{
+		StatusCode: resp.StatusCode,
+		Message:    message,
+		Hint:       serverErrorHint(resp.StatusCode, message),
+	}
+}
+
+// serverErrorHint maps well-known server responses to remediation advice
+func serverErrorHint(status int, message string) string {
+	lower := strings.ToLower(message)
+
+	switch {
+	case strings.Contains(lower, "invalid subdomain"):
+		return "subdomains must be 4-63 lowercase letters, digits or dashes"
+	case strings.Contains(lower, "banned"), strings.Contains(lower, "reserved"), strings.Contains(lower, "not allowed"):
+		return "this subdomain can't be used on this server, pick another one"
+	case subdomainTaken(status, message):
+		return "another client holds this subdomain, pick another one or retry later"
+	}
+
+	switch {
+	case status == http.StatusTooManyRequests:
+		return "the server is rate limiting registrations, wait a bit before retrying"
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return "the server refused the registration, check the subdomain and any credentials"
+	case status >= 500:
+		return "the tunnel server is having trouble, retry later or use another --host"
+	}
+
+	return ""
+}
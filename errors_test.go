@@ -0,0 +1,126 @@
+package vrata
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestTunnelServerError(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		message     string
+		hint        string
+	}{
+		{
+			name:        "localtunnel json message",
+			status:      http.StatusForbidden,
+			contentType: "application/json",
+			body:        `{"message":"Invalid subdomain. Subdomains must be lowercase and between 4 and 63 alphanumeric characters."}`,
+			message:     "Invalid subdomain. Subdomains must be lowercase and between 4 and 63 alphanumeric characters.",
+			hint:        "lowercase",
+		},
+		{
+			name:        "plain text",
+			status:      http.StatusTooManyRequests,
+			contentType: "text/plain",
+			body:        "slow down\n",
+			message:     "slow down",
+			hint:        "rate limiting",
+		},
+		{
+			name:        "html error page",
+			status:      http.StatusBadGateway,
+			contentType: "text/html",
+			body:        "<html><body>Bad Gateway</body></html>",
+			message:     "",
+			hint:        "retry later",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			tunnel, err := NewTunnel(8080, &TunnelOptions{Host: server.URL})
+			if err != nil {
+				t.Fatalf("NewTunnel() failed: %v", err)
+			}
+
+			_, err = tunnel.requestTunnel(tunnel.ctx)
+			var serverErr *ServerError
+			if !errors.As(err, &serverErr) {
+				t.Fatalf("Expected *ServerError, got %v", err)
+			}
+			if serverErr.StatusCode != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, serverErr.StatusCode)
+			}
+			if serverErr.Message != tt.message {
+				t.Errorf("Expected message '%s', got '%s'", tt.message, serverErr.Message)
+			}
+			if !strings.Contains(serverErr.Hint, tt.hint) {
+				t.Errorf("Expected hint containing '%s', got '%s'", tt.hint, serverErr.Hint)
+			}
+		})
+	}
+}
+
+func TestServerErrorIs(t *testing.T) {
+	tests := []struct {
+		err         *ServerError
+		taken       bool
+		unavailable bool
+	}{
+		{&ServerError{StatusCode: http.StatusConflict}, true, false},
+		{&ServerError{StatusCode: http.StatusForbidden, Message: "Subdomain myapp is already in use"}, true, false},
+		{&ServerError{StatusCode: http.StatusForbidden, Message: "Invalid subdomain"}, false, false},
+		{&ServerError{StatusCode: http.StatusServiceUnavailable, Message: "Service Unavailable"}, false, true},
+		{&ServerError{StatusCode: http.StatusTooManyRequests}, false, true},
+	}
+	for _, tt := range tests {
+		if got := errors.Is(tt.err, ErrSubdomainTaken); got != tt.taken {
+			t.Errorf("%v: Is(ErrSubdomainTaken) = %v", tt.err, got)
+		}
+		if got := errors.Is(tt.err, ErrServerUnavailable); got != tt.unavailable {
+			t.Errorf("%v: Is(ErrServerUnavailable) = %v", tt.err, got)
+		}
+	}
+}
+
+func TestRequestTunnelUnreachable(t *testing.T) {
+	tunnel, err := NewTunnel(8080, &TunnelOptions{Host: fmt.Sprintf("http://127.0.0.1:%d", closedPort(t))})
+	if err != nil {
+		t.Fatalf("NewTunnel() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	if _, err := tunnel.requestTunnel(tunnel.ctx); !errors.Is(err, ErrServerUnavailable) {
+		t.Errorf("Expected ErrServerUnavailable, got %v", err)
+	}
+}
+
+func TestOpenAfterClose(t *testing.T) {
+	tunnel, err := NewTunnel(8080, &TunnelOptions{Host: "http://127.0.0.1:1"})
+	if err != nil {
+		t.Fatalf("NewTunnel() failed: %v", err)
+	}
+	tunnel.Close()
+
+	if err := tunnel.Open(); !errors.Is(err, ErrTunnelClosed) {
+		t.Errorf("Open: expected ErrTunnelClosed, got %v", err)
+	}
+	if _, err := tunnel.URL(); !errors.Is(err, ErrTunnelClosed) {
+		t.Errorf("URL: expected ErrTunnelClosed, got %v", err)
+	}
+}
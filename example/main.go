@@ -61,6 +61,10 @@ func main() {
 		select {
 		case req := <-events.Request:
 			fmt.Printf("📞 %s %s\n", req.Method, req.Path)
+		case res := <-events.Response:
+			if res.StatusCode >= 500 {
+				fmt.Printf("🔥 %d %s %s (%s)\n", res.StatusCode, res.Method, res.Path, res.Duration)
+			}
 		case err := <-events.Error:
 			fmt.Printf("❌ Error: %v\n", err)
 		case <-events.Close:
@@ -0,0 +1,89 @@
+package vrata
+
+import (
+	"expvar"
+	"sync"
+)
+
+// ExpvarName is the expvar variable under which live tunnel stats are
+// published, keyed by tunnel ID
+const ExpvarName = "vrata"
+
+var (
+	expvarOnce    sync.Once
+	expvarTunnels sync.Map // tunnel ID -> *Tunnel
+)
+
+// publishExpvar makes an open tunnel visible in /debug/vars
+func publishExpvar(t *Tunnel) {
+	expvarOnce.Do(func() {
+		expvar.Publish(ExpvarName, expvar.Func(expvarSnapshot))
+	})
+	expvarTunnels.Store(t.expvarKey(), t)
+}
+
+// unpublishExpvar removes a closed tunnel
+func unpublishExpvar(t *Tunnel) {
+	expvarTunnels.CompareAndDelete(t.expvarKey(), t)
+}
+
+func (t *Tunnel) expvarKey() string {
+	if t.info == nil {
+		return ""
+	}
+	if t.info.ID != "" {
+		return t.info.ID
+	}
+	return t.info.URL
+}
+
+// expvarSnapshot collects the stats of every open tunnel
+func expvarSnapshot() any {
+	snapshot := make(map[string]any)
+	expvarTunnels.Range(func(key, value any) bool {
+		snapshot[key.(string)] = value.(*Tunnel).expvarStats()
+		return true
+	})
+	return snapshot
+}
+
+// expvarStats describes a single tunnel for expvar
+func (t *Tunnel) expvarStats() map[string]any {
+	s := t.Stats()
+
+	stats := map[string]any{
+		"url":                t.info.URL,
+		"port":               t.options.Port,
+		"connections_active": s.ActiveConnections,
+		"connections_total":  s.TotalConnections,
+		"reconnects":         s.Reconnects,
+		"requests":           s.Requests,
+		"rejected":           s.Rejected,
+		"bytes_in":           s.BytesIn,
+		"bytes_out":          s.BytesOut,
+		"uptime_seconds":     s.Uptime.Seconds(),
+		"queue":              s.Queue,
+		"capture_bytes":      s.CaptureBytes,
+	}
+	if len(s.Routes) > 0 {
+		routes := make(map[string]any, len(s.Routes))
+		for route, h := range s.Routes {
+			routes[route] = map[string]any{
+				"count":   h.Count,
+				"mean_ms": h.Mean().Seconds() * 1000,
+				"p50_ms":  h.Quantile(0.5).Seconds() * 1000,
+				"p90_ms":  h.Quantile(0.9).Seconds() * 1000,
+				"p99_ms":  h.Quantile(0.99).Seconds() * 1000,
+			}
+		}
+		stats["routes"] = routes
+	}
+	if len(s.Labels) > 0 {
+		stats["labels"] = s.Labels
+	}
+	if s.LastError != nil {
+		stats["last_error"] = s.LastError.Error()
+		stats["last_error_at"] = s.LastErrorAt
+	}
+	return stats
+}
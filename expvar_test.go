@@ -0,0 +1,44 @@
+package vrata
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+)
+
+func TestExpvarPublishesOpenTunnels(t *testing.T) {
+	relay := newMockRelay(t, 2)
+
+	tunnel, err := ConnectAndOpen(8080, &TunnelOptions{Host: relay.server.URL})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+
+	readVars := func() map[string]map[string]any {
+		v := expvar.Get(ExpvarName)
+		if v == nil {
+			t.Fatal("expvar variable not published")
+		}
+		var vars map[string]map[string]any
+		if err := json.Unmarshal([]byte(v.String()), &vars); err != nil {
+			t.Fatalf("Invalid expvar JSON: %v", err)
+		}
+		return vars
+	}
+
+	stats, ok := readVars()["mock"]
+	if !ok {
+		t.Fatal("Open tunnel missing from expvar")
+	}
+	for _, key := range []string{"url", "connections_total", "reconnects", "requests", "bytes_in", "queue"} {
+		if _, ok := stats[key]; !ok {
+			t.Errorf("Expected expvar key %q in %v", key, stats)
+		}
+	}
+
+	tunnel.Close()
+
+	if _, ok := readVars()["mock"]; ok {
+		t.Error("Closed tunnel should be removed from expvar")
+	}
+}
@@ -0,0 +1,120 @@
+package vrata
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// connectionAttemptDelay is how long a relay dial waits on one address
+// before racing the next (RFC 8305, section 5)
+var connectionAttemptDelay = 250 * time.Millisecond
+
+// lookupIPAddr resolves relay host names; tests replace it
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+// dialRacing connects to address the Happy Eyeballs way (RFC 8305): when
+// the host resolves to several addresses, a new attempt starts every
+// connectionAttemptDelay, or as soon as the previous one fails, and the
+// first connection wins. A dead address then costs a fraction of a second
+// instead of a full dial timeout.
+func dialRacing(ctx context.Context, dial DialFunc, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return dial(ctx, "tcp", address)
+	}
+	ips, err := lookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]string, 0, len(ips))
+	for _, ip := range interleaveFamilies(ips) {
+		addresses = append(addresses, net.JoinHostPort(ip.String(), port))
+	}
+	if len(addresses) == 1 {
+		return dial(ctx, "tcp", addresses[0])
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type attempt struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan attempt, len(addresses))
+	next, pending := 0, 0
+	start := func() {
+		address := addresses[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, "tcp", address)
+			results <- attempt{conn, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(connectionAttemptDelay)
+	defer timer.Stop()
+
+	var firstErr error
+	for pending > 0 {
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				// Losers that connect anyway are closed
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return result.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			if next < len(addresses) {
+				start()
+				timer.Reset(connectionAttemptDelay)
+			}
+		case <-timer.C:
+			if next < len(addresses) {
+				start()
+				timer.Reset(connectionAttemptDelay)
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+// interleaveFamilies alternates IPv6 and IPv4 addresses, starting with
+// the family the resolver listed first, and otherwise keeps its order
+func interleaveFamilies(ips []net.IPAddr) []net.IPAddr {
+	var v4, v6 []net.IPAddr
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	first, second := v6, v4
+	if len(ips) > 0 && ips[0].IP.To4() != nil {
+		first, second = v4, v6
+	}
+
+	interleaved := make([]net.IPAddr, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			interleaved = append(interleaved, first[i])
+		}
+		if i < len(second) {
+			interleaved = append(interleaved, second[i])
+		}
+	}
+	return interleaved
+}
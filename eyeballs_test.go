@@ -0,0 +1,124 @@
+package vrata
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInterleaveFamilies(t *testing.T) {
+	ips := func(addresses ...string) []net.IPAddr {
+		var parsed []net.IPAddr
+		for _, address := range addresses {
+			parsed = append(parsed, net.IPAddr{IP: net.ParseIP(address)})
+		}
+		return parsed
+	}
+	tests := []struct {
+		name string
+		in   []net.IPAddr
+		want []net.IPAddr
+	}{
+		{"IPv6 first", ips("2001:db8::1", "2001:db8::2", "192.0.2.1"), ips("2001:db8::1", "192.0.2.1", "2001:db8::2")},
+		{"IPv4 first", ips("192.0.2.1", "192.0.2.2", "2001:db8::1"), ips("192.0.2.1", "2001:db8::1", "192.0.2.2")},
+		{"one family", ips("192.0.2.1", "192.0.2.2"), ips("192.0.2.1", "192.0.2.2")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := interleaveFamilies(tt.in)
+			if !slices.EqualFunc(got, tt.want, func(a, b net.IPAddr) bool { return a.IP.Equal(b.IP) }) {
+				t.Errorf("Got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeResolver makes every host resolve to ips for the test
+func fakeResolver(t *testing.T, ips ...string) {
+	t.Helper()
+	saved := lookupIPAddr
+	lookupIPAddr = func(context.Context, string) ([]net.IPAddr, error) {
+		var resolved []net.IPAddr
+		for _, ip := range ips {
+			resolved = append(resolved, net.IPAddr{IP: net.ParseIP(ip)})
+		}
+		return resolved, nil
+	}
+	t.Cleanup(func() { lookupIPAddr = saved })
+}
+
+func TestDialRacingSkipsDeadAddress(t *testing.T) {
+	fakeResolver(t, "2001:db8::dead", "192.0.2.1")
+
+	var mutex sync.Mutex
+	var abandoned bool
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == "[2001:db8::dead]:443" {
+			// Blackholed: hangs until the race is over
+			<-ctx.Done()
+			mutex.Lock()
+			abandoned = true
+			mutex.Unlock()
+			return nil, ctx.Err()
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+
+	started := time.Now()
+	conn, err := dialRacing(context.Background(), dial, "relay.example:443")
+	if err != nil {
+		t.Fatalf("dialRacing() failed: %v", err)
+	}
+	conn.Close()
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("Took %s to get past the dead address", elapsed)
+	}
+
+	// The hanging attempt is called off once another one wins
+	deadline := time.Now().Add(time.Second)
+	for {
+		mutex.Lock()
+		done := abandoned
+		mutex.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The losing attempt was never cancelled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDialRacingAllFail(t *testing.T) {
+	fakeResolver(t, "192.0.2.1", "192.0.2.2", "2001:db8::1")
+
+	refused := errors.New("refused")
+	var mutex sync.Mutex
+	var tried []string
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		mutex.Lock()
+		tried = append(tried, address)
+		mutex.Unlock()
+		return nil, refused
+	}
+
+	started := time.Now()
+	_, err := dialRacing(context.Background(), dial, "relay.example:443")
+	if !errors.Is(err, refused) {
+		t.Errorf("Expected the first failure, got %v", err)
+	}
+	// Failures start the next attempt without waiting out the delay
+	if elapsed := time.Since(started); elapsed > connectionAttemptDelay {
+		t.Errorf("Took %s to try every address", elapsed)
+	}
+	if want := []string{"192.0.2.1:443", "[2001:db8::1]:443", "192.0.2.2:443"}; !slices.Equal(tried, want) {
+		t.Errorf("Tried %v, want %v", tried, want)
+	}
+}
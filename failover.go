@@ -0,0 +1,102 @@
+package vrata
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// FailoverInfo describes traffic moving between a local address and
+// LocalFallback
+type FailoverInfo struct {
+	// Active is true when visitors of Primary are sent to Fallback, false
+	// when Primary answers again
+	Active   bool
+	Primary  string
+	Fallback string
+	// Error is why Primary couldn't be reached; empty when it is back
+	Error string
+}
+
+// failoverState remembers which primaries are failed over, so events
+// fire on changes rather than on every visitor connection
+type failoverState struct {
+	active map[string]bool
+	mutex  sync.Mutex
+}
+
+// change records whether primary is failed over and reports if that is
+// news
+func (f *failoverState) change(primary string, active bool) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.active[primary] == active {
+		return false
+	}
+	if f.active == nil {
+		f.active = make(map[string]bool)
+	}
+	f.active[primary] = active
+	return true
+}
+
+// dialWithFallback connects to primary, or to LocalFallback when primary
+// can't be reached. It returns the address it connected to.
+func (tc *TunnelCluster) dialWithFallback(ctx context.Context, primary string) (net.Conn, string, error) {
+	local, err := tc.dialAddress(ctx, primary)
+	fallback := tc.options.LocalFallback
+	if fallback == "" || fallback == primary {
+		local, err = tc.throughRestart(ctx, primary, local, err)
+		return local, primary, err
+	}
+	if err == nil {
+		if tc.failover.change(primary, false) {
+			tc.failoverChanged(FailoverInfo{Primary: primary, Fallback: fallback})
+		}
+		return local, primary, nil
+	}
+
+	local, fallbackErr := tc.dialAddress(ctx, fallback)
+	if fallbackErr != nil {
+		// Report the primary, the fallback only stands in for it
+		return nil, primary, err
+	}
+	if tc.failover.change(primary, true) {
+		tc.failoverChanged(FailoverInfo{Active: true, Primary: primary, Fallback: fallback, Error: err.Error()})
+	}
+	return local, fallback, nil
+}
+
+// dialAddress connects to a local address within Timeouts.LocalDial, over
+// HTTP/2 when it can
+func (tc *TunnelCluster) dialAddress(ctx context.Context, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, tc.options.Timeouts.localDial())
+	defer cancel()
+	local, err := tc.options.dialLocal(ctx, address, tc.options.localProtocols()...)
+	if err != nil {
+		return nil, err
+	}
+	return tc.overHTTP2(ctx, local, address), nil
+}
+
+// failoverChanged logs and publishes a failover or recovery
+func (tc *TunnelCluster) failoverChanged(info FailoverInfo) {
+	if info.Active {
+		tc.log().Warn("local server is down, failing over", "primary", info.Primary, "fallback", info.Fallback, "error", info.Error)
+	} else {
+		tc.log().Info("local server is back, failing back", "primary", info.Primary)
+	}
+
+	tc.stream.publish("failover", map[string]any{
+		"active":   info.Active,
+		"primary":  info.Primary,
+		"fallback": info.Fallback,
+		"error":    info.Error,
+	})
+
+	select {
+	case tc.events.Failover <- info:
+	default:
+	}
+}
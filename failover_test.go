@@ -0,0 +1,117 @@
+package vrata
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewTunnelRejectsBadFallback(t *testing.T) {
+	_, err := NewTunnel(8080, &TunnelOptions{LocalFallback: "localhost"})
+	if !errors.Is(err, ErrBadLocalTarget) {
+		t.Errorf("Expected ErrBadLocalTarget, got %v", err)
+	}
+}
+
+func TestTunnelFailover(t *testing.T) {
+	relay := newMockRelay(t, 2)
+
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "fallback "+r.Host)
+	}))
+	defer fallback.Close()
+	fallbackAddress := fallback.Listener.Addr().String()
+
+	port := closedPort(t)
+	tunnel, err := ConnectAndOpen(port, &TunnelOptions{
+		Host:          relay.server.URL,
+		LocalHost:     "127.0.0.1",
+		LocalFallback: fallbackAddress,
+	})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	for i := range 2 {
+		var conn net.Conn
+		select {
+		case conn = <-relay.conns:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Tunnel client never connected to the relay")
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: public.example\r\nConnection: close\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("Request %d: failed to read response: %v", i, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		conn.Close()
+
+		if want := "fallback " + fallbackAddress; string(body) != want {
+			t.Errorf("Request %d: got %q, want %q", i, body, want)
+		}
+	}
+
+	select {
+	case info := <-tunnel.Events().Failover:
+		want := fmt.Sprintf("127.0.0.1:%d", port)
+		if !info.Active || info.Primary != want || info.Fallback != fallbackAddress || info.Error == "" {
+			t.Errorf("Unexpected failover event %+v", info)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No failover event")
+	}
+	select {
+	case info := <-tunnel.Events().Failover:
+		t.Errorf("Expected one event while failed over, got another %+v", info)
+	default:
+	}
+}
+
+func TestDialWithFallbackFailsBack(t *testing.T) {
+	var addresses []string
+	for range 2 {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		defer listener.Close()
+		addresses = append(addresses, listener.Addr().String())
+	}
+	primary, fallback := addresses[0], addresses[1]
+
+	tc := &TunnelCluster{
+		options: &TunnelOptions{LocalFallback: fallback},
+		events:  &TunnelEvents{Failover: make(chan FailoverInfo, 10)},
+	}
+	// primary was down, and listens again
+	tc.failover.change(primary, true)
+
+	for range 2 {
+		local, address, err := tc.dialWithFallback(context.Background(), primary)
+		if err != nil {
+			t.Fatalf("dialWithFallback() failed: %v", err)
+		}
+		local.Close()
+		if address != primary {
+			t.Errorf("Expected the primary, got %s", address)
+		}
+	}
+
+	if n := len(tc.events.Failover); n != 1 {
+		t.Fatalf("Expected one event, got %d", n)
+	}
+	if info := <-tc.events.Failover; info.Active || info.Primary != primary {
+		t.Errorf("Unexpected fail back event %+v", info)
+	}
+}
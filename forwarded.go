@@ -0,0 +1,109 @@
+package vrata
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+)
+
+// ForwardedMode selects what happens to the forwarding headers visitors'
+// requests arrive with: X-Forwarded-For, X-Forwarded-Proto,
+// X-Forwarded-Host and Forwarded
+type ForwardedMode int
+
+const (
+	// ForwardedTrust keeps the headers as the relay sent them and adds
+	// X-Forwarded-Proto and X-Forwarded-Host with the tunnel's scheme and
+	// host when they are missing (default)
+	ForwardedTrust ForwardedMode = iota
+	// ForwardedReplace sets X-Forwarded-For to the client address the
+	// relay appended, which visitors can't forge, and X-Forwarded-Proto
+	// and X-Forwarded-Host to the tunnel's scheme and host. Forwarded is
+	// removed.
+	ForwardedReplace
+	// ForwardedStrip removes the headers, so the local server sees none
+	ForwardedStrip
+)
+
+// forwardedHeaders are the headers ForwardedMode applies to
+var forwardedHeaders = []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"}
+
+// forwarding applies ForwardedHeaders to the requests of a tunnel
+type forwarding struct {
+	mode  ForwardedMode
+	proto string // scheme of the tunnel URL
+	host  string // host of the tunnel URL
+}
+
+// forwarding returns the forwarding header handling of the tunnel at
+// publicURL
+func (o *TunnelOptions) forwarding(publicURL string) forwarding {
+	f := forwarding{mode: o.ForwardedHeaders}
+	if u, err := url.Parse(publicURL); err == nil {
+		f.proto, f.host = u.Scheme, u.Host
+	}
+	return f
+}
+
+// apply rewrites the forwarding headers of a parsed request. Headers the
+// options set or strip are handled after it, and win.
+func (f forwarding) apply(header http.Header) {
+	switch f.mode {
+	case ForwardedReplace:
+		client := relayClientIP(header)
+		for _, name := range forwardedHeaders {
+			header.Del(name)
+		}
+		if client != "" {
+			header.Set("X-Forwarded-For", client)
+		}
+		f.fill(header)
+	case ForwardedStrip:
+		for _, name := range forwardedHeaders {
+			header.Del(name)
+		}
+	default:
+		f.fill(header)
+	}
+}
+
+// fill sets X-Forwarded-Proto and X-Forwarded-Host where they are missing
+func (f forwarding) fill(header http.Header) {
+	if f.proto != "" && header.Get("X-Forwarded-Proto") == "" {
+		header.Set("X-Forwarded-Proto", f.proto)
+	}
+	if f.host != "" && header.Get("X-Forwarded-Host") == "" {
+		header.Set("X-Forwarded-Host", f.host)
+	}
+}
+
+// prepare sets up h to apply the forwarding headers to the request heads
+// it rewrites. Headers h already replaces or strips are left to it.
+func (f forwarding) prepare(h *HeaderHostTransformer) {
+	var proto, host []byte
+	if f.proto != "" && !h.drops([]byte("X-Forwarded-Proto")) {
+		proto = []byte("X-Forwarded-Proto: " + f.proto + "\r\n")
+	}
+	if f.host != "" && !h.drops([]byte("X-Forwarded-Host")) {
+		host = []byte("X-Forwarded-Host: " + f.host + "\r\n")
+	}
+
+	switch f.mode {
+	case ForwardedReplace:
+		h.forwardFor = !h.drops([]byte("X-Forwarded-For"))
+		h.lines = bytes.Join([][]byte{h.lines, proto, host}, nil)
+		h.drop = append(h.drop, forwardedHeaders...)
+	case ForwardedStrip:
+		h.drop = append(h.drop, forwardedHeaders...)
+	default:
+		h.protoLine, h.hostLine = proto, host
+	}
+}
+
+// lastEntry returns the last entry of a comma-separated header value
+func lastEntry(value []byte) []byte {
+	if i := bytes.LastIndexByte(value, ','); i >= 0 {
+		value = value[i+1:]
+	}
+	return bytes.TrimSpace(value)
+}
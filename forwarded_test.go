@@ -0,0 +1,161 @@
+package vrata
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// forwardedHead arrives with a forged client first and the one the relay
+// appended last
+const forwardedHead = "GET / HTTP/1.1\r\n" +
+	"Host: abc123.loca.lt\r\n" +
+	"X-Forwarded-For: 10.0.0.1\r\n" +
+	"X-Forwarded-For: 203.0.113.9, 192.0.2.1\r\n" +
+	"Forwarded: for=10.0.0.1\r\n" +
+	"\r\n"
+
+func TestForwardedHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    ForwardedMode
+		options TunnelOptions
+		head    string
+		want    http.Header
+	}{
+		{"trust", ForwardedTrust, TunnelOptions{}, forwardedHead, http.Header{
+			"X-Forwarded-For":   {"10.0.0.1", "203.0.113.9, 192.0.2.1"},
+			"X-Forwarded-Proto": {"https"},
+			"X-Forwarded-Host":  {"abc123.loca.lt"},
+			"Forwarded":         {"for=10.0.0.1"},
+		}},
+		{"trust keeps values", ForwardedTrust, TunnelOptions{},
+			"GET / HTTP/1.1\r\nX-Forwarded-Proto: http\r\nX-Forwarded-Host: other.example\r\n\r\n", http.Header{
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Host":  {"other.example"},
+			}},
+		{"replace", ForwardedReplace, TunnelOptions{}, forwardedHead, http.Header{
+			"X-Forwarded-For":   {"192.0.2.1"},
+			"X-Forwarded-Proto": {"https"},
+			"X-Forwarded-Host":  {"abc123.loca.lt"},
+		}},
+		{"replace without client", ForwardedReplace, TunnelOptions{},
+			"GET / HTTP/1.1\r\nX-Forwarded-Proto: http\r\n\r\n", http.Header{
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"abc123.loca.lt"},
+			}},
+		{"strip", ForwardedStrip, TunnelOptions{}, forwardedHead, http.Header{}},
+		{"options win", ForwardedReplace, TunnelOptions{
+			RequestHeaders: http.Header{"X-Forwarded-Proto": {"wss"}},
+			StripHeaders:   []string{"X-Forwarded-Host"},
+		}, forwardedHead, http.Header{
+			"X-Forwarded-For":   {"192.0.2.1"},
+			"X-Forwarded-Proto": {"wss"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := tt.options
+			options.ForwardedHeaders = tt.mode
+			forwarding := options.forwarding("https://abc123.loca.lt")
+
+			// Raw heads are rewritten as they come
+			transformer := options.headerTransformer("localhost:8080")
+			forwarding.prepare(transformer)
+			var out bytes.Buffer
+			if err := transformer.rewriteHead([]byte(tt.head), &out); err != nil {
+				t.Fatalf("rewriteHead() failed: %v", err)
+			}
+			req, err := http.ReadRequest(bufio.NewReader(&out))
+			if err != nil {
+				t.Fatalf("Rewritten head %q doesn't parse: %v", out.String(), err)
+			}
+			if got := forwardingHeaders(req.Header); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Raw: headers = %v, want %v", got, tt.want)
+			}
+
+			// Parsed requests, with interceptors or in structured mode,
+			// end up the same
+			req, _ = http.ReadRequest(bufio.NewReader(strings.NewReader(tt.head)))
+			forwarding.apply(req.Header)
+			options.rewriteLocalRequest(req, "localhost:8080")
+			if got := forwardingHeaders(req.Header); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parsed: headers = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteHeadForwardedAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("Buffers aren't recycled reliably under the race detector")
+	}
+	options := benchmarkOptions
+	options.ForwardedHeaders = ForwardedReplace
+	transformer := options.headerTransformer("localhost:8080")
+	options.forwarding("https://abc123.loca.lt").prepare(transformer)
+
+	head := []byte(benchmarkHead)
+	allocs := testing.AllocsPerRun(100, func() {
+		transformer.rewriteHead(head, io.Discard)
+	})
+	if allocs != 0 {
+		t.Errorf("rewriteHead() allocated %v times per head, want 0", allocs)
+	}
+}
+
+func TestTunnelForwardedHeaders(t *testing.T) {
+	for name, mode := range map[string]ProxyMode{"raw": ProxyRaw, "structured": ProxyStructured} {
+		t.Run(name, func(t *testing.T) {
+			relay := newMockRelay(t, 1)
+			received := make(chan http.Header, 1)
+			local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received <- r.Header
+			}))
+			defer local.Close()
+
+			tunnel, err := ConnectAndOpen(local.Listener.Addr().(*net.TCPAddr).Port, &TunnelOptions{
+				Host:             relay.server.URL,
+				LocalHost:        "127.0.0.1",
+				ProxyMode:        mode,
+				ForwardedHeaders: ForwardedReplace,
+			})
+			if err != nil {
+				t.Fatalf("ConnectAndOpen() failed: %v", err)
+			}
+			defer tunnel.Close()
+
+			resp := relay.roundTrip(t, "GET / HTTP/1.1\r\nHost: public.example\r\n"+
+				"X-Forwarded-For: 203.0.113.9, 192.0.2.1\r\nConnection: close\r\n\r\n")
+			resp.Body.Close()
+
+			// The mock relay's URL is http://127.0.0.1
+			want := http.Header{
+				"X-Forwarded-For":   {"192.0.2.1"},
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Host":  {"127.0.0.1"},
+			}
+			if got := forwardingHeaders(<-received); !reflect.DeepEqual(got, want) {
+				t.Errorf("Local server got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// forwardingHeaders returns the forwarding headers in header
+func forwardingHeaders(header http.Header) http.Header {
+	got := http.Header{}
+	for _, name := range forwardedHeaders {
+		if values := header.Values(name); len(values) > 0 {
+			got[name] = values
+		}
+	}
+	return got
+}
@@ -0,0 +1,332 @@
+package vrata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+)
+
+// GeoIPDB looks up client countries in a MaxMind DB file, such as the free
+// GeoLite2-Country database
+type GeoIPDB struct {
+	tree       []byte // search tree
+	section    []byte // data section
+	nodeCount  uint
+	recordSize uint
+	ipv4Start  uint // node where IPv4 lookups start in an IPv6 tree
+}
+
+// ErrInvalidGeoIP is returned for files that aren't MaxMind databases
+var ErrInvalidGeoIP = errors.New("invalid MaxMind database")
+
+// metadataMarker precedes the metadata at the end of a MaxMind database
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// OpenGeoIP loads a MaxMind database file
+func OpenGeoIP(path string) (*GeoIPDB, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewGeoIP(data)
+}
+
+// NewGeoIP parses a MaxMind database held in memory
+func NewGeoIP(data []byte) (*GeoIPDB, error) {
+	start := bytes.LastIndex(data, metadataMarker)
+	if start < 0 {
+		return nil, ErrInvalidGeoIP
+	}
+	metadata := data[start+len(metadataMarker):]
+
+	value, _, err := decodeMMDB(metadata, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: metadata: %v", ErrInvalidGeoIP, err)
+	}
+	fields, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", ErrInvalidGeoIP)
+	}
+	nodeCount, _ := fields["node_count"].(uint64)
+	recordSize, _ := fields["record_size"].(uint64)
+	ipVersion, _ := fields["ip_version"].(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("%w: unsupported record size %d", ErrInvalidGeoIP, recordSize)
+	}
+
+	treeSize := nodeCount * recordSize / 4
+	if treeSize+16 > uint64(start) {
+		return nil, fmt.Errorf("%w: search tree exceeds the file", ErrInvalidGeoIP)
+	}
+
+	db := &GeoIPDB{
+		tree:       data[:treeSize],
+		section:    data[treeSize+16 : start],
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+	}
+
+	// IPv4 addresses live under ::/96 in IPv6 databases
+	if ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < db.nodeCount; i++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a tree node
+func (db *GeoIPDB) record(node uint, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		b := db.tree[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := db.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(db.tree[node*8+bit*4:]))
+	}
+}
+
+// Lookup returns the record for ip, or nil when the database has none
+func (db *GeoIPDB) Lookup(ip netip.Addr) (any, error) {
+	ip = ip.Unmap()
+	bits := ip.AsSlice()
+
+	node := uint(0)
+	if ip.Is4() {
+		node = db.ipv4Start
+	}
+
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		bit := uint(bits[i/8]>>(7-i%8)) & 1
+		node = db.record(node, bit)
+	}
+
+	switch {
+	case node == db.nodeCount:
+		return nil, nil
+	case node < db.nodeCount:
+		return nil, fmt.Errorf("%w: search tree too deep", ErrInvalidGeoIP)
+	}
+
+	offset := node - db.nodeCount - 16
+	if offset >= uint(len(db.section)) {
+		return nil, fmt.Errorf("%w: record outside the data section", ErrInvalidGeoIP)
+	}
+	value, _, err := decodeMMDB(db.section, offset)
+	return value, err
+}
+
+// Country returns the ISO 3166 country code for ip, or "" if unknown
+func (db *GeoIPDB) Country(ip netip.Addr) (string, error) {
+	record, err := db.Lookup(ip)
+	if err != nil {
+		return "", err
+	}
+
+	fields, _ := record.(map[string]any)
+	for _, key := range []string{"country", "registered_country"} {
+		country, _ := fields[key].(map[string]any)
+		if code, _ := country["iso_code"].(string); code != "" {
+			return code, nil
+		}
+	}
+	return "", nil
+}
+
+// MaxMind DB data types
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// errMMDBTruncated is returned when a value runs past the end of its section
+var errMMDBTruncated = errors.New("truncated value")
+
+// decodeMMDB decodes the value at offset in a data section and returns it
+// with the offset that follows it. Maps decode to map[string]any, arrays
+// to []any and unsigned integers to uint64; 128-bit integers stay bytes.
+func decodeMMDB(section []byte, offset uint) (any, uint, error) {
+	return decodeMMDBDepth(section, offset, 0)
+}
+
+func decodeMMDBDepth(section []byte, offset uint, depth int) (any, uint, error) {
+	if depth > 32 {
+		return nil, 0, errors.New("data nested too deep")
+	}
+	if offset >= uint(len(section)) {
+		return nil, 0, errMMDBTruncated
+	}
+
+	control := section[offset]
+	offset++
+	kind := uint(control >> 5)
+
+	if kind == mmdbPointer {
+		size := uint(control>>3) & 3
+		if offset+size+1 > uint(len(section)) {
+			return nil, 0, errMMDBTruncated
+		}
+		b := section[offset : offset+size+1]
+		var target uint
+		switch size {
+		case 0:
+			target = uint(control&7)<<8 | uint(b[0])
+		case 1:
+			target = (uint(control&7)<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 2:
+			target = (uint(control&7)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		default:
+			target = uint(binary.BigEndian.Uint32(b))
+		}
+		value, _, err := decodeMMDBDepth(section, target, depth+1)
+		return value, offset + size + 1, err
+	}
+
+	if kind == mmdbExtended {
+		if offset >= uint(len(section)) {
+			return nil, 0, errMMDBTruncated
+		}
+		kind = 7 + uint(section[offset])
+		offset++
+	}
+
+	size := uint(control & 0x1f)
+	if size >= 29 {
+		extra := size - 28
+		if offset+extra > uint(len(section)) {
+			return nil, 0, errMMDBTruncated
+		}
+		n := uint(0)
+		for _, b := range section[offset : offset+extra] {
+			n = n<<8 | uint(b)
+		}
+		size = [...]uint{29, 285, 65821}[extra-1] + n
+		offset += extra
+	}
+
+	switch kind {
+	case mmdbMap:
+		fields := make(map[string]any, min(size, 1024))
+		for range size {
+			key, next, err := decodeMMDBDepth(section, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			value, next, err := decodeMMDBDepth(section, next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			fields[name] = value
+			offset = next
+		}
+		return fields, offset, nil
+	case mmdbArray:
+		items := make([]any, 0, min(size, 1024))
+		for range size {
+			value, next, err := decodeMMDBDepth(section, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			items = append(items, value)
+			offset = next
+		}
+		return items, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbContainer, mmdbEndMarker:
+		return nil, offset, nil
+	}
+
+	if offset+size > uint(len(section)) {
+		return nil, 0, errMMDBTruncated
+	}
+	b := section[offset : offset+size]
+	offset += size
+
+	switch kind {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbBytes, mmdbUint128:
+		return slices.Clone(b), offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errors.New("bad double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errors.New("bad float size")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbInt32:
+		if size > 8 {
+			return nil, 0, errors.New("integer too large")
+		}
+		n := uint64(0)
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		if kind == mmdbInt32 {
+			return int64(int32(n)), offset, nil
+		}
+		return n, offset, nil
+	}
+	return nil, 0, fmt.Errorf("unknown data type %d", kind)
+}
+
+// countryRules admits clients by the country of their address. Clients
+// whose country is unknown only pass when there is no allow list.
+func countryRules(db *GeoIPDB, allow, deny []string) accessCheck {
+	return func(req *http.Request) *rejection {
+		forbidden := &rejection{status: http.StatusForbidden}
+
+		country := ""
+		if addr, err := netip.ParseAddr(relayClientIP(req.Header)); err == nil {
+			country, _ = db.Country(addr)
+		}
+
+		matches := func(list []string) bool {
+			return slices.ContainsFunc(list, func(code string) bool { return strings.EqualFold(code, country) })
+		}
+		if country != "" && matches(deny) {
+			return forbidden
+		}
+		if len(allow) > 0 && (country == "" || !matches(allow)) {
+			return forbidden
+		}
+		return nil
+	}
+}
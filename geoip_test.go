@@ -0,0 +1,207 @@
+package vrata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+// buildMMDB writes a MaxMind database mapping prefixes to country codes.
+// Every record after the first refers to the "country" key by pointer, as
+// real databases do to share strings.
+func buildMMDB(t *testing.T, ipVersion int, recordSize int, countries map[string]string) []byte {
+	t.Helper()
+
+	// Trie records: >= 0 is a node, -1 is empty, -2-k is data record k
+	nodes := [][2]int{{-1, -1}}
+	var section []byte
+	var records []int
+	countryKey := -1
+
+	for prefixText, code := range countries {
+		prefix := netip.MustParsePrefix(prefixText)
+		addr, bitsLen := prefix.Addr(), prefix.Bits()
+		if ipVersion == 6 && addr.Is4() {
+			addr = netip.AddrFrom16(addr.As16())
+			b := addr.As16()
+			clear(b[10:12])
+			addr = netip.AddrFrom16(b)
+			bitsLen += 96
+		}
+
+		records = append(records, len(section))
+		section = append(section, 7<<5|1)
+		if countryKey < 0 {
+			countryKey = len(section)
+			section = append(section, mmdbTestString("country")...)
+		} else {
+			section = append(section, 1<<5|byte(countryKey>>8&7), byte(countryKey))
+		}
+		section = append(section, 7<<5|1)
+		section = append(section, mmdbTestString("iso_code")...)
+		section = append(section, mmdbTestString(code)...)
+
+		bits := addr.AsSlice()
+		node := 0
+		for i := 0; i < bitsLen; i++ {
+			bit := int(bits[i/8]>>(7-i%8)) & 1
+			if i == bitsLen-1 {
+				nodes[node][bit] = -2 - (len(records) - 1)
+				break
+			}
+			if nodes[node][bit] < 0 {
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	var db []byte
+	value := func(r int) uint32 {
+		switch {
+		case r >= 0:
+			return uint32(r)
+		case r == -1:
+			return uint32(len(nodes))
+		default:
+			return uint32(len(nodes) + 16 + records[-2-r])
+		}
+	}
+	for _, node := range nodes {
+		left, right := value(node[0]), value(node[1])
+		switch recordSize {
+		case 24:
+			db = append(db, byte(left>>16), byte(left>>8), byte(left), byte(right>>16), byte(right>>8), byte(right))
+		case 28:
+			db = append(db, byte(left>>16), byte(left>>8), byte(left), byte(left>>20&0xf0|right>>24&0x0f),
+				byte(right>>16), byte(right>>8), byte(right))
+		case 32:
+			db = binary.BigEndian.AppendUint32(db, left)
+			db = binary.BigEndian.AppendUint32(db, right)
+		}
+	}
+	db = append(db, make([]byte, 16)...)
+	db = append(db, section...)
+
+	db = append(db, metadataMarker...)
+	db = append(db, 7<<5|4)
+	db = append(db, mmdbTestString("node_count")...)
+	db = append(db, 6<<5|4)
+	db = binary.BigEndian.AppendUint32(db, uint32(len(nodes)))
+	db = append(db, mmdbTestString("record_size")...)
+	db = append(db, 5<<5|1, byte(recordSize))
+	db = append(db, mmdbTestString("ip_version")...)
+	db = append(db, 5<<5|1, byte(ipVersion))
+	// An extended type (uint64) the reader must skip over
+	db = append(db, mmdbTestString("build_epoch")...)
+	db = append(db, 0<<5|8, mmdbUint64-7)
+	db = binary.BigEndian.AppendUint64(db, 1700000000)
+	return db
+}
+
+func mmdbTestString(s string) []byte {
+	return append([]byte{byte(2<<5 | len(s))}, s...)
+}
+
+func TestGeoIPCountry(t *testing.T) {
+	countries := map[string]string{
+		"203.0.113.0/24":  "US",
+		"198.51.100.0/25": "DE",
+	}
+	v6 := map[string]string{
+		"203.0.113.0/24": "US",
+		"2001:db8::/32":  "FR",
+	}
+
+	for _, recordSize := range []int{24, 28, 32} {
+		db, err := NewGeoIP(buildMMDB(t, 4, recordSize, countries))
+		if err != nil {
+			t.Fatalf("NewGeoIP(record size %d) failed: %v", recordSize, err)
+		}
+		for ip, want := range map[string]string{
+			"203.0.113.7":        "US",
+			"198.51.100.1":       "DE",
+			"198.51.100.200":     "",
+			"192.0.2.1":          "",
+			"::ffff:203.0.113.9": "US",
+		} {
+			if got, err := db.Country(netip.MustParseAddr(ip)); err != nil || got != want {
+				t.Errorf("Record size %d: Country(%s) = %q, %v; expected %q", recordSize, ip, got, err, want)
+			}
+		}
+	}
+
+	db, err := NewGeoIP(buildMMDB(t, 6, 28, v6))
+	if err != nil {
+		t.Fatalf("NewGeoIP(IPv6) failed: %v", err)
+	}
+	for ip, want := range map[string]string{"203.0.113.7": "US", "2001:db8::1": "FR", "2001:db9::1": ""} {
+		if got, err := db.Country(netip.MustParseAddr(ip)); err != nil || got != want {
+			t.Errorf("IPv6 database: Country(%s) = %q, %v; expected %q", ip, got, err, want)
+		}
+	}
+}
+
+func TestNewGeoIPRejectsGarbage(t *testing.T) {
+	if _, err := NewGeoIP([]byte("not a database")); !errors.Is(err, ErrInvalidGeoIP) {
+		t.Errorf("Expected ErrInvalidGeoIP, got %v", err)
+	}
+
+	// A tree larger than the file
+	db := buildMMDB(t, 4, 24, map[string]string{"10.0.0.0/8": "US"})
+	truncated := append(bytes.Clone(db[:3]), db[bytes.LastIndex(db, metadataMarker):]...)
+	if _, err := NewGeoIP(truncated); !errors.Is(err, ErrInvalidGeoIP) {
+		t.Errorf("Expected ErrInvalidGeoIP for a truncated file, got %v", err)
+	}
+}
+
+func TestNewTunnelRequiresGeoIP(t *testing.T) {
+	_, err := NewTunnel(8080, &TunnelOptions{AllowCountries: []string{"US"}})
+	if !errors.Is(err, ErrNoGeoIP) {
+		t.Errorf("Expected ErrNoGeoIP, got %v", err)
+	}
+}
+
+func TestCountryRules(t *testing.T) {
+	db, err := NewGeoIP(buildMMDB(t, 4, 24, map[string]string{
+		"203.0.113.0/24":  "US",
+		"198.51.100.0/24": "CN",
+	}))
+	if err != nil {
+		t.Fatalf("NewGeoIP() failed: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		allow   []string
+		deny    []string
+		client  string
+		allowed bool
+	}{
+		{name: "allowed country", allow: []string{"us", "DE"}, client: "203.0.113.7", allowed: true},
+		{name: "other country", allow: []string{"US"}, client: "198.51.100.7"},
+		{name: "unknown country with allow list", allow: []string{"US"}, client: "192.0.2.1"},
+		{name: "denied country", deny: []string{"CN"}, client: "198.51.100.7"},
+		{name: "unknown country with deny list", deny: []string{"CN"}, client: "192.0.2.1", allowed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-Forwarded-For", tt.client)
+
+			denied := countryRules(db, tt.allow, tt.deny)(req)
+			if tt.allowed && denied != nil {
+				t.Errorf("Expected %s to be allowed, got %d", tt.client, denied.status)
+			}
+			if !tt.allowed && (denied == nil || denied.status != http.StatusForbidden) {
+				t.Errorf("Expected %s to get 403, got %+v", tt.client, denied)
+			}
+		})
+	}
+}
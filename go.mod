@@ -1,3 +1,5 @@
 module github.com/korya/vrata
 
 go 1.24.3
+
+require go.uber.org/goleak v1.3.0
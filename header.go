@@ -0,0 +1,225 @@
+package vrata
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// errHeadTooLarge is returned for a request head longer than
+// http.DefaultMaxHeaderBytes
+var errHeadTooLarge = errors.New("request head too large")
+
+// HeaderHostTransformer modifies HTTP headers to use localhost
+type HeaderHostTransformer struct {
+	host  string
+	lines []byte   // header lines set on every request, Host aside
+	drop  []string // names of incoming headers replaced or stripped
+
+	// Forwarding headers, see ForwardedMode: lines added when the request
+	// has none of its own, and whether X-Forwarded-For is set to the
+	// client the relay appended
+	protoLine  []byte
+	hostLine   []byte
+	forwardFor bool
+}
+
+// headBuffers recycles the buffers request heads are rewritten into
+var headBuffers = sync.Pool{New: func() any { return new([]byte) }}
+
+// NewHeaderHostTransformer creates a new header transformer. An empty host
+// keeps the Host of every request.
+func NewHeaderHostTransformer(host string) *HeaderHostTransformer {
+	return &HeaderHostTransformer{host: host}
+}
+
+// Transform copies the requests read from reader to writer, rewriting
+// every head on the way. Bodies are framed by their Content-Length or
+// chunked encoding and copied as is, so each request on a kept-alive
+// connection is rewritten. After a CONNECT or an upgrade, or a head
+// net/http can't parse, the rest of the stream is copied untouched.
+func (h *HeaderHostTransformer) Transform(reader io.Reader, writer io.Writer) error {
+	buffered, ok := reader.(*bufio.Reader)
+	if !ok {
+		buffered = bufio.NewReader(reader)
+	}
+
+	for {
+		head, err := readRequestHead(buffered)
+		if len(head) == 0 && err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := h.rewriteHead(head, writer); err != nil {
+			return err
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+		if err != nil || req.Method == http.MethodConnect || isUpgrade(req.Header) {
+			_, err := io.Copy(writer, buffered)
+			return err
+		}
+		if err := copyRequestBody(writer, buffered, nil, req); err != nil {
+			return err
+		}
+	}
+}
+
+// readRequestHead reads a request head up to and including the empty line
+// that ends it. Lines may be longer than the reader's buffer; empty lines
+// before the request line are skipped.
+func readRequestHead(reader *bufio.Reader) ([]byte, error) {
+	var head []byte
+	lineStart := true
+	for {
+		line, err := reader.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			err = nil
+		} else if err == nil && lineStart && len(bytes.TrimRight(line, "\r\n")) == 0 {
+			if len(head) == 0 {
+				continue
+			}
+			return append(head, line...), nil
+		}
+		head = append(head, line...)
+		if err != nil {
+			return head, err
+		}
+		if len(head) > http.DefaultMaxHeaderBytes {
+			return head, errHeadTooLarge
+		}
+		lineStart = line[len(line)-1] == '\n'
+	}
+}
+
+// rewriteHead writes a request head with Host set to h's, unless it's
+// empty, configured headers replacing the visitor's and stripped ones
+// dropped. The request line and every other header line, folded
+// continuations included, are kept byte for byte. It scans the head in
+// place and writes it in one go from a recycled buffer, without
+// allocating.
+func (h *HeaderHostTransformer) rewriteHead(head []byte, writer io.Writer) error {
+	buffer := headBuffers.Get().(*[]byte)
+	defer headBuffers.Put(buffer)
+
+	line, rest := cutLine(head)
+	out := append((*buffer)[:0], line...)
+	dropped := false
+	var client []byte
+	sawProto, sawHost := false, false
+	for len(rest) > 0 {
+		line, rest = cutLine(rest)
+		content := bytes.TrimRight(line, "\r\n")
+		switch {
+		case len(content) == 0:
+			out = append(out, h.lines...)
+			if len(client) > 0 {
+				out = append(out, "X-Forwarded-For: "...)
+				out = append(out, client...)
+				out = append(out, "\r\n"...)
+			}
+			if !sawProto {
+				out = append(out, h.protoLine...)
+			}
+			if !sawHost {
+				out = append(out, h.hostLine...)
+			}
+			out = append(out, line...)
+		case content[0] == ' ' || content[0] == '\t':
+			// A folded continuation belongs to the previous line
+			if !dropped {
+				out = append(out, line...)
+			}
+		default:
+			name, value, _ := bytes.Cut(content, []byte(":"))
+			name = bytes.TrimSpace(name)
+			switch {
+			case equalFoldASCII(name, "X-Forwarded-For"):
+				if h.forwardFor {
+					client = lastEntry(value)
+				}
+			case equalFoldASCII(name, "X-Forwarded-Proto"):
+				sawProto = true
+			case equalFoldASCII(name, "X-Forwarded-Host"):
+				sawHost = true
+			}
+			switch {
+			case h.host != "" && equalFoldASCII(name, "Host"):
+				out = append(out, "Host: "...)
+				out = append(out, h.host...)
+				out = append(out, "\r\n"...)
+				dropped = true
+			case h.drops(name):
+				// Replaced by the configured value, or stripped
+				dropped = true
+			default:
+				out = append(out, line...)
+				dropped = false
+			}
+		}
+	}
+	*buffer = out
+
+	_, err := writer.Write(out)
+	return err
+}
+
+// cutLine splits off the first line of head, newline included
+func cutLine(head []byte) (line, rest []byte) {
+	if i := bytes.IndexByte(head, '\n'); i >= 0 {
+		return head[:i+1], head[i+1:]
+	}
+	return head, nil
+}
+
+// drops reports whether incoming headers named name are removed
+func (h *HeaderHostTransformer) drops(name []byte) bool {
+	for _, dropped := range h.drop {
+		if equalFoldASCII(name, dropped) {
+			return true
+		}
+	}
+	return false
+}
+
+// equalFoldASCII reports whether b and s are equal under ASCII case
+// folding, which is how header names compare
+func equalFoldASCII(b []byte, s string) bool {
+	if len(b) != len(s) {
+		return false
+	}
+	for i := range len(b) {
+		if lowerASCII(b[i]) != lowerASCII(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func lowerASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// writeHeaderLines writes configured headers, Host aside, in a stable
+// order
+func writeHeaderLines(writer io.Writer, header http.Header) {
+	for _, name := range slices.Sorted(maps.Keys(header)) {
+		if http.CanonicalHeaderKey(name) == "Host" {
+			continue
+		}
+		for _, value := range header[name] {
+			fmt.Fprintf(writer, "%s: %s\r\n", name, value)
+		}
+	}
+}
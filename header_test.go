@@ -0,0 +1,247 @@
+package vrata
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestHeaderHostTransformer(t *testing.T) {
+	transformer := NewHeaderHostTransformer("localhost:8080")
+	if transformer == nil {
+		t.Fatal("NewHeaderHostTransformer() returned nil")
+	}
+	if transformer.host != "localhost:8080" {
+		t.Errorf("Expected host 'localhost:8080', got '%s'", transformer.host)
+	}
+}
+
+func TestHeaderHostTransformerKeepsBody(t *testing.T) {
+	transformer := NewHeaderHostTransformer("localhost:8080")
+
+	input := "POST /hook HTTP/1.1\r\nHost: public.example\r\nContent-Length: 5\r\n\r\nhello"
+	var output bytes.Buffer
+	if err := transformer.Transform(strings.NewReader(input), &output); err != nil {
+		t.Fatalf("Transform() failed: %v", err)
+	}
+
+	want := "POST /hook HTTP/1.1\r\nHost: localhost:8080\r\nContent-Length: 5\r\n\r\nhello"
+	if output.String() != want {
+		t.Errorf("Expected %q, got %q", want, output.String())
+	}
+}
+
+func TestHeaderHostTransformerSetsHeaders(t *testing.T) {
+	transformer := (&TunnelOptions{Port: 8080, RequestHeaders: http.Header{
+		"x-tunnel": {"vrata"},
+		"X-Env":    {"dev", "local"},
+	}}).headerTransformer("localhost:8080")
+
+	input := "GET / HTTP/1.1\r\nHost: public.example\r\nX-Tunnel: forged\r\nAccept: */*\r\n\r\n"
+	var output bytes.Buffer
+	if err := transformer.Transform(strings.NewReader(input), &output); err != nil {
+		t.Fatalf("Transform() failed: %v", err)
+	}
+
+	want := "GET / HTTP/1.1\r\nHost: localhost:8080\r\nAccept: */*\r\nX-Env: dev\r\nX-Env: local\r\nX-Tunnel: vrata\r\n\r\n"
+	if output.String() != want {
+		t.Errorf("Expected %q, got %q", want, output.String())
+	}
+
+	// A configured Host replaces the local address
+	transformer = (&TunnelOptions{Port: 8080, RequestHeaders: http.Header{"Host": {"app.test"}}}).headerTransformer("localhost:8080")
+	output.Reset()
+	transformer.Transform(strings.NewReader(input), &output)
+	if !strings.Contains(output.String(), "Host: app.test\r\n") || strings.Count(output.String(), "Host:") != 1 {
+		t.Errorf("Expected a single Host: app.test, got %q", output.String())
+	}
+}
+
+func TestHeaderHostTransformerKeepAlive(t *testing.T) {
+	transformer := NewHeaderHostTransformer("localhost:8080")
+
+	// Bodies that look like heads must be left alone
+	input := "POST /a HTTP/1.1\r\nHost: public.example\r\nContent-Length: 25\r\n\r\nGET / HTTP/1.1\r\nHost: x\r\n" +
+		"POST /b HTTP/1.1\r\nHost: public.example\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nHost:\r\n0\r\n\r\n" +
+		"GET /c HTTP/1.1\r\nHost: public.example\r\n\r\n"
+	var output bytes.Buffer
+	if err := transformer.Transform(strings.NewReader(input), &output); err != nil {
+		t.Fatalf("Transform() failed: %v", err)
+	}
+
+	want := strings.ReplaceAll(input, "Host: public.example", "Host: localhost:8080")
+	if output.String() != want {
+		t.Errorf("Expected %q, got %q", want, output.String())
+	}
+}
+
+func TestHeaderHostTransformerKeepsLines(t *testing.T) {
+	transformer := (&TunnelOptions{Port: 8080, StripHeaders: []string{"X-Secret"}}).headerTransformer("localhost:8080")
+
+	long := strings.Repeat("a", 100<<10)
+	input := "GET / HTTP/1.1\r\nHost: public.example\r\nX-Odd:   spaced  \r\nX-Long: " + long + "\r\n" +
+		"X-Secret: one\r\n two\r\nX-Folded: one\r\n\ttwo\r\n\r\n"
+	var output bytes.Buffer
+	if err := transformer.Transform(strings.NewReader(input), &output); err != nil {
+		t.Fatalf("Transform() failed: %v", err)
+	}
+
+	want := "GET / HTTP/1.1\r\nHost: localhost:8080\r\nX-Odd:   spaced  \r\nX-Long: " + long + "\r\n" +
+		"X-Folded: one\r\n\ttwo\r\n\r\n"
+	if output.String() != want {
+		t.Errorf("Expected unknown lines kept as is, got %q", output.String())
+	}
+}
+
+func TestHeaderHostTransformerUpgrade(t *testing.T) {
+	transformer := NewHeaderHostTransformer("localhost:8080")
+
+	// Frames after the upgrade aren't HTTP
+	input := "GET /ws HTTP/1.1\r\nHost: public.example\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n\x81\x05Host:"
+	var output bytes.Buffer
+	if err := transformer.Transform(strings.NewReader(input), &output); err != nil {
+		t.Fatalf("Transform() failed: %v", err)
+	}
+
+	want := strings.Replace(input, "Host: public.example", "Host: localhost:8080", 1)
+	if output.String() != want {
+		t.Errorf("Expected %q, got %q", want, output.String())
+	}
+}
+
+func TestHeaderHostTransformerRejectsHugeHead(t *testing.T) {
+	transformer := NewHeaderHostTransformer("localhost:8080")
+
+	input := "GET / HTTP/1.1\r\nX-Huge: " + strings.Repeat("a", http.DefaultMaxHeaderBytes) + "\r\n\r\n"
+	if err := transformer.Transform(strings.NewReader(input), &bytes.Buffer{}); err != errHeadTooLarge {
+		t.Errorf("Expected errHeadTooLarge, got %v", err)
+	}
+}
+
+// rewriteHeadSplit is the transformer's former rewrite, which splits the
+// head into lines and canonicalizes every name; the benchmarks compare
+// against it
+func rewriteHeadSplit(head []byte, writer io.Writer, host string, headers http.Header, strip []string) error {
+	lines := bytes.SplitAfter(head, []byte("\n"))
+
+	var out bytes.Buffer
+	out.Write(lines[0])
+	dropped := false
+	for _, line := range lines[1:] {
+		content := bytes.TrimRight(line, "\r\n")
+		switch {
+		case len(line) == 0:
+		case len(content) == 0:
+			writeHeaderLines(&out, headers)
+			out.Write(line)
+		case content[0] == ' ' || content[0] == '\t':
+			if !dropped {
+				out.Write(line)
+			}
+		default:
+			name, _, _ := bytes.Cut(content, []byte(":"))
+			key := http.CanonicalHeaderKey(string(bytes.TrimSpace(name)))
+			switch {
+			case key == "Host":
+				fmt.Fprintf(&out, "Host: %s\r\n", host)
+				dropped = true
+			case headers[key] != nil || slices.Contains(strip, key):
+				dropped = true
+			default:
+				out.Write(line)
+				dropped = false
+			}
+		}
+	}
+
+	_, err := writer.Write(out.Bytes())
+	return err
+}
+
+// benchmarkHead is a typical browser request
+const benchmarkHead = "GET /assets/app.js?v=3 HTTP/1.1\r\n" +
+	"Host: abc123.loca.lt\r\n" +
+	"User-Agent: Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0 Safari/537.36\r\n" +
+	"Accept: */*\r\n" +
+	"Accept-Encoding: gzip, deflate, br\r\n" +
+	"Accept-Language: en-US,en;q=0.9\r\n" +
+	"Cookie: session=0123456789abcdef; theme=dark\r\n" +
+	"Referer: https://abc123.loca.lt/\r\n" +
+	"X-Forwarded-For: 192.0.2.1\r\n" +
+	"X-Forwarded-Proto: https\r\n" +
+	"\r\n"
+
+// benchmarkOptions sets and strips a header, like a typical configuration
+var benchmarkOptions = TunnelOptions{
+	Port:           8080,
+	RequestHeaders: http.Header{"X-Tunnel": {"vrata"}},
+	StripHeaders:   []string{"Cookie"},
+}
+
+func TestRewriteHeadMatchesSplit(t *testing.T) {
+	transformer := benchmarkOptions.headerTransformer("localhost:8080")
+	for _, head := range []string{
+		benchmarkHead,
+		"GET / HTTP/1.1\nhost: public.example\nX-TUNNEL: forged\ncookie: a\n\tb\nAccept: */*\n\n",
+		"GET / HTTP/1.1\r\nX-Folded: one\r\n two\r\n\r\n",
+	} {
+		var got, want bytes.Buffer
+		transformer.rewriteHead([]byte(head), &got)
+		rewriteHeadSplit([]byte(head), &want, "localhost:8080", canonicalHeaders(benchmarkOptions.RequestHeaders), []string{"Cookie"})
+		if got.String() != want.String() {
+			t.Errorf("rewriteHead(%q) = %q, want %q", head, got.String(), want.String())
+		}
+	}
+}
+
+func TestRewriteHeadAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("Buffers aren't recycled reliably under the race detector")
+	}
+	transformer := benchmarkOptions.headerTransformer("localhost:8080")
+	head := []byte(benchmarkHead)
+	allocs := testing.AllocsPerRun(100, func() {
+		transformer.rewriteHead(head, io.Discard)
+	})
+	if allocs != 0 {
+		t.Errorf("rewriteHead() allocated %v times per head, want 0", allocs)
+	}
+}
+
+func BenchmarkRewriteHead(b *testing.B) {
+	head := []byte(benchmarkHead)
+
+	b.Run("scan", func(b *testing.B) {
+		transformer := benchmarkOptions.headerTransformer("localhost:8080")
+		b.SetBytes(int64(len(head)))
+		b.ReportAllocs()
+		for b.Loop() {
+			transformer.rewriteHead(head, io.Discard)
+		}
+	})
+
+	b.Run("split", func(b *testing.B) {
+		headers := canonicalHeaders(benchmarkOptions.RequestHeaders)
+		strip := []string{"Cookie"}
+		b.SetBytes(int64(len(head)))
+		b.ReportAllocs()
+		for b.Loop() {
+			rewriteHeadSplit(head, io.Discard, "localhost:8080", headers, strip)
+		}
+	})
+}
+
+func BenchmarkTransform(b *testing.B) {
+	// A kept-alive connection carrying many requests
+	input := []byte(strings.Repeat(benchmarkHead, 100))
+	transformer := benchmarkOptions.headerTransformer("localhost:8080")
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	for b.Loop() {
+		transformer.Transform(bytes.NewReader(input), io.Discard)
+	}
+}
@@ -0,0 +1,217 @@
+package vrata
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthCheck configures active probing of the local server
+type HealthCheck struct {
+	// Path is requested with GET on the local server, e.g. "/healthz". Any
+	// status below 400 is healthy.
+	Path string
+	// Interval between probes; zero means 10 seconds
+	Interval time.Duration
+	// Timeout of a probe; zero means 2 seconds
+	Timeout time.Duration
+	// Failures is how many probes in a row must fail before the local
+	// server counts as unhealthy; zero means 2. One passing probe makes it
+	// healthy again.
+	Failures int
+	// WhenUnhealthy selects what happens to visitors while the local
+	// server is unhealthy
+	WhenUnhealthy UnhealthyBehavior
+}
+
+// UnhealthyBehavior selects how a tunnel treats visitors while its local
+// server fails health checks
+type UnhealthyBehavior int
+
+const (
+	// UnhealthyForward keeps forwarding visitors as usual (default)
+	UnhealthyForward UnhealthyBehavior = iota
+	// UnhealthyErrorPage answers visitors with the error page without
+	// trying the local server
+	UnhealthyErrorPage
+	// UnhealthyPause holds visitors until the local server is healthy
+	// again
+	UnhealthyPause
+)
+
+// HealthInfo describes a change in the health of the local server
+type HealthInfo struct {
+	Healthy bool
+	// Status is the status of the probe that caused the change, zero when
+	// the probe got no response
+	Status int
+	// Error explains why the probe failed; empty when it passed
+	Error string
+}
+
+const (
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 2 * time.Second
+	defaultHealthFailures = 2
+)
+
+// healthState tracks the outcome of health probes. The local server counts
+// as healthy until probes say otherwise.
+type healthState struct {
+	unhealthy bool
+	failures  int
+	last      HealthInfo
+	// recovered is closed when an unhealthy server becomes healthy again
+	recovered chan struct{}
+	mutex     sync.Mutex
+}
+
+// record folds a probe result into the state and reports whether it
+// changed the server's health
+func (s *healthState) record(info HealthInfo, threshold int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.last = info
+	if info.Healthy {
+		s.failures = 0
+		if !s.unhealthy {
+			return false
+		}
+		s.unhealthy = false
+		close(s.recovered)
+		return true
+	}
+
+	s.failures++
+	if s.unhealthy || s.failures < threshold {
+		return false
+	}
+	s.unhealthy = true
+	s.recovered = make(chan struct{})
+	return true
+}
+
+// status returns the channel closed on recovery while the server is
+// unhealthy, and the probe that made it so
+func (s *healthState) status() (<-chan struct{}, HealthInfo) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.unhealthy {
+		return nil, HealthInfo{Healthy: true}
+	}
+	return s.recovered, s.last
+}
+
+// checkHealth probes the local server until ctx is done
+func (tc *TunnelCluster) checkHealth(ctx context.Context) {
+	check := tc.options.HealthCheck
+	interval := check.Interval
+	if interval <= 0 {
+		interval = defaultHealthInterval
+	}
+	threshold := check.Failures
+	if threshold <= 0 {
+		threshold = defaultHealthFailures
+	}
+
+	client := &http.Client{
+		Transport: LocalTransport(tc.options),
+		Timeout:   check.Timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	if client.Timeout <= 0 {
+		client.Timeout = defaultHealthTimeout
+	}
+	defer client.CloseIdleConnections()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		info := probeHealth(ctx, client, check.Path)
+		if ctx.Err() != nil {
+			return
+		}
+		if tc.health.record(info, threshold) {
+			tc.healthChanged(info)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeHealth requests the health endpoint once
+func probeHealth(ctx context.Context, client *http.Client, path string) HealthInfo {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://local"+path, nil)
+	if err != nil {
+		return HealthInfo{Error: err.Error()}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return HealthInfo{Error: err.Error()}
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxErrorBody))
+	resp.Body.Close()
+
+	info := HealthInfo{Healthy: resp.StatusCode < 400, Status: resp.StatusCode}
+	if !info.Healthy {
+		info.Error = resp.Status
+	}
+	return info
+}
+
+// healthChanged reports a health transition
+func (tc *TunnelCluster) healthChanged(info HealthInfo) {
+	if info.Healthy {
+		tc.log().Info("local server is healthy again", "status", info.Status)
+	} else {
+		tc.log().Warn("local server is unhealthy", "status", info.Status, "error", info.Error)
+	}
+
+	tc.stream.publish("health", map[string]any{
+		"healthy": info.Healthy,
+		"status":  info.Status,
+		"error":   info.Error,
+	})
+
+	select {
+	case tc.events.Health <- info:
+	default:
+	}
+}
+
+// awaitHealthy decides whether a visitor may be forwarded to the local
+// server, holding it while the server is unhealthy when the health check
+// says to pause. It returns the reason to answer with the error page
+// instead.
+func (tc *TunnelCluster) awaitHealthy(ctx context.Context) error {
+	check := tc.options.HealthCheck
+	if check == nil || check.WhenUnhealthy == UnhealthyForward {
+		return nil
+	}
+	recovered, info := tc.health.status()
+	if recovered == nil {
+		return nil
+	}
+	if check.WhenUnhealthy == UnhealthyPause {
+		select {
+		case <-recovered:
+			return nil
+		case <-ctx.Done():
+		}
+	}
+	return fmt.Errorf("local server failed its health check: %s", info.Error)
+}
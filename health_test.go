@@ -0,0 +1,144 @@
+package vrata
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthStateRecord(t *testing.T) {
+	var state healthState
+	fail := HealthInfo{Status: 503, Error: "503 Service Unavailable"}
+
+	if state.record(fail, 2) {
+		t.Error("One failure below the threshold changed the health")
+	}
+	if recovered, _ := state.status(); recovered != nil {
+		t.Error("Expected the server to still be healthy")
+	}
+	if !state.record(fail, 2) {
+		t.Error("Reaching the threshold didn't change the health")
+	}
+	recovered, info := state.status()
+	if recovered == nil || info.Status != 503 {
+		t.Fatalf("Expected the server to be unhealthy with the failed probe, got %+v", info)
+	}
+	if state.record(fail, 2) {
+		t.Error("Further failures reported another change")
+	}
+
+	if !state.record(HealthInfo{Healthy: true, Status: 200}, 2) {
+		t.Error("A passing probe didn't make the server healthy")
+	}
+	select {
+	case <-recovered:
+	default:
+		t.Error("Recovery wasn't signaled")
+	}
+}
+
+func TestTunnelHealthCheck(t *testing.T) {
+	// One pool connection per request
+	relay := newMockRelay(t, 2)
+
+	var down atomic.Bool
+	down.Store(true)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer local.Close()
+
+	tunnel, err := ConnectAndOpen(local.Listener.Addr().(*net.TCPAddr).Port, &TunnelOptions{
+		Host:      relay.server.URL,
+		LocalHost: "127.0.0.1",
+		HealthCheck: &HealthCheck{
+			Path:          "/healthz",
+			Interval:      20 * time.Millisecond,
+			Failures:      1,
+			WhenUnhealthy: UnhealthyErrorPage,
+		},
+	})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	awaitHealth := func(healthy bool) {
+		t.Helper()
+		select {
+		case info := <-tunnel.Events().Health:
+			if info.Healthy != healthy {
+				t.Fatalf("Expected healthy=%v, got %+v", healthy, info)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("No health event (healthy=%v)", healthy)
+		}
+	}
+	get := func() int {
+		t.Helper()
+		conn := <-relay.conns
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: public.example\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	awaitHealth(false)
+	if status := get(); status != http.StatusBadGateway {
+		t.Errorf("Expected the error page while unhealthy, got %d", status)
+	}
+
+	down.Store(false)
+	awaitHealth(true)
+	if status := get(); status != http.StatusOK {
+		t.Errorf("Expected the request to be forwarded once healthy, got %d", status)
+	}
+}
+
+func TestAwaitHealthyPause(t *testing.T) {
+	tc := &TunnelCluster{options: &TunnelOptions{
+		HealthCheck: &HealthCheck{WhenUnhealthy: UnhealthyPause},
+	}}
+	tc.health.record(HealthInfo{Error: "connection refused"}, 1)
+
+	done := make(chan error, 1)
+	go func() { done <- tc.awaitHealthy(context.Background()) }()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Visitor wasn't held while unhealthy: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	tc.health.record(HealthInfo{Healthy: true, Status: 200}, 1)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected the visitor to go through after recovery, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Visitor still held after recovery")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tc.health.record(HealthInfo{Error: "connection refused"}, 1)
+	if err := tc.awaitHealthy(ctx); err == nil {
+		t.Error("Expected an error once the visitor gave up")
+	}
+}
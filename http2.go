@@ -0,0 +1,310 @@
+package vrata
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// h2cPreface opens an HTTP/2 connection with prior knowledge: the client
+// connection preface followed by an empty SETTINGS frame
+const h2cPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n" + "\x00\x00\x00\x04\x00\x00\x00\x00\x00"
+
+// h2cProbeTimeout bounds the wait for a local server's answer to the
+// preface; HTTP/1.1 servers may wait for more of a request instead
+const h2cProbeTimeout = time.Second
+
+// errHTTP2ConnUsed is returned when the HTTP/2 client of a translated
+// connection asks for a second connection to the local server
+var errHTTP2ConnUsed = errors.New("local HTTP/2 connection already used")
+
+// http2Targets remembers which local addresses speak HTTP/2 over
+// cleartext, so each one is probed once
+type http2Targets struct {
+	speaks map[string]bool
+	mutex  sync.Mutex
+}
+
+// h2c reports whether the local server at address speaks HTTP/2 with
+// prior knowledge. Addresses that can't be probed are taken to speak
+// HTTP/1.1 for now and probed again next time.
+func (tc *TunnelCluster) h2c(ctx context.Context, address string) bool {
+	targets := &tc.http2
+	targets.mutex.Lock()
+	speaks, known := targets.speaks[address]
+	targets.mutex.Unlock()
+	if known {
+		return speaks
+	}
+
+	speaks, err := tc.options.probeH2C(ctx, address)
+	if err != nil {
+		return false
+	}
+	tc.log().Debug("probed local server", "address", address, "http2", speaks)
+
+	targets.mutex.Lock()
+	defer targets.mutex.Unlock()
+	if targets.speaks == nil {
+		targets.speaks = make(map[string]bool)
+	}
+	targets.speaks[address] = speaks
+	return speaks
+}
+
+// probeH2C sends the HTTP/2 preface to address on a connection of its own
+// and reports whether the server answers with a SETTINGS frame
+func (o *TunnelOptions) probeH2C(ctx context.Context, address string) (bool, error) {
+	conn, err := o.dial(ctx, "tcp", address)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(h2cProbeTimeout))
+	if _, err := io.WriteString(conn, h2cPreface); err != nil {
+		return false, err
+	}
+	// A frame header is 9 bytes; the type is the fourth. HTTP/1.1 servers
+	// answer with an error status or hang up.
+	var header [9]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return false, nil
+	}
+	return header[3] == 0x4, nil
+}
+
+// overHTTP2 returns local as is, or, when LocalHTTP2 is set and the local
+// server at address speaks HTTP/2, a connection that translates the
+// HTTP/1.1 the tunnel speaks. Over TLS, ALPN decides.
+func (tc *TunnelCluster) overHTTP2(ctx context.Context, local net.Conn, address string) net.Conn {
+	if !tc.options.LocalHTTP2 {
+		return local
+	}
+	if tlsConn, ok := local.(*tls.Conn); ok {
+		if tlsConn.ConnectionState().NegotiatedProtocol != "h2" {
+			return local
+		}
+		return newHTTP2Conn(local, "https", address, tc.dialHTTP1(address))
+	}
+	if !tc.h2c(ctx, address) {
+		return local
+	}
+	return newHTTP2Conn(local, "http", address, tc.dialHTTP1(address))
+}
+
+// dialHTTP1 returns a dialer of HTTP/1.1 connections to address, which
+// carry upgraded requests HTTP/2 can't
+func (tc *TunnelCluster) dialHTTP1(address string) func(context.Context) (net.Conn, error) {
+	return func(ctx context.Context) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, tc.options.Timeouts.localDial())
+		defer cancel()
+		return tc.options.dialLocal(ctx, address)
+	}
+}
+
+// http2Conn is the tunnel's end of a connection to an HTTP/2 local server.
+// HTTP/1.1 requests written to it are sent as HTTP/2 requests, and their
+// responses read back as HTTP/1.1, trailers included.
+type http2Conn struct {
+	net.Conn
+	front  net.Conn
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newHTTP2Conn starts translating between the tunnel and local, which
+// speaks HTTP/2 for scheme at address
+func newHTTP2Conn(local net.Conn, scheme, address string, dialHTTP1 func(context.Context) (net.Conn, error)) net.Conn {
+	conns := make(chan net.Conn, 1)
+	conns <- local
+	dial := func(context.Context, string, string) (net.Conn, error) {
+		select {
+		case conn := <-conns:
+			return conn, nil
+		default:
+			return nil, errHTTP2ConnUsed
+		}
+	}
+
+	var protocols http.Protocols
+	transport := &http.Transport{Protocols: &protocols}
+	if scheme == "https" {
+		protocols.SetHTTP2(true)
+		transport.DialTLSContext = dial
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+		transport.DialContext = dial
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tunnel, front := net.Pipe()
+	translator := &http2Translator{
+		front:     front,
+		local:     local,
+		transport: transport,
+		scheme:    scheme,
+		address:   address,
+		dialHTTP1: dialHTTP1,
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		translator.serve(ctx)
+	}()
+
+	return &http2Conn{Conn: tunnel, front: front, cancel: cancel, done: done}
+}
+
+// Close stops the translator and returns once it has
+func (c *http2Conn) Close() error {
+	c.cancel()
+	err := c.Conn.Close()
+	<-c.done
+	return err
+}
+
+// CloseWrite ends the requests: the translator stops once it has answered
+// those it already read. Writes to a pipe return only once they are read.
+func (c *http2Conn) CloseWrite() error {
+	return c.front.SetReadDeadline(time.Now())
+}
+
+// http2Translator serves the HTTP/1.1 requests of one tunneled connection
+// over an HTTP/2 connection to the local server
+type http2Translator struct {
+	front     net.Conn
+	local     net.Conn
+	transport *http.Transport
+	scheme    string
+	address   string
+	dialHTTP1 func(context.Context) (net.Conn, error)
+}
+
+// serve translates requests one at a time until the tunnel or the local
+// server is done
+func (t *http2Translator) serve(ctx context.Context) {
+	defer t.front.Close()
+	defer t.local.Close()
+	defer t.transport.CloseIdleConnections()
+
+	reader := bufio.NewReader(t.front)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		if req.Method == http.MethodConnect || isUpgrade(req.Header) {
+			// HTTP/2 can't switch protocols
+			t.passThrough(ctx, req, reader)
+			return
+		}
+		if err := t.roundTrip(ctx, req); err != nil || req.Close {
+			return
+		}
+	}
+}
+
+// roundTrip sends req to the local server and writes its response back
+func (t *http2Translator) roundTrip(ctx context.Context, req *http.Request) error {
+	var body *notifyingBody
+	if req.Body != http.NoBody {
+		body = &notifyingBody{ReadCloser: req.Body, closed: make(chan struct{})}
+		req.Body = body
+	}
+	req.RequestURI = ""
+	req.URL.Scheme, req.URL.Host = t.scheme, t.address
+	removeHopHeaders(req.Header)
+
+	resp, err := t.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		writeRejection(t.front, http.StatusBadGateway, nil)
+		return err
+	}
+	defer resp.Body.Close()
+
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	// HTTP/1.1 sends trailers only after a chunked body. The transport
+	// fills them in once the body is read.
+	if bodyAllowed(req.Method, resp.StatusCode) && (resp.ContentLength < 0 || len(resp.Trailer) > 0) {
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		resp.TransferEncoding = []string{"chunked"}
+	}
+	if resp.Trailer == nil {
+		resp.Trailer = make(http.Header)
+	}
+	if err := resp.Write(t.front); err != nil {
+		return err
+	}
+
+	// The transport closes the request body once it's done with it, which
+	// drains the rest of it before the next request is read
+	resp.Body.Close()
+	if body != nil {
+		<-body.closed
+	}
+	return nil
+}
+
+// passThrough forwards req, and the rest of the connection, to the local
+// server over HTTP/1.1
+func (t *http2Translator) passThrough(ctx context.Context, req *http.Request, reader *bufio.Reader) {
+	local, err := t.dialHTTP1(ctx)
+	if err != nil {
+		writeRejection(t.front, http.StatusBadGateway, nil)
+		return
+	}
+	defer local.Close()
+	defer closeWhenDone(ctx, local)()
+
+	if err := writeLocalRequest(local, req); err != nil {
+		return
+	}
+	requests := make(chan struct{})
+	go func() {
+		defer close(requests)
+		io.Copy(local, reader)
+		closeWrite(local)
+	}()
+	io.Copy(t.front, local)
+	t.front.Close()
+	<-requests
+}
+
+// notifyingBody is a request body that reports when it's closed
+type notifyingBody struct {
+	io.ReadCloser
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (b *notifyingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { close(b.closed) })
+	return err
+}
+
+// removeHopHeaders removes the headers of an HTTP/1.1 connection, which
+// HTTP/2 doesn't allow. TE stays: "TE: trailers" is allowed, and gRPC
+// requires it.
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); !strings.EqualFold(name, "TE") {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Upgrade"} {
+		header.Del(name)
+	}
+}
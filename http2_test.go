@@ -0,0 +1,172 @@
+package vrata
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newH2CServer starts a local server speaking HTTP/1.1 and HTTP/2 with
+// prior knowledge
+func newH2CServer(handler http.Handler) *httptest.Server {
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetHTTP1(true)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	return server
+}
+
+// protoHandler answers with the protocol, host and body of the request,
+// and a trailer like gRPC's status
+func protoHandler(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	w.Header().Set("Trailer", "Grpc-Status")
+	fmt.Fprintf(w, "%s %s %s", r.Proto, r.Host, body)
+	w.Header().Set("Grpc-Status", "0")
+}
+
+func TestTunnelLocalHTTP2(t *testing.T) {
+	tests := []struct {
+		name      string
+		server    func(http.Handler) *httptest.Server
+		https     bool
+		wantProto string
+	}{
+		{"h2c", newH2CServer, false, "HTTP/2.0"},
+		{"http/1.1 only", httptest.NewServer, false, "HTTP/1.1"},
+		{"alpn", func(handler http.Handler) *httptest.Server {
+			server := httptest.NewUnstartedServer(handler)
+			server.EnableHTTP2 = true
+			server.StartTLS()
+			return server
+		}, true, "HTTP/2.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := newMockRelay(t, 1)
+			local := tt.server(http.HandlerFunc(protoHandler))
+			defer local.Close()
+			localPort := local.Listener.Addr().(*net.TCPAddr).Port
+
+			tunnel, err := ConnectAndOpen(localPort, &TunnelOptions{
+				Host:       relay.server.URL,
+				LocalHost:  "127.0.0.1",
+				LocalHTTPS: tt.https,
+				LocalHTTP2: true,
+			})
+			if err != nil {
+				t.Fatalf("ConnectAndOpen() failed: %v", err)
+			}
+			defer tunnel.Close()
+
+			conn := <-relay.conns
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			reader := bufio.NewReader(conn)
+
+			// Requests on a kept-alive connection, with and without a body
+			for i, body := range []string{"", "hello"} {
+				fmt.Fprintf(conn, "POST /echo HTTP/1.1\r\nHost: public.example\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+				resp, err := http.ReadResponse(reader, nil)
+				if err != nil {
+					t.Fatalf("Request %d: failed to read response: %v", i, err)
+				}
+				got, _ := io.ReadAll(resp.Body)
+				want := fmt.Sprintf("%s 127.0.0.1:%d %s", tt.wantProto, localPort, body)
+				if string(got) != want {
+					t.Errorf("Request %d: body = %q, want %q", i, got, want)
+				}
+				if resp.Trailer.Get("Grpc-Status") != "0" {
+					t.Errorf("Request %d: trailers = %v, want Grpc-Status 0", i, resp.Trailer)
+				}
+			}
+		})
+	}
+}
+
+func TestTunnelLocalHTTP2WebSocket(t *testing.T) {
+	relay := newMockRelay(t, 1)
+	local := newH2CServer(echoUpgradeHandler(t))
+	defer local.Close()
+
+	tunnel, err := ConnectAndOpen(local.Listener.Addr().(*net.TCPAddr).Port, &TunnelOptions{
+		Host:       relay.server.URL,
+		LocalHost:  "127.0.0.1",
+		LocalHTTP2: true,
+	})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	conn := <-relay.conns
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// The upgrade goes over HTTP/1.1
+	reader := openWebSocket(t, conn)
+	io.WriteString(conn, "hello")
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(reader, got); err != nil || string(got) != "hello" {
+		t.Errorf("Echo = %q, %v, want hello", got, err)
+	}
+}
+
+func TestProbeH2C(t *testing.T) {
+	h2c := newH2CServer(http.NotFoundHandler())
+	defer h2c.Close()
+	http1 := httptest.NewServer(http.NotFoundHandler())
+	defer http1.Close()
+
+	// A server that reads without answering
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	go func() {
+		conn, err := silent.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	var options TunnelOptions
+	for address, want := range map[string]bool{
+		h2c.Listener.Addr().String():   true,
+		http1.Listener.Addr().String(): false,
+		silent.Addr().String():         false,
+	} {
+		speaks, err := options.probeH2C(context.Background(), address)
+		if err != nil {
+			t.Errorf("probeH2C(%s) failed: %v", address, err)
+		}
+		if speaks != want {
+			t.Errorf("probeH2C(%s) = %v, want %v", address, speaks, want)
+		}
+	}
+}
+
+func TestRemoveHopHeaders(t *testing.T) {
+	header := http.Header{
+		"Connection": {"keep-alive, TE, X-Hop"},
+		"Keep-Alive": {"timeout=5"},
+		"Te":         {"trailers"},
+		"X-Hop":      {"1"},
+		"X-Kept":     {"1"},
+	}
+	removeHopHeaders(header)
+
+	if len(header) != 2 || header.Get("Te") != "trailers" || header.Get("X-Kept") != "1" {
+		t.Errorf("Headers left = %v, want Te and X-Kept", header)
+	}
+}
@@ -0,0 +1,71 @@
+package vrata
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTunnelInfo(t *testing.T) {
+	relay := newMockRelay(t, 2)
+
+	tunnel, err := NewTunnel(8080, &TunnelOptions{Host: relay.server.URL})
+	if err != nil {
+		t.Fatalf("NewTunnel() failed: %v", err)
+	}
+	if tunnel.Info() != nil {
+		t.Error("Expected no info before Open")
+	}
+	if tunnel.Subdomain() != "" || tunnel.MaxConnections() != 0 || tunnel.DataPort() != 0 {
+		t.Error("Expected zero values before Open")
+	}
+
+	before := time.Now()
+	if err := tunnel.Open(); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	info := tunnel.Info()
+	if info.ID != "mock" || info.MaxConn != 2 || info.Port == 0 {
+		t.Errorf("Unexpected info: %+v", info)
+	}
+	if info.RegisteredAt.Before(before) || info.RTT <= 0 {
+		t.Errorf("Expected registration time and RTT, got %+v", info)
+	}
+
+	// Once data connections are up, the RTT comes from their handshakes
+	waitFor(t, func() bool { return tunnel.cluster.rtt.Load() > 0 })
+	if rtt := tunnel.Info().RTT; rtt != time.Duration(tunnel.cluster.rtt.Load()) {
+		t.Errorf("Expected handshake RTT, got %s", rtt)
+	}
+
+	if tunnel.MaxConnections() != 2 || tunnel.DataPort() != info.Port {
+		t.Errorf("Getters disagree with %+v", info)
+	}
+
+	info.ID = "changed"
+	if tunnel.Info().ID != "mock" {
+		t.Error("Info() must return a copy")
+	}
+}
+
+func TestTunnelSubdomain(t *testing.T) {
+	tunnel := &Tunnel{info: &TunnelInfo{ID: "abc", URL: "https://myapp.loca.lt"}}
+	if got := tunnel.Subdomain(); got != "myapp" {
+		t.Errorf("Expected the URL's first label, got %q", got)
+	}
+	tunnel.info.URL = "not a url"
+	if got := tunnel.Subdomain(); got != "abc" {
+		t.Errorf("Expected the ID without a URL host, got %q", got)
+	}
+}
+
+func TestObserveRTT(t *testing.T) {
+	var tc TunnelCluster
+	tc.observeRTT(80 * time.Millisecond)
+	tc.observeRTT(160 * time.Millisecond)
+
+	if rtt := time.Duration(tc.rtt.Load()); rtt != 90*time.Millisecond {
+		t.Errorf("Expected smoothed RTT of 90ms, got %s", rtt)
+	}
+}
@@ -0,0 +1,272 @@
+package vrata
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// RequestInterceptor sees every request before it is forwarded to the
+// local server, and may change it. Returning a response answers the
+// visitor with it instead, and the request never reaches the local server.
+// Returning an error answers with 502 and closes the connection.
+type RequestInterceptor interface {
+	InterceptRequest(req *http.Request) (*http.Response, error)
+}
+
+// ResponseInterceptor sees every response of the local server before it
+// is sent back to the visitor, and may change it; resp.Request is the
+// request it answers. Returning an error answers with 502 and closes the
+// connection.
+type ResponseInterceptor interface {
+	InterceptResponse(resp *http.Response) error
+}
+
+// RequestInterceptorFunc adapts a function to RequestInterceptor
+type RequestInterceptorFunc func(req *http.Request) (*http.Response, error)
+
+// InterceptRequest calls f(req)
+func (f RequestInterceptorFunc) InterceptRequest(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// ResponseInterceptorFunc adapts a function to ResponseInterceptor
+type ResponseInterceptorFunc func(resp *http.Response) error
+
+// InterceptResponse calls f(resp)
+func (f ResponseInterceptorFunc) InterceptResponse(resp *http.Response) error {
+	return f(resp)
+}
+
+// intercepts reports whether requests go through the interceptor pipeline
+func (o *TunnelOptions) intercepts() bool {
+	return len(o.RequestInterceptors) > 0 || len(o.ResponseInterceptors) > 0 || o.RewriteLocalURLs
+}
+
+// interceptExchanges serves a connection one parsed request at a time:
+// each passes the access checks and header rewriting, then the request
+// interceptors, and its response passes the response interceptors on the
+// way back. Upgraded connections are copied as is after the 101 response.
+func (conn *TunnelConnection) interceptExchanges(upstream *bufferedConn, local net.Conn, host string, added http.Header) {
+	options := conn.cluster.options
+	reader := upstream.reader
+	localReader := bufio.NewReader(local)
+
+	// Request bodies still being written, and the visitor's side of an
+	// upgraded connection, are interrupted and waited for on the way out
+	var copies sync.WaitGroup
+	defer func() {
+		interrupt(upstream, local)
+		copies.Wait()
+	}()
+
+	for first := true; ; first = false {
+		// Wait for the next request; the visitor may be done
+		if _, err := reader.Peek(1); err != nil {
+			return
+		}
+
+		// The first request was checked before the local server was dialed
+		head, status := checkRequestHead(reader)
+		if status != 0 {
+			conn.deny(upstream, &rejection{status: status})
+			return
+		}
+		if !first {
+			if denied := conn.cluster.checkAccess(head); denied != nil {
+				conn.deny(upstream, denied)
+				return
+			}
+		}
+
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		req.RemoteAddr = forwardedFor(req.Header)
+		conn.cluster.forwarding.apply(req.Header)
+		options.rewriteLocalRequest(req, host)
+
+		reqBody := req.Body
+		resp, err := conn.interceptRequest(req)
+		if err != nil {
+			conn.interceptFailed(upstream, err)
+			return
+		}
+		if resp != nil {
+			// Answered by an interceptor; drop the body the visitor sent
+			reqBody.Close()
+			prepareResponse(resp, req, nil)
+			err := resp.Write(upstream)
+			resp.Body.Close()
+			if err != nil || resp.Close || req.Close {
+				return
+			}
+			continue
+		}
+		if req.Body != reqBody {
+			// A rewritten body has an unknown length
+			req.ContentLength = -1
+			req.Header.Del("Content-Length")
+		}
+
+		// The request is written while the response is read, so the local
+		// server can answer 100 Continue before the body arrives
+		written := make(chan error, 1)
+		copies.Add(1)
+		go func() {
+			defer copies.Done()
+			err := writeLocalRequest(local, req)
+			reqBody.Close()
+			written <- err
+		}()
+
+		resp, err = readFinalResponse(localReader, req, upstream)
+		if err != nil {
+			return
+		}
+
+		if resp.StatusCode == http.StatusSwitchingProtocols ||
+			(req.Method == http.MethodConnect && resp.StatusCode/100 == 2) {
+			// The rest of the connection is another protocol
+			setHeaders(resp.Header, options.ResponseHeaders)
+			addHeaders(resp.Header, added)
+			if resp.Write(upstream) != nil {
+				return
+			}
+			copies.Add(1)
+			go func() {
+				defer copies.Done()
+				io.Copy(local, reader)
+			}()
+			io.Copy(upstream, localReader)
+			return
+		}
+
+		setHeaders(resp.Header, options.ResponseHeaders)
+		addHeaders(resp.Header, added)
+		respBody := resp.Body
+		for _, interceptor := range conn.cluster.responseInterceptors {
+			if err := interceptor.InterceptResponse(resp); err != nil {
+				resp.Body.Close()
+				conn.interceptFailed(upstream, err)
+				return
+			}
+		}
+		prepareResponse(resp, req, respBody)
+
+		err = resp.Write(upstream)
+		// Closing a body read from the connection consumes what is left of
+		// it, even when an interceptor replaced it
+		resp.Body.Close()
+		respBody.Close()
+		if err != nil || <-written != nil || resp.Close || req.Close {
+			return
+		}
+	}
+}
+
+// interceptRequest runs the request interceptors until one answers
+func (conn *TunnelConnection) interceptRequest(req *http.Request) (*http.Response, error) {
+	for _, interceptor := range conn.cluster.options.RequestInterceptors {
+		resp, err := interceptor.InterceptRequest(req)
+		if err != nil || resp != nil {
+			return resp, err
+		}
+	}
+	return nil, nil
+}
+
+// interceptFailed answers a request whose interceptor failed
+func (conn *TunnelConnection) interceptFailed(upstream io.Writer, err error) {
+	conn.reportError(fmt.Errorf("interceptor failed: %w", err))
+	writeRejection(upstream, http.StatusBadGateway, nil)
+}
+
+// readFinalResponse reads the response to req, passing interim responses
+// such as 100 Continue on to the visitor
+func readFinalResponse(reader *bufio.Reader, req *http.Request, upstream io.Writer) (*http.Response, error) {
+	for {
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode/100 != 1 || resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, nil
+		}
+		if err := resp.Write(upstream); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// writeLocalRequest forwards a parsed request to the local server
+func writeLocalRequest(local io.Writer, req *http.Request) error {
+	// Request.Write adds a Go User-Agent to requests without one
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header["User-Agent"] = []string{""}
+	}
+	return req.Write(directWriter{local})
+}
+
+// directWriter keeps Request.Write from buffering, so the head of a request
+// waiting for 100 Continue reaches the local server before its body
+type directWriter struct {
+	io.Writer
+}
+
+func (w directWriter) WriteByte(c byte) error {
+	_, err := w.Write([]byte{c})
+	return err
+}
+
+// prepareResponse fills in what Response.Write needs in a response to req.
+// A body that differs from the one it was read with, or a new body without
+// a length, is sent chunked, unless it was buffered by RewriteBodies.
+func prepareResponse(resp *http.Response, req *http.Request, body io.ReadCloser) {
+	resp.Request = req
+	if resp.ProtoMajor == 0 {
+		resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	if resp.Body == nil {
+		resp.Body = http.NoBody
+	}
+	if resp.Body == body || resp.Body == http.NoBody || (body == nil && resp.ContentLength > 0) {
+		return
+	}
+
+	resp.Header.Del("Content-Length")
+	if buffered, ok := resp.Body.(bufferedBody); ok {
+		resp.ContentLength = int64(buffered.Len())
+		resp.TransferEncoding = nil
+		return
+	}
+	resp.ContentLength = -1
+	if resp.ProtoAtLeast(1, 1) {
+		resp.TransferEncoding = []string{"chunked"}
+	} else {
+		resp.Close = true
+	}
+}
+
+// addHeaders adds the values of added to header
+func addHeaders(header, added http.Header) {
+	for name, values := range added {
+		for _, value := range values {
+			header.Add(name, value)
+		}
+	}
+}
+
+// setHeaders sets the configured headers on header
+func setHeaders(header, configured http.Header) {
+	for name, values := range configured {
+		header[http.CanonicalHeaderKey(name)] = values
+	}
+}
@@ -0,0 +1,199 @@
+package vrata
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// interceptedTunnel opens a tunnel with the given interceptors to a local
+// server echoing request bodies, and returns a relay connection to it
+func interceptedTunnel(t *testing.T, options *TunnelOptions) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	relay := newMockRelay(t, 1)
+
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Tag", r.Header.Get("X-Tag"))
+		w.Header().Set("X-Seen-Host", r.Host)
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, "echo:"+string(body))
+	}))
+	t.Cleanup(local.Close)
+
+	options.Host = relay.server.URL
+	options.LocalHost = "127.0.0.1"
+	tunnel, err := ConnectAndOpen(local.Listener.Addr().(*net.TCPAddr).Port, options)
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	t.Cleanup(func() { tunnel.Close() })
+
+	var conn net.Conn
+	select {
+	case conn = <-relay.conns:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Tunnel client never connected to the relay")
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, bufio.NewReader(conn)
+}
+
+func TestTunnelInterceptors(t *testing.T) {
+	conn, reader := interceptedTunnel(t, &TunnelOptions{
+		RequestInterceptors: []RequestInterceptor{
+			RequestInterceptorFunc(func(req *http.Request) (*http.Response, error) {
+				req.Header.Set("X-Tag", "intercepted")
+				return nil, nil
+			}),
+			RequestInterceptorFunc(func(req *http.Request) (*http.Response, error) {
+				if req.URL.Path == "/teapot" {
+					return &http.Response{
+						StatusCode: http.StatusTeapot,
+						Body:       io.NopCloser(strings.NewReader("short and stout")),
+					}, nil
+				}
+				return nil, nil
+			}),
+		},
+		ResponseInterceptors: []ResponseInterceptor{
+			ResponseInterceptorFunc(func(resp *http.Response) error {
+				resp.Header.Set("X-Path", resp.Request.URL.Path)
+				if resp.Request.URL.Path == "/shout" {
+					body, _ := io.ReadAll(resp.Body)
+					resp.Body = io.NopCloser(strings.NewReader(strings.ToUpper(string(body))))
+				}
+				return nil
+			}),
+		},
+	})
+
+	tests := []struct {
+		request string
+		status  int
+		body    string
+		path    string
+	}{
+		{"POST /upload HTTP/1.1\r\nHost: public.example\r\nContent-Length: 5\r\n\r\nhello", 200, "echo:hello", "/upload"},
+		{"GET /teapot HTTP/1.1\r\nHost: public.example\r\n\r\n", 418, "short and stout", ""},
+		{"POST /shout HTTP/1.1\r\nHost: public.example\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n", 200, "ECHO:ABC", "/shout"},
+		{"GET / HTTP/1.1\r\nHost: public.example\r\n\r\n", 200, "echo:", "/"},
+	}
+	for _, tt := range tests {
+		io.WriteString(conn, tt.request)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("%q: failed to read response: %v", tt.request, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != tt.status || string(body) != tt.body {
+			t.Errorf("%q: got %d %q, want %d %q", tt.request, resp.StatusCode, body, tt.status, tt.body)
+		}
+		if tt.path == "" {
+			continue
+		}
+		if got := resp.Header.Get("X-Path"); got != tt.path {
+			t.Errorf("%q: X-Path = %q, want %q", tt.request, got, tt.path)
+		}
+		if got := resp.Header.Get("X-Seen-Tag"); got != "intercepted" {
+			t.Errorf("%q: local server saw X-Tag %q", tt.request, got)
+		}
+		if got := resp.Header.Get("X-Seen-Host"); !strings.HasPrefix(got, "127.0.0.1:") {
+			t.Errorf("%q: local server saw Host %q", tt.request, got)
+		}
+	}
+}
+
+func TestTunnelInterceptorsExpectContinue(t *testing.T) {
+	conn, reader := interceptedTunnel(t, &TunnelOptions{
+		ResponseInterceptors: []ResponseInterceptor{
+			ResponseInterceptorFunc(func(resp *http.Response) error { return nil }),
+		},
+	})
+
+	io.WriteString(conn, "POST / HTTP/1.1\r\nHost: public.example\r\nExpect: 100-continue\r\nContent-Length: 2\r\n\r\n")
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil || resp.StatusCode != http.StatusContinue {
+		t.Fatalf("Expected 100 Continue before the body, got %v (%v)", resp, err)
+	}
+
+	io.WriteString(conn, "hi")
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "echo:hi" {
+		t.Errorf("Expected echo:hi, got %q", body)
+	}
+}
+
+func TestTunnelInterceptorError(t *testing.T) {
+	conn, reader := interceptedTunnel(t, &TunnelOptions{
+		RequestInterceptors: []RequestInterceptor{
+			RequestInterceptorFunc(func(req *http.Request) (*http.Response, error) {
+				return nil, errors.New("boom")
+			}),
+		},
+	})
+
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: public.example\r\n\r\n")
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected 502, got %d", resp.StatusCode)
+	}
+}
+
+func TestTunnelInterceptorsUpgrade(t *testing.T) {
+	relay := newMockRelay(t, 1)
+
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buffered, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		line, _ := buffered.ReadString('\n')
+		io.WriteString(conn, "echo "+line)
+	}))
+	defer local.Close()
+
+	tunnel, err := ConnectAndOpen(local.Listener.Addr().(*net.TCPAddr).Port, &TunnelOptions{
+		Host:      relay.server.URL,
+		LocalHost: "127.0.0.1",
+		ResponseInterceptors: []ResponseInterceptor{
+			ResponseInterceptorFunc(func(resp *http.Response) error { return nil }),
+		},
+	})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	conn := <-relay.conns
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: public.example\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, got %v (%v)", resp, err)
+	}
+
+	io.WriteString(conn, "ping\n")
+	line, err := reader.ReadString('\n')
+	if err != nil || line != "echo ping\n" {
+		t.Errorf("Expected the upgraded stream to be copied, got %q (%v)", line, err)
+	}
+}
@@ -0,0 +1,72 @@
+package vrata
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/netip"
+	"net/textproto"
+	"strings"
+)
+
+// ipRules admits clients by address: denied prefixes always lose, and a
+// non-empty allow list admits only the prefixes on it
+func ipRules(allow, deny []netip.Prefix) accessCheck {
+	return func(req *http.Request) *rejection {
+		forbidden := &rejection{status: http.StatusForbidden}
+
+		addr, err := netip.ParseAddr(relayClientIP(req.Header))
+		if err != nil {
+			// Without an address only an open allow list can admit
+			if len(allow) > 0 {
+				return forbidden
+			}
+			return nil
+		}
+		addr = addr.Unmap()
+
+		for _, prefix := range deny {
+			if prefix.Contains(addr) {
+				return forbidden
+			}
+		}
+		if len(allow) == 0 {
+			return nil
+		}
+		for _, prefix := range allow {
+			if prefix.Contains(addr) {
+				return nil
+			}
+		}
+		return forbidden
+	}
+}
+
+// headClientIP returns relayClientIP of a request head, or "" when the
+// head doesn't parse
+func headClientIP(head []byte) string {
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(head)))
+	if _, err := reader.ReadLine(); err != nil {
+		return ""
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return ""
+	}
+	return relayClientIP(http.Header(header))
+}
+
+// relayClientIP returns the client address the relay appended to
+// X-Forwarded-For. Earlier entries come from the client and can be forged,
+// so access rules only trust the last one.
+func relayClientIP(header http.Header) string {
+	values := header.Values("X-Forwarded-For")
+	if len(values) == 0 {
+		return ""
+	}
+	last := values[len(values)-1]
+	if i := strings.LastIndexByte(last, ','); i >= 0 {
+		last = last[i+1:]
+	}
+	return strings.TrimSpace(last)
+}
@@ -0,0 +1,78 @@
+package vrata
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestIPRules(t *testing.T) {
+	office := netip.MustParsePrefix("203.0.113.0/24")
+	intruder := netip.MustParsePrefix("203.0.113.66/32")
+	v6 := netip.MustParsePrefix("2001:db8::/32")
+
+	tests := []struct {
+		name    string
+		allow   []netip.Prefix
+		deny    []netip.Prefix
+		client  string
+		allowed bool
+	}{
+		{name: "allowed", allow: []netip.Prefix{office}, client: "203.0.113.7", allowed: true},
+		{name: "not on allow list", allow: []netip.Prefix{office}, client: "198.51.100.1"},
+		{name: "denied wins", allow: []netip.Prefix{office}, deny: []netip.Prefix{intruder}, client: "203.0.113.66"},
+		{name: "deny only", deny: []netip.Prefix{intruder}, client: "198.51.100.1", allowed: true},
+		{name: "ipv6", allow: []netip.Prefix{v6}, client: "2001:db8::1", allowed: true},
+		{name: "mapped ipv4", allow: []netip.Prefix{office}, client: "::ffff:203.0.113.7", allowed: true},
+		{name: "unknown client with allow list", allow: []netip.Prefix{office}, client: ""},
+		{name: "unknown client with deny list", deny: []netip.Prefix{intruder}, client: "", allowed: true},
+		{name: "forged entry ignored", allow: []netip.Prefix{office}, client: "203.0.113.7, 198.51.100.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.client != "" {
+				req.Header.Set("X-Forwarded-For", tt.client)
+			}
+
+			denied := ipRules(tt.allow, tt.deny)(req)
+			if tt.allowed && denied != nil {
+				t.Errorf("Expected %q to be allowed, got %d", tt.client, denied.status)
+			}
+			if !tt.allowed && (denied == nil || denied.status != http.StatusForbidden) {
+				t.Errorf("Expected %q to get 403, got %+v", tt.client, denied)
+			}
+		})
+	}
+}
+
+func TestRelayClientIP(t *testing.T) {
+	header := http.Header{"X-Forwarded-For": {"10.0.0.1, 10.0.0.2", "192.0.2.9"}}
+	if got := relayClientIP(header); got != "192.0.2.9" {
+		t.Errorf("Expected the last forwarded address, got %q", got)
+	}
+}
+
+func TestHeadClientIP(t *testing.T) {
+	head := []byte("GET / HTTP/1.1\r\nHost: x\r\nx-forwarded-for: 198.51.100.1, 203.0.113.7\r\n\r\n")
+	if client := headClientIP(head); client != "203.0.113.7" {
+		t.Errorf("Expected the relay's entry '203.0.113.7', got %q", client)
+	}
+	if client := headClientIP([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n")); client != "" {
+		t.Errorf("Expected empty client, got %q", client)
+	}
+}
+
+func TestCheckAccessRunsIPRulesFirst(t *testing.T) {
+	tc := &TunnelCluster{checks: accessChecks(&TunnelOptions{
+		DenyIPs:   []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		BasicAuth: &BasicAuth{Username: "alice", Password: "s3cret"},
+	})}
+
+	denied := tc.checkAccess([]byte("GET / HTTP/1.1\r\nHost: a\r\nX-Forwarded-For: 192.0.2.1\r\n\r\n"))
+	if denied == nil || denied.status != http.StatusForbidden {
+		t.Errorf("Expected a blocked client to get 403 before the login prompt, got %+v", denied)
+	}
+}
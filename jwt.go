@@ -0,0 +1,266 @@
+package vrata
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidToken is returned for bearer tokens that fail validation
+var ErrInvalidToken = errors.New("invalid token")
+
+const (
+	// jwtLeeway tolerates clock skew when checking exp and nbf
+	jwtLeeway = 30 * time.Second
+
+	// jwksMaxAge is how long fetched keys are trusted before a refetch
+	jwksMaxAge = time.Hour
+	// jwksMinRefresh rate limits refetches triggered by unknown key IDs
+	jwksMinRefresh = time.Minute
+)
+
+// JWTAuth requires visitors to send a valid JSON Web Token as a bearer
+// token. HS256 tokens are checked against Secret, RS256 tokens against the
+// keys published at JWKSURL. Requests without a valid token are answered
+// with 401 and never reach the local server. Tokens must carry an exp
+// claim, so none is valid forever.
+type JWTAuth struct {
+	Secret  []byte
+	JWKSURL string
+
+	// Issuer and Audience, when set, must match the iss and aud claims
+	Issuer   string
+	Audience string
+
+	// Client fetches the key set; defaults to a client with a 10s timeout
+	Client *http.Client
+
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+	// fetching is closed when the key set being fetched is stored, and is
+	// nil when no fetch is under way
+	fetching chan struct{}
+	mutex    sync.Mutex
+}
+
+// check admits requests carrying a valid bearer token
+func (a *JWTAuth) check(req *http.Request) *rejection {
+	challenge := `Bearer realm="vrata"`
+
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if ok {
+		if _, err := a.Verify(strings.TrimSpace(token)); err == nil {
+			return nil
+		}
+		challenge += `, error="invalid_token"`
+	}
+
+	return &rejection{
+		status: http.StatusUnauthorized,
+		header: http.Header{"Www-Authenticate": {challenge}},
+	}
+}
+
+// Verify checks a token's signature and standard claims and returns its
+// claims
+func (a *JWTAuth) Verify(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad signature encoding", ErrInvalidToken)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	digest := sha256.Sum256(signed)
+
+	// The algorithm comes from the configuration, never from the token
+	// alone, so "none" and HS256-with-the-public-key tricks fail
+	switch {
+	case header.Alg == "HS256" && len(a.Secret) > 0:
+		mac := hmac.New(sha256.New, a.Secret)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+		}
+	case header.Alg == "RS256" && a.JWKSURL != "":
+		key, err := a.key(header.Kid)
+		if err != nil {
+			return nil, err
+		}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unexpected algorithm %q", ErrInvalidToken, header.Alg)
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := a.checkClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// checkClaims validates exp, which is required, and nbf, iss and aud
+func (a *JWTAuth) checkClaims(claims map[string]any, now time.Time) error {
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: no expiry", ErrInvalidToken)
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+	if a.Issuer != "" && claims["iss"] != a.Issuer {
+		return fmt.Errorf("%w: wrong issuer", ErrInvalidToken)
+	}
+	if a.Audience != "" {
+		var audiences []string
+		switch aud := claims["aud"].(type) {
+		case string:
+			audiences = []string{aud}
+		case []any:
+			for _, item := range aud {
+				if s, ok := item.(string); ok {
+					audiences = append(audiences, s)
+				}
+			}
+		}
+		if !slices.Contains(audiences, a.Audience) {
+			return fmt.Errorf("%w: wrong audience", ErrInvalidToken)
+		}
+	}
+	return nil
+}
+
+// decodeJWTPart decodes a base64url JSON segment
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: bad encoding", ErrInvalidToken)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: bad JSON", ErrInvalidToken)
+	}
+	return nil
+}
+
+// key returns the RS256 key with the given ID, fetching the key set when
+// it is stale or doesn't know the ID yet. The fetch runs outside the lock;
+// meanwhile known keys stay in use and unknown ones wait for it rather
+// than fetching the key set again.
+func (a *JWTAuth) key(kid string) (*rsa.PublicKey, error) {
+	a.mutex.Lock()
+	age := time.Since(a.fetchedAt)
+	_, known := a.keys[kid]
+	stale := (known && age >= jwksMaxAge) || (!known && age >= jwksMinRefresh)
+
+	var err error
+	switch fetching := a.fetching; {
+	case !stale, fetching != nil && known:
+		// Known keys don't wait for a refetch under way
+	case fetching != nil:
+		a.mutex.Unlock()
+		<-fetching
+		a.mutex.Lock()
+	default:
+		fetching = make(chan struct{})
+		a.fetching = fetching
+		a.mutex.Unlock()
+
+		var keys map[string]*rsa.PublicKey
+		keys, err = a.fetchKeys()
+
+		a.mutex.Lock()
+		if err == nil {
+			a.keys, a.fetchedAt = keys, time.Now()
+		}
+		a.fetching = nil
+		close(fetching)
+	}
+	key, known := a.keys[kid]
+	a.mutex.Unlock()
+
+	// Known keys stay in use while the key set is unreachable
+	switch {
+	case known:
+		return key, nil
+	case err != nil:
+		return nil, err
+	}
+	return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+}
+
+// fetchKeys downloads the RSA signing keys of the key set
+func (a *JWTAuth) fetchKeys() (map[string]*rsa.PublicKey, error) {
+	client := a.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	resp, err := client.Get(a.JWKSURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,242 @@
+package vrata
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// signJWT builds a token; key is a []byte secret for HS256 or an
+// *rsa.PrivateKey for RS256
+func signJWT(t *testing.T, header, claims map[string]any, key any) string {
+	t.Helper()
+
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("Failed to encode token: %v", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTAuthHS256(t *testing.T) {
+	secret := []byte("shared secret")
+	auth := &JWTAuth{Secret: secret, Issuer: "ci", Audience: "api"}
+	hs256 := map[string]any{"alg": "HS256", "typ": "JWT"}
+	future := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name   string
+		header map[string]any
+		claims map[string]any
+		key    []byte
+		valid  bool
+	}{
+		{name: "valid", header: hs256, claims: map[string]any{"iss": "ci", "aud": "api", "exp": future}, key: secret, valid: true},
+		{name: "audience list", header: hs256, claims: map[string]any{"iss": "ci", "aud": []string{"web", "api"}, "exp": future}, key: secret, valid: true},
+		{name: "expired", header: hs256, claims: map[string]any{"iss": "ci", "aud": "api", "exp": time.Now().Add(-time.Hour).Unix()}, key: secret},
+		{name: "no expiry", header: hs256, claims: map[string]any{"iss": "ci", "aud": "api"}, key: secret},
+		{name: "not yet valid", header: hs256, claims: map[string]any{"iss": "ci", "aud": "api", "nbf": future, "exp": future}, key: secret},
+		{name: "wrong issuer", header: hs256, claims: map[string]any{"iss": "prod", "aud": "api", "exp": future}, key: secret},
+		{name: "wrong audience", header: hs256, claims: map[string]any{"iss": "ci", "aud": "web", "exp": future}, key: secret},
+		{name: "wrong secret", header: hs256, claims: map[string]any{"iss": "ci", "aud": "api", "exp": future}, key: []byte("guess")},
+		{name: "alg none", header: map[string]any{"alg": "none"}, claims: map[string]any{"iss": "ci", "aud": "api", "exp": future}, key: secret},
+		{name: "RS256 without JWKS", header: map[string]any{"alg": "RS256"}, claims: map[string]any{"iss": "ci", "aud": "api", "exp": future}, key: secret},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := auth.Verify(signJWT(t, tt.header, tt.claims, tt.key))
+			if tt.valid && err != nil {
+				t.Errorf("Expected a valid token, got %v", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("Expected ErrInvalidToken, got %v", err)
+			}
+		})
+	}
+}
+
+func TestJWTAuthRS256WithJWKS(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	var rotated atomic.Bool
+	var fetches atomic.Int64
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		keys := []any{jwk("old", &oldKey.PublicKey)}
+		if rotated.Load() {
+			keys = append(keys, jwk("new", &newKey.PublicKey))
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	}))
+	defer jwks.Close()
+
+	auth := &JWTAuth{JWKSURL: jwks.URL}
+	claims := map[string]any{"sub": "tester", "exp": time.Now().Add(time.Hour).Unix()}
+
+	if _, err := auth.Verify(signJWT(t, map[string]any{"alg": "RS256", "kid": "old"}, claims, oldKey)); err != nil {
+		t.Fatalf("Expected a valid RS256 token, got %v", err)
+	}
+
+	// HS256 signed with the public key must not pass as RS256
+	forged := signJWT(t, map[string]any{"alg": "HS256", "kid": "old"}, claims, oldKey.PublicKey.N.Bytes())
+	if _, err := auth.Verify(forged); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected the algorithm confusion token to fail, got %v", err)
+	}
+
+	// A new key ID triggers a refetch, but not more than once a minute
+	rotated.Store(true)
+	token := signJWT(t, map[string]any{"alg": "RS256", "kid": "new"}, claims, newKey)
+	if _, err := auth.Verify(token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected the unknown key to be rejected until the refresh interval, got %v", err)
+	}
+	auth.fetchedAt = auth.fetchedAt.Add(-jwksMinRefresh)
+	if _, err := auth.Verify(token); err != nil {
+		t.Errorf("Expected the rotated key to be fetched, got %v", err)
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("Expected 2 key set fetches, got %d", n)
+	}
+}
+
+func TestJWTAuthFetchesKeysOutsideLock(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	var fetches atomic.Int64
+	fetching := make(chan struct{}, 1)
+	release := make(chan struct{})
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) > 1 {
+			fetching <- struct{}{}
+			<-release
+		}
+		keys := []any{jwk("old", &oldKey.PublicKey), jwk("new", &newKey.PublicKey)}
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	}))
+	defer jwks.Close()
+	releaseFetch := sync.OnceFunc(func() { close(release) })
+	defer releaseFetch()
+
+	auth := &JWTAuth{JWKSURL: jwks.URL}
+	claims := map[string]any{"exp": time.Now().Add(time.Hour).Unix()}
+	oldToken := signJWT(t, map[string]any{"alg": "RS256", "kid": "old"}, claims, oldKey)
+	if _, err := auth.Verify(oldToken); err != nil {
+		t.Fatalf("Expected a valid RS256 token, got %v", err)
+	}
+
+	// Expire the key set, so the next tokens refetch it
+	auth.mutex.Lock()
+	auth.fetchedAt = auth.fetchedAt.Add(-jwksMaxAge)
+	delete(auth.keys, "new")
+	auth.mutex.Unlock()
+
+	newToken := signJWT(t, map[string]any{"alg": "RS256", "kid": "new"}, claims, newKey)
+	errs := make(chan error, 3)
+	for range 3 {
+		go func() {
+			_, err := auth.Verify(newToken)
+			errs <- err
+		}()
+	}
+	<-fetching
+
+	// Tokens of known keys pass while the key set is being fetched
+	done := make(chan error)
+	go func() {
+		_, err := auth.Verify(oldToken)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected the known key to pass during the fetch, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Verify blocked on the key set fetch")
+	}
+
+	releaseFetch()
+	for range 3 {
+		if err := <-errs; err != nil {
+			t.Errorf("Expected the fetched key to pass, got %v", err)
+		}
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("Expected 2 key set fetches, got %d", n)
+	}
+}
+
+func jwk(kid string, key *rsa.PublicKey) map[string]any {
+	return map[string]any{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func TestJWTAuthCheck(t *testing.T) {
+	auth := &JWTAuth{Secret: []byte("s")}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	if denied := auth.check(req); denied == nil || denied.header.Get("WWW-Authenticate") != `Bearer realm="vrata"` {
+		t.Errorf("Expected a bearer challenge without a token, got %+v", denied)
+	}
+
+	req.Header.Set("Authorization", "Bearer nonsense")
+	if denied := auth.check(req); denied == nil || denied.status != http.StatusUnauthorized ||
+		denied.header.Get("WWW-Authenticate") != `Bearer realm="vrata", error="invalid_token"` {
+		t.Errorf("Expected invalid_token for a bad token, got %+v", denied)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", signJWT(t, map[string]any{"alg": "HS256"}, map[string]any{"exp": time.Now().Add(time.Hour).Unix()}, []byte("s"))))
+	if denied := auth.check(req); denied != nil {
+		t.Errorf("Expected a valid token to pass, got %d", denied.status)
+	}
+}
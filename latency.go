@@ -0,0 +1,177 @@
+package vrata
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the latency histogram buckets.
+// A final implicit bucket counts everything slower.
+var LatencyBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// maxRoutes bounds the number of routes tracked per tunnel; requests for
+// further routes are counted under otherRoute
+const maxRoutes = 200
+
+const otherRoute = "OTHER"
+
+// LatencyHistogram is the latency distribution of one route, measured
+// from the moment a request is forwarded to the local server until its
+// response is complete
+type LatencyHistogram struct {
+	// Counts holds one count per LatencyBuckets entry plus one for
+	// slower requests
+	Counts []int64
+	Count  int64
+	Sum    time.Duration
+}
+
+// Mean returns the average latency
+func (h LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Quantile estimates the q-quantile (0 < q <= 1) by interpolating within
+// the bucket it falls in. Latencies beyond the last bucket are reported as
+// its upper bound.
+func (h LatencyHistogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+
+	rank := q * float64(h.Count)
+	var seen int64
+	for i, count := range h.Counts {
+		if count == 0 || float64(seen+count) < rank {
+			seen += count
+			continue
+		}
+		if i == len(LatencyBuckets) {
+			return LatencyBuckets[len(LatencyBuckets)-1]
+		}
+
+		var lower time.Duration
+		if i > 0 {
+			lower = LatencyBuckets[i-1]
+		}
+		fraction := (rank - float64(seen)) / float64(count)
+		return lower + time.Duration(fraction*float64(LatencyBuckets[i]-lower))
+	}
+	return LatencyBuckets[len(LatencyBuckets)-1]
+}
+
+// observe adds a latency to the histogram
+func (h *LatencyHistogram) observe(d time.Duration) {
+	if h.Counts == nil {
+		h.Counts = make([]int64, len(LatencyBuckets)+1)
+	}
+
+	i := 0
+	for i < len(LatencyBuckets) && d > LatencyBuckets[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+// routeLatencies tracks a histogram per "METHOD /path/template"
+type routeLatencies struct {
+	routes map[string]*LatencyHistogram
+	mutex  sync.Mutex
+}
+
+func newRouteLatencies() *routeLatencies {
+	return &routeLatencies{routes: make(map[string]*LatencyHistogram)}
+}
+
+// record adds a completed exchange. Protocol upgrades are skipped since
+// their duration is the lifetime of the upgraded stream.
+func (r *routeLatencies) record(info RequestInfo) {
+	if info.StatusCode == 101 {
+		return
+	}
+
+	route := info.Method + " " + routeTemplate(info.Path)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	h, ok := r.routes[route]
+	if !ok {
+		if len(r.routes) >= maxRoutes {
+			route = otherRoute
+			h = r.routes[route]
+		}
+		if h == nil {
+			h = &LatencyHistogram{}
+			r.routes[route] = h
+		}
+	}
+	h.observe(info.Duration)
+}
+
+// snapshot copies all histograms
+func (r *routeLatencies) snapshot() map[string]LatencyHistogram {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	routes := make(map[string]LatencyHistogram, len(r.routes))
+	for route, h := range r.routes {
+		routes[route] = LatencyHistogram{
+			Counts: append([]int64(nil), h.Counts...),
+			Count:  h.Count,
+			Sum:    h.Sum,
+		}
+	}
+	return routes
+}
+
+var (
+	uuidSegment = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hexSegment  = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+)
+
+// routeTemplate replaces path segments that look like identifiers with
+// placeholders, so /users/42 and /users/43 share the route /users/:id
+func routeTemplate(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		switch {
+		case segment == "":
+		case isDigits(segment):
+			segments[i] = ":id"
+		case uuidSegment.MatchString(segment):
+			segments[i] = ":uuid"
+		case hexSegment.MatchString(segment):
+			segments[i] = ":hash"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package vrata
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRouteTemplate(t *testing.T) {
+	tests := map[string]string{
+		"/":                 "/",
+		"/users/42":         "/users/:id",
+		"/users/42/posts/7": "/users/:id/posts/:id",
+		"/orders/3f2c8a1e-9b7d-4c2a-8e1f-0a1b2c3d4e5f": "/orders/:uuid",
+		"/blobs/0123456789abcdef0123":                  "/blobs/:hash",
+		"/v2/status":                                   "/v2/status",
+	}
+
+	for path, want := range tests {
+		if got := routeTemplate(path); got != want {
+			t.Errorf("routeTemplate(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	var h LatencyHistogram
+	for i := 0; i < 90; i++ {
+		h.observe(3 * time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		h.observe(400 * time.Millisecond)
+	}
+
+	if h.Count != 100 {
+		t.Errorf("Expected 100 observations, got %d", h.Count)
+	}
+	if mean := h.Mean(); mean != 42700*time.Microsecond {
+		t.Errorf("Expected 42.7ms mean, got %s", mean)
+	}
+	if p50 := h.Quantile(0.5); p50 > 5*time.Millisecond {
+		t.Errorf("Expected p50 within the first bucket, got %s", p50)
+	}
+	if p99 := h.Quantile(0.99); p99 <= 250*time.Millisecond || p99 > 500*time.Millisecond {
+		t.Errorf("Expected p99 in the 250-500ms bucket, got %s", p99)
+	}
+
+	h.observe(time.Minute)
+	if max := h.Quantile(1); max != 10*time.Second {
+		t.Errorf("Expected overflow to report the last bound, got %s", max)
+	}
+}
+
+func TestRouteLatencies(t *testing.T) {
+	latencies := newRouteLatencies()
+	latencies.record(RequestInfo{Method: "GET", Path: "/users/1", StatusCode: 200, Duration: time.Millisecond})
+	latencies.record(RequestInfo{Method: "GET", Path: "/users/2", StatusCode: 200, Duration: time.Millisecond})
+	latencies.record(RequestInfo{Method: "GET", Path: "/ws", StatusCode: 101, Duration: time.Hour})
+
+	routes := latencies.snapshot()
+	if len(routes) != 1 || routes["GET /users/:id"].Count != 2 {
+		t.Errorf("Unexpected routes: %v", routes)
+	}
+
+	for i := 0; i < maxRoutes+10; i++ {
+		latencies.record(RequestInfo{Method: "GET", Path: fmt.Sprintf("/page-%d", i), Duration: time.Millisecond})
+	}
+	routes = latencies.snapshot()
+	if len(routes) > maxRoutes+1 || routes[otherRoute].Count == 0 {
+		t.Errorf("Expected routes to be capped, got %d routes", len(routes))
+	}
+}
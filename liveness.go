@@ -0,0 +1,97 @@
+package vrata
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// ReconnectInfo describes a data connection redialed after it dropped.
+// Many of them for a connection that was up briefly mean it's flapping.
+type ReconnectInfo struct {
+	// Connection is the pool index of the connection
+	Connection int
+	// Reason is why it dropped, e.g. "idle timeout" or "closed by relay"
+	Reason string
+	// Uptime is how long the dropped connection was up; zero when it
+	// couldn't be dialed
+	Uptime time.Duration
+}
+
+// connectionDrop records why an idle data connection went away
+type connectionDrop struct {
+	reason string
+	uptime time.Duration
+}
+
+// dropReason describes the error that ended an idle wait for a visitor
+func dropReason(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, io.EOF):
+		return "closed by relay"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "idle timeout"
+	}
+	return err.Error()
+}
+
+// dropped records that the idle connection went away
+func (conn *TunnelConnection) dropped(reason string) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	connectedAt := time.Unix(0, conn.connectedAt.Load())
+	conn.drop = &connectionDrop{reason: reason, uptime: time.Since(connectedAt)}
+}
+
+// redialDropped redials a connection that dropped while idle right away,
+// instead of waiting for maintenance. Connections that drop right after
+// connecting, and pools that shouldn't grow, are left to maintenance.
+func (tc *TunnelCluster) redialDropped(ctx context.Context, conn *TunnelConnection, host string, port int) {
+	conn.mutex.RLock()
+	drop := conn.drop
+	conn.mutex.RUnlock()
+	if drop == nil || drop.uptime < quickReset || ctx.Err() != nil {
+		return
+	}
+
+	tc.mutex.RLock()
+	defer tc.mutex.RUnlock()
+
+	if tc.closed || tc.draining.Load() || tc.throttle.limited() || conn.id >= tc.scale.allowed(len(tc.connections)) {
+		return
+	}
+	conn.reconnect(ctx, host, port)
+}
+
+// reconnect redials the connection and reports why it dropped
+func (conn *TunnelConnection) reconnect(ctx context.Context, host string, port int) {
+	conn.mutex.Lock()
+	info := ReconnectInfo{Connection: conn.id, Reason: "closed"}
+	switch {
+	case conn.failing:
+		info.Reason = "dial failed"
+	case conn.drop != nil:
+		info.Reason, info.Uptime = conn.drop.reason, conn.drop.uptime
+	}
+	conn.drop = nil
+	conn.mutex.Unlock()
+
+	tc := conn.cluster
+	conn.log().Debug("reconnecting", "reason", info.Reason, "uptime", info.Uptime)
+	tc.reconnects.Add(1)
+	tc.stream.publish("reconnect", map[string]any{
+		"connection": info.Connection,
+		"reason":     info.Reason,
+		"uptime_ms":  info.Uptime.Milliseconds(),
+	})
+	select {
+	case tc.events.Reconnect <- info:
+	default:
+	}
+
+	tc.spawn(func() { conn.connect(ctx, host, port) })
+}
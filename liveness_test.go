@@ -0,0 +1,63 @@
+package vrata
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRedialOnEOF(t *testing.T) {
+	relay := newMockRelay(t, 1)
+
+	tunnel, err := ConnectAndOpen(8080, &TunnelOptions{Host: relay.server.URL})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	first := <-relay.conns
+	// Past quickReset, so it isn't taken for throttling
+	time.Sleep(quickReset + 100*time.Millisecond)
+	first.Close()
+
+	// The redial doesn't wait for maintenance
+	select {
+	case conn := <-relay.conns:
+		conn.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the dropped connection to be redialed at once")
+	}
+
+	select {
+	case info := <-tunnel.Events().Reconnect:
+		if info.Connection != 0 || info.Reason != "closed by relay" || info.Uptime < quickReset {
+			t.Errorf("Unexpected reconnect: %+v", info)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a reconnect event")
+	}
+}
+
+func TestDropReason(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	client.SetReadDeadline(time.Now())
+	_, timeout := client.Read(make([]byte, 1))
+	client.Close()
+
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{io.EOF, "closed by relay"},
+		{timeout, "idle timeout"},
+		{errors.New("boom"), "boom"},
+	}
+	for _, tt := range tests {
+		if got := dropReason(tt.err); got != tt.want {
+			t.Errorf("dropReason(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package vrata
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// requestHeadTimeout bounds how long a client may take to send the
+// request line and headers once it started sending
+var requestHeadTimeout = 10 * time.Second
+
+// checkRequestHead reads the head of the first request on a connection and
+// returns it, or the error status to answer with when it must not be
+// forwarded to the local server. Internet scanners send all kinds of
+// garbage; anything that isn't a well-formed HTTP/1.x request is rejected.
+func checkRequestHead(reader *bufio.Reader) ([]byte, int) {
+	head, err := peekRequestHead(reader)
+	switch {
+	case errors.Is(err, bufio.ErrBufferFull):
+		return nil, http.StatusRequestHeaderFieldsTooLarge
+	case isTimeout(err):
+		return nil, http.StatusRequestTimeout
+	case err != nil:
+		return nil, http.StatusBadRequest
+	}
+
+	return head, validateRequestHead(head)
+}
+
+// validateRequestHead returns 0 for a well-formed HTTP/1.x request head,
+// or the error status to reject it with
+func validateRequestHead(head []byte) int {
+	if bytes.IndexByte(head, 0) >= 0 {
+		return http.StatusBadRequest
+	}
+
+	// Every line must end with CRLF
+	for i, c := range head {
+		if c == '\n' && (i == 0 || head[i-1] != '\r') {
+			return http.StatusBadRequest
+		}
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(head), "\r\n\r\n"), "\r\n")
+
+	method, rest, ok1 := strings.Cut(lines[0], " ")
+	target, proto, ok2 := strings.Cut(rest, " ")
+	if !ok1 || !ok2 || !isToken(method) || target == "" || strings.ContainsAny(target, " \t") {
+		return http.StatusBadRequest
+	}
+	major, _, ok := http.ParseHTTPVersion(proto)
+	if !ok {
+		return http.StatusBadRequest
+	}
+	if major != 1 {
+		return http.StatusHTTPVersionNotSupported
+	}
+
+	var contentLength, transferEncoding bool
+	for _, line := range lines[1:] {
+		// Obsolete line folding is a classic smuggling vector
+		if line == "" || line[0] == ' ' || line[0] == '\t' {
+			return http.StatusBadRequest
+		}
+		name, _, ok := strings.Cut(line, ":")
+		if !ok || !isToken(name) {
+			return http.StatusBadRequest
+		}
+		switch http.CanonicalHeaderKey(name) {
+		case "Content-Length":
+			contentLength = true
+		case "Transfer-Encoding":
+			transferEncoding = true
+		}
+	}
+	if contentLength && transferEncoding {
+		return http.StatusBadRequest
+	}
+
+	// Let net/http catch everything else, e.g. bad Content-Length values
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		return http.StatusBadRequest
+	}
+	if req.ProtoAtLeast(1, 1) && req.Host == "" {
+		return http.StatusBadRequest
+	}
+
+	return 0
+}
+
+// writeRejection answers a rejected request, with extra headers if any,
+// and asks the client to close the connection
+func writeRejection(w io.Writer, status int, header http.Header) {
+	text := http.StatusText(status)
+
+	var response strings.Builder
+	fmt.Fprintf(&response, "HTTP/1.1 %d %s\r\n", status, text)
+	header.Write(&response)
+	fmt.Fprintf(&response, "Content-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s\n",
+		len(text)+1, text)
+
+	if conn, ok := w.(net.Conn); ok {
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	}
+	io.WriteString(w, response.String())
+}
+
+// isToken reports whether s is a valid HTTP token (RFC 9110)
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range []byte(s) {
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// isTimeout reports whether err is a network timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
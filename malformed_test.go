@@ -0,0 +1,117 @@
+package vrata
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadRequestCorpus returns the raw requests in testdata/requests keyed by
+// file name. Names start with the expected rejection status, or "ok".
+func loadRequestCorpus(t *testing.T) map[string][]byte {
+	t.Helper()
+
+	paths, err := filepath.Glob("testdata/requests/*.http")
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("No request corpus found: %v", err)
+	}
+
+	corpus := make(map[string][]byte, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", path, err)
+		}
+		corpus[filepath.Base(path)] = data
+	}
+	return corpus
+}
+
+// expectedStatus parses the status a corpus entry should be rejected with
+func expectedStatus(t *testing.T, name string) int {
+	prefix, _, _ := strings.Cut(name, "-")
+	if prefix == "ok" {
+		return 0
+	}
+	status, err := strconv.Atoi(prefix)
+	if err != nil {
+		t.Fatalf("Bad corpus file name %q", name)
+	}
+	return status
+}
+
+func TestCheckRequestHeadCorpus(t *testing.T) {
+	for name, data := range loadRequestCorpus(t) {
+		reader := bufio.NewReaderSize(bytes.NewReader(data), maxRequestHead)
+		if _, status := checkRequestHead(reader); status != expectedStatus(t, name) {
+			t.Errorf("%s: expected status %d, got %d", name, expectedStatus(t, name), status)
+		}
+	}
+}
+
+func TestCheckRequestHeadTooLarge(t *testing.T) {
+	data := "GET / HTTP/1.1\r\nHost: example.com\r\nX-Big: " + strings.Repeat("a", maxRequestHead) + "\r\n\r\n"
+	reader := bufio.NewReaderSize(strings.NewReader(data), maxRequestHead)
+
+	if _, status := checkRequestHead(reader); status != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Expected 431, got %d", status)
+	}
+}
+
+func TestTunnelRejectsMalformedRequests(t *testing.T) {
+	relay := newMockRelay(t, 1)
+
+	defer func(interval time.Duration) { maintenanceInterval = interval }(maintenanceInterval)
+	maintenanceInterval = 10 * time.Millisecond
+
+	tunnel, err := ConnectAndOpen(8080, &TunnelOptions{Host: relay.server.URL})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	rejected := int64(0)
+	for name, data := range loadRequestCorpus(t) {
+		status := expectedStatus(t, name)
+		if status == 0 || strings.Contains(name, "truncated") {
+			continue
+		}
+
+		resp := relay.roundTrip(t, string(data))
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode != status || !resp.Close {
+			t.Errorf("%s: expected %d with Connection: close, got %d", name, status, resp.StatusCode)
+		}
+		rejected++
+	}
+
+	if got := tunnel.Stats().Rejected; got != rejected {
+		t.Errorf("Expected %d rejected requests, got %d", rejected, got)
+	}
+}
+
+func TestTunnelSlowRequestHead(t *testing.T) {
+	relay := newMockRelay(t, 1)
+
+	defer func(timeout time.Duration) { requestHeadTimeout = timeout }(requestHeadTimeout)
+	requestHeadTimeout = 100 * time.Millisecond
+
+	tunnel, err := ConnectAndOpen(8080, &TunnelOptions{Host: relay.server.URL})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	// Send the request line and then stall
+	resp := relay.roundTrip(t, "GET / HTTP/1.1\r\n")
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("Expected 408, got %d", resp.StatusCode)
+	}
+}
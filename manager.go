@@ -0,0 +1,171 @@
+package vrata
+
+import (
+	"maps"
+	"slices"
+	"sync"
+)
+
+// Budget is the resource allowance of each tunnel run by a Manager. Zero
+// fields are unlimited.
+type Budget struct {
+	// MaxConnections caps the tunnel's connection pool
+	MaxConnections int
+	// MaxConcurrentRequests caps requests forwarded at once
+	MaxConcurrentRequests int
+	// BandwidthLimit caps local traffic in bytes per second
+	BandwidthLimit int64
+	// MaxCaptureBytes caps memory buffered for request monitoring
+	MaxCaptureBytes int64
+}
+
+// Manager runs many tunnels in one process. Every tunnel has its own
+// connection pool, admission queue, bandwidth and capture budget, so a
+// noisy tunnel can't starve the others, and its metrics and logs carry a
+// "tunnel" label with its name.
+type Manager struct {
+	defaults Budget
+	tunnels  map[string]*Tunnel
+	mutex    sync.Mutex
+}
+
+// NewManager creates a manager whose tunnels get the default budget
+// unless their options say otherwise
+func NewManager(defaults Budget) *Manager {
+	return &Manager{
+		defaults: defaults,
+		tunnels:  make(map[string]*Tunnel),
+	}
+}
+
+// Open creates and opens a tunnel under name. Budget fields left at zero
+// in options are taken from the manager's defaults.
+func (m *Manager) Open(name string, port int, options *TunnelOptions) (*Tunnel, error) {
+	var opts TunnelOptions
+	if options != nil {
+		opts = *options
+	}
+	m.applyBudget(&opts)
+
+	opts.Labels = maps.Clone(opts.Labels)
+	if opts.Labels == nil {
+		opts.Labels = make(map[string]string)
+	}
+	opts.Labels["tunnel"] = name
+
+	tunnel, err := NewTunnel(port, &opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reserve the name before registering so concurrent opens can't race
+	m.mutex.Lock()
+	if _, exists := m.tunnels[name]; exists {
+		m.mutex.Unlock()
+		return nil, ErrTunnelExists
+	}
+	m.tunnels[name] = tunnel
+	m.mutex.Unlock()
+
+	if err := tunnel.Open(); err != nil {
+		tunnel.Close()
+		m.remove(name, tunnel)
+		return nil, err
+	}
+
+	return tunnel, nil
+}
+
+// Add puts an already created tunnel under the manager's control. Its
+// options are used as they are.
+func (m *Manager) Add(name string, tunnel *Tunnel) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, exists := m.tunnels[name]; exists {
+		return ErrTunnelExists
+	}
+	m.tunnels[name] = tunnel
+	return nil
+}
+
+// applyBudget fills unset resource limits from the defaults
+func (m *Manager) applyBudget(options *TunnelOptions) {
+	if options.MaxConnections == 0 {
+		options.MaxConnections = m.defaults.MaxConnections
+	}
+	if options.MaxConcurrentRequests == 0 {
+		options.MaxConcurrentRequests = m.defaults.MaxConcurrentRequests
+	}
+	if options.BandwidthLimit == 0 {
+		options.BandwidthLimit = m.defaults.BandwidthLimit
+	}
+	if options.MaxCaptureBytes == 0 {
+		options.MaxCaptureBytes = m.defaults.MaxCaptureBytes
+	}
+}
+
+// Get returns the tunnel registered under name
+func (m *Manager) Get(name string) (*Tunnel, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	tunnel, ok := m.tunnels[name]
+	return tunnel, ok
+}
+
+// Names returns the names of all managed tunnels, sorted
+func (m *Manager) Names() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return slices.Sorted(maps.Keys(m.tunnels))
+}
+
+// Stats returns a snapshot of every managed tunnel, keyed by name
+func (m *Manager) Stats() map[string]Stats {
+	m.mutex.Lock()
+	tunnels := maps.Clone(m.tunnels)
+	m.mutex.Unlock()
+
+	stats := make(map[string]Stats, len(tunnels))
+	for name, tunnel := range tunnels {
+		stats[name] = tunnel.Stats()
+	}
+	return stats
+}
+
+// Close closes and forgets the tunnel registered under name
+func (m *Manager) Close(name string) error {
+	m.mutex.Lock()
+	tunnel, ok := m.tunnels[name]
+	delete(m.tunnels, name)
+	m.mutex.Unlock()
+
+	if !ok {
+		return ErrTunnelNotFound
+	}
+	return tunnel.Close()
+}
+
+// CloseAll closes every managed tunnel
+func (m *Manager) CloseAll() {
+	m.mutex.Lock()
+	tunnels := m.tunnels
+	m.tunnels = make(map[string]*Tunnel)
+	m.mutex.Unlock()
+
+	for _, tunnel := range tunnels {
+		tunnel.Close()
+	}
+}
+
+// remove forgets a tunnel if it is still the one registered under name
+func (m *Manager) remove(name string, tunnel *Tunnel) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.tunnels[name] == tunnel {
+		delete(m.tunnels, name)
+	}
+}
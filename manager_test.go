@@ -0,0 +1,90 @@
+package vrata
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestManagerAppliesBudgets(t *testing.T) {
+	relay := newMockRelay(t, 4)
+
+	manager := NewManager(Budget{MaxConnections: 2, BandwidthLimit: 1 << 20})
+	defer manager.CloseAll()
+
+	noisy, err := manager.Open("noisy", 8080, &TunnelOptions{Host: relay.server.URL, Labels: map[string]string{"tenant": "a"}})
+	if err != nil {
+		t.Fatalf("Open(noisy) failed: %v", err)
+	}
+	quiet, err := manager.Open("quiet", 8081, &TunnelOptions{Host: relay.server.URL, MaxConnections: 1})
+	if err != nil {
+		t.Fatalf("Open(quiet) failed: %v", err)
+	}
+
+	waitFor(t, func() bool {
+		return noisy.Stats().TotalConnections == 2 && quiet.Stats().TotalConnections == 1
+	})
+
+	stats := manager.Stats()
+	if labels := stats["noisy"].Labels; labels["tunnel"] != "noisy" || labels["tenant"] != "a" {
+		t.Errorf("Unexpected labels: %v", labels)
+	}
+	if noisy.options.BandwidthLimit != 1<<20 {
+		t.Errorf("Expected default bandwidth budget, got %d", noisy.options.BandwidthLimit)
+	}
+
+	if names := manager.Names(); len(names) != 2 || names[0] != "noisy" || names[1] != "quiet" {
+		t.Errorf("Unexpected names: %v", names)
+	}
+}
+
+func TestManagerLifecycle(t *testing.T) {
+	relay := newMockRelay(t, 1)
+	manager := NewManager(Budget{})
+	defer manager.CloseAll()
+
+	if _, err := manager.Open("app", 8080, &TunnelOptions{Host: relay.server.URL}); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	if _, err := manager.Open("app", 8081, &TunnelOptions{Host: relay.server.URL}); !errors.Is(err, ErrTunnelExists) {
+		t.Errorf("Expected ErrTunnelExists, got %v", err)
+	}
+
+	if err := manager.Close("app"); err != nil {
+		t.Errorf("Close() failed: %v", err)
+	}
+	if _, ok := manager.Get("app"); ok {
+		t.Error("Closed tunnel is still managed")
+	}
+	if err := manager.Close("app"); !errors.Is(err, ErrTunnelNotFound) {
+		t.Errorf("Expected ErrTunnelNotFound, got %v", err)
+	}
+}
+
+func TestManagerOpenFailure(t *testing.T) {
+	manager := NewManager(Budget{})
+
+	if _, err := manager.Open("broken", 8080, &TunnelOptions{Host: "http://127.0.0.1:1"}); err == nil {
+		t.Fatal("Expected registration to fail")
+	}
+	if _, ok := manager.Get("broken"); ok {
+		t.Error("Failed tunnel should not be managed")
+	}
+}
+
+func TestManagerAdd(t *testing.T) {
+	manager := NewManager(Budget{})
+
+	tunnel, err := NewTunnel(8080, nil)
+	if err != nil {
+		t.Fatalf("NewTunnel() failed: %v", err)
+	}
+	if err := manager.Add("existing", tunnel); err != nil {
+		t.Fatalf("Add() failed: %v", err)
+	}
+	if err := manager.Add("existing", tunnel); !errors.Is(err, ErrTunnelExists) {
+		t.Errorf("Expected ErrTunnelExists, got %v", err)
+	}
+	if got, ok := manager.Get("existing"); !ok || got != tunnel {
+		t.Error("Added tunnel not found")
+	}
+}
@@ -0,0 +1,442 @@
+package vrata
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxTapBuffer bounds how far a parser may fall behind the proxied stream
+// before monitoring of the connection is abandoned
+const maxTapBuffer = 1 << 20
+
+// exchangeMonitor follows the HTTP traffic flowing through a raw proxied
+// connection and reports every completed request/response exchange. It
+// parses copies of the streams, so the proxied bytes are never altered and
+// the proxy is never slowed down by it.
+type exchangeMonitor struct {
+	requests   *streamTap
+	responses  *streamTap
+	pending    chan *RequestInfo
+	onRequest  func(RequestInfo)
+	onResponse func(RequestInfo)
+	onStream   func()
+	wg         sync.WaitGroup
+
+	// upgraded is the exchange that switched protocols, if any. Bytes of
+	// the tunneled stream that follows are attributed to it and it is
+	// reported once the connection ends.
+	upgraded    *RequestInfo
+	upgradedIn  int64
+	upgradedOut int64
+}
+
+// newExchangeMonitor starts parsing both directions of a connection.
+// onRequest is called once a request has been forwarded, onResponse once
+// the local server has finished answering it. onStream, which may be nil,
+// is called once the local server switches protocols or starts an event
+// stream. Buffered stream copies are charged to budget, which may be nil.
+func newExchangeMonitor(budget *captureBudget, onRequest, onResponse func(RequestInfo), onStream func()) *exchangeMonitor {
+	m := &exchangeMonitor{
+		requests:   newStreamTap(maxTapBuffer, budget),
+		responses:  newStreamTap(maxTapBuffer, budget),
+		pending:    make(chan *RequestInfo, 64),
+		onRequest:  onRequest,
+		onResponse: onResponse,
+		onStream:   onStream,
+	}
+
+	m.wg.Add(2)
+	go m.parseRequests(m.requests)
+	go m.parseResponses(m.responses)
+
+	return m
+}
+
+// wrap returns a connection that feeds everything written to and read from
+// localConn into the monitor and the owner's byte counters
+func (m *exchangeMonitor) wrap(localConn net.Conn, owner *TunnelConnection) net.Conn {
+	return &monitoredConn{Conn: localConn, monitor: m, owner: owner}
+}
+
+// close stops the parsers and waits for pending events to be emitted
+func (m *exchangeMonitor) close() {
+	m.requests.Close()
+	m.responses.Close()
+	m.wg.Wait()
+
+	if m.upgraded != nil {
+		info := *m.upgraded
+		info.BytesIn += m.upgradedIn
+		info.BytesOut += m.upgradedOut
+		info.Duration = time.Since(info.start)
+		m.onResponse(info)
+	}
+}
+
+// parseRequests reads requests sent to the local server
+func (m *exchangeMonitor) parseRequests(r io.Reader) {
+	defer m.wg.Done()
+
+	counter := &countingReader{reader: r}
+	reader := bufio.NewReader(counter)
+
+	var upgradeStart int64 = -1
+	defer func() {
+		close(m.pending)
+		io.Copy(io.Discard, reader)
+		if upgradeStart >= 0 {
+			m.upgradedIn = counter.n - upgradeStart
+		}
+	}()
+
+	for {
+		if _, err := reader.Peek(1); err != nil {
+			return
+		}
+		start := time.Now()
+		before := counter.n - int64(reader.Buffered())
+
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+
+		info := &RequestInfo{
+			Method:     req.Method,
+			Path:       req.URL.Path,
+			URL:        req.URL.RequestURI(),
+			RemoteAddr: forwardedFor(req.Header),
+			Header:     req.Header,
+			BytesIn:    counter.n - int64(reader.Buffered()) - before,
+			start:      start,
+			proto:      req.Proto,
+		}
+		m.onRequest(*info)
+		m.pending <- info
+
+		if isUpgrade(req.Header) {
+			upgradeStart = counter.n - int64(reader.Buffered())
+			return
+		}
+	}
+}
+
+// parseResponses reads responses from the local server and pairs them with
+// the requests they answer
+func (m *exchangeMonitor) parseResponses(r io.Reader) {
+	defer m.wg.Done()
+
+	counter := &countingReader{reader: r}
+	reader := bufio.NewReader(counter)
+	defer io.Copy(io.Discard, reader)
+
+	for info := range m.pending {
+		before := counter.n - int64(reader.Buffered())
+		req := &http.Request{Method: info.Method}
+
+		resp, err := http.ReadResponse(reader, req)
+		// Skip interim responses such as 100 Continue
+		for err == nil && resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+			resp, err = http.ReadResponse(reader, req)
+		}
+		if err != nil {
+			return
+		}
+		if m.onStream != nil && isEventStream(resp.Header) {
+			m.onStream()
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		info.StatusCode = resp.StatusCode
+		info.ResponseHeader = resp.Header
+		info.BytesOut = counter.n - int64(reader.Buffered()) - before
+
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			// Attribute the rest of the stream to this exchange
+			m.upgraded = info
+			if m.onStream != nil {
+				m.onStream()
+			}
+			upgradeStart := counter.n - int64(reader.Buffered())
+			io.Copy(io.Discard, reader)
+			m.upgradedOut = counter.n - upgradeStart
+			return
+		}
+
+		info.Duration = time.Since(info.start)
+		m.onResponse(*info)
+	}
+}
+
+// monitoredConn mirrors local connection traffic into an exchangeMonitor
+// and the owning tunnel connection's byte counters
+type monitoredConn struct {
+	net.Conn
+	monitor *exchangeMonitor
+	owner   *TunnelConnection
+}
+
+func (mc *monitoredConn) Write(p []byte) (int, error) {
+	n, err := mc.Conn.Write(p)
+	if n > 0 {
+		mc.monitor.requests.Write(p[:n])
+		mc.countIn(int64(n))
+	}
+	return n, err
+}
+
+func (mc *monitoredConn) Read(p []byte) (int, error) {
+	n, err := mc.Conn.Read(p)
+	if n > 0 {
+		mc.monitor.responses.Write(p[:n])
+		mc.countOut(int64(n))
+	}
+	return n, err
+}
+
+// bypassedWrite accounts for n bytes sent to the local server around mc,
+// e.g. spliced; the request parser reads zeros in their place
+func (mc *monitoredConn) bypassedWrite(n int64) {
+	if mc != nil && n > 0 {
+		mc.monitor.requests.skip(n)
+		mc.countIn(n)
+	}
+}
+
+// bypassedRead accounts for n bytes received from the local server around
+// mc, like bypassedWrite
+func (mc *monitoredConn) bypassedRead(n int64) {
+	if mc != nil && n > 0 {
+		mc.monitor.responses.skip(n)
+		mc.countOut(n)
+	}
+}
+
+func (mc *monitoredConn) countIn(n int64) {
+	if mc.owner != nil {
+		mc.owner.bytesIn.Add(n)
+		mc.owner.touch()
+	}
+}
+
+func (mc *monitoredConn) countOut(n int64) {
+	if mc.owner != nil {
+		mc.owner.bytesOut.Add(n)
+		mc.owner.touch()
+	}
+}
+
+// streamTap is an in-memory pipe whose writes never block. If the reader
+// falls more than limit bytes behind, or the shared budget runs out, the tap
+// overflows: buffered data is dropped and the reader gets an error.
+type streamTap struct {
+	buf      bytes.Buffer
+	gaps     []tapGap // skipped runs of the stream, in order
+	written  int64    // stream offset after the last write or gap
+	read     int64    // stream offset of the reader
+	limit    int
+	budget   *captureBudget
+	closed   bool
+	overflow bool
+	mutex    sync.Mutex
+	cond     *sync.Cond
+}
+
+// tapGap is a run of the stream that went around the tap; the reader gets
+// zeros in its place
+type tapGap struct {
+	offset int64
+	n      int64
+}
+
+var errTapOverflow = errors.New("monitor fell too far behind")
+
+func newStreamTap(limit int, budget *captureBudget) *streamTap {
+	tap := &streamTap{limit: limit, budget: budget}
+	tap.cond = sync.NewCond(&tap.mutex)
+	return tap
+}
+
+func (t *streamTap) Write(p []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed || t.overflow {
+		return len(p), nil
+	}
+	if t.buf.Len()+len(p) > t.limit || !t.budget.reserve(len(p)) {
+		t.overflow = true
+		t.budget.release(t.buf.Len())
+		t.buf = bytes.Buffer{}
+		t.gaps = nil
+	} else {
+		t.buf.Write(p)
+		t.written += int64(len(p))
+	}
+	t.cond.Broadcast()
+	return len(p), nil
+}
+
+// skip adds n bytes that went around the tap to the stream. They take no
+// buffer space.
+func (t *streamTap) skip(n int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed || t.overflow {
+		return
+	}
+	t.gaps = append(t.gaps, tapGap{offset: t.written, n: n})
+	t.written += n
+	t.cond.Broadcast()
+}
+
+func (t *streamTap) Read(p []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for t.buf.Len() == 0 && len(t.gaps) == 0 && !t.closed && !t.overflow {
+		t.cond.Wait()
+	}
+	if t.overflow {
+		return 0, errTapOverflow
+	}
+	if len(t.gaps) > 0 {
+		gap := &t.gaps[0]
+		if gap.offset == t.read {
+			n := int(min(int64(len(p)), gap.n))
+			clear(p[:n])
+			gap.offset += int64(n)
+			gap.n -= int64(n)
+			if gap.n == 0 {
+				t.gaps = t.gaps[1:]
+			}
+			t.read += int64(n)
+			return n, nil
+		}
+		// Buffered data comes before the gap
+		p = p[:min(int64(len(p)), gap.offset-t.read)]
+	}
+	if t.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	n, err := t.buf.Read(p)
+	t.budget.release(n)
+	t.read += int64(n)
+	return n, err
+}
+
+// Close makes the reader see EOF once the buffered data is consumed
+func (t *streamTap) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.closed = true
+	t.cond.Broadcast()
+	return nil
+}
+
+// captureBudget caps the memory that all stream taps of a tunnel may hold
+// at once, so a tunnel with a slow monitor can't grow without bound
+type captureBudget struct {
+	limit int64
+	used  atomic.Int64
+}
+
+// newCaptureBudget returns a budget of limit bytes, or nil (unlimited) when
+// limit isn't positive
+func newCaptureBudget(limit int64) *captureBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &captureBudget{limit: limit}
+}
+
+// reserve claims n bytes and reports whether they fit in the budget
+func (b *captureBudget) reserve(n int) bool {
+	if b == nil {
+		return true
+	}
+	if b.used.Add(int64(n)) > b.limit {
+		b.used.Add(-int64(n))
+		return false
+	}
+	return true
+}
+
+// release returns n bytes to the budget
+func (b *captureBudget) release(n int) {
+	if b != nil {
+		b.used.Add(-int64(n))
+	}
+}
+
+// inUse returns the number of bytes currently held
+func (b *captureBudget) inUse() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.used.Load()
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.reader.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	writer io.Writer
+	n      int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.writer.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// forwardedFor returns the original client address reported by the tunnel
+// server
+func forwardedFor(header http.Header) string {
+	client, _, _ := strings.Cut(header.Get("X-Forwarded-For"), ",")
+	return strings.TrimSpace(client)
+}
+
+// isEventStream reports whether a response is a stream of Server-Sent
+// Events, which lasts as long as the visitor listens
+func isEventStream(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// isUpgrade reports whether a request asks to switch protocols
+func isUpgrade(header http.Header) bool {
+	for _, value := range header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
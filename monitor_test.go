@@ -0,0 +1,183 @@
+package vrata
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+func collectExchanges(t *testing.T, requests, responses string) []RequestInfo {
+	t.Helper()
+
+	var mutex sync.Mutex
+	var infos []RequestInfo
+	m := newExchangeMonitor(nil, func(RequestInfo) {}, func(info RequestInfo) {
+		mutex.Lock()
+		infos = append(infos, info)
+		mutex.Unlock()
+	}, nil)
+
+	io.WriteString(m.requests, requests)
+	io.WriteString(m.responses, responses)
+	m.close()
+
+	return infos
+}
+
+func TestExchangeMonitorKeepAlive(t *testing.T) {
+	requests := "GET /one HTTP/1.1\r\nHost: localhost\r\nX-Forwarded-For: 198.51.100.2\r\n\r\n" +
+		"POST /two?x=1 HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\nbody"
+	first := "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"
+	second := "HTTP/1.1 503 Service Unavailable\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nbye\r\n0\r\n\r\n"
+
+	infos := collectExchanges(t, requests, first+second)
+	if len(infos) != 2 {
+		t.Fatalf("Expected 2 exchanges, got %d", len(infos))
+	}
+
+	if infos[0].Method != "GET" || infos[0].Path != "/one" || infos[0].StatusCode != 200 {
+		t.Errorf("Unexpected first exchange: %+v", infos[0])
+	}
+	if infos[0].RemoteAddr != "198.51.100.2" {
+		t.Errorf("Expected remote address from X-Forwarded-For, got '%s'", infos[0].RemoteAddr)
+	}
+	if infos[0].BytesOut != int64(len(first)) {
+		t.Errorf("Expected %d response bytes, got %d", len(first), infos[0].BytesOut)
+	}
+
+	if infos[1].URL != "/two?x=1" || infos[1].StatusCode != 503 {
+		t.Errorf("Unexpected second exchange: %+v", infos[1])
+	}
+	if infos[1].BytesOut != int64(len(second)) {
+		t.Errorf("Expected %d response bytes, got %d", len(second), infos[1].BytesOut)
+	}
+	if infos[1].BytesIn != int64(len(requests))-infos[0].BytesIn {
+		t.Errorf("Request byte counts don't add up: %d + %d != %d", infos[0].BytesIn, infos[1].BytesIn, len(requests))
+	}
+	if infos[1].ResponseHeader == nil || infos[1].Header.Get("Content-Length") != "4" {
+		t.Errorf("Expected headers to be captured, got %+v", infos[1])
+	}
+}
+
+func TestExchangeMonitorInterimAndHead(t *testing.T) {
+	requests := "PUT /upload HTTP/1.1\r\nHost: x\r\nExpect: 100-continue\r\nContent-Length: 2\r\n\r\nhi" +
+		"HEAD /file HTTP/1.1\r\nHost: x\r\n\r\n"
+	responses := "HTTP/1.1 100 Continue\r\n\r\n" +
+		"HTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\n"
+
+	infos := collectExchanges(t, requests, responses)
+	if len(infos) != 2 {
+		t.Fatalf("Expected 2 exchanges, got %d", len(infos))
+	}
+	if infos[0].StatusCode != 201 {
+		t.Errorf("Expected interim response to be skipped, got %d", infos[0].StatusCode)
+	}
+	if infos[1].Method != "HEAD" || infos[1].StatusCode != 200 {
+		t.Errorf("Unexpected HEAD exchange: %+v", infos[1])
+	}
+}
+
+func TestExchangeMonitorUpgradeAttribution(t *testing.T) {
+	request := "GET /ws HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"
+	response := "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"
+	clientFrames := "client-frames"
+	serverFrames := "server-frames-and-more"
+
+	infos := collectExchanges(t, request+clientFrames, response+serverFrames)
+	if len(infos) != 1 {
+		t.Fatalf("Expected 1 exchange, got %d", len(infos))
+	}
+
+	info := infos[0]
+	if info.StatusCode != 101 {
+		t.Errorf("Expected status 101, got %d", info.StatusCode)
+	}
+	if info.BytesIn != int64(len(request+clientFrames)) {
+		t.Errorf("Expected %d bytes in, got %d", len(request+clientFrames), info.BytesIn)
+	}
+	if info.BytesOut != int64(len(response+serverFrames)) {
+		t.Errorf("Expected %d bytes out, got %d", len(response+serverFrames), info.BytesOut)
+	}
+}
+
+func TestStreamTapOverflow(t *testing.T) {
+	tap := newStreamTap(8, nil)
+
+	// Writes never block, even without a reader
+	tap.Write([]byte("12345"))
+	tap.Write([]byte("67890"))
+
+	if _, err := tap.Read(make([]byte, 4)); err != errTapOverflow {
+		t.Errorf("Expected overflow error, got %v", err)
+	}
+}
+
+func TestStreamTapSkip(t *testing.T) {
+	tap := newStreamTap(8, nil)
+	tap.Write([]byte("ab"))
+	tap.skip(3)
+	tap.Write([]byte("cd"))
+	tap.skip(2)
+	tap.Close()
+
+	got, err := io.ReadAll(tap)
+	if err != nil || string(got) != "ab\x00\x00\x00cd\x00\x00" {
+		t.Errorf("ReadAll() = %q, %v; want the skipped bytes as zeros in order", got, err)
+	}
+}
+
+func TestStreamTapSharedBudget(t *testing.T) {
+	budget := newCaptureBudget(10)
+	first := newStreamTap(8, budget)
+	second := newStreamTap(8, budget)
+
+	first.Write([]byte("123456"))
+	second.Write([]byte("12345"))
+
+	if _, err := second.Read(make([]byte, 4)); err != errTapOverflow {
+		t.Errorf("Expected overflow once the budget is spent, got %v", err)
+	}
+	if used := budget.inUse(); used != 6 {
+		t.Errorf("Expected 6 bytes in use, got %d", used)
+	}
+
+	first.Read(make([]byte, 8))
+	if used := budget.inUse(); used != 0 {
+		t.Errorf("Expected budget to be released by reads, got %d", used)
+	}
+}
+
+func TestMonitoredConnCountsBytes(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	owner := &TunnelConnection{}
+	m := newExchangeMonitor(nil, func(RequestInfo) {}, func(RequestInfo) {}, nil)
+	conn := m.wrap(local, owner)
+
+	go func() {
+		buf := make([]byte, 64)
+		n, _ := remote.Read(buf)
+		remote.Write(buf[:n])
+		remote.Write([]byte("!"))
+	}()
+
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 64)
+	total := 0
+	for total < 5 {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		total += n
+	}
+	conn.Close()
+	m.close()
+
+	if owner.bytesIn.Load() != 4 || owner.bytesOut.Load() != 5 {
+		t.Errorf("Expected 4 bytes in and 5 out, got %d and %d", owner.bytesIn.Load(), owner.bytesOut.Load())
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !race
+
+package vrata
+
+// raceEnabled is set under the race detector, which makes sync.Pool drop
+// pooled values at random
+const raceEnabled = false
@@ -0,0 +1,359 @@
+package vrata
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcCallbackPath is where the provider sends visitors back after login.
+// Requests to it are answered by the tunnel and never forwarded.
+const oidcCallbackPath = "/.vrata/oidc/callback"
+
+const (
+	oidcSessionCookie = "vrata_session"
+	oidcStateCookie   = "vrata_oidc_state"
+
+	// oidcLoginTimeout bounds how long a login round trip may take
+	oidcLoginTimeout = 10 * time.Minute
+)
+
+// OIDCAuth puts an OpenID Connect login in front of the tunnel: visitors
+// are redirected to the provider, and once they log in a signed session
+// cookie lets their requests through to the local server. Register
+// RedirectURL, by default https://<tunnel host>/.vrata/oidc/callback, with
+// the provider.
+type OIDCAuth struct {
+	// Issuer is the provider URL, e.g. https://accounts.google.com; its
+	// endpoints are discovered from /.well-known/openid-configuration
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+
+	// RedirectURL overrides the callback URL derived from the tunnel URL
+	RedirectURL string
+
+	// AllowedEmails restricts who may log in, by address or by domain
+	// ("@example.com"). Empty admits anyone the provider authenticates.
+	AllowedEmails []string
+
+	// SessionTTL is how long a login lasts; defaults to 12 hours
+	SessionTTL time.Duration
+
+	// Client talks to the provider; defaults to a client with a 10s timeout
+	Client *http.Client
+
+	mutex     sync.Mutex
+	ready     bool
+	authorize string // authorization endpoint
+	token     string // token endpoint
+	verifier  *JWTAuth
+	key       []byte // signs session and state cookies
+}
+
+// oidcSession is the payload of the session cookie
+type oidcSession struct {
+	Subject string `json:"sub"`
+	Email   string `json:"email,omitempty"`
+	Expires int64  `json:"exp"`
+}
+
+// oidcState is the payload of the cookie binding a login to the browser
+// that started it
+type oidcState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Return   string `json:"return"`
+	Expires  int64  `json:"exp"`
+}
+
+// check admits requests with a valid session and starts or completes a
+// login for the others
+func (a *OIDCAuth) check(req *http.Request) *rejection {
+	if err := a.discover(); err != nil {
+		return &rejection{status: http.StatusBadGateway}
+	}
+
+	if req.URL.Path == oidcCallbackPath {
+		return a.callback(req)
+	}
+
+	var session oidcSession
+	if cookie, err := req.Cookie(oidcSessionCookie); err == nil &&
+		a.open(cookie.Value, &session) && time.Now().Unix() < session.Expires {
+		return nil
+	}
+
+	// Only browsers navigating can follow a login redirect
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return &rejection{status: http.StatusUnauthorized}
+	}
+	return a.login(req)
+}
+
+// discover looks up the provider's endpoints, retrying on later requests
+// until it succeeds
+func (a *OIDCAuth) discover() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.ready {
+		return nil
+	}
+	if a.key == nil {
+		a.key = make([]byte, 32)
+		rand.Read(a.key)
+	}
+
+	client := a.client()
+	resp, err := client.Get(strings.TrimSuffix(a.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return fmt.Errorf("OIDC discovery failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("OIDC discovery failed: status %d", resp.StatusCode)
+	}
+
+	var config struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return fmt.Errorf("OIDC discovery failed: %w", err)
+	}
+
+	a.authorize, a.token = config.AuthorizationEndpoint, config.TokenEndpoint
+	a.verifier = &JWTAuth{JWKSURL: config.JWKSURI, Issuer: config.Issuer, Audience: a.ClientID, Client: client}
+	a.ready = true
+	return nil
+}
+
+// login redirects the visitor to the provider
+func (a *OIDCAuth) login(req *http.Request) *rejection {
+	state := oidcState{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: randomToken() + randomToken(),
+		Return:   req.URL.RequestURI(),
+		Expires:  time.Now().Add(oidcLoginTimeout).Unix(),
+	}
+	challenge := sha256.Sum256([]byte(state.Verifier))
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {a.ClientID},
+		"redirect_uri":          {a.redirectURL(req)},
+		"scope":                 {"openid email profile"},
+		"state":                 {state.State},
+		"nonce":                 {state.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	location := a.authorize
+	if strings.Contains(location, "?") {
+		location += "&" + query.Encode()
+	} else {
+		location += "?" + query.Encode()
+	}
+
+	header := http.Header{"Location": {location}}
+	header.Add("Set-Cookie", a.cookie(req, oidcStateCookie, a.seal(state), oidcLoginTimeout))
+	return &rejection{status: http.StatusFound, header: header}
+}
+
+// callback completes a login: it redeems the code, checks the ID token
+// and sets the session cookie
+func (a *OIDCAuth) callback(req *http.Request) *rejection {
+	forbidden := &rejection{status: http.StatusForbidden}
+
+	var state oidcState
+	cookie, err := req.Cookie(oidcStateCookie)
+	if err != nil || !a.open(cookie.Value, &state) || time.Now().Unix() >= state.Expires {
+		return forbidden
+	}
+	query := req.URL.Query()
+	if !hmac.Equal([]byte(query.Get("state")), []byte(state.State)) || query.Get("code") == "" {
+		return forbidden
+	}
+
+	claims, err := a.redeem(req, query.Get("code"), state.Verifier)
+	if err != nil || claims["nonce"] != state.Nonce {
+		return forbidden
+	}
+
+	session := oidcSession{Expires: time.Now().Add(a.sessionTTL()).Unix()}
+	session.Subject, _ = claims["sub"].(string)
+	session.Email, _ = claims["email"].(string)
+	if verified, ok := claims["email_verified"].(bool); ok && !verified {
+		session.Email = ""
+	}
+	if !a.allowed(session.Email) {
+		return forbidden
+	}
+
+	// Only return to paths on this host
+	target := state.Return
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+		target = "/"
+	}
+
+	header := http.Header{"Location": {target}}
+	header.Add("Set-Cookie", a.cookie(req, oidcSessionCookie, a.seal(session), a.sessionTTL()))
+	header.Add("Set-Cookie", a.cookie(req, oidcStateCookie, "", -1))
+	return &rejection{status: http.StatusFound, header: header}
+}
+
+// redeem exchanges an authorization code for a verified ID token's claims
+func (a *OIDCAuth) redeem(req *http.Request, code, verifier string) (map[string]any, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {a.redirectURL(req)},
+		"client_id":     {a.ClientID},
+		"code_verifier": {verifier},
+	}
+	if a.ClientSecret != "" {
+		form.Set("client_secret", a.ClientSecret)
+	}
+
+	resp, err := a.client().PostForm(a.token, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned status %d", resp.StatusCode)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("no ID token in the token response")
+	}
+	return a.verifier.Verify(tokens.IDToken)
+}
+
+// allowed reports whether the email may log in
+func (a *OIDCAuth) allowed(email string) bool {
+	if len(a.AllowedEmails) == 0 {
+		return true
+	}
+	if email == "" {
+		return false
+	}
+	email = strings.ToLower(email)
+	for _, entry := range a.AllowedEmails {
+		entry = strings.ToLower(entry)
+		if email == entry || (strings.HasPrefix(entry, "@") && strings.HasSuffix(email, entry)) {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectURL returns the callback URL for the host the visitor reached
+func (a *OIDCAuth) redirectURL(req *http.Request) string {
+	if a.RedirectURL != "" {
+		return a.RedirectURL
+	}
+	return requestScheme(req) + "://" + req.Host + oidcCallbackPath
+}
+
+// cookie formats a Set-Cookie value; a negative maxAge deletes the cookie
+func (a *OIDCAuth) cookie(req *http.Request, name, value string, maxAge time.Duration) string {
+	c := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   requestScheme(req) == "https",
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(maxAge.Seconds()),
+	}
+	if maxAge < 0 {
+		c.MaxAge = -1
+	}
+	return c.String()
+}
+
+func (a *OIDCAuth) sessionTTL() time.Duration {
+	if a.SessionTTL > 0 {
+		return a.SessionTTL
+	}
+	return 12 * time.Hour
+}
+
+func (a *OIDCAuth) client() *http.Client {
+	if a.Client != nil {
+		return a.Client
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+// seal encodes and signs a cookie payload
+func (a *OIDCAuth) seal(v any) string {
+	data, _ := json.Marshal(v)
+	return signToken(a.key, data)
+}
+
+// open verifies a sealed cookie and decodes it into v
+func (a *OIDCAuth) open(value string, v any) bool {
+	data, ok := verifyToken(a.key, value)
+	return ok && json.Unmarshal(data, v) == nil
+}
+
+// signToken returns payload and its HMAC-SHA256, base64url encoded and
+// joined by a dot
+func signToken(key, payload []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyToken checks a signToken value and returns its payload
+func verifyToken(key []byte, token string) ([]byte, bool) {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, false
+	}
+	payload, err1 := base64.RawURLEncoding.DecodeString(encoded)
+	signature, err2 := base64.RawURLEncoding.DecodeString(sig)
+	if err1 != nil || err2 != nil {
+		return nil, false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return payload, hmac.Equal(signature, mac.Sum(nil))
+}
+
+// randomToken returns 128 random bits, base64url encoded
+func randomToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// requestScheme returns the scheme the visitor used to reach the relay
+func requestScheme(req *http.Request) string {
+	if proto := req.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		return proto
+	}
+	return "https"
+}
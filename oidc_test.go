@@ -0,0 +1,172 @@
+package vrata
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeIdP is a minimal OpenID provider that issues ID tokens for codes
+// registered by the test
+type fakeIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	codes  map[string]fakeLogin
+	mutex  sync.Mutex
+}
+
+type fakeLogin struct {
+	nonce, challenge, email string
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	idp := &fakeIdP{key: key, codes: make(map[string]fakeLogin)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []any{jwk("k1", &key.PublicKey)}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		idp.mutex.Lock()
+		login, ok := idp.codes[r.FormValue("code")]
+		idp.mutex.Unlock()
+
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != login.challenge {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+
+		token := signJWT(t, map[string]any{"alg": "RS256", "kid": "k1"}, map[string]any{
+			"iss":   idp.server.URL,
+			"aud":   r.FormValue("client_id"),
+			"sub":   "user-1",
+			"email": login.email,
+			"nonce": login.nonce,
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		}, key)
+		json.NewEncoder(w).Encode(map[string]string{"id_token": token})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// login starts a login at path and lets the provider authenticate email.
+// It returns the callback request the browser would make.
+func (idp *fakeIdP) login(t *testing.T, auth *OIDCAuth, path, email string) *http.Request {
+	t.Helper()
+
+	req := httptest.NewRequest("GET", path, nil)
+	req.Host = "app.example.test"
+	denied := auth.check(req)
+	if denied == nil || denied.status != http.StatusFound {
+		t.Fatalf("Expected a login redirect, got %+v", denied)
+	}
+
+	location, err := url.Parse(denied.header.Get("Location"))
+	if err != nil {
+		t.Fatalf("Bad redirect: %v", err)
+	}
+	query := location.Query()
+	if got := query.Get("redirect_uri"); got != "https://app.example.test/.vrata/oidc/callback" {
+		t.Errorf("Unexpected redirect_uri %q", got)
+	}
+
+	idp.mutex.Lock()
+	idp.codes["code-"+email] = fakeLogin{nonce: query.Get("nonce"), challenge: query.Get("code_challenge"), email: email}
+	idp.mutex.Unlock()
+
+	callback := httptest.NewRequest("GET", oidcCallbackPath+"?code=code-"+email+"&state="+query.Get("state"), nil)
+	callback.Host = req.Host
+	for _, cookie := range (&http.Response{Header: denied.header}).Cookies() {
+		callback.AddCookie(cookie)
+	}
+	return callback
+}
+
+func TestOIDCAuthLogin(t *testing.T) {
+	idp := newFakeIdP(t)
+	auth := &OIDCAuth{Issuer: idp.server.URL, ClientID: "tunnel", AllowedEmails: []string{"@example.com"}}
+
+	callback := idp.login(t, auth, "/dashboard?tab=1", "dev@example.com")
+	denied := auth.check(callback)
+	if denied == nil || denied.status != http.StatusFound || denied.header.Get("Location") != "/dashboard?tab=1" {
+		t.Fatalf("Expected a redirect back to the app, got %+v", denied)
+	}
+
+	var session *http.Cookie
+	for _, cookie := range (&http.Response{Header: denied.header}).Cookies() {
+		if cookie.Name == oidcSessionCookie {
+			session = cookie
+		}
+	}
+	if session == nil || !session.HttpOnly || !session.Secure {
+		t.Fatalf("Expected a secure session cookie, got %+v", session)
+	}
+
+	req := httptest.NewRequest("POST", "/api", nil)
+	req.AddCookie(session)
+	if denied := auth.check(req); denied != nil {
+		t.Errorf("Expected the session to be accepted, got %d", denied.status)
+	}
+
+	// Replaying the callback with a forged state fails
+	forged := callback.Clone(callback.Context())
+	forged.URL.RawQuery = "code=code-dev@example.com&state=forged"
+	if denied := auth.check(forged); denied == nil || denied.status != http.StatusForbidden {
+		t.Errorf("Expected 403 for a forged state, got %+v", denied)
+	}
+}
+
+func TestOIDCAuthRejects(t *testing.T) {
+	idp := newFakeIdP(t)
+	auth := &OIDCAuth{Issuer: idp.server.URL, ClientID: "tunnel", AllowedEmails: []string{"@example.com", "guest@other.test"}}
+
+	if denied := auth.check(idp.login(t, auth, "/", "intruder@evil.test")); denied == nil || denied.status != http.StatusForbidden {
+		t.Errorf("Expected 403 for a disallowed email, got %+v", denied)
+	}
+	if denied := auth.check(idp.login(t, auth, "/", "guest@other.test")); denied == nil || denied.status != http.StatusFound {
+		t.Errorf("Expected an allowed address to log in, got %+v", denied)
+	}
+
+	api := httptest.NewRequest("POST", "/api", nil)
+	if denied := auth.check(api); denied == nil || denied.status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a non-navigation request, got %+v", denied)
+	}
+
+	tampered := httptest.NewRequest("GET", "/", nil)
+	tampered.AddCookie(&http.Cookie{Name: oidcSessionCookie, Value: signToken([]byte("other key"), []byte(`{"sub":"x","exp":9999999999}`))})
+	if denied := auth.check(tampered); denied == nil || denied.status != http.StatusFound {
+		t.Errorf("Expected a forged session to be sent to login, got %+v", denied)
+	}
+}
+
+func TestOIDCAuthDiscoveryFailure(t *testing.T) {
+	auth := &OIDCAuth{Issuer: "http://127.0.0.1:1", ClientID: "tunnel"}
+	if denied := auth.check(httptest.NewRequest("GET", "/", nil)); denied == nil || denied.status != http.StatusBadGateway {
+		t.Errorf("Expected 502 while the provider is unreachable, got %+v", denied)
+	}
+}
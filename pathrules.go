@@ -0,0 +1,57 @@
+package vrata
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// pathRules admits requests by path: denied patterns always lose, and a
+// non-empty allow list admits only the paths it matches
+func pathRules(allow, deny []string) accessCheck {
+	return func(req *http.Request) *rejection {
+		// Clean the path so /public/../admin and //admin can't slip past
+		// a deny rule
+		p := path.Clean("/" + req.URL.Path)
+
+		matches := func(patterns []string) bool {
+			for _, pattern := range patterns {
+				if matchPath(pattern, p) {
+					return true
+				}
+			}
+			return false
+		}
+		if matches(deny) || (len(allow) > 0 && !matches(allow)) {
+			return &rejection{status: http.StatusForbidden}
+		}
+		return nil
+	}
+}
+
+// matchPath reports whether p matches pattern. A trailing /* matches the
+// directory and everything below it; other patterns use path.Match, where *
+// stays within one segment.
+func matchPath(pattern, p string) bool {
+	if dir, ok := strings.CutSuffix(pattern, "/*"); ok && !strings.ContainsAny(dir, "*?[\\") {
+		return p == dir || strings.HasPrefix(p, dir+"/")
+	}
+	matched, _ := path.Match(pattern, p)
+	return matched
+}
+
+// validatePathPatterns reports the first malformed path pattern
+func validatePathPatterns(patterns ...[]string) error {
+	for _, list := range patterns {
+		for _, pattern := range list {
+			if !strings.HasPrefix(pattern, "/") {
+				return fmt.Errorf("%w: %q must start with /", ErrBadPathPattern, pattern)
+			}
+			if _, err := path.Match(pattern, "/"); err != nil {
+				return fmt.Errorf("%w: %q", ErrBadPathPattern, pattern)
+			}
+		}
+	}
+	return nil
+}
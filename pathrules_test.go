@@ -0,0 +1,56 @@
+package vrata
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPathRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		allow   []string
+		deny    []string
+		target  string
+		allowed bool
+	}{
+		{name: "denied subtree", deny: []string{"/admin/*"}, target: "/admin/users"},
+		{name: "denied directory itself", deny: []string{"/admin/*"}, target: "/admin"},
+		{name: "sibling prefix", deny: []string{"/admin/*"}, target: "/administrator", allowed: true},
+		{name: "dot segments", deny: []string{"/admin/*"}, target: "/public/../admin/x"},
+		{name: "double slash", deny: []string{"/admin/*"}, target: "//admin/x"},
+		{name: "encoded slash", deny: []string{"/admin/*"}, target: "/admin%2Fx"},
+		{name: "allowed subtree", allow: []string{"/webhooks/*"}, target: "/webhooks/github", allowed: true},
+		{name: "not on allow list", allow: []string{"/webhooks/*"}, target: "/"},
+		{name: "deny wins", allow: []string{"/webhooks/*"}, deny: []string{"/webhooks/internal/*"}, target: "/webhooks/internal/x"},
+		{name: "single segment glob", allow: []string{"/api/*/status"}, target: "/api/v1/status", allowed: true},
+		{name: "glob stays in segment", allow: []string{"/api/*/status"}, target: "/api/v1/x/status"},
+		{name: "exact", deny: []string{"/.env"}, target: "/.env?x=1"},
+		{name: "everything", deny: []string{"/*"}, target: "/"},
+		{name: "query ignored", deny: []string{"/admin/*"}, target: "/?next=/admin/x", allowed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.target, nil)
+
+			denied := pathRules(tt.allow, tt.deny)(req)
+			if tt.allowed && denied != nil {
+				t.Errorf("Expected %q to be allowed, got %d", tt.target, denied.status)
+			}
+			if !tt.allowed && (denied == nil || denied.status != http.StatusForbidden) {
+				t.Errorf("Expected %q to get 403, got %+v", tt.target, denied)
+			}
+		})
+	}
+}
+
+func TestNewTunnelRejectsBadPathPatterns(t *testing.T) {
+	for _, pattern := range []string{"admin/*", "/[admin"} {
+		_, err := NewTunnel(8080, &TunnelOptions{DenyPaths: []string{pattern}})
+		if !errors.Is(err, ErrBadPathPattern) {
+			t.Errorf("Pattern %q: expected ErrBadPathPattern, got %v", pattern, err)
+		}
+	}
+}
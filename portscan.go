@@ -0,0 +1,121 @@
+package vrata
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommonDevPorts lists ports popular development servers listen on
+var CommonDevPorts = []int{3000, 3001, 4000, 4200, 5000, 5173, 5500, 8000, 8008, 8080, 8081, 8888, 9000}
+
+// PortProbe describes what was found on a local port
+type PortProbe struct {
+	Port      int
+	Listening bool
+	// Server is the HTTP Server header, when the port speaks HTTP
+	Server string
+	// HTTP reports whether the port answered an HTTP request
+	HTTP bool
+}
+
+// IsListening reports whether something accepts TCP connections on host:port
+func IsListening(host string, port int, timeout time.Duration) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), timeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// ScanLocalPorts probes the given ports on host concurrently and returns
+// the results in the same order
+func ScanLocalPorts(host string, ports []int, timeout time.Duration) []PortProbe {
+	results := make([]PortProbe, len(ports))
+
+	var wg sync.WaitGroup
+	for i, port := range ports {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = probePort(host, port, timeout)
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+// probePort checks a single port and tries to identify an HTTP server on it
+func probePort(host string, port int, timeout time.Duration) PortProbe {
+	probe := PortProbe{Port: port}
+	if !IsListening(host, port, timeout) {
+		return probe
+	}
+	probe.Listening = true
+
+	client := &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Head("http://" + net.JoinHostPort(host, strconv.Itoa(port)) + "/")
+	if err != nil {
+		return probe
+	}
+	resp.Body.Close()
+
+	probe.HTTP = true
+	probe.Server = resp.Header.Get("Server")
+	return probe
+}
+
+// ParsePorts parses a list of ports and ranges such as "3000,8000-8010"
+func ParsePorts(spec string) ([]int, error) {
+	var ports []int
+
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		first, last, isRange := strings.Cut(part, "-")
+		from, err := parsePort(first)
+		if err != nil {
+			return nil, err
+		}
+		to := from
+		if isRange {
+			if to, err = parsePort(last); err != nil {
+				return nil, err
+			}
+			if to < from {
+				return nil, fmt.Errorf("invalid port range %q", part)
+			}
+		}
+
+		for port := from; port <= to; port++ {
+			ports = append(ports, port)
+		}
+	}
+
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("no ports in %q", spec)
+	}
+	return ports, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
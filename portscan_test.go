@@ -0,0 +1,63 @@
+package vrata
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestScanLocalPorts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "test-server")
+	}))
+	defer server.Close()
+	httpPort := server.Listener.Addr().(*net.TCPAddr).Port
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	rawPort := raw.Addr().(*net.TCPAddr).Port
+	raw.Close()
+
+	results := ScanLocalPorts("127.0.0.1", []int{httpPort, rawPort}, time.Second)
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(results))
+	}
+
+	if !results[0].Listening || !results[0].HTTP || results[0].Server != "test-server" {
+		t.Errorf("Expected HTTP server on port %d, got %+v", httpPort, results[0])
+	}
+	if results[1].Listening {
+		t.Errorf("Expected closed port %d, got %+v", rawPort, results[1])
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []int
+		wantErr bool
+	}{
+		{spec: "3000", want: []int{3000}},
+		{spec: "3000, 8000-8002", want: []int{3000, 8000, 8001, 8002}},
+		{spec: "8002-8000", wantErr: true},
+		{spec: "0", wantErr: true},
+		{spec: "http", wantErr: true},
+		{spec: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParsePorts(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePorts(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParsePorts(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package vrata
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// environmentProxy picks the proxy for a relay address, honoring
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY. Tests replace it, since the
+// standard lookup never proxies loopback addresses.
+var environmentProxy = http.ProxyFromEnvironment
+
+// parseProxy parses a Proxy option; an empty one yields nil
+func parseProxy(proxy string) (*url.URL, error) {
+	if proxy == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadProxy, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("%w: %q must be an http, https or socks5 URL", ErrBadProxy, proxy)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("%w: %q has no host", ErrBadProxy, proxy)
+	}
+	return u, nil
+}
+
+// relayProxy returns the proxy the data connections to address go
+// through, or nil to dial directly. Without a Proxy option, the relay's
+// scheme decides between HTTPS_PROXY and HTTP_PROXY.
+func (o *TunnelOptions) relayProxy(address string) (*url.URL, error) {
+	if o.Proxy != "" {
+		return parseProxy(o.Proxy)
+	}
+	scheme := "https"
+	if relay, err := url.Parse(o.Host); err == nil && relay.Scheme == "http" {
+		scheme = "http"
+	}
+	return environmentProxy(&http.Request{URL: &url.URL{Scheme: scheme, Host: address}})
+}
+
+// dialRelay opens a data connection to the relay, tunneling it through
+// the proxy when there is one and securing it with RelayTLS when set
+func (tc *TunnelCluster) dialRelay(ctx context.Context, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, tc.options.Timeouts.dial())
+	defer cancel()
+
+	conn, err := tc.options.dialRelayTCP(ctx, address)
+	if err != nil || tc.options.RelayTLS == nil {
+		return conn, err
+	}
+	return tc.options.relayHandshake(ctx, conn, address)
+}
+
+// DialRelay opens a TCP connection to address, a host:port of the relay,
+// the way the tunnel's data connections are opened: through Proxy or the
+// environment's proxy when there is one, and with Dial when set. It lets
+// diagnostics reach the relay by the same route.
+func DialRelay(ctx context.Context, options *TunnelOptions, address string) (net.Conn, error) {
+	return options.dialRelayTCP(ctx, address)
+}
+
+// dialRelayTCP opens the TCP connection under a data connection
+func (o *TunnelOptions) dialRelayTCP(ctx context.Context, address string) (net.Conn, error) {
+	proxy, err := o.relayProxy(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy: %w", err)
+	}
+	if proxy == nil {
+		// A custom Dial resolves names its own way
+		if o.Dial != nil {
+			return o.Dial(ctx, "tcp", address)
+		}
+		return dialRacing(ctx, o.dial, address)
+	}
+	if proxy.Scheme == "socks5" || proxy.Scheme == "socks5h" {
+		return dialSOCKS5(ctx, o.dial, proxy, address)
+	}
+	return dialThroughProxy(ctx, o.dial, proxy, address)
+}
+
+// dialThroughProxy asks proxy, reached with dial, to CONNECT to address
+// and returns the tunneled connection
+func dialThroughProxy(ctx context.Context, dial DialFunc, proxy *url.URL, address string) (net.Conn, error) {
+	proxyAddress := proxy.Host
+	if proxy.Port() == "" {
+		port := "80"
+		if proxy.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddress = net.JoinHostPort(proxy.Hostname(), port)
+	}
+
+	if proxy.Scheme != "http" && proxy.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxy.Scheme)
+	}
+	conn, err := dial(ctx, "tcp", proxyAddress)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %w", proxyAddress, err)
+	}
+	if proxy.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("proxy %s: %w", proxyAddress, err)
+		}
+		conn = tlsConn
+	}
+
+	// The handshake must not outlive the dial deadline
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		req.SetBasicAuth(proxy.User.Username(), password)
+		req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+		delete(req.Header, "Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", proxyAddress, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", proxyAddress, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", proxyAddress, address, resp.Status)
+	}
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Keep whatever the relay sent right behind the proxy's answer
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// dialSOCKS5 asks a SOCKS5 proxy, reached with dial, to connect to
+// address. Host names are resolved by the proxy.
+func dialSOCKS5(ctx context.Context, dial DialFunc, proxy *url.URL, address string) (net.Conn, error) {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %s", address)
+	}
+
+	proxyAddress := proxy.Host
+	if proxy.Port() == "" {
+		proxyAddress = net.JoinHostPort(proxy.Hostname(), "1080")
+	}
+	conn, err := dial(ctx, "tcp", proxyAddress)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %w", proxyAddress, err)
+	}
+
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+	if err := socks5Handshake(conn, proxy.User, host, port); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", proxyAddress, err)
+	}
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// socks5Handshake negotiates authentication (RFC 1928, RFC 1929) and a
+// CONNECT to host:port over conn
+func socks5Handshake(conn net.Conn, user *url.Userinfo, host string, port int) error {
+	methods := []byte{0x00} // no authentication
+	if user != nil {
+		methods = append(methods, 0x02) // username and password
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return fmt.Errorf("not a SOCKS5 proxy")
+	}
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		if user == nil {
+			return fmt.Errorf("SOCKS5 proxy requires a username and password")
+		}
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return fmt.Errorf("SOCKS5 credentials too long")
+		}
+		auth := []byte{0x01, byte(len(user.Username()))}
+		auth = append(auth, user.Username()...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return fmt.Errorf("SOCKS5 proxy rejected the credentials")
+		}
+	default:
+		return fmt.Errorf("SOCKS5 proxy accepts none of the offered authentication methods")
+	}
+
+	request := []byte{0x05, 0x01, 0x00} // CONNECT
+	if ip := net.ParseIP(host); ip.To4() != nil {
+		request = append(append(request, 0x01), ip.To4()...)
+	} else if ip != nil {
+		request = append(append(request, 0x04), ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long for SOCKS5: %s", host)
+		}
+		request = append(append(request, 0x03, byte(len(host))), host...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	// The reply echoes the bound address, which isn't needed
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 proxy refused CONNECT to %s: %s", net.JoinHostPort(host, strconv.Itoa(port)), socks5Reply(head[1]))
+	}
+	var skip int
+	switch head[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("malformed SOCKS5 reply")
+	}
+	_, err := io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// socks5Reply describes a SOCKS5 reply code
+func socks5Reply(code byte) string {
+	switch code {
+	case 0x01:
+		return "general failure"
+	case 0x02:
+		return "not allowed by ruleset"
+	case 0x03:
+		return "network unreachable"
+	case 0x04:
+		return "host unreachable"
+	case 0x05:
+		return "connection refused"
+	case 0x06:
+		return "TTL expired"
+	case 0x07:
+		return "command not supported"
+	case 0x08:
+		return "address type not supported"
+	}
+	return fmt.Sprintf("code %d", code)
+}
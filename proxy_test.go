@@ -0,0 +1,233 @@
+package vrata
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// connectProxy starts an HTTP CONNECT proxy that demands auth, when set,
+// as Proxy-Authorization
+func connectProxy(t *testing.T, auth string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer client.Close()
+				req, err := http.ReadRequest(bufio.NewReader(client))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				if auth != "" && req.Header.Get("Proxy-Authorization") != auth {
+					io.WriteString(client, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(client, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(target, client)
+				io.Copy(client, target)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// useProxy routes relay connections through proxy for the test
+func useProxy(t *testing.T, proxy string) {
+	t.Helper()
+	saved := environmentProxy
+	environmentProxy = func(*http.Request) (*url.URL, error) {
+		return url.Parse(proxy)
+	}
+	t.Cleanup(func() { environmentProxy = saved })
+}
+
+func TestDialRelayThroughProxy(t *testing.T) {
+	relay, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer relay.Close()
+	go func() {
+		conn, err := relay.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "hello from the relay\n")
+	}()
+
+	useProxy(t, "http://user:secret@"+connectProxy(t, "Basic dXNlcjpzZWNyZXQ="))
+	tc := &TunnelCluster{options: &TunnelOptions{Host: "https://relay.example"}}
+
+	conn, err := tc.dialRelay(context.Background(), relay.Addr().String())
+	if err != nil {
+		t.Fatalf("dialRelay() failed: %v", err)
+	}
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "hello from the relay\n" {
+		t.Errorf("Expected the relay's greeting, got %q (%v)", line, err)
+	}
+}
+
+func TestDialRelayProxyRefuses(t *testing.T) {
+	useProxy(t, "http://"+connectProxy(t, "Basic expected"))
+	tc := &TunnelCluster{options: &TunnelOptions{Host: "https://relay.example"}}
+
+	_, err := tc.dialRelay(context.Background(), "127.0.0.1:1")
+	if err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("Expected the proxy's refusal, got %v", err)
+	}
+}
+
+// socksProxy starts a SOCKS5 proxy that demands user:pass when set
+func socksProxy(t *testing.T, user, pass string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer client.Close()
+				head := make([]byte, 2)
+				io.ReadFull(client, head)
+				methods := make([]byte, head[1])
+				io.ReadFull(client, methods)
+				if user == "" {
+					client.Write([]byte{0x05, 0x00})
+				} else {
+					client.Write([]byte{0x05, 0x02})
+					auth := make([]byte, 2)
+					io.ReadFull(client, auth)
+					name := make([]byte, auth[1])
+					io.ReadFull(client, name)
+					io.ReadFull(client, auth[:1])
+					password := make([]byte, auth[0])
+					io.ReadFull(client, password)
+					if string(name) != user || string(password) != pass {
+						client.Write([]byte{0x01, 0x01})
+						return
+					}
+					client.Write([]byte{0x01, 0x00})
+				}
+
+				request := make([]byte, 5)
+				io.ReadFull(client, request)
+				host := make([]byte, request[4])
+				io.ReadFull(client, host)
+				port := make([]byte, 2)
+				io.ReadFull(client, port)
+				if request[3] != 0x03 {
+					client.Write([]byte{0x05, 0x08, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				target, err := net.Dial("tcp", net.JoinHostPort(string(host), strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+				if err != nil {
+					client.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer target.Close()
+				client.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+				go io.Copy(target, client)
+				io.Copy(client, target)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestDialRelayThroughSOCKS5(t *testing.T) {
+	relay, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer relay.Close()
+	go func() {
+		for {
+			conn, err := relay.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, "hello from the relay\n")
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(relay.Addr().String())
+	address := net.JoinHostPort("localhost", port)
+
+	tests := []struct {
+		name    string
+		proxy   string
+		wantErr string
+	}{
+		{"no authentication", "socks5://" + socksProxy(t, "", ""), ""},
+		{"username and password", "socks5h://user:secret@" + socksProxy(t, "user", "secret"), ""},
+		{"wrong password", "socks5://user:wrong@" + socksProxy(t, "user", "secret"), "rejected the credentials"},
+		{"missing credentials", "socks5://" + socksProxy(t, "user", "secret"), "requires a username"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := &TunnelCluster{options: &TunnelOptions{Proxy: tt.proxy}}
+			conn, err := tc.dialRelay(context.Background(), address)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Expected %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dialRelay() failed: %v", err)
+			}
+			defer conn.Close()
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil || line != "hello from the relay\n" {
+				t.Errorf("Expected the relay's greeting, got %q (%v)", line, err)
+			}
+		})
+	}
+}
+
+func TestParseProxy(t *testing.T) {
+	for _, proxy := range []string{"", "http://proxy:3128", "https://proxy", "socks5://127.0.0.1:1080", "socks5h://u:p@proxy"} {
+		if _, err := parseProxy(proxy); err != nil {
+			t.Errorf("parseProxy(%q) failed: %v", proxy, err)
+		}
+	}
+	for _, proxy := range []string{"ftp://proxy", "proxy:3128", "socks5://"} {
+		if _, err := NewTunnel(8080, &TunnelOptions{Proxy: proxy}); !errors.Is(err, ErrBadProxy) {
+			t.Errorf("NewTunnel with proxy %q: expected ErrBadProxy, got %v", proxy, err)
+		}
+	}
+}
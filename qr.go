@@ -0,0 +1,472 @@
+package vrata
+
+import (
+	"errors"
+	"io"
+	"strings"
+)
+
+// ErrQRTooLong is returned by WriteQR for text that doesn't fit the
+// largest QR code it draws, version 10 with 213 bytes
+var ErrQRTooLong = errors.New("text too long for a QR code")
+
+// qrQuietZone is the light margin around a code, in modules, the 4 the
+// QR standard asks for
+const qrQuietZone = 4
+
+// qrVersion is the layout of a QR code version at error correction level
+// M, the only one WriteQR uses
+type qrVersion struct {
+	ecPerBlock int   // error correction codewords of each block
+	blocks     []int // data codewords of each block
+	align      []int // alignment pattern centers, in both directions
+}
+
+// qrVersions are versions 1 to 10, enough for any tunnel URL
+var qrVersions = []qrVersion{
+	{10, []int{16}, nil},
+	{16, []int{28}, []int{6, 18}},
+	{26, []int{44}, []int{6, 22}},
+	{18, []int{32, 32}, []int{6, 26}},
+	{24, []int{43, 43}, []int{6, 30}},
+	{16, []int{27, 27, 27, 27}, []int{6, 34}},
+	{18, []int{31, 31, 31, 31}, []int{6, 22, 38}},
+	{22, []int{38, 38, 39, 39}, []int{6, 24, 42}},
+	{22, []int{36, 36, 36, 37, 37}, []int{6, 26, 46}},
+	{26, []int{43, 43, 43, 43, 44}, []int{6, 28, 50}},
+}
+
+// WriteQR draws text as a QR code on a terminal, two rows of modules per
+// line with Unicode half blocks. Light modules are drawn, for light text
+// on a dark background; phone cameras read the inverted code light themes
+// get as well.
+func WriteQR(w io.Writer, text string) error {
+	modules, err := qrEncode([]byte(text))
+	if err != nil {
+		return err
+	}
+
+	size := len(modules)
+	light := func(row, col int) bool {
+		row, col = row-qrQuietZone, col-qrQuietZone
+		return row < 0 || col < 0 || row >= size || col >= size || !modules[row][col]
+	}
+	var out strings.Builder
+	for row := 0; row < size+2*qrQuietZone; row += 2 {
+		for col := 0; col < size+2*qrQuietZone; col++ {
+			switch top, bottom := light(row, col), light(row+1, col); {
+			case top && bottom:
+				out.WriteString("█")
+			case top:
+				out.WriteString("▀")
+			case bottom:
+				out.WriteString("▄")
+			default:
+				out.WriteString(" ")
+			}
+		}
+		out.WriteString("\n")
+	}
+	_, err = io.WriteString(w, out.String())
+	return err
+}
+
+// qrEncode returns the modules of the smallest QR code holding data in
+// byte mode at error correction level M, true for dark, by row
+func qrEncode(data []byte) ([][]bool, error) {
+	number := 0
+	for i, v := range qrVersions {
+		if 4+qrCountBits(i+1)+8*len(data) <= 8*sum(v.blocks) {
+			number = i + 1
+			break
+		}
+	}
+	if number == 0 {
+		return nil, ErrQRTooLong
+	}
+
+	q := newQRCode(number)
+	q.drawCodewords(q.codewords(data))
+
+	// Keep the mask that makes the code easiest to read
+	best, bestPenalty := 0, -1
+	for mask := range 8 {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if penalty := q.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormat(best)
+	return q.modules, nil
+}
+
+// qrCountBits is the size of the byte count in a code of version number
+func qrCountBits(number int) int {
+	if number < 10 {
+		return 8
+	}
+	return 16
+}
+
+func sum(values []int) int {
+	total := 0
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
+
+// qrCode is a code being drawn. Function modules, the patterns and format
+// areas, are left alone by the data and masks.
+type qrCode struct {
+	number   int
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+// newQRCode returns a code of version number with its function patterns
+func newQRCode(number int) *qrCode {
+	size := 17 + 4*number
+	q := &qrCode{number: number, size: size}
+	q.modules, q.function = make([][]bool, size), make([][]bool, size)
+	for i := range size {
+		q.modules[i], q.function[i] = make([]bool, size), make([]bool, size)
+	}
+
+	for i := range size {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	q.drawFinder(3, 3)
+	q.drawFinder(3, size-4)
+	q.drawFinder(size-4, 3)
+
+	align := qrVersions[number-1].align
+	last := len(align) - 1
+	for i, row := range align {
+		for j, col := range align {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue // under a finder
+			}
+			q.drawAlignment(row, col)
+		}
+	}
+
+	// Reserve the format areas until a mask is chosen
+	q.drawFormat(0)
+	if number >= 7 {
+		q.drawVersion()
+	}
+	return q
+}
+
+// set draws a function module
+func (q *qrCode) set(row, col int, dark bool) {
+	q.modules[row][col] = dark
+	q.function[row][col] = true
+}
+
+// drawFinder draws a finder pattern and its separator around a center
+func (q *qrCode) drawFinder(row, col int) {
+	for dr := -4; dr <= 4; dr++ {
+		for dc := -4; dc <= 4; dc++ {
+			r, c := row+dr, col+dc
+			if r < 0 || c < 0 || r >= q.size || c >= q.size {
+				continue
+			}
+			distance := max(abs(dr), abs(dc))
+			q.set(r, c, distance != 2 && distance != 4)
+		}
+	}
+}
+
+// drawAlignment draws an alignment pattern around a center
+func (q *qrCode) drawAlignment(row, col int) {
+	for dr := -2; dr <= 2; dr++ {
+		for dc := -2; dc <= 2; dc++ {
+			q.set(row+dr, col+dc, max(abs(dr), abs(dc)) != 1)
+		}
+	}
+}
+
+// drawFormat draws both copies of the format information, error
+// correction level M with mask, and the dark module
+func (q *qrCode) drawFormat(mask int) {
+	bits := qrBCH(mask, 10, 0x537) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 != 0 }
+
+	for i := range 6 {
+		q.set(i, 8, bit(i))
+	}
+	q.set(7, 8, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(8, 7, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(8, 14-i, bit(i))
+	}
+
+	for i := range 8 {
+		q.set(8, q.size-1-i, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(q.size-15+i, 8, bit(i))
+	}
+	q.set(q.size-8, 8, true)
+}
+
+// drawVersion draws both copies of the version information
+func (q *qrCode) drawVersion() {
+	bits := qrBCH(q.number, 12, 0x1F25)
+	for i := range 18 {
+		dark := bits>>i&1 != 0
+		a, b := q.size-11+i%3, i/3
+		q.set(b, a, dark)
+		q.set(a, b, dark)
+	}
+}
+
+// qrBCH appends the n-bit BCH code of value with generator poly
+func qrBCH(value, n, poly int) int {
+	rem := value
+	for range n {
+		rem = rem<<1 ^ (rem>>(n-1))*poly
+	}
+	return value<<n | rem
+}
+
+// codewords returns data in byte mode, padded and split into blocks, with
+// the blocks' error correction, interleaved
+func (q *qrCode) codewords(data []byte) []byte {
+	v := qrVersions[q.number-1]
+	capacity := 8 * sum(v.blocks)
+
+	var bits qrBits
+	bits.append(0b0100, 4)
+	bits.append(len(data), qrCountBits(q.number))
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	bits.append(0, min(4, capacity-bits.n))
+	bits.append(0, -bits.n&7)
+	for pad := 0xEC; bits.n < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+
+	divisor := qrDivisor(v.ecPerBlock)
+	var blocks, ecs [][]byte
+	offset := 0
+	for _, n := range v.blocks {
+		block := bits.bytes[offset : offset+n]
+		offset += n
+		blocks = append(blocks, block)
+		ecs = append(ecs, qrRemainder(block, divisor))
+	}
+
+	var out []byte
+	for i := range v.blocks[len(v.blocks)-1] {
+		for _, block := range blocks {
+			if i < len(block) {
+				out = append(out, block[i])
+			}
+		}
+	}
+	for i := range v.ecPerBlock {
+		for _, ec := range ecs {
+			out = append(out, ec[i])
+		}
+	}
+	return out
+}
+
+// drawCodewords places codewords in the data area, two columns at a time
+// from the right, zigzagging up and down
+func (q *qrCode) drawCodewords(codewords []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		upward := (right+1)&2 == 0
+		for vert := range q.size {
+			row := vert
+			if upward {
+				row = q.size - 1 - vert
+			}
+			for j := range 2 {
+				col := right - j
+				if q.function[row][col] || i >= 8*len(codewords) {
+					continue
+				}
+				q.modules[row][col] = codewords[i>>3]>>(7-i&7)&1 != 0
+				i++
+			}
+		}
+	}
+}
+
+// applyMask flips the data modules mask selects; applying it twice undoes
+// it
+func (q *qrCode) applyMask(mask int) {
+	for row := range q.size {
+		for col := range q.size {
+			if q.function[row][col] {
+				continue
+			}
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (row+col)%2 == 0
+			case 1:
+				flip = row%2 == 0
+			case 2:
+				flip = col%3 == 0
+			case 3:
+				flip = (row+col)%3 == 0
+			case 4:
+				flip = (row/2+col/3)%2 == 0
+			case 5:
+				flip = row*col%2+row*col%3 == 0
+			case 6:
+				flip = (row*col%2+row*col%3)%2 == 0
+			case 7:
+				flip = ((row+col)%2+row*col%3)%2 == 0
+			}
+			q.modules[row][col] = q.modules[row][col] != flip
+		}
+	}
+}
+
+// penalty scores how hard the code is to read: long runs, blocks of one
+// color, finder-like patterns and unbalanced colors cost
+func (q *qrCode) penalty() int {
+	total, dark := 0, 0
+	at := func(row, col int, transposed bool) bool {
+		if transposed {
+			return q.modules[col][row]
+		}
+		return q.modules[row][col]
+	}
+
+	for _, transposed := range []bool{false, true} {
+		for row := range q.size {
+			run := 0
+			for col := range q.size {
+				if col > 0 && at(row, col, transposed) == at(row, col-1, transposed) {
+					run++
+				} else {
+					run = 1
+				}
+				if run == 5 {
+					total += 3
+				} else if run > 5 {
+					total++
+				}
+
+				if col >= 10 && qrFinderLike(func(i int) bool { return at(row, col-10+i, transposed) }) {
+					total += 40
+				}
+			}
+		}
+	}
+
+	for row := range q.size {
+		for col := range q.size {
+			if q.modules[row][col] {
+				dark++
+			}
+			if row > 0 && col > 0 {
+				c := q.modules[row][col]
+				if c == q.modules[row-1][col] && c == q.modules[row][col-1] && c == q.modules[row-1][col-1] {
+					total += 3
+				}
+			}
+		}
+	}
+
+	cells := q.size * q.size
+	k := (abs(dark*20-cells*10)+cells-1)/cells - 1
+	return total + max(k, 0)*10
+}
+
+// qrFinderLike reports whether 11 modules read 1011101 with four light
+// ones on either side
+func qrFinderLike(dark func(i int) bool) bool {
+	const pattern = "10111010000"
+	forward, backward := true, true
+	for i := range 11 {
+		forward = forward && dark(i) == (pattern[i] == '1')
+		backward = backward && dark(i) == (pattern[10-i] == '1')
+	}
+	return forward || backward
+}
+
+// qrBits is a growing big-endian bit string
+type qrBits struct {
+	bytes []byte
+	n     int
+}
+
+func (b *qrBits) append(value, bits int) {
+	for i := bits - 1; i >= 0; i-- {
+		if b.n%8 == 0 {
+			b.bytes = append(b.bytes, 0)
+		}
+		b.bytes[b.n/8] |= byte(value>>i&1) << (7 - b.n%8)
+		b.n++
+	}
+}
+
+// qrDivisor returns the Reed-Solomon generator polynomial of degree n,
+// highest coefficient first and without the leading 1
+func qrDivisor(n int) []byte {
+	divisor := make([]byte, n)
+	divisor[n-1] = 1
+	root := byte(1)
+	for range n {
+		for j := range n {
+			divisor[j] = qrMultiply(divisor[j], root)
+			if j+1 < n {
+				divisor[j] ^= divisor[j+1]
+			}
+		}
+		root = qrMultiply(root, 2)
+	}
+	return divisor
+}
+
+// qrRemainder returns the Reed-Solomon error correction of data
+func qrRemainder(data, divisor []byte) []byte {
+	remainder := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ remainder[0]
+		copy(remainder, remainder[1:])
+		remainder[len(remainder)-1] = 0
+		for i, d := range divisor {
+			remainder[i] ^= qrMultiply(d, factor)
+		}
+	}
+	return remainder
+}
+
+// qrMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func qrMultiply(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		carry := z >> 7
+		z <<= 1
+		z ^= carry * 0x1D
+		z ^= (y >> i & 1) * x
+	}
+	return z
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,119 @@
+package vrata
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// tunnelQR is the QR code of https://abc123.loca.lt, as ZXing draws it
+// with the same mask
+var tunnelQR = []string{
+	"#######.#.#..##...#######",
+	"#.....#.#...#.#.#.#.....#",
+	"#.###.#.##..###...#.###.#",
+	"#.###.#..#...#.##.#.###.#",
+	"#.###.#.##.#..#.#.#.###.#",
+	"#.....#....#....#.#.....#",
+	"#######.#.#.#.#.#.#######",
+	"..........##.#..#........",
+	"#..######..##...##..#.###",
+	"..###...#..#.###...#####.",
+	"...######.#.##.#.#####..#",
+	".##..#...##....#.#...####",
+	"..##..#..###....#.##....#",
+	"##.###.#.##.#.##....#..#.",
+	"##..#.###.#..###..#.#####",
+	"#.#.#..#..#.#.####.#.##.#",
+	"#..##.#.#..###.######.##.",
+	"........####..###...#.##.",
+	"#######.#...##..#.#.#...#",
+	"#.....#.##.#.##.#...#....",
+	"#.###.#.####.#.######..##",
+	"#.###.#.##..###...#....##",
+	"#.###.#..#.#.#.#....#####",
+	"#.....#..#####.#.####.###",
+	"#######.#..###.##.#..#..#",
+}
+
+func TestQREncode(t *testing.T) {
+	modules, err := qrEncode([]byte("https://abc123.loca.lt"))
+	if err != nil {
+		t.Fatalf("qrEncode() failed: %v", err)
+	}
+	var got []string
+	for _, row := range modules {
+		var line strings.Builder
+		for _, dark := range row {
+			if dark {
+				line.WriteByte('#')
+			} else {
+				line.WriteByte('.')
+			}
+		}
+		got = append(got, line.String())
+	}
+	if strings.Join(got, "\n") != strings.Join(tunnelQR, "\n") {
+		t.Errorf("qrEncode() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tunnelQR, "\n"))
+	}
+}
+
+func TestQRVersions(t *testing.T) {
+	// Byte mode at level M: version 1 holds 14 bytes, version 10 213
+	tests := []struct {
+		length int
+		size   int
+	}{
+		{1, 21}, {14, 21}, {15, 25}, {106, 41}, {107, 45}, {213, 57},
+	}
+	for _, tt := range tests {
+		modules, err := qrEncode([]byte(strings.Repeat("a", tt.length)))
+		if err != nil || len(modules) != tt.size {
+			t.Errorf("qrEncode(%d bytes) is %d modules wide (%v), want %d", tt.length, len(modules), err, tt.size)
+		}
+	}
+
+	if _, err := qrEncode(make([]byte, 214)); !errors.Is(err, ErrQRTooLong) {
+		t.Errorf("qrEncode(214 bytes) = %v, want ErrQRTooLong", err)
+	}
+}
+
+func TestWriteQR(t *testing.T) {
+	var out strings.Builder
+	if err := WriteQR(&out, "https://abc123.loca.lt"); err != nil {
+		t.Fatalf("WriteQR() failed: %v", err)
+	}
+
+	// tunnelQR in a quiet zone of 4 light modules, two rows per line
+	margin := strings.Repeat(".", 4)
+	var padded []string
+	for range 4 {
+		padded = append(padded, strings.Repeat(".", 33))
+	}
+	for _, row := range tunnelQR {
+		padded = append(padded, margin+row+margin)
+	}
+	for range 4 {
+		padded = append(padded, strings.Repeat(".", 33))
+	}
+	padded = append(padded, strings.Repeat(".", 33)) // below the last line
+	var want strings.Builder
+	for row := 0; row < 33; row += 2 {
+		for col := range 33 {
+			switch top, bottom := padded[row][col] == '.', padded[row+1][col] == '.'; {
+			case top && bottom:
+				want.WriteString("█")
+			case top:
+				want.WriteString("▀")
+			case bottom:
+				want.WriteString("▄")
+			default:
+				want.WriteString(" ")
+			}
+		}
+		want.WriteString("\n")
+	}
+	if out.String() != want.String() {
+		t.Errorf("WriteQR() =\n%s\nwant\n%s", out.String(), want.String())
+	}
+}
@@ -0,0 +1,164 @@
+package vrata
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// QueueStats reports how visitors were admitted to the local server
+type QueueStats struct {
+	Active    int           // Visitors currently being forwarded
+	Waiting   int           // Visitors waiting for admission
+	Admitted  int64         // Visitors admitted so far
+	Queued    int64         // Admitted visitors that had to wait
+	TotalWait time.Duration // Accumulated time spent waiting
+	MaxWait   time.Duration // Longest single wait
+}
+
+// admissionQueue is a FIFO gate that limits how many visitors are forwarded
+// to the local server at once. A per-client cap keeps one busy client from
+// occupying every slot; waiters blocked by their own cap are skipped so they
+// don't hold up other clients behind them.
+type admissionQueue struct {
+	limit     int
+	perClient int
+
+	active   int
+	byClient map[string]int
+	waiters  []*admissionWaiter
+	stats    QueueStats
+	mutex    sync.Mutex
+}
+
+type admissionWaiter struct {
+	client string
+	ready  chan struct{}
+}
+
+// newAdmissionQueue creates a queue; a limit of zero means unlimited
+func newAdmissionQueue(limit, perClient int) *admissionQueue {
+	return &admissionQueue{
+		limit:     limit,
+		perClient: perClient,
+		byClient:  make(map[string]int),
+	}
+}
+
+// acquire blocks until the visitor may be forwarded. The returned function
+// must be called once the visitor is done.
+func (q *admissionQueue) acquire(ctx context.Context, client string) (func(), error) {
+	start := time.Now()
+
+	q.mutex.Lock()
+	// Waiters still queued are blocked by their own per-client cap, so a
+	// visitor that fits may go ahead of them
+	if q.canAdmit(client) {
+		q.admit(client)
+		q.mutex.Unlock()
+		return q.releaseFunc(client), nil
+	}
+
+	waiter := &admissionWaiter{client: client, ready: make(chan struct{})}
+	q.waiters = append(q.waiters, waiter)
+	q.mutex.Unlock()
+
+	select {
+	case <-waiter.ready:
+		q.mutex.Lock()
+		q.recordWait(time.Since(start))
+		q.mutex.Unlock()
+		return q.releaseFunc(client), nil
+	case <-ctx.Done():
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+
+		select {
+		case <-waiter.ready:
+			// Admitted concurrently with cancellation, give the slot back
+			q.release(client)
+		default:
+			q.remove(waiter)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// Stats returns a snapshot of the queue counters
+func (q *admissionQueue) Stats() QueueStats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	stats := q.stats
+	stats.Active = q.active
+	stats.Waiting = len(q.waiters)
+	return stats
+}
+
+func (q *admissionQueue) releaseFunc(client string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mutex.Lock()
+			defer q.mutex.Unlock()
+			q.release(client)
+		})
+	}
+}
+
+func (q *admissionQueue) canAdmit(client string) bool {
+	if q.limit > 0 && q.active >= q.limit {
+		return false
+	}
+	if q.perClient > 0 && client != "" && q.byClient[client] >= q.perClient {
+		return false
+	}
+	return true
+}
+
+func (q *admissionQueue) admit(client string) {
+	q.active++
+	if client != "" {
+		q.byClient[client]++
+	}
+	q.stats.Admitted++
+}
+
+func (q *admissionQueue) recordWait(wait time.Duration) {
+	q.stats.Queued++
+	q.stats.TotalWait += wait
+	if wait > q.stats.MaxWait {
+		q.stats.MaxWait = wait
+	}
+}
+
+func (q *admissionQueue) release(client string) {
+	q.active--
+	if client != "" {
+		q.byClient[client]--
+		if q.byClient[client] <= 0 {
+			delete(q.byClient, client)
+		}
+	}
+
+	// Hand freed capacity to the oldest eligible waiters
+	for i := 0; i < len(q.waiters); {
+		waiter := q.waiters[i]
+		if !q.canAdmit(waiter.client) {
+			i++
+			continue
+		}
+		q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+		q.admit(waiter.client)
+		close(waiter.ready)
+	}
+}
+
+func (q *admissionQueue) remove(waiter *admissionWaiter) {
+	for i, w := range q.waiters {
+		if w == waiter {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package vrata
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdmissionQueueUnlimited(t *testing.T) {
+	q := newAdmissionQueue(0, 0)
+
+	for i := 0; i < 100; i++ {
+		if _, err := q.acquire(context.Background(), "1.2.3.4"); err != nil {
+			t.Fatalf("acquire() failed: %v", err)
+		}
+	}
+
+	if stats := q.Stats(); stats.Active != 100 || stats.Queued != 0 {
+		t.Errorf("Expected 100 active and none queued, got %+v", stats)
+	}
+}
+
+func TestAdmissionQueueFIFO(t *testing.T) {
+	q := newAdmissionQueue(1, 0)
+
+	release, err := q.acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("acquire() failed: %v", err)
+	}
+
+	order := make(chan string, 2)
+	for i, client := range []string{"b", "c"} {
+		go func() {
+			next, err := q.acquire(context.Background(), client)
+			if err != nil {
+				return
+			}
+			order <- client
+			next()
+		}()
+		// Make sure b is queued before c
+		waitFor(t, func() bool { return q.Stats().Waiting == i+1 })
+	}
+
+	release()
+
+	if first := <-order; first != "b" {
+		t.Errorf("Expected b to be admitted first, got %s", first)
+	}
+	if second := <-order; second != "c" {
+		t.Errorf("Expected c to be admitted second, got %s", second)
+	}
+
+	stats := q.Stats()
+	if stats.Queued != 2 || stats.Admitted != 3 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if stats.MaxWait <= 0 || stats.TotalWait < stats.MaxWait {
+		t.Errorf("Expected wait times to be recorded, got %+v", stats)
+	}
+}
+
+func TestAdmissionQueuePerClientCap(t *testing.T) {
+	q := newAdmissionQueue(3, 1)
+
+	if _, err := q.acquire(context.Background(), "greedy"); err != nil {
+		t.Fatalf("acquire() failed: %v", err)
+	}
+
+	// A second request from the same client waits...
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		q.acquire(ctx, "greedy")
+		close(done)
+	}()
+	waitFor(t, func() bool { return q.Stats().Waiting == 1 })
+
+	// ...while other clients go straight through
+	if _, err := q.acquire(context.Background(), "polite"); err != nil {
+		t.Fatalf("acquire() failed: %v", err)
+	}
+
+	<-done
+	if stats := q.Stats(); stats.Waiting != 0 || stats.Active != 2 {
+		t.Errorf("Expected cancelled waiter to be removed, got %+v", stats)
+	}
+}
+
+func TestTunnelPerClientCapIgnoresForgedHops(t *testing.T) {
+	relay := newMockRelay(t, 2)
+	arrived := make(chan struct{}, 2)
+	release := make(chan struct{})
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		io.WriteString(w, "ok")
+	}))
+	defer local.Close()
+
+	tunnel, err := ConnectAndOpen(local.Listener.Addr().(*net.TCPAddr).Port, &TunnelOptions{
+		Host:                 relay.server.URL,
+		LocalHost:            "127.0.0.1",
+		MaxRequestsPerClient: 1,
+	})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	// The relay appends the real client after whatever it sent
+	send := func(forwardedFor string) net.Conn {
+		var conn net.Conn
+		select {
+		case conn = <-relay.conns:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Tunnel client never connected to the relay")
+		}
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: x\r\nX-Forwarded-For: %s\r\nConnection: close\r\n\r\n", forwardedFor)
+		return conn
+	}
+	first := send("203.0.113.7")
+	defer first.Close()
+	<-arrived
+	second := send("198.51.100.1, 203.0.113.7")
+	defer second.Close()
+
+	waitFor(t, func() bool { return tunnel.cluster.queue.Stats().Waiting == 1 })
+	select {
+	case <-arrived:
+		t.Fatal("A forged first hop got around the per-client cap")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-arrived:
+	case <-time.After(2 * time.Second):
+		t.Fatal("The waiting request was never admitted")
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
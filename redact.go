@@ -0,0 +1,45 @@
+package vrata
+
+import (
+	"net/http"
+	"slices"
+)
+
+// redactedValue replaces the values of redacted headers
+const redactedValue = "[REDACTED]"
+
+// redactHeader returns header with the values of the named headers
+// replaced by redactedValue. The header is copied when it has any, so the
+// caller's copy is never modified.
+func redactHeader(header http.Header, names []string) http.Header {
+	var redacted http.Header
+	for _, name := range names {
+		values := header.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		if redacted == nil {
+			redacted = header.Clone()
+		}
+		masked := slices.Repeat([]string{redactedValue}, len(values))
+		redacted[http.CanonicalHeaderKey(name)] = masked
+	}
+	if redacted == nil {
+		return header
+	}
+	return redacted
+}
+
+// redactInfo masks RedactHeaders in a captured exchange
+func (o *TunnelOptions) redactInfo(info RequestInfo) RequestInfo {
+	info.Header = redactHeader(info.Header, o.RedactHeaders)
+	info.ResponseHeader = redactHeader(info.ResponseHeader, o.RedactHeaders)
+	return info
+}
+
+// redactInteraction masks RedactHeaders in a recorded interaction
+func (o *TunnelOptions) redactInteraction(interaction Interaction) Interaction {
+	interaction.Request.Header = redactHeader(interaction.Request.Header, o.RedactHeaders)
+	interaction.Response.Header = redactHeader(interaction.Response.Header, o.RedactHeaders)
+	return interaction
+}
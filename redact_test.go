@@ -0,0 +1,94 @@
+package vrata
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedactHeader(t *testing.T) {
+	header := http.Header{"Cookie": {"a=1", "b=2"}, "Accept": {"*/*"}}
+
+	redacted := redactHeader(header, []string{"cookie", "authorization"})
+	if got := redacted.Values("Cookie"); len(got) != 2 || got[0] != "[REDACTED]" || got[1] != "[REDACTED]" {
+		t.Errorf("Cookie = %q, want two [REDACTED] values", got)
+	}
+	if redacted.Get("Accept") != "*/*" {
+		t.Errorf("Accept was changed: %q", redacted.Get("Accept"))
+	}
+	if _, ok := redacted["Authorization"]; ok {
+		t.Error("Absent header was added")
+	}
+	if header.Get("Cookie") != "a=1" {
+		t.Error("The original header was modified")
+	}
+}
+
+func TestTunnelStripAndRedactHeaders(t *testing.T) {
+	relay := newMockRelay(t, 1)
+
+	seen := make(chan http.Header, 1)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header
+	}))
+	defer local.Close()
+	localPort := local.Listener.Addr().(*net.TCPAddr).Port
+
+	tunnel, err := ConnectAndOpen(localPort, &TunnelOptions{
+		Host:          relay.server.URL,
+		LocalHost:     "127.0.0.1",
+		StripHeaders:  []string{"cookie"},
+		RedactHeaders: []string{"Authorization"},
+	})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	var conn net.Conn
+	select {
+	case conn = <-relay.conns:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Tunnel client never connected to the relay")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	io.WriteString(conn, strings.Join([]string{
+		"GET / HTTP/1.1",
+		"Host: public.example",
+		"Cookie: session=secret",
+		"Authorization: Bearer secret",
+		"", "",
+	}, "\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	resp.Body.Close()
+
+	header := <-seen
+	if header.Get("Cookie") != "" {
+		t.Errorf("Stripped Cookie reached the local server: %q", header.Get("Cookie"))
+	}
+	if header.Get("Authorization") != "Bearer secret" {
+		t.Errorf("Redacted Authorization must still be forwarded, got %q", header.Get("Authorization"))
+	}
+
+	select {
+	case info := <-tunnel.Events().Request:
+		if got := info.Header.Get("Authorization"); got != "[REDACTED]" {
+			t.Errorf("Request event Authorization = %q, want [REDACTED]", got)
+		}
+		if info.Header.Get("Cookie") != "" {
+			t.Errorf("Request event has the stripped Cookie")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No request event")
+	}
+}
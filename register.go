@@ -0,0 +1,78 @@
+package vrata
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	defaultRegisterBackoff = time.Second
+	maxRegisterBackoff     = 30 * time.Second
+)
+
+// register requests the tunnel from the relay, trying the requested
+// subdomains in order while they are taken
+func (t *Tunnel) register(ctx context.Context) (*TunnelInfo, error) {
+	if len(t.subdomains) == 0 {
+		return t.registerRetrying(ctx)
+	}
+
+	var err error
+	for i, subdomain := range t.subdomains {
+		if i > 0 {
+			t.logger.Info("subdomain taken, trying the next one", "taken", t.subdomains[i-1], "next", subdomain)
+		}
+
+		t.options.Subdomain = subdomain
+		var info *TunnelInfo
+		if info, err = t.registerRetrying(ctx); err == nil {
+			info.Subdomain = subdomain
+			return info, nil
+		}
+		if !errors.Is(err, ErrSubdomainTaken) {
+			return nil, err
+		}
+	}
+
+	if t.reclaim {
+		t.logger.Warn("reserved subdomain is taken, requesting a random one", "subdomain", t.options.Subdomain)
+		t.options.Subdomain = ""
+		return t.registerRetrying(ctx)
+	}
+	return nil, err
+}
+
+// registerRetrying requests the tunnel from the relay, retrying failures
+// that may be transient up to RegisterRetries times
+func (t *Tunnel) registerRetrying(ctx context.Context) (*TunnelInfo, error) {
+	wait := t.options.RegisterBackoff
+	if wait <= 0 {
+		wait = defaultRegisterBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		info, err := t.requestTunnel(ctx)
+		if err == nil || attempt >= t.options.RegisterRetries || !retryRegistration(ctx, err) {
+			return info, err
+		}
+
+		// Jitter spreads out clients that failed together
+		delay := min(wait/2+rand.N(wait), maxRegisterBackoff)
+		t.logger.Warn("tunnel registration failed, retrying", "error", err, "attempt", attempt+1, "in", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, t.openError(ctx)
+		}
+		wait = min(wait*2, maxRegisterBackoff)
+	}
+}
+
+// retryRegistration reports whether a failed registration may succeed when
+// retried: network errors and relay overload may pass, refusals such as a
+// taken subdomain won't
+func retryRegistration(ctx context.Context, err error) bool {
+	return ctx.Err() == nil && errors.Is(err, ErrServerUnavailable)
+}
@@ -0,0 +1,158 @@
+package vrata
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRegisterRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int // answered until the third attempt
+		retries  int
+		wantErr  bool
+		attempts int32
+	}{
+		{"overloaded relay recovers", http.StatusServiceUnavailable, 3, false, 3},
+		{"rate limit passes", http.StatusTooManyRequests, 3, false, 3},
+		{"too few retries", http.StatusBadGateway, 1, true, 2},
+		{"no retries by default", http.StatusServiceUnavailable, 0, true, 1},
+		{"taken subdomain is final", http.StatusConflict, 3, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if attempts.Add(1) < 3 {
+					http.Error(w, `{"message": "try again"}`, tt.status)
+					return
+				}
+				w.Write([]byte(`{"id": "abc", "url": "https://abc.example", "port": 1, "max_conn_count": 1}`))
+			}))
+			defer relay.Close()
+
+			tunnel, err := NewTunnel(8080, &TunnelOptions{
+				Host:            relay.URL,
+				RegisterRetries: tt.retries,
+				RegisterBackoff: 10 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatalf("NewTunnel() failed: %v", err)
+			}
+			defer tunnel.Close()
+
+			info, err := tunnel.register(tunnel.ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("register() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && info.ID != "abc" {
+				t.Errorf("Unexpected tunnel %+v", info)
+			}
+			if got := attempts.Load(); got != tt.attempts {
+				t.Errorf("Got %d attempts, want %d", got, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestRegisterStopsOnClose(t *testing.T) {
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer relay.Close()
+
+	tunnel, err := NewTunnel(8080, &TunnelOptions{
+		Host:            relay.URL,
+		RegisterRetries: 10,
+		RegisterBackoff: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("NewTunnel() failed: %v", err)
+	}
+
+	time.AfterFunc(100*time.Millisecond, func() { tunnel.Close() })
+	started := time.Now()
+	_, err = tunnel.register(tunnel.ctx)
+	if !errors.Is(err, ErrTunnelClosed) {
+		t.Errorf("Expected ErrTunnelClosed, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("Close took %s to stop the retries", elapsed)
+	}
+}
+
+func TestRegistrationHeaders(t *testing.T) {
+	var got http.Header
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Write([]byte(`{"id": "abc", "url": "https://abc.example", "port": 1, "max_conn_count": 1}`))
+	}))
+	defer relay.Close()
+
+	tunnel, err := NewTunnel(8080, &TunnelOptions{
+		Host: relay.URL,
+		RegistrationHeaders: http.Header{
+			"Cf-Access-Client-Id": {"client"},
+			"Authorization":       {"Basic gateway"},
+		},
+		Token: "secret",
+	})
+	if err != nil {
+		t.Fatalf("NewTunnel() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	if _, err := tunnel.register(tunnel.ctx); err != nil {
+		t.Fatalf("register() failed: %v", err)
+	}
+	if v := got.Get("CF-Access-Client-Id"); v != "client" {
+		t.Errorf("Expected the gateway header, got %q", v)
+	}
+	if v := got.Get("Authorization"); v != "Bearer secret" {
+		t.Errorf("Expected the token to win, got %q", v)
+	}
+
+	_, err = NewTunnel(8080, &TunnelOptions{
+		RegistrationHeaders: http.Header{"Bad Name": {"x"}},
+	})
+	if !errors.Is(err, ErrInvalidHeader) {
+		t.Errorf("Expected ErrInvalidHeader, got %v", err)
+	}
+}
+
+type countingTransport struct {
+	requests atomic.Int32
+}
+
+func (c *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	c.requests.Add(1)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestRegistrationClient(t *testing.T) {
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": "abc", "url": "https://abc.example", "port": 1, "max_conn_count": 1}`))
+	}))
+	defer relay.Close()
+
+	transport := &countingTransport{}
+	tunnel, err := NewTunnel(8080, &TunnelOptions{
+		Host:               relay.URL,
+		RegistrationClient: &http.Client{Transport: transport},
+	})
+	if err != nil {
+		t.Fatalf("NewTunnel() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	if _, err := tunnel.register(tunnel.ctx); err != nil {
+		t.Fatalf("register() failed: %v", err)
+	}
+	if got := transport.requests.Load(); got != 1 {
+		t.Errorf("Expected the registration through the custom client, got %d requests", got)
+	}
+}
@@ -0,0 +1,57 @@
+package vrata
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// ErrBadRelayCA is returned by LoadRelayTLS for a CA file without any
+// PEM certificate
+var ErrBadRelayCA = errors.New("no certificates in relay CA file")
+
+// LoadRelayTLS returns a RelayTLS configuration presenting the client
+// certificate and key in certFile and keyFile, and trusting the relay
+// certificates issued by the CA in caFile. Either pair may be empty: the
+// system roots are trusted without a CA file, and no certificate is
+// presented without certFile.
+func LoadRelayTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load relay client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read relay CA: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%w: %s", ErrBadRelayCA, caFile)
+		}
+	}
+	return config, nil
+}
+
+// relayHandshake secures a data connection to the relay at address with
+// RelayTLS
+func (o *TunnelOptions) relayHandshake(ctx context.Context, conn net.Conn, address string) (net.Conn, error) {
+	config := o.RelayTLS.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(address)
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with relay: %w", err)
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,137 @@
+package vrata
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1, good for
+// servers and clients and as its own CA, and its key to dir
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func TestLoadRelayTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir)
+
+	config, err := LoadRelayTLS(certFile, keyFile, certFile)
+	if err != nil {
+		t.Fatalf("LoadRelayTLS() failed: %v", err)
+	}
+	if len(config.Certificates) != 1 || config.RootCAs == nil {
+		t.Errorf("Expected a client certificate and CA pool, got %+v", config)
+	}
+
+	if _, err := LoadRelayTLS(certFile, "", ""); err == nil {
+		t.Error("Expected an error for a certificate without its key")
+	}
+	if _, err := LoadRelayTLS("", "", keyFile); !errors.Is(err, ErrBadRelayCA) {
+		t.Errorf("Expected ErrBadRelayCA for a CA file without certificates, got %v", err)
+	}
+}
+
+func TestTunnelRelayTLS(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+	config, err := LoadRelayTLS(certFile, keyFile, certFile)
+	if err != nil {
+		t.Fatalf("LoadRelayTLS() failed: %v", err)
+	}
+
+	// The relay demands a client certificate from its CA on registration
+	// and data connections alike
+	serverConfig := &tls.Config{
+		Certificates: config.Certificates,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    config.RootCAs,
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	registration := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id":"mock","url":"https://127.0.0.1","port":%d,"max_conn_count":1}`, listener.Addr().(*net.TCPAddr).Port)
+	}))
+	registration.TLS = serverConfig
+	registration.StartTLS()
+	defer registration.Close()
+
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "local")
+	}))
+	defer local.Close()
+	localPort := local.Listener.Addr().(*net.TCPAddr).Port
+
+	if _, err := ConnectAndOpen(localPort, &TunnelOptions{Host: registration.URL}); err == nil {
+		t.Fatal("Expected registration without RelayTLS to fail")
+	}
+
+	tunnel, err := ConnectAndOpen(localPort, &TunnelOptions{Host: registration.URL, LocalHost: "127.0.0.1", RelayTLS: config})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if err := conn.(*tls.Conn).Handshake(); err != nil {
+		t.Fatalf("Data connection handshake failed: %v", err)
+	}
+
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: public.example\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != "local" {
+		t.Errorf("Body = %q, want local", body)
+	}
+}
@@ -0,0 +1,53 @@
+package vrata
+
+import (
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultRequestFormat prints when a request arrived, the client, the
+// request line, the status, how long the answer took and the sizes of the
+// request and response
+const DefaultRequestFormat = `{{.Time.Format "15:04:05"}} {{.Client}} {{.Method}} {{.URL}} {{.StatusCode}} {{.Duration.Milliseconds}}ms {{.BytesIn}}B in {{.BytesOut}}B out`
+
+// RequestFormat formats completed exchanges as lines of text, e.g. to
+// print them as they happen. Its text/template sees the fields of
+// RequestInfo, plus Time, when the request arrived, and Client, the
+// RemoteAddr or "-" when the relay didn't report it.
+type RequestFormat struct {
+	template *template.Template
+}
+
+// requestLine is what RequestFormat templates see
+type requestLine struct {
+	RequestInfo
+	Time   time.Time
+	Client string
+}
+
+// ParseRequestFormat parses a template for RequestFormat. Templates that
+// refer to fields that don't exist are rejected.
+func ParseRequestFormat(format string) (*RequestFormat, error) {
+	t, err := template.New("request").Option("missingkey=error").Parse(format)
+	if err != nil {
+		return nil, err
+	}
+	f := &RequestFormat{template: t}
+	if _, err := f.Format(RequestInfo{}); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Format returns the line for a completed exchange, without a trailing
+// newline
+func (f *RequestFormat) Format(info RequestInfo) (string, error) {
+	var line strings.Builder
+	err := f.template.Execute(&line, requestLine{
+		RequestInfo: info,
+		Time:        info.start,
+		Client:      orDash(info.RemoteAddr),
+	})
+	return strings.TrimRight(line.String(), "\n"), err
+}
@@ -0,0 +1,49 @@
+package vrata
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRequestFormat(t *testing.T) {
+	info := RequestInfo{
+		Method:     "POST",
+		Path:       "/hooks",
+		URL:        "/hooks?id=1",
+		RemoteAddr: "192.0.2.1",
+		Header:     http.Header{"User-Agent": {"curl/8.0"}},
+		StatusCode: 201,
+		Duration:   12500 * time.Microsecond,
+		BytesIn:    312,
+		BytesOut:   1024,
+		start:      time.Date(2024, 3, 5, 14, 7, 9, 0, time.UTC),
+	}
+
+	tests := []struct {
+		format string
+		info   RequestInfo
+		want   string
+	}{
+		{DefaultRequestFormat, info, "14:07:09 192.0.2.1 POST /hooks?id=1 201 12ms 312B in 1024B out"},
+		{DefaultRequestFormat, RequestInfo{Method: "GET", URL: "/", StatusCode: 200, start: info.start}, "14:07:09 - GET / 200 0ms 0B in 0B out"},
+		{`{{.StatusCode}} {{.Path}} {{.Header.Get "User-Agent"}}` + "\n", info, "201 /hooks curl/8.0"},
+	}
+	for _, tt := range tests {
+		format, err := ParseRequestFormat(tt.format)
+		if err != nil {
+			t.Fatalf("ParseRequestFormat(%q) failed: %v", tt.format, err)
+		}
+		if got, err := format.Format(tt.info); err != nil || got != tt.want {
+			t.Errorf("Format() = %q, %v, want %q", got, err, tt.want)
+		}
+	}
+}
+
+func TestParseRequestFormatRejectsBadTemplates(t *testing.T) {
+	for _, format := range []string{"{{.Method", "{{.Status}}", "{{.Header.Nope}}"} {
+		if _, err := ParseRequestFormat(format); err == nil {
+			t.Errorf("ParseRequestFormat(%q) succeeded, want an error", format)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package vrata
+
+import (
+	"errors"
+	"time"
+)
+
+// defaultReregisterAfter is how long a tunnel may fail to reconnect before
+// it registers again
+const defaultReregisterAfter = time.Minute
+
+// URLChange describes a tunnel that registered again under another URL
+type URLChange struct {
+	Previous string
+	URL      string
+}
+
+func (o *TunnelOptions) reregisterAfter() time.Duration {
+	if o.ReregisterAfter == 0 {
+		return defaultReregisterAfter
+	}
+	return o.ReregisterAfter
+}
+
+// scheduleReregister arms re-registration when the tunnel starts
+// reconnecting, and disarms it when the tunnel recovers or closes
+func (t *Tunnel) scheduleReregister(state TunnelState) {
+	after := t.options.reregisterAfter()
+	if after < 0 {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	switch state {
+	case StateReconnecting:
+		if t.reregistration == nil && !t.closed {
+			t.reregistration = time.AfterFunc(after, t.reregister)
+		}
+	case StateConnected, StateDegraded, StateClosed:
+		if t.reregistration != nil {
+			t.reregistration.Stop()
+			t.reregistration = nil
+		}
+	}
+}
+
+// reregister registers the tunnel again after the relay forgot it, e.g.
+// because it expired, and replaces the connection pool. A tunnel that got
+// a random subdomain asks for the same one first.
+func (t *Tunnel) reregister() {
+	t.mutex.Lock()
+	t.reregistration = nil
+	closed, previous, old := t.closed, t.info, t.cluster
+	t.mutex.Unlock()
+	if closed {
+		return
+	}
+
+	t.logger.Warn("tunnel server unreachable, registering again", "url", previous.URL)
+	t.setState(StateRegistering)
+
+	var info *TunnelInfo
+	var err error
+	if subdomain := t.Subdomain(); len(t.subdomains) == 0 && subdomain != "" {
+		t.options.Subdomain = subdomain
+		info, err = t.registerRetrying(t.ctx)
+		t.options.Subdomain = ""
+		if errors.Is(err, ErrSubdomainTaken) {
+			info, err = t.registerRetrying(t.ctx)
+		}
+	} else {
+		info, err = t.register(t.ctx)
+	}
+
+	var cluster *TunnelCluster
+	if err == nil {
+		cluster, err = t.newCluster(info)
+	}
+	if err != nil {
+		if t.ctx.Err() != nil {
+			return
+		}
+		t.logger.Error("registering again failed", "error", err)
+		t.stream.publish("error", map[string]string{"error": err.Error()})
+		select {
+		case t.events.Error <- err:
+		default:
+		}
+		// Back to reconnecting, which schedules the next attempt
+		t.setState(StateReconnecting)
+		return
+	}
+
+	t.mutex.Lock()
+	if t.closed {
+		t.mutex.Unlock()
+		return
+	}
+	t.info = info
+	t.cluster = cluster
+	t.mutex.Unlock()
+
+	if err := t.options.saveReservation(info.ID); err != nil {
+		t.logger.Warn("failed to save the subdomain reservation", "file", t.options.ReservationFile, "error", err)
+	}
+	old.Close()
+	t.startCluster(cluster)
+
+	t.logger.Info("tunnel registered again", "id", info.ID, "url", info.URL)
+	if info.URL != previous.URL {
+		t.stream.publish("url", map[string]string{"url": info.URL, "previous": previous.URL})
+		select {
+		case t.events.URLChanged <- URLChange{Previous: previous.URL, URL: info.URL}:
+		default:
+		}
+	}
+}
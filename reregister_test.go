@@ -0,0 +1,96 @@
+package vrata
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReregisterAfterRelayDropsTunnel(t *testing.T) {
+	defer func(interval time.Duration) { maintenanceInterval = interval }(maintenanceInterval)
+	maintenanceInterval = 20 * time.Millisecond
+
+	listen := func() net.Listener {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		return listener
+	}
+	first, second := listen(), listen()
+	accepted := make(chan net.Conn, 10)
+	for _, listener := range []net.Listener{first, second} {
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				accepted <- conn
+			}
+		}()
+	}
+
+	var mutex sync.Mutex
+	var paths []string
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		paths = append(paths, r.URL.Path)
+		n := len(paths)
+		mutex.Unlock()
+
+		listener, path := first, "first"
+		if n > 1 {
+			listener, path = second, "second"
+		}
+		fmt.Fprintf(w, `{"id":"%s","url":"http://127.0.0.1/%s","port":%d,"max_conn_count":1}`,
+			path, path, listener.Addr().(*net.TCPAddr).Port)
+	}))
+	defer relay.Close()
+
+	tunnel, err := ConnectAndOpen(8080, &TunnelOptions{Host: relay.URL, ReregisterAfter: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+	<-tunnel.Ready()
+
+	// The relay forgets the tunnel: its data port goes away
+	conn := <-accepted
+	first.Close()
+	conn.Close()
+
+	select {
+	case change := <-tunnel.Events().URLChanged:
+		if change.Previous != "http://127.0.0.1/first" || change.URL != "http://127.0.0.1/second" {
+			t.Errorf("Unexpected URL change %+v", change)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Never registered again, state %s", tunnel.State())
+	}
+
+	if url, _ := tunnel.URL(); url != "http://127.0.0.1/second" {
+		t.Errorf("URL() still returns %q", url)
+	}
+	waitFor(t, func() bool { return tunnel.State() == StateConnected })
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	// The previous subdomain is asked for first
+	if len(paths) != 2 || paths[1] != "/127" {
+		t.Errorf("Unexpected registrations %v", paths)
+	}
+}
+
+func TestReregisterDisabled(t *testing.T) {
+	tunnel := &Tunnel{options: &TunnelOptions{ReregisterAfter: -1}}
+	tunnel.scheduleReregister(StateReconnecting)
+	if tunnel.reregistration != nil {
+		t.Error("Re-registration scheduled although disabled")
+	}
+}
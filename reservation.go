@@ -0,0 +1,112 @@
+package vrata
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// DefaultReservationFile returns the per-user ReservationFile the CLI uses,
+// or an empty string when the user has no config directory
+func DefaultReservationFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "varta", "reservations.json")
+}
+
+// relayReservation is what a ReservationFile keeps for one relay: the
+// account token and the subdomain last granted to each local port
+type relayReservation struct {
+	Token      string            `json:"token,omitempty"`
+	Subdomains map[string]string `json:"subdomains,omitempty"`
+}
+
+// reservationMutex serializes updates of reservation files by tunnels of
+// the same process
+var reservationMutex sync.Mutex
+
+// loadReservations reads a ReservationFile; a missing file holds nothing
+func loadReservations(path string) (map[string]relayReservation, error) {
+	reservations := make(map[string]relayReservation)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return reservations, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &reservations); err != nil {
+		return nil, fmt.Errorf("invalid reservation file %s: %w", path, err)
+	}
+	return reservations, nil
+}
+
+// applyReservation fills in Token and Subdomain from ReservationFile when
+// they aren't set. It reports whether the subdomain came from the file.
+func (o *TunnelOptions) applyReservation() (bool, error) {
+	if o.ReservationFile == "" {
+		return false, nil
+	}
+	reservations, err := loadReservations(o.ReservationFile)
+	if err != nil {
+		return false, err
+	}
+
+	stored := reservations[o.Host]
+	if o.Token == "" {
+		o.Token = stored.Token
+	}
+	// A subdomain reserved by another account can't be reclaimed
+	if o.Token == "" || o.Token != stored.Token || o.Subdomain != "" {
+		return false, nil
+	}
+	o.Subdomain = stored.Subdomains[strconv.Itoa(o.Port)]
+	return o.Subdomain != "", nil
+}
+
+// saveReservation records Token and the subdomain granted to the local
+// port in ReservationFile, readable by the user only
+func (o *TunnelOptions) saveReservation(subdomain string) error {
+	if o.ReservationFile == "" || o.Token == "" {
+		return nil
+	}
+
+	reservationMutex.Lock()
+	defer reservationMutex.Unlock()
+
+	reservations, err := loadReservations(o.ReservationFile)
+	if err != nil {
+		return err
+	}
+	stored := reservations[o.Host]
+	if stored.Token != o.Token {
+		stored = relayReservation{Token: o.Token}
+	}
+	if stored.Subdomains == nil {
+		stored.Subdomains = make(map[string]string)
+	}
+	stored.Subdomains[strconv.Itoa(o.Port)] = subdomain
+	reservations[o.Host] = stored
+
+	data, err := json.MarshalIndent(reservations, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(o.ReservationFile), 0o700); err != nil {
+		return err
+	}
+
+	// Replace the file in one step, so a crash can't lose the token
+	tmp := o.ReservationFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, o.ReservationFile)
+}
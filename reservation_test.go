@@ -0,0 +1,108 @@
+package vrata
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// reservingRelay grants subdomains to bearer tokens and holds the names in
+// taken for other accounts
+func reservingRelay(t *testing.T, taken ...string) (*httptest.Server, *[]string) {
+	t.Helper()
+	var requests []string
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		requests = append(requests, r.Header.Get("Authorization")+" "+name)
+		for _, held := range taken {
+			if name == held {
+				http.Error(w, `{"message": "subdomain taken"}`, http.StatusConflict)
+				return
+			}
+		}
+		if name == "" {
+			name = "random"
+		}
+		fmt.Fprintf(w, `{"id": %q, "url": "https://%s.example", "port": 1, "max_conn_count": 1}`, name, name)
+	}))
+	t.Cleanup(relay.Close)
+	return relay, &requests
+}
+
+// registerOnce registers a tunnel like Open does, without the pool
+func registerOnce(t *testing.T, options *TunnelOptions) *TunnelInfo {
+	t.Helper()
+	tunnel, err := NewTunnel(3000, options)
+	if err != nil {
+		t.Fatalf("NewTunnel() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	info, err := tunnel.register(tunnel.ctx)
+	if err != nil {
+		t.Fatalf("register() failed: %v", err)
+	}
+	if err := tunnel.options.saveReservation(info.ID); err != nil {
+		t.Fatalf("saveReservation() failed: %v", err)
+	}
+	return info
+}
+
+func TestReservationReclaimsSubdomain(t *testing.T) {
+	relay, requests := reservingRelay(t)
+	file := filepath.Join(t.TempDir(), "varta", "reservations.json")
+
+	registerOnce(t, &TunnelOptions{Host: relay.URL, Subdomain: "myapp", Token: "s3cret", ReservationFile: file})
+	if stat, err := os.Stat(file); err != nil || stat.Mode().Perm() != 0o600 {
+		t.Fatalf("Reservation file not saved privately: %v %v", stat, err)
+	}
+
+	// A restart names neither the token nor the subdomain
+	info := registerOnce(t, &TunnelOptions{Host: relay.URL, ReservationFile: file})
+	if info.ID != "myapp" {
+		t.Errorf("Expected the reserved subdomain, got %q", info.ID)
+	}
+	want := []string{"Bearer s3cret myapp", "Bearer s3cret myapp"}
+	if strings.Join(*requests, "|") != strings.Join(want, "|") {
+		t.Errorf("Relay got %q, want %q", *requests, want)
+	}
+
+	// Other ports and other accounts don't share it
+	tunnel, err := NewTunnel(4000, &TunnelOptions{Host: relay.URL, ReservationFile: file})
+	if err != nil {
+		t.Fatalf("NewTunnel() failed: %v", err)
+	}
+	if tunnel.options.Subdomain != "" || tunnel.options.Token != "s3cret" {
+		t.Errorf("Port 4000 got subdomain %q and token %q", tunnel.options.Subdomain, tunnel.options.Token)
+	}
+	tunnel, err = NewTunnel(3000, &TunnelOptions{Host: relay.URL, Token: "other", ReservationFile: file})
+	if err != nil {
+		t.Fatalf("NewTunnel() failed: %v", err)
+	}
+	if tunnel.options.Subdomain != "" {
+		t.Errorf("Another account reclaimed %q", tunnel.options.Subdomain)
+	}
+}
+
+func TestReservationFallsBackWhenTaken(t *testing.T) {
+	relay, _ := reservingRelay(t, "myapp")
+	file := filepath.Join(t.TempDir(), "reservations.json")
+	os.WriteFile(file, []byte(fmt.Sprintf(`{%q: {"token": "s3cret", "subdomains": {"3000": "myapp"}}}`, relay.URL)), 0o600)
+
+	info := registerOnce(t, &TunnelOptions{Host: relay.URL, ReservationFile: file})
+	if info.ID != "random" {
+		t.Fatalf("Expected a random subdomain, got %q", info.ID)
+	}
+
+	reservations, err := loadReservations(file)
+	if err != nil {
+		t.Fatalf("loadReservations() failed: %v", err)
+	}
+	if got := reservations[relay.URL].Subdomains["3000"]; got != "random" {
+		t.Errorf("Expected the new subdomain to be reserved, got %q", got)
+	}
+}
@@ -0,0 +1,128 @@
+package vrata
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxResponseHead bounds how much of a response is buffered to rewrite its
+// headers; larger heads are passed through untouched
+const maxResponseHead = 64 << 10
+
+// forwardResponses copies responses from the local server to the visitor
+// one at a time, setting the configured response headers on each and
+// adding added. methods receives the method of every request forwarded on
+// the connection, in order, since the framing of a response depends on it.
+func (conn *TunnelConnection) forwardResponses(upstream io.Writer, local io.Reader, methods <-chan string, added http.Header) {
+	headers := canonicalHeaders(conn.cluster.options.ResponseHeaders)
+	reader := bufio.NewReaderSize(local, maxResponseHead)
+
+	// Whatever can't be framed, such as upgraded connections, is copied
+	// as is
+	defer spliceCopy(upstream, local, reader, -1)
+
+	for {
+		// Wait for the next response, or for the local server to hang up
+		if _, err := reader.Peek(1); err != nil {
+			return
+		}
+		method, ok := <-methods
+		if !ok {
+			return
+		}
+		for {
+			head, err := peekRequestHead(reader)
+			if err != nil {
+				return
+			}
+			head = bytes.Clone(head)
+			reader.Discard(len(head))
+
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), &http.Request{Method: method})
+			if err != nil {
+				upstream.Write(head)
+				return
+			}
+			if err := writeResponseHead(upstream, head, headers, added); err != nil {
+				return
+			}
+
+			switch {
+			case resp.StatusCode == http.StatusSwitchingProtocols,
+				method == http.MethodConnect && resp.StatusCode/100 == 2:
+				// The rest of the connection is another protocol
+				return
+			case resp.StatusCode/100 == 1:
+				// Interim responses such as 100 Continue precede the real one
+				continue
+			}
+
+			if !bodyAllowed(method, resp.StatusCode) {
+				break
+			}
+			if len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked" {
+				if copyChunked(upstream, reader, local) != nil {
+					return
+				}
+				break
+			}
+			if resp.ContentLength < 0 {
+				// The body ends when the local server closes the connection
+				return
+			}
+			if _, err := spliceCopy(upstream, local, reader, resp.ContentLength); err != nil {
+				return
+			}
+			break
+		}
+	}
+}
+
+// bodyAllowed reports whether a response to method with status may have a
+// body
+func bodyAllowed(method string, status int) bool {
+	return method != http.MethodHead && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// writeResponseHead writes a response head with the given headers replacing
+// those of the same name, and added appended. Without either, the head is
+// written as is.
+func writeResponseHead(w io.Writer, head []byte, headers, added http.Header) error {
+	if headers == nil && added == nil {
+		_, err := w.Write(head)
+		return err
+	}
+
+	var out bytes.Buffer
+	lines := strings.Split(strings.TrimRight(string(head), "\r\n"), "\n")
+	out.WriteString(strings.TrimRight(lines[0], "\r") + "\r\n")
+	for _, line := range lines[1:] {
+		line = strings.TrimRight(line, "\r")
+		name, _, _ := strings.Cut(line, ":")
+		if headers[http.CanonicalHeaderKey(strings.TrimSpace(name))] != nil {
+			continue
+		}
+		out.WriteString(line + "\r\n")
+	}
+	writeHeaderLines(&out, headers)
+	writeHeaderLines(&out, added)
+	out.WriteString("\r\n")
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// canonicalHeaders returns header with canonical keys, or nil when empty
+func canonicalHeaders(header http.Header) http.Header {
+	if len(header) == 0 {
+		return nil
+	}
+	canonical := make(http.Header, len(header))
+	for name, values := range header {
+		canonical[http.CanonicalHeaderKey(name)] = values
+	}
+	return canonical
+}
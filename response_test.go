@@ -0,0 +1,129 @@
+package vrata
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForwardResponses(t *testing.T) {
+	conn := &TunnelConnection{cluster: &TunnelCluster{options: &TunnelOptions{
+		ResponseHeaders: http.Header{"access-control-allow-origin": {"*"}},
+	}}}
+
+	local := strings.Join([]string{
+		// HEAD: Content-Length but no body
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n",
+		// Interim response, then a chunked body with a trailer
+		"HTTP/1.1 100 Continue\r\n\r\n",
+		"HTTP/1.1 201 Created\r\nTransfer-Encoding: chunked\r\nAccess-Control-Allow-Origin: https://app.test\r\n\r\n" +
+			"3\r\nabc\r\n0\r\nX-Sum: 1\r\n\r\n",
+		// No body
+		"HTTP/1.1 204 No Content\r\n\r\n",
+		// Body up to the end of the connection
+		"HTTP/1.0 200 OK\r\n\r\nthe end",
+	}, "")
+
+	methods := make(chan string, 4)
+	for _, method := range []string{"HEAD", "POST", "DELETE", "GET"} {
+		methods <- method
+	}
+	close(methods)
+
+	var out bytes.Buffer
+	conn.forwardResponses(&out, strings.NewReader(local), methods, nil)
+
+	reader := bufio.NewReader(&out)
+	for i, want := range []struct {
+		method, body string
+		status       int
+	}{
+		{"HEAD", "", 200},
+		{"POST", "", 100},
+		{"POST", "abc", 201},
+		{"DELETE", "", 204},
+		{"GET", "the end", 200},
+	} {
+		resp, err := http.ReadResponse(reader, &http.Request{Method: want.method})
+		if err != nil {
+			t.Fatalf("Response %d: %v", i, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != want.status || string(body) != want.body {
+			t.Errorf("Response %d: got %d %q, want %d %q", i, resp.StatusCode, body, want.status, want.body)
+		}
+		if got := resp.Header.Values("Access-Control-Allow-Origin"); len(got) != 1 || got[0] != "*" {
+			t.Errorf("Response %d: Access-Control-Allow-Origin = %q, want [*]", i, got)
+		}
+		if want.status == 201 && resp.Trailer.Get("X-Sum") != "1" {
+			t.Errorf("Response %d: trailer lost, got %v", i, resp.Trailer)
+		}
+	}
+}
+
+func TestForwardResponsesUpgrade(t *testing.T) {
+	conn := &TunnelConnection{cluster: &TunnelCluster{options: &TunnelOptions{
+		ResponseHeaders: http.Header{"X-Tunnel": {"vrata"}},
+	}}}
+
+	methods := make(chan string, 1)
+	methods <- "GET"
+	close(methods)
+
+	var out bytes.Buffer
+	conn.forwardResponses(&out, strings.NewReader("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n\x81\x02hi"), methods, nil)
+
+	want := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nX-Tunnel: vrata\r\n\r\n\x81\x02hi"
+	if out.String() != want {
+		t.Errorf("Expected %q, got %q", want, out.String())
+	}
+}
+
+func TestTunnelResponseHeaders(t *testing.T) {
+	relay := newMockRelay(t, 1)
+
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer local.Close()
+	localPort := local.Listener.Addr().(*net.TCPAddr).Port
+
+	tunnel, err := ConnectAndOpen(localPort, &TunnelOptions{
+		Host:            relay.server.URL,
+		LocalHost:       "127.0.0.1",
+		ResponseHeaders: http.Header{"Access-Control-Allow-Origin": {"*"}},
+	})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	var conn net.Conn
+	select {
+	case conn = <-relay.conns:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Tunnel client never connected to the relay")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	// Every response on the kept-alive connection gets the header
+	for i := range 2 {
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: public.example\r\n\r\n")
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Request %d: failed to read response: %v", i, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "ok" || resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+			t.Errorf("Request %d: got %q with headers %v", i, body, resp.Header)
+		}
+	}
+}
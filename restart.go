@@ -0,0 +1,98 @@
+package vrata
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// restartState remembers since when local addresses refuse connections,
+// so a restart is logged once rather than for every held visitor
+type restartState struct {
+	since map[string]time.Time
+	mutex sync.Mutex
+}
+
+// begin records that address refuses connections and reports if that is
+// news
+func (r *restartState) begin(address string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.since[address]; ok {
+		return false
+	}
+	if r.since == nil {
+		r.since = make(map[string]time.Time)
+	}
+	r.since[address] = time.Now()
+	return true
+}
+
+// end records that address accepts connections again and returns for how
+// long it didn't, or zero when it was up already
+func (r *restartState) end(address string) time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	since, ok := r.since[address]
+	if !ok {
+		return 0
+	}
+	delete(r.since, address)
+	return time.Since(since)
+}
+
+// throughRestart takes the result of dialing address and, when the local
+// server refused the connection, keeps redialing for up to RestartGrace so
+// visitors ride out a restart instead of getting the error page
+func (tc *TunnelCluster) throughRestart(ctx context.Context, address string, local net.Conn, err error) (net.Conn, error) {
+	grace := tc.options.RestartGrace
+	if grace <= 0 {
+		return local, err
+	}
+	if err == nil {
+		tc.restartEnded(address)
+		return local, nil
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return nil, err
+	}
+
+	if tc.restart.begin(address) {
+		tc.log().Info("local server refuses connections, holding visitors while it restarts", "address", address, "grace", grace)
+	}
+
+	refused := err
+	ctx, cancel := context.WithTimeout(ctx, grace)
+	defer cancel()
+	ticker := time.NewTicker(localPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// The refusal says more than the timeout
+			return nil, refused
+		case <-ticker.C:
+		}
+
+		local, err = tc.dialAddress(ctx, address)
+		if err == nil {
+			tc.restartEnded(address)
+			return local, nil
+		}
+		if ctx.Err() == nil && !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, err
+		}
+	}
+}
+
+// restartEnded logs the local server at address coming back
+func (tc *TunnelCluster) restartEnded(address string) {
+	if down := tc.restart.end(address); down > 0 {
+		tc.log().Info("local server is back", "address", address, "down", down.Round(time.Millisecond))
+	}
+}
@@ -0,0 +1,66 @@
+package vrata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestThroughRestartWaitsForLocal(t *testing.T) {
+	address := fmt.Sprintf("127.0.0.1:%d", closedPort(t))
+	tc := &TunnelCluster{options: &TunnelOptions{RestartGrace: 5 * time.Second}}
+
+	// The app comes back while the visitor is held
+	listening := make(chan net.Listener, 1)
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			t.Errorf("Failed to listen again: %v", err)
+		}
+		listening <- listener
+	}()
+
+	local, got, err := tc.dialWithFallback(context.Background(), address)
+	if listener := <-listening; listener != nil {
+		defer listener.Close()
+	}
+	if err != nil {
+		t.Fatalf("Expected the visitor to reach the restarted server, got %v", err)
+	}
+	local.Close()
+	if got != address {
+		t.Errorf("Expected %s, got %s", address, got)
+	}
+	if down := tc.restart.end(address); down != 0 {
+		t.Errorf("Restart still recorded after the server came back (%s)", down)
+	}
+}
+
+func TestThroughRestartGivesUp(t *testing.T) {
+	address := fmt.Sprintf("127.0.0.1:%d", closedPort(t))
+	tc := &TunnelCluster{options: &TunnelOptions{RestartGrace: 400 * time.Millisecond}}
+
+	started := time.Now()
+	_, _, err := tc.dialWithFallback(context.Background(), address)
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("Expected the refusal, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed < 400*time.Millisecond {
+		t.Errorf("Gave up after %s, before the grace period", elapsed)
+	}
+
+	// Without grace, refusals fail right away
+	tc.options.RestartGrace = 0
+	started = time.Now()
+	if _, _, err := tc.dialWithFallback(context.Background(), address); err == nil {
+		t.Error("Expected an error")
+	}
+	if elapsed := time.Since(started); elapsed > 200*time.Millisecond {
+		t.Errorf("Waited %s without grace", elapsed)
+	}
+}
@@ -0,0 +1,192 @@
+package vrata
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxRewriteBody bounds the bodies buffered for rewriting; larger ones are
+// forwarded unchanged
+const maxRewriteBody = 8 << 20
+
+// BodyRewriter transforms a whole response body; resp is the response it
+// belongs to, with its headers still open to changes
+type BodyRewriter func(resp *http.Response, body []byte) ([]byte, error)
+
+// RewriteBodies returns a ResponseInterceptor passing response bodies whose
+// media type is one of types, e.g. "text/html" or "text/*", through
+// rewrite; without types, HTML, CSS, JavaScript, JSON and XML bodies are.
+// Gzip bodies are decompressed first and sent uncompressed. Bodies in other
+// encodings or over 8MB are forwarded unchanged. A rewritten body is sent
+// with its new Content-Length. Server-Sent Events streams never end, so
+// they are always forwarded as they come.
+func RewriteBodies(rewrite BodyRewriter, types ...string) ResponseInterceptor {
+	return ResponseInterceptorFunc(func(resp *http.Response) error {
+		if !rewritable(resp, types) {
+			return nil
+		}
+		body, ok, err := readRewriteBody(resp)
+		if !ok || err != nil {
+			return err
+		}
+		body, err = rewrite(resp, body)
+		if err != nil {
+			return err
+		}
+		resp.Body = bufferedBody{bytes.NewReader(body)}
+		resp.ContentLength = int64(len(body))
+		return nil
+	})
+}
+
+// rewritable reports whether the body of resp is one RewriteBodies changes
+func rewritable(resp *http.Response, types []string) bool {
+	if resp.Body == nil || resp.Body == http.NoBody || isEventStream(resp.Header) {
+		return false
+	}
+	switch resp.Header.Get("Content-Encoding") {
+	case "", "identity", "gzip":
+	default:
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	if len(types) == 0 {
+		return textual(mediaType)
+	}
+	for _, t := range types {
+		if prefix, ok := strings.CutSuffix(t, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if strings.EqualFold(t, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// textual reports whether a media type is markup, code or data that can
+// hold links
+func textual(mediaType string) bool {
+	switch mediaType {
+	case "text/html", "text/css", "text/javascript", "text/plain", "text/xml",
+		"application/javascript", "application/json", "application/xml",
+		"application/xhtml+xml", "application/manifest+json":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// readRewriteBody reads the body of resp, decompressed. When it is too large
+// or cannot be decompressed, ok is false and resp.Body still yields the
+// whole original body.
+func readRewriteBody(resp *http.Response) (body []byte, ok bool, err error) {
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxRewriteBody+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(raw) > maxRewriteBody {
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(raw), resp.Body), resp.Body}
+		return nil, false, nil
+	}
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return raw, true, nil
+	}
+
+	body, ok = gunzip(raw)
+	if !ok {
+		resp.Body = bufferedBody{bytes.NewReader(raw)}
+		return nil, false, nil
+	}
+	resp.Header.Del("Content-Encoding")
+	return body, true, nil
+}
+
+// gunzip decompresses a gzip body of at most maxRewriteBody bytes
+func gunzip(raw []byte) ([]byte, bool) {
+	reader, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(reader, maxRewriteBody+1))
+	if err != nil || len(body) > maxRewriteBody {
+		return nil, false
+	}
+	return body, true
+}
+
+// bufferedBody is a body held in memory, sent with its length
+type bufferedBody struct {
+	*bytes.Reader
+}
+
+func (bufferedBody) Close() error { return nil }
+
+// readCloser pairs a reader with the closer of the body it reads from
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// localOrigins returns the origins the local server may put in links:
+// its address as configured, as localhost and as 127.0.0.1
+func (o *TunnelOptions) localOrigins() []string {
+	scheme := "http://"
+	if o.LocalHTTPS {
+		scheme = "https://"
+	}
+	port := strconv.Itoa(o.Port)
+
+	var origins []string
+	for _, host := range []string{o.LocalHost, "localhost", "127.0.0.1"} {
+		origin := scheme + net.JoinHostPort(host, port)
+		if host != "" && !slices.Contains(origins, origin) {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// localURLRewriter returns the interceptor behind RewriteLocalURLs, which
+// replaces the local server's origins with tunnelURL in bodies and in
+// Location headers
+func (o *TunnelOptions) localURLRewriter(tunnelURL string) ResponseInterceptor {
+	tunnelURL = strings.TrimSuffix(tunnelURL, "/")
+	var pairs []string
+	for _, origin := range o.localOrigins() {
+		pairs = append(pairs, origin, tunnelURL)
+	}
+	replacer := strings.NewReplacer(pairs...)
+
+	bodies := RewriteBodies(func(resp *http.Response, body []byte) ([]byte, error) {
+		return []byte(replacer.Replace(string(body))), nil
+	})
+	return ResponseInterceptorFunc(func(resp *http.Response) error {
+		for _, name := range []string{"Location", "Content-Location"} {
+			if value := resp.Header.Get(name); value != "" {
+				resp.Header.Set(name, replacer.Replace(value))
+			}
+		}
+		return bodies.InterceptResponse(resp)
+	})
+}
+
+// responseInterceptors returns the interceptors run on responses of a
+// tunnel at tunnelURL: the local URL rewriting, then ResponseInterceptors
+func (o *TunnelOptions) responseInterceptors(tunnelURL string) []ResponseInterceptor {
+	if !o.RewriteLocalURLs {
+		return o.ResponseInterceptors
+	}
+	interceptors := []ResponseInterceptor{o.localURLRewriter(tunnelURL)}
+	return append(interceptors, o.ResponseInterceptors...)
+}
@@ -0,0 +1,147 @@
+package vrata
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRewriteBodies(t *testing.T) {
+	var zipped bytes.Buffer
+	zw := gzip.NewWriter(&zipped)
+	io.WriteString(zw, "hello world")
+	zw.Close()
+
+	upper := func(resp *http.Response, body []byte) ([]byte, error) {
+		return bytes.ToUpper(body), nil
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		encoding    string
+		body        []byte
+		types       []string
+		want        string
+	}{
+		{"html", "text/html; charset=utf-8", "", []byte("hello"), nil, "HELLO"},
+		{"gzip", "application/json", "gzip", zipped.Bytes(), nil, "HELLO WORLD"},
+		{"binary", "image/png", "", []byte("hello"), nil, "hello"},
+		{"brotli", "text/html", "br", []byte("hello"), nil, "hello"},
+		{"untyped", "", "", []byte("hello"), nil, "hello"},
+		{"wildcard", "image/svg+xml", "", []byte("hello"), []string{"image/*"}, "HELLO"},
+		{"filtered", "text/css", "", []byte("hello"), []string{"text/html"}, "hello"},
+		{"event stream", "text/event-stream", "", []byte("data: hello\n\n"), []string{"text/*"}, "data: hello\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := io.NopCloser(bytes.NewReader(tt.body))
+			resp := &http.Response{
+				StatusCode:    http.StatusOK,
+				Proto:         "HTTP/1.1",
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				Header:        http.Header{},
+				Body:          body,
+				ContentLength: int64(len(tt.body)),
+			}
+			if tt.contentType != "" {
+				resp.Header.Set("Content-Type", tt.contentType)
+			}
+			if tt.encoding != "" {
+				resp.Header.Set("Content-Encoding", tt.encoding)
+			}
+
+			if err := RewriteBodies(upper, tt.types...).InterceptResponse(resp); err != nil {
+				t.Fatalf("InterceptResponse() failed: %v", err)
+			}
+			prepareResponse(resp, &http.Request{Method: http.MethodGet}, body)
+
+			var out bytes.Buffer
+			resp.Write(&out)
+			got, err := http.ReadResponse(bufio.NewReader(&out), nil)
+			if err != nil {
+				t.Fatalf("Failed to read the written response: %v", err)
+			}
+			gotBody, _ := io.ReadAll(got.Body)
+			if string(gotBody) != tt.want {
+				t.Errorf("Body = %q, want %q", gotBody, tt.want)
+			}
+			if tt.want != string(tt.body) {
+				if got.ContentLength != int64(len(tt.want)) || got.TransferEncoding != nil {
+					t.Errorf("Expected Content-Length %d, got %d %v", len(tt.want), got.ContentLength, got.TransferEncoding)
+				}
+				if got.Header.Get("Content-Encoding") != "" {
+					t.Errorf("Rewritten body still has Content-Encoding %q", got.Header.Get("Content-Encoding"))
+				}
+			}
+		})
+	}
+}
+
+func TestTunnelRewriteLocalURLs(t *testing.T) {
+	relay := newMockRelay(t, 1)
+
+	var localPort int
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, fmt.Sprintf("http://localhost:%d/new", localPort), http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<a href="http://localhost:%d/a">a</a> <a href="http://127.0.0.1:%d/b">b</a>`, localPort, localPort)
+	}))
+	defer local.Close()
+	localPort = local.Listener.Addr().(*net.TCPAddr).Port
+
+	tunnel, err := ConnectAndOpen(localPort, &TunnelOptions{
+		Host:             relay.server.URL,
+		LocalHost:        "127.0.0.1",
+		RewriteLocalURLs: true,
+	})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	var conn net.Conn
+	select {
+	case conn = <-relay.conns:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Tunnel client never connected to the relay")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: public.example\r\n\r\n")
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	want := `<a href="http://127.0.0.1/a">a</a> <a href="http://127.0.0.1/b">b</a>`
+	if string(body) != want {
+		t.Errorf("Body = %q, want %q", body, want)
+	}
+	if resp.ContentLength != int64(len(want)) {
+		t.Errorf("Content-Length = %d, want %d", resp.ContentLength, len(want))
+	}
+
+	io.WriteString(conn, "GET /old HTTP/1.1\r\nHost: public.example\r\n\r\n")
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read redirect: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	if got := resp.Header.Get("Location"); got != "http://127.0.0.1/new" {
+		t.Errorf("Location = %q, want http://127.0.0.1/new", got)
+	}
+}
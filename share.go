@@ -0,0 +1,106 @@
+package vrata
+
+import (
+	"crypto/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// shareParam is the query parameter carrying a share token
+	shareParam = "token"
+	// shareCookie keeps a visitor in once a share link was opened, so the
+	// page's own requests don't need the token
+	shareCookie = "vrata_share"
+)
+
+// ShareLinks only admits visitors holding a link signed with Secret that
+// hasn't expired yet. Opening a link sets a cookie valid until the link
+// expires, so pages keep working as the visitor navigates.
+type ShareLinks struct {
+	// Secret signs the tokens; links stay valid across restarts as long as
+	// it doesn't change
+	Secret []byte
+}
+
+// NewShareLinks returns share links signed with a random secret
+func NewShareLinks() *ShareLinks {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return &ShareLinks{Secret: secret}
+}
+
+// Token returns a token valid until expires
+func (s *ShareLinks) Token(expires time.Time) string {
+	return signToken(s.Secret, []byte(strconv.FormatInt(expires.Unix(), 10)))
+}
+
+// Sign adds a token valid for ttl to rawURL
+func (s *ShareLinks) Sign(rawURL string, ttl time.Duration) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set(shareParam, s.Token(time.Now().Add(ttl)))
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Valid reports whether token was signed with Secret and hasn't expired
+func (s *ShareLinks) Valid(token string) bool {
+	_, ok := s.expiry(token)
+	return ok
+}
+
+// expiry returns when a valid token expires
+func (s *ShareLinks) expiry(token string) (time.Time, bool) {
+	payload, ok := verifyToken(s.Secret, token)
+	if !ok {
+		return time.Time{}, false
+	}
+	unix, err := strconv.ParseInt(string(payload), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	expires := time.Unix(unix, 0)
+	return expires, time.Now().Before(expires)
+}
+
+// check admits requests carrying a valid token in the query or the cookie.
+// Browsers opening a link are redirected to the same URL without the token
+// and given the cookie instead, which keeps the token out of the local
+// server's logs and Referer headers.
+func (s *ShareLinks) check(req *http.Request) *rejection {
+	if cookie, err := req.Cookie(shareCookie); err == nil && s.Valid(cookie.Value) {
+		return nil
+	}
+
+	query := req.URL.Query()
+	token := query.Get(shareParam)
+	expires, ok := s.expiry(token)
+	if !ok {
+		return &rejection{status: http.StatusForbidden}
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return nil
+	}
+
+	query.Del(shareParam)
+	target := *req.URL
+	target.RawQuery = query.Encode()
+
+	header := http.Header{"Location": {target.RequestURI()}}
+	header.Add("Set-Cookie", (&http.Cookie{
+		Name:     shareCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   requestScheme(req) == "https",
+		SameSite: http.SameSiteLaxMode,
+	}).String())
+	return &rejection{status: http.StatusFound, header: header}
+}
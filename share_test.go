@@ -0,0 +1,83 @@
+package vrata
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareLinksSign(t *testing.T) {
+	links := NewShareLinks()
+
+	signed, err := links.Sign("https://abc.example.com/docs?page=2", 10*time.Minute)
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	u, _ := url.Parse(signed)
+	if u.Path != "/docs" || u.Query().Get("page") != "2" {
+		t.Errorf("Signed URL %q lost the original path or query", signed)
+	}
+	if !links.Valid(u.Query().Get("token")) {
+		t.Errorf("Token of %q is not valid", signed)
+	}
+
+	if links.Valid(links.Token(time.Now().Add(-time.Second))) {
+		t.Error("Expired token is valid")
+	}
+	if NewShareLinks().Valid(u.Query().Get("token")) {
+		t.Error("Token is valid under another secret")
+	}
+
+	token := links.Token(time.Now().Add(time.Minute))
+	payload, sig, _ := strings.Cut(token, ".")
+	if links.Valid(payload+"0."+sig) || links.Valid("garbage") || links.Valid("") {
+		t.Error("Tampered token is valid")
+	}
+}
+
+func TestShareLinksCheck(t *testing.T) {
+	links := NewShareLinks()
+	token := links.Token(time.Now().Add(time.Hour))
+
+	// Without a token
+	req := httptest.NewRequest("GET", "/docs", nil)
+	if r := links.check(req); r == nil || r.status != http.StatusForbidden {
+		t.Errorf("Request without token: got %+v, want 403", r)
+	}
+
+	// Opening the link trades the token for a cookie
+	req = httptest.NewRequest("GET", "/docs?page=2&token="+url.QueryEscape(token), nil)
+	r := links.check(req)
+	if r == nil || r.status != http.StatusFound {
+		t.Fatalf("Request with token: got %+v, want 302", r)
+	}
+	if location := r.header.Get("Location"); location != "/docs?page=2" {
+		t.Errorf("Location = %q, want /docs?page=2", location)
+	}
+	cookie, err := http.ParseSetCookie(r.header.Get("Set-Cookie"))
+	if err != nil || cookie.Name != "vrata_share" || cookie.Value != token {
+		t.Fatalf("Set-Cookie = %q (%v)", r.header.Get("Set-Cookie"), err)
+	}
+
+	req = httptest.NewRequest("GET", "/style.css", nil)
+	req.AddCookie(cookie)
+	if r := links.check(req); r != nil {
+		t.Errorf("Request with cookie: got %+v, want admitted", r)
+	}
+
+	// Non-navigation requests with a token are admitted directly
+	req = httptest.NewRequest("POST", "/api?token="+url.QueryEscape(token), nil)
+	if r := links.check(req); r != nil {
+		t.Errorf("POST with token: got %+v, want admitted", r)
+	}
+
+	// An expired cookie doesn't admit
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "vrata_share", Value: links.Token(time.Now().Add(-time.Minute))})
+	if r := links.check(req); r == nil || r.status != http.StatusForbidden {
+		t.Errorf("Request with expired cookie: got %+v, want 403", r)
+	}
+}
@@ -0,0 +1,346 @@
+//go:build soak
+
+package vrata
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSoak keeps a tunnel open against the mock relay under churn and checks
+// that it doesn't leak goroutines, file descriptors or memory. Run it with
+//
+//	VRATA_SOAK_DURATION=2h go test -tags soak -run Soak -timeout 0 .
+func TestSoak(t *testing.T) {
+	duration := time.Minute
+	if value := os.Getenv("VRATA_SOAK_DURATION"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			t.Fatalf("Invalid VRATA_SOAK_DURATION: %v", err)
+		}
+		duration = d
+	}
+
+	// Redial dropped connections quickly so churn keeps the pool busy
+	defer func(interval time.Duration) { maintenanceInterval = interval }(maintenanceInterval)
+	maintenanceInterval = 100 * time.Millisecond
+
+	const poolSize = 4
+	relay := newMockRelay(t, poolSize)
+	local := newRestartableServer(t)
+	defer local.stop()
+
+	baseGoroutines := runtime.NumGoroutine()
+
+	tunnel, err := ConnectAndOpen(local.port, &TunnelOptions{Host: relay.server.URL, LocalHost: "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	drainEvents(tunnel.Events())
+
+	var idle []net.Conn
+	settle := func() {
+		for _, conn := range idle {
+			conn.Close()
+		}
+		idle = waitForIdlePool(t, relay, tunnel, poolSize)
+		runtime.GC()
+	}
+
+	settle()
+	goroutines, fds, heap := runtime.NumGoroutine(), openFDs(), heapInUse()
+	t.Logf("baseline: %d goroutines, %d fds, %d KiB heap", goroutines, fds, heap>>10)
+
+	// Hand the idle connections back to the churn workers
+	for _, conn := range idle {
+		relay.conns <- conn
+	}
+	idle = nil
+
+	stats := runChurn(relay, local, duration, poolSize)
+	t.Logf("churn: %+v", stats)
+	if stats.ok == 0 {
+		t.Fatal("No request made it through the tunnel")
+	}
+
+	settle()
+	t.Logf("after churn: %d goroutines, %d fds, %d KiB heap", runtime.NumGoroutine(), openFDs(), heapInUse()>>10)
+
+	if n := waitForAtMost(runtime.NumGoroutine, goroutines+5); n > goroutines+5 {
+		buf := make([]byte, 1<<20)
+		t.Errorf("Goroutines grew from %d to %d:\n%s", goroutines, n, buf[:runtime.Stack(buf, true)])
+	}
+	if fds >= 0 {
+		if n := waitForAtMost(openFDs, fds+5); n > fds+5 {
+			t.Errorf("File descriptors grew from %d to %d", fds, n)
+		}
+	}
+	if n := heapInUse(); n > heap+16<<20 {
+		t.Errorf("Heap grew from %d KiB to %d KiB", heap>>10, n>>10)
+	}
+
+	for _, conn := range idle {
+		conn.Close()
+	}
+	tunnel.Close()
+
+	if n := waitForAtMost(runtime.NumGoroutine, baseGoroutines+5); n > baseGoroutines+5 {
+		buf := make([]byte, 1<<20)
+		t.Errorf("Closed tunnel left %d goroutines behind (baseline %d):\n%s", n, baseGoroutines, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+// churnStats counts what the churn workers did
+type churnStats struct {
+	ok, failed, dropped, restarts int
+}
+
+// runChurn drives traffic through the tunnel: bursts of requests, idle
+// connections dropped by the relay and local server restarts
+func runChurn(relay *mockRelay, local *restartableServer, duration time.Duration, workers int) churnStats {
+	var (
+		stats churnStats
+		mutex sync.Mutex
+		wg    sync.WaitGroup
+	)
+	count := func(field *int) {
+		mutex.Lock()
+		*field++
+		mutex.Unlock()
+	}
+
+	deadline := time.Now().Add(duration)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for time.Now().Before(deadline) {
+			time.Sleep(3 * time.Second)
+			local.restart()
+			count(&stats.restarts)
+		}
+	}()
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(seed))
+
+			for time.Now().Before(deadline) {
+				var conn net.Conn
+				select {
+				case conn = <-relay.conns:
+				case <-time.After(time.Second):
+					continue
+				}
+
+				switch n := random.Intn(10); {
+				case n < 7:
+					// Alternate between bursts and quiet periods
+					if time.Now().Unix()/5%2 == 0 {
+						time.Sleep(time.Duration(random.Intn(50)) * time.Millisecond)
+					}
+					if soakRequest(conn, random.Intn(64<<10)) {
+						count(&stats.ok)
+					} else {
+						count(&stats.failed)
+					}
+				default:
+					// The relay drops an idle connection
+					count(&stats.dropped)
+				}
+				conn.Close()
+			}
+		}(int64(i))
+	}
+
+	wg.Wait()
+	local.ensureRunning()
+	return stats
+}
+
+// soakRequest sends a request with a body of the given size over a tunnel
+// connection and reports whether it was echoed back
+func soakRequest(conn net.Conn, size int) bool {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	go func() {
+		fmt.Fprintf(conn, "POST /echo HTTP/1.1\r\nHost: public.example\r\nX-Forwarded-For: 192.0.2.1\r\nContent-Length: %d\r\nConnection: close\r\n\r\n", size)
+		io.CopyN(conn, zeroReader{}, int64(size))
+	}()
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	n, err := io.Copy(io.Discard, resp.Body)
+	return err == nil && resp.StatusCode == http.StatusOK && n == int64(size)
+}
+
+// waitForIdlePool waits until every tunnel connection is connected and idle
+// and returns the relay side of those connections
+func waitForIdlePool(t *testing.T, relay *mockRelay, tunnel *Tunnel, size int) []net.Conn {
+	t.Helper()
+
+	var idle []net.Conn
+	deadline := time.Now().Add(10 * time.Second)
+	for len(idle) < size {
+		select {
+		case conn := <-relay.conns:
+			idle = append(idle, conn)
+		case <-time.After(time.Until(deadline)):
+			t.Fatalf("Only %d of %d connections came back", len(idle), size)
+		}
+	}
+
+	for {
+		if active, _ := tunnel.cluster.poolSize(); active == size {
+			return idle
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Connection pool never recovered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForAtMost polls measure until it drops to limit or a few seconds pass,
+// and returns the last value
+func waitForAtMost(measure func() int, limit int) int {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n := measure()
+		if n <= limit || time.Now().After(deadline) {
+			return n
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// openFDs returns the number of open file descriptors, or -1 where it
+// can't be determined
+func openFDs() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries)
+}
+
+// heapInUse returns the live heap size after a collection
+func heapInUse() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse
+}
+
+// drainEvents consumes tunnel events until the tunnel closes
+func drainEvents(events *TunnelEvents) {
+	go func() {
+		for {
+			select {
+			case <-events.URL:
+			case <-events.Error:
+			case <-events.Request:
+			case <-events.Response:
+			case <-events.Close:
+				return
+			}
+		}
+	}()
+}
+
+// restartableServer is an echo server that can be restarted on the same port
+type restartableServer struct {
+	t      *testing.T
+	port   int
+	server *http.Server
+	mutex  sync.Mutex
+}
+
+func newRestartableServer(t *testing.T) *restartableServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start local server: %v", err)
+	}
+
+	s := &restartableServer{t: t, port: listener.Addr().(*net.TCPAddr).Port}
+	s.serve(listener)
+	return s
+}
+
+func (s *restartableServer) serve(listener net.Listener) {
+	s.server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})}
+	go s.server.Serve(listener)
+}
+
+// restart stops the server, leaves the port closed for a moment and starts
+// it again
+func (s *restartableServer) restart() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.server.Close()
+	s.server = nil
+	time.Sleep(200 * time.Millisecond)
+	s.listen()
+}
+
+// ensureRunning makes sure the server is up
+func (s *restartableServer) ensureRunning() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.server == nil {
+		s.listen()
+	}
+}
+
+func (s *restartableServer) listen() {
+	address := net.JoinHostPort("127.0.0.1", fmt.Sprint(s.port))
+	for i := 0; ; i++ {
+		listener, err := net.Listen("tcp", address)
+		if err == nil {
+			s.serve(listener)
+			return
+		}
+		if i == 50 {
+			s.t.Errorf("Failed to restart local server: %v", err)
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func (s *restartableServer) stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.server != nil {
+		s.server.Close()
+	}
+}
+
+// zeroReader is an endless stream of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
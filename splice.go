@@ -0,0 +1,87 @@
+package vrata
+
+import (
+	"bufio"
+	"io"
+	"net"
+)
+
+// minSplice is the smallest body worth moving between sockets directly;
+// shorter ones are copied through the proxy's buffers
+const minSplice = 64 << 10
+
+// spliceCopy copies n bytes, or the rest of the stream when n is negative,
+// from src, read through reader, to dst. What reader has buffered goes
+// first. When both connections are plain TCP under their wrappers, the rest
+// goes from socket to socket through io.ReaderFrom, which Linux splices in
+// the kernel without copying it through user space.
+func spliceCopy(dst io.Writer, src io.Reader, reader *bufio.Reader, n int64) (int64, error) {
+	written, err := copyBuffered(dst, reader, n)
+	if err != nil || written == n {
+		return written, err
+	}
+
+	dstTCP, dstMonitor := spliceable(dst)
+	srcTCP, srcMonitor := spliceable(src)
+	if dstTCP == nil || srcTCP == nil || (n >= 0 && n-written < minSplice) {
+		var copied int64
+		if n < 0 {
+			copied, err = io.Copy(dst, reader)
+		} else {
+			copied, err = io.CopyN(dst, reader, n-written)
+		}
+		return written + copied, err
+	}
+
+	var from io.Reader = srcTCP
+	if n >= 0 {
+		from = io.LimitReader(srcTCP, n-written)
+	}
+	copied, err := dstTCP.ReadFrom(from)
+	dstMonitor.bypassedWrite(copied)
+	srcMonitor.bypassedRead(copied)
+	written += copied
+	if err == nil && n >= 0 && written < n {
+		err = io.ErrUnexpectedEOF
+	}
+	return written, err
+}
+
+// copyBuffered writes up to n bytes, or all when n is negative, of what
+// reader has buffered to dst
+func copyBuffered(dst io.Writer, reader *bufio.Reader, n int64) (int64, error) {
+	size := reader.Buffered()
+	if n >= 0 && int64(size) > n {
+		size = int(n)
+	}
+	if size == 0 {
+		return 0, nil
+	}
+	buffered, _ := reader.Peek(size)
+	written, err := dst.Write(buffered)
+	reader.Discard(written)
+	return int64(written), err
+}
+
+// spliceable unwraps conn down to its TCP connection when bytes may go
+// around its wrappers, and returns the monitor to account them to, if any.
+// Connections that pace or record traffic, or speak TLS or HTTP/2, can't
+// be spliced.
+func spliceable(conn any) (*net.TCPConn, *monitoredConn) {
+	var monitor *monitoredConn
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, monitor
+		case *bufferedConn:
+			conn = c.Conn
+		case *targetConn:
+			conn = c.Conn
+		case *monitoredConn:
+			monitor = c
+			conn = c.Conn
+		default:
+			return nil, nil
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package vrata
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSpliceCopy(t *testing.T) {
+	for _, size := range []int64{minSplice / 2, 4 * minSplice, -1} {
+		t.Run(strconv.FormatInt(size, 10), func(t *testing.T) {
+			srcClient, srcServer := tcpConns(t)
+			dstClient, dstServer := tcpConns(t)
+
+			payload := bytes.Repeat([]byte("x"), 4*minSplice)
+			if size > 0 {
+				payload = payload[:size]
+			}
+			go func() {
+				srcClient.Write(payload)
+				if size < 0 {
+					srcClient.(*net.TCPConn).CloseWrite()
+					return
+				}
+				io.WriteString(srcClient, "next")
+			}()
+
+			received := make(chan []byte, 1)
+			go func() {
+				got, _ := io.ReadAll(io.LimitReader(dstClient, int64(len(payload))))
+				received <- got
+			}()
+
+			// Part of the payload is already buffered
+			reader := bufio.NewReader(srcServer)
+			reader.Peek(1)
+			monitor := &exchangeMonitor{requests: newStreamTap(maxTapBuffer, nil)}
+			dst := &monitoredConn{Conn: &targetConn{Conn: dstServer}, monitor: monitor}
+
+			n, err := spliceCopy(dst, srcServer, reader, size)
+			if err != nil || n != int64(len(payload)) {
+				t.Fatalf("spliceCopy() = %d, %v; want %d", n, err, len(payload))
+			}
+			if got := <-received; !bytes.Equal(got, payload) {
+				t.Errorf("Received %d bytes, want the %d bytes sent", len(got), len(payload))
+			}
+
+			// The monitor hears of every byte, even those that went around it
+			monitor.requests.Close()
+			if tapped, _ := io.ReadAll(monitor.requests); len(tapped) != len(payload) {
+				t.Errorf("Monitor saw %d bytes, want %d", len(tapped), len(payload))
+			}
+
+			// Bytes past the copied ones are left to the reader
+			if size > 0 {
+				rest := make([]byte, 4)
+				if _, err := io.ReadFull(reader, rest); err != nil || string(rest) != "next" {
+					t.Errorf("Rest = %q, %v; want next", rest, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSpliceable(t *testing.T) {
+	conn := tcpPair(t)
+	monitored := &monitoredConn{Conn: &targetConn{Conn: conn}}
+	if tcp, monitor := spliceable(monitored); tcp != conn || monitor != monitored {
+		t.Errorf("spliceable(monitored) = %v, %v; want the TCP connection and its monitor", tcp, monitor)
+	}
+	if tcp, _ := spliceable(&bufferedConn{Conn: conn}); tcp != conn {
+		t.Error("Expected a buffered connection to unwrap")
+	}
+
+	for name, wrapped := range map[string]net.Conn{
+		"limited":   &limitedConn{Conn: conn},
+		"recording": &recordingConn{Conn: conn},
+		"tls":       tls.Client(conn, &tls.Config{}),
+	} {
+		if tcp, _ := spliceable(wrapped); tcp != nil {
+			t.Errorf("%s: expected no splicing", name)
+		}
+	}
+}
+
+func TestTunnelLargeBodies(t *testing.T) {
+	const size = 1 << 20
+	payload := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+
+	tests := []struct {
+		name    string
+		options TunnelOptions
+	}{
+		{"plain", TunnelOptions{}},
+		{"response headers", TunnelOptions{ResponseHeaders: http.Header{"X-Tunnel": {"1"}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := newMockRelay(t, 1)
+			local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if !bytes.Equal(body, payload) {
+					http.Error(w, fmt.Sprintf("got %d bytes", len(body)), http.StatusBadRequest)
+					return
+				}
+				if r.URL.Query().Has("length") {
+					w.Header().Set("Content-Length", strconv.Itoa(size))
+				}
+				w.Write(payload)
+			}))
+			defer local.Close()
+
+			options := tt.options
+			options.Host = relay.server.URL
+			options.LocalHost = "127.0.0.1"
+			tunnel, err := ConnectAndOpen(local.Listener.Addr().(*net.TCPAddr).Port, &options)
+			if err != nil {
+				t.Fatalf("ConnectAndOpen() failed: %v", err)
+			}
+			defer tunnel.Close()
+
+			conn := <-relay.conns
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			reader := bufio.NewReader(conn)
+
+			// Uploads on a kept-alive connection, answered with a length
+			// and chunked
+			for i, path := range []string{"/upload?length", "/upload"} {
+				go func() {
+					fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: public.example\r\nContent-Length: %d\r\n\r\n", path, size)
+					conn.Write(payload)
+				}()
+				resp, err := http.ReadResponse(reader, nil)
+				if err != nil {
+					t.Fatalf("Request %d: failed to read response: %v", i, err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				if resp.StatusCode != http.StatusOK || !bytes.Equal(body, payload) {
+					t.Fatalf("Request %d: got %d with %d bytes, want 200 with %d", i, resp.StatusCode, len(body), size)
+				}
+
+				select {
+				case info := <-tunnel.Events().Response:
+					if info.StatusCode != http.StatusOK || info.BytesIn < size || info.BytesOut < size {
+						t.Errorf("Request %d: event = %d, %d bytes in, %d out; want 200 and the bodies counted", i, info.StatusCode, info.BytesIn, info.BytesOut)
+					}
+				case <-time.After(2 * time.Second):
+					t.Errorf("Request %d: no response event emitted", i)
+				}
+			}
+		})
+	}
+}
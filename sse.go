@@ -0,0 +1,139 @@
+package vrata
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sseHeartbeat is how often idle event streams get a keep-alive comment
+var sseHeartbeat = 15 * time.Second
+
+// EventStream serves tunnel events as Server-Sent Events, so processes that
+// don't link the library (editors, dashboards, curl) can follow a tunnel.
+// Events are named url, request, response, error, reconnect, throttled and
+// close, and carry JSON data. Subscribers that fall behind miss events
+// rather than slowing the tunnel down.
+type EventStream struct {
+	subscribers map[chan sseEvent]struct{}
+	nextID      int64
+	mutex       sync.Mutex
+}
+
+type sseEvent struct {
+	id   int64
+	name string
+	data []byte
+}
+
+func newEventStream() *EventStream {
+	return &EventStream{subscribers: make(map[chan sseEvent]struct{})}
+}
+
+// publish sends an event to every subscriber
+func (s *EventStream) publish(name string, payload any) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.subscribers) == 0 {
+		return
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+
+	s.nextID++
+	event := sseEvent{id: s.nextID, name: name, data: data}
+	for ch := range s.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func (s *EventStream) subscribe() chan sseEvent {
+	ch := make(chan sseEvent, 64)
+	s.mutex.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.mutex.Unlock()
+	return ch
+}
+
+func (s *EventStream) unsubscribe(ch chan sseEvent) {
+	s.mutex.Lock()
+	delete(s.subscribers, ch)
+	s.mutex.Unlock()
+}
+
+// ServeHTTP streams events until the client disconnects
+func (s *EventStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := s.subscribe()
+	defer s.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event := <-ch:
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.id, event.name, event.data)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// streamRequest is the JSON form of request and response events
+type streamRequest struct {
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	URL        string  `json:"url"`
+	RemoteAddr string  `json:"remote_addr,omitempty"`
+	Status     int     `json:"status,omitempty"`
+	DurationMS float64 `json:"duration_ms,omitempty"`
+	BytesIn    int64   `json:"bytes_in"`
+	BytesOut   int64   `json:"bytes_out,omitempty"`
+}
+
+func newStreamRequest(info RequestInfo) streamRequest {
+	return streamRequest{
+		Method:     info.Method,
+		Path:       info.Path,
+		URL:        info.URL,
+		RemoteAddr: info.RemoteAddr,
+		Status:     info.StatusCode,
+		DurationMS: info.Duration.Seconds() * 1000,
+		BytesIn:    info.BytesIn,
+		BytesOut:   info.BytesOut,
+	}
+}
+
+// EventStream returns an http.Handler serving this tunnel's events as
+// Server-Sent Events
+func (t *Tunnel) EventStream() *EventStream {
+	return t.stream
+}
@@ -0,0 +1,87 @@
+package vrata
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventStream(t *testing.T) {
+	relay := newMockRelay(t, 1)
+
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer local.Close()
+	localPort := local.Listener.Addr().(*net.TCPAddr).Port
+
+	tunnel, err := ConnectAndOpen(localPort, &TunnelOptions{Host: relay.server.URL, LocalHost: "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	events := httptest.NewServer(tunnel.EventStream())
+	defer events.Close()
+
+	resp, err := http.Get(events.URL)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected text/event-stream, got %q", ct)
+	}
+
+	lines := make(chan string, 100)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	tunneled := relay.roundTrip(t, "GET /events-test HTTP/1.1\r\nHost: public.example\r\nConnection: close\r\n\r\n")
+	io.Copy(io.Discard, tunneled.Body)
+
+	var seen []string
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case line := <-lines:
+			seen = append(seen, line)
+			if line == "event: response" {
+				data := <-lines
+				if !strings.Contains(data, `"path":"/events-test"`) || !strings.Contains(data, `"status":202`) {
+					t.Errorf("Unexpected response data: %s", data)
+				}
+				if !strings.Contains(strings.Join(seen, "\n"), "event: request") {
+					t.Errorf("Expected a request event before the response, got:\n%s", strings.Join(seen, "\n"))
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatalf("No response event, got:\n%s", strings.Join(seen, "\n"))
+		}
+	}
+}
+
+func TestEventStreamSkipsWithoutSubscribers(t *testing.T) {
+	stream := newEventStream()
+	stream.publish("request", make(chan int)) // not JSON-encodable, must not be marshaled
+
+	ch := stream.subscribe()
+	stream.publish("error", map[string]string{"error": "boom"})
+	stream.unsubscribe(ch)
+
+	event := <-ch
+	if event.id != 1 || event.name != "error" || string(event.data) != `{"error":"boom"}` {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+}
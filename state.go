@@ -0,0 +1,137 @@
+package vrata
+
+import (
+	"sync"
+	"time"
+)
+
+// TunnelState is where a tunnel is in its lifecycle, as far as the
+// relay connection goes
+type TunnelState int
+
+const (
+	// StateCreated is a tunnel that isn't opened yet, or whose
+	// registration failed
+	StateCreated TunnelState = iota
+	// StateRegistering is a tunnel registering with the relay and making
+	// its first data connections
+	StateRegistering
+	// StateConnected is a tunnel whose data connections are up
+	StateConnected
+	// StateDegraded is a tunnel serving visitors with part of its pool:
+	// some data connections can't be redialed, or the relay throttles it
+	StateDegraded
+	// StateReconnecting is a tunnel that lost every data connection and
+	// fails to redial them; visitors don't get through
+	StateReconnecting
+	// StateClosed is a closed tunnel
+	StateClosed
+)
+
+func (s TunnelState) String() string {
+	switch s {
+	case StateCreated:
+		return "created"
+	case StateRegistering:
+		return "registering"
+	case StateConnected:
+		return "connected"
+	case StateDegraded:
+		return "degraded"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// StateChange describes a tunnel state transition
+type StateChange struct {
+	From TunnelState
+	To   TunnelState
+	At   time.Time
+}
+
+// setState moves the tunnel to state, announcing the transition. Nothing
+// leaves StateClosed.
+func (t *Tunnel) setState(state TunnelState) {
+	t.mutex.Lock()
+	from := t.state
+	if from == state || from == StateClosed {
+		t.mutex.Unlock()
+		return
+	}
+	t.state = state
+	t.mutex.Unlock()
+	t.stateChanged(StateChange{From: from, To: state, At: time.Now()})
+	t.scheduleReregister(state)
+}
+
+// stateChanged logs and publishes a state transition
+func (t *Tunnel) stateChanged(change StateChange) {
+	t.logger.Info("tunnel state changed", "from", change.From, "to", change.To)
+	t.stream.publish("state", map[string]string{"from": change.From.String(), "to": change.To.String()})
+	select {
+	case t.events.State <- change:
+	default:
+	}
+}
+
+// State returns the tunnel's current state
+func (t *Tunnel) State() TunnelState {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.state
+}
+
+// poolState tracks what the connection pool last reported, serializing
+// reports so a stale one can't overwrite a newer one
+type poolState struct {
+	connected bool // a data connection was ever made
+	mutex     sync.Mutex
+}
+
+// updateState reports the state the connection pool is in: connected
+// while every connection is up or idle, degraded while some fail to
+// redial or the relay throttles the pool, reconnecting when none is up
+// and redials fail. Connections dropped after serving a visitor wait for
+// their redial without degrading the tunnel.
+func (tc *TunnelCluster) updateState() {
+	if tc.state == nil {
+		return
+	}
+	tc.pool.mutex.Lock()
+	defer tc.pool.mutex.Unlock()
+
+	tc.mutex.RLock()
+	if tc.closed {
+		// A replaced pool has nothing to say
+		tc.mutex.RUnlock()
+		return
+	}
+	var active, failing int
+	for _, conn := range tc.connections {
+		conn.mutex.RLock()
+		if conn.active {
+			active++
+		}
+		if conn.failing {
+			failing++
+		}
+		conn.mutex.RUnlock()
+	}
+	tc.mutex.RUnlock()
+
+	switch {
+	case active > 0:
+		tc.pool.connected = true
+		if failing > 0 || tc.throttle.limited() {
+			tc.state(StateDegraded)
+		} else {
+			tc.state(StateConnected)
+		}
+	case failing > 0 && tc.pool.connected:
+		tc.state(StateReconnecting)
+	}
+}
@@ -0,0 +1,89 @@
+package vrata
+
+import (
+	"testing"
+	"time"
+)
+
+// nextState waits for the next state change of tunnel
+func nextState(t *testing.T, tunnel *Tunnel) StateChange {
+	t.Helper()
+	select {
+	case change := <-tunnel.Events().State:
+		return change
+	case <-time.After(3 * time.Second):
+		t.Fatalf("No state change, still %s", tunnel.State())
+		return StateChange{}
+	}
+}
+
+func TestTunnelStates(t *testing.T) {
+	defer func(interval time.Duration) { maintenanceInterval = interval }(maintenanceInterval)
+	maintenanceInterval = 20 * time.Millisecond
+
+	relay := newMockRelay(t, 1)
+	tunnel, err := NewTunnel(8080, &TunnelOptions{Host: relay.server.URL})
+	if err != nil {
+		t.Fatalf("NewTunnel() failed: %v", err)
+	}
+	defer tunnel.Close()
+	if tunnel.State() != StateCreated {
+		t.Errorf("Expected created, got %s", tunnel.State())
+	}
+
+	if err := tunnel.Open(); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	for _, want := range []TunnelState{StateRegistering, StateConnected} {
+		if change := nextState(t, tunnel); change.To != want {
+			t.Fatalf("Expected %s, got %s -> %s", want, change.From, change.To)
+		}
+	}
+
+	// The relay goes away: the connection drops and redials fail
+	conn := <-relay.conns
+	relay.listener.Close()
+	conn.Close()
+	if change := nextState(t, tunnel); change.From != StateConnected || change.To != StateReconnecting {
+		t.Errorf("Expected connected -> reconnecting, got %s -> %s", change.From, change.To)
+	}
+
+	tunnel.Close()
+	if change := nextState(t, tunnel); change.To != StateClosed {
+		t.Errorf("Expected closed, got %s", change.To)
+	}
+	if tunnel.State() != StateClosed {
+		t.Errorf("Expected closed, got %s", tunnel.State())
+	}
+}
+
+func TestPoolStates(t *testing.T) {
+	tests := []struct {
+		name      string
+		active    []bool
+		failing   []bool
+		connected bool // a connection was made before
+		want      TunnelState
+	}{
+		{"all up", []bool{true, true}, []bool{false, false}, false, StateConnected},
+		{"dropped after a visitor", []bool{true, false}, []bool{false, false}, true, StateConnected},
+		{"redial failing", []bool{true, false}, []bool{false, true}, true, StateDegraded},
+		{"all down", []bool{false, false}, []bool{true, true}, true, StateReconnecting},
+		{"never connected", []bool{false, false}, []bool{true, true}, false, StateRegistering},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := StateRegistering
+			tc := &TunnelCluster{state: func(state TunnelState) { got = state }}
+			tc.pool.connected = tt.connected
+			for i := range tt.active {
+				tc.connections = append(tc.connections, &TunnelConnection{active: tt.active[i], failing: tt.failing[i]})
+			}
+
+			tc.updateState()
+			if got != tt.want {
+				t.Errorf("Got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package vrata
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a point-in-time snapshot of a running tunnel
+type Stats struct {
+	// ActiveConnections is the number of pool connections currently
+	// connected to the tunnel server, out of TotalConnections
+	ActiveConnections int
+	TotalConnections  int
+
+	// Requests counts completed request/response exchanges
+	Requests int64
+	// BytesIn and BytesOut count bytes sent to and received from the
+	// local server
+	BytesIn  int64
+	BytesOut int64
+
+	// Reconnects counts redials of dropped pool connections
+	Reconnects int64
+
+	// Rejected counts requests answered with an error status instead of
+	// being forwarded, because they were malformed or denied access
+	// instead of being forwarded
+	Rejected int64
+
+	// Uptime is the time since the tunnel was opened
+	Uptime time.Duration
+
+	// LastError is the most recent error reported by the tunnel, if any
+	LastError   error
+	LastErrorAt time.Time
+
+	Queue QueueStats
+
+	// CaptureBytes is the memory currently buffered for request monitoring
+	CaptureBytes int64
+	// Routes holds the local latency distribution per route, keyed by
+	// method and path template ("GET /users/:id")
+	Routes map[string]LatencyHistogram
+
+	// Labels are the tunnel's metrics labels
+	Labels map[string]string
+}
+
+// errorRecord is an error with the time it was reported
+type errorRecord struct {
+	err error
+	at  time.Time
+}
+
+// lastError remembers the most recent error of a cluster
+type lastError struct {
+	record atomic.Pointer[errorRecord]
+}
+
+func (l *lastError) store(err error) {
+	l.record.Store(&errorRecord{err: err, at: time.Now()})
+}
+
+func (l *lastError) load() (error, time.Time) {
+	record := l.record.Load()
+	if record == nil {
+		return nil, time.Time{}
+	}
+	return record.err, record.at
+}
+
+// Stats returns a snapshot of the tunnel's connection pool, traffic and
+// error counters. It is safe to call at any time; before Open it returns
+// zero values.
+func (t *Tunnel) Stats() Stats {
+	t.mutex.RLock()
+	cluster := t.cluster
+	opened := t.opened
+	t.mutex.RUnlock()
+
+	if cluster == nil {
+		return Stats{}
+	}
+
+	stats := Stats{
+		Requests:   cluster.requests.Load(),
+		Reconnects: cluster.reconnects.Load(),
+		Rejected:   cluster.rejected.Load(),
+		Uptime:     time.Since(opened),
+		Queue:      cluster.queue.Stats(),
+
+		CaptureBytes: cluster.capture.inUse(),
+		Routes:       cluster.latencies.snapshot(),
+		Labels:       t.options.Labels,
+	}
+	stats.ActiveConnections, stats.TotalConnections = cluster.poolSize()
+	stats.BytesIn, stats.BytesOut = cluster.bytesTransferred()
+	stats.LastError, stats.LastErrorAt = cluster.lastError.load()
+	return stats
+}
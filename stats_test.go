@@ -0,0 +1,87 @@
+package vrata
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTunnelStats(t *testing.T) {
+	relay := newMockRelay(t, 2)
+
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer local.Close()
+	localPort := local.Listener.Addr().(*net.TCPAddr).Port
+
+	tunnel, err := NewTunnel(localPort, &TunnelOptions{Host: relay.server.URL, LocalHost: "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("NewTunnel() failed: %v", err)
+	}
+	if stats := tunnel.Stats(); stats.TotalConnections != 0 || stats.Uptime != 0 {
+		t.Errorf("Expected zero stats before Open, got %+v", stats)
+	}
+
+	if err := tunnel.Open(); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	resp := relay.roundTrip(t, "GET / HTTP/1.1\r\nHost: public.example\r\nConnection: close\r\n\r\n")
+	io.Copy(io.Discard, resp.Body)
+
+	var stats Stats
+	waitFor(t, func() bool {
+		stats = tunnel.Stats()
+		return stats.Requests == 1
+	})
+
+	if stats.TotalConnections != 2 {
+		t.Errorf("Expected 2 connections, got %d", stats.TotalConnections)
+	}
+	if stats.BytesIn == 0 || stats.BytesOut == 0 {
+		t.Errorf("Expected byte counts, got in=%d out=%d", stats.BytesIn, stats.BytesOut)
+	}
+	if stats.Uptime <= 0 {
+		t.Errorf("Expected positive uptime, got %s", stats.Uptime)
+	}
+	if stats.LastError != nil {
+		t.Errorf("Expected no error, got %v", stats.LastError)
+	}
+}
+
+func TestTunnelStatsLastError(t *testing.T) {
+	relay := newMockRelay(t, 1)
+
+	// Reserve a port nobody listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to reserve port: %v", err)
+	}
+	deadPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	tunnel, err := ConnectAndOpen(deadPort, &TunnelOptions{Host: relay.server.URL, LocalHost: "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	select {
+	case conn := <-relay.conns:
+		defer conn.Close()
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: public.example\r\n\r\n")
+	case <-time.After(2 * time.Second):
+		t.Fatal("Tunnel client never connected to the relay")
+	}
+
+	waitFor(t, func() bool { return tunnel.Stats().LastError != nil })
+
+	if stats := tunnel.Stats(); stats.LastErrorAt.IsZero() {
+		t.Errorf("Expected error timestamp, got %+v", stats)
+	}
+}
@@ -0,0 +1,407 @@
+package vrata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProxyMode selects how tunneled connections reach the local server
+type ProxyMode int
+
+const (
+	// ProxyRaw copies the bytes of each connection, parsing no more of its
+	// requests than the options need (default)
+	ProxyRaw ProxyMode = iota
+	// ProxyStructured parses every request into an *http.Request and
+	// forwards it with an httputil.ReverseProxy, through Middleware
+	ProxyStructured
+)
+
+// Middleware wraps the handler that forwards requests in ProxyStructured
+// mode, e.g. to add headers, answer some requests itself or measure them
+type Middleware func(http.Handler) http.Handler
+
+// proxyRetryDelay is the pause before a failed request is retried
+var proxyRetryDelay = 100 * time.Millisecond
+
+// infoKey is the context key of the RequestInfo of a structured exchange
+type infoKey struct{}
+
+// validateProxyMode rejects options the proxy mode can't honor
+func (o *TunnelOptions) validateProxyMode() error {
+	switch {
+	case o.ProxyRetries < 0:
+		return fmt.Errorf("invalid proxy retries %d: must not be negative", o.ProxyRetries)
+	case o.ProxyMode == ProxyStructured && o.RecordFile != "":
+		return errors.New("recording needs the raw proxy mode")
+	case o.ProxyMode != ProxyStructured && (len(o.Middleware) > 0 || o.ProxyRetries > 0):
+		return errors.New("middleware and proxy retries need the structured proxy mode")
+	}
+	return nil
+}
+
+// middleware wraps handler in the Middleware, the first outermost
+func (o *TunnelOptions) middleware(handler http.Handler) http.Handler {
+	for i := len(o.Middleware) - 1; i >= 0; i-- {
+		handler = o.Middleware[i](handler)
+	}
+	return handler
+}
+
+// serveStructured serves the requests of a visitor connection with an
+// http.Server, forwarding them through Middleware and a ReverseProxy to
+// the local server over local. streaming is called when a response turns
+// into a WebSocket or an event stream.
+func (conn *TunnelConnection) serveStructured(ctx context.Context, upstream *bufferedConn, local net.Conn, target localTarget, streaming func()) {
+	visitor := &structuredConn{Conn: upstream, owner: conn, closed: make(chan struct{})}
+	proxy, transport := conn.reverseProxy(ctx, local, target, streaming)
+	defer transport.CloseIdleConnections()
+
+	host := conn.cluster.options.hostHeader(target.address)
+	inner := conn.interceptHandler(proxy)
+	server := &http.Server{
+		Handler:           conn.structuredHandler(visitor, host, conn.cluster.options.middleware(inner)),
+		ReadHeaderTimeout: requestHeadTimeout,
+		ErrorLog:          slog.NewLogLogger(conn.log().Handler(), slog.LevelDebug),
+		// Requests, upgraded ones included, end with the visitor
+		BaseContext: func(net.Listener) context.Context { return ctx },
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			// The response has been written
+			if state == http.StateIdle || state == http.StateClosed {
+				visitor.finish()
+			}
+		},
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		server.Serve(newConnListener(visitor))
+	}()
+
+	select {
+	case <-visitor.closed:
+		// Upgraded connections are closed before their handler returns,
+		// others before the server reports them closed
+		visitor.handlers.Wait()
+		visitor.finish()
+	case <-ctx.Done():
+	}
+	server.Close()
+	<-served
+	visitor.handlers.Wait()
+}
+
+// structuredHandler runs the access checks on every request after the
+// first, which was checked before the local server was dialed, rewrites
+// its headers for the local server and reports the exchange
+func (conn *TunnelConnection) structuredHandler(visitor *structuredConn, host string, next http.Handler) http.Handler {
+	tc := conn.cluster
+	first := true
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		visitor.handlers.Add(1)
+		defer visitor.handlers.Done()
+
+		if first {
+			first = false
+			r.RemoteAddr = forwardedFor(r.Header)
+		} else if denied := tc.checkRequest(r); denied != nil {
+			conn.denyHTTP(w, denied)
+			return
+		}
+		tc.forwarding.apply(r.Header)
+		tc.options.rewriteLocalRequest(r, host)
+
+		info := &RequestInfo{
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			URL:        r.URL.RequestURI(),
+			RemoteAddr: r.RemoteAddr,
+			Header:     r.Header.Clone(),
+			start:      time.Now(),
+			proto:      r.Proto,
+		}
+		visitor.begin(info)
+
+		r = r.WithContext(context.WithValue(r.Context(), infoKey{}, info))
+		next.ServeHTTP(&statusWriter{ResponseWriter: w, info: info}, r)
+
+		if info.StatusCode == http.StatusSwitchingProtocols {
+			// The upgraded connection is done
+			visitor.finish()
+		}
+	})
+}
+
+// interceptHandler runs the request interceptors before next
+func (conn *TunnelConnection) interceptHandler(next http.Handler) http.Handler {
+	if len(conn.cluster.options.RequestInterceptors) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, err := conn.interceptRequest(r)
+		switch {
+		case err != nil:
+			conn.reportError(fmt.Errorf("interceptor failed: %w", err))
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		case resp != nil:
+			// Answered by an interceptor
+			defer resp.Body.Close()
+			for name, values := range resp.Header {
+				w.Header()[name] = values
+			}
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// reverseProxy returns the ReverseProxy that forwards requests to target,
+// over local first and over new connections once the local server closes
+// it, and the transport it uses
+func (conn *TunnelConnection) reverseProxy(ctx context.Context, local net.Conn, target localTarget, streaming func()) (*httputil.ReverseProxy, *http.Transport) {
+	tc := conn.cluster
+	conns := make(chan net.Conn, 1)
+	conns <- local
+
+	transport := &http.Transport{
+		DialContext: func(dialCtx context.Context, _, _ string) (net.Conn, error) {
+			select {
+			case local := <-conns:
+				return local, nil
+			default:
+			}
+			local, err := tc.dialAddress(dialCtx, target.address)
+			if err == nil && tc.bandwidth != nil {
+				local = &limitedConn{Conn: local, ctx: ctx, limiter: tc.bandwidth}
+			}
+			return local, err
+		},
+		DisableCompression:  true,
+		MaxIdleConnsPerHost: 1,
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme, pr.Out.URL.Host = "http", target.address
+			// Rewrite drops these; the local server gets them as
+			// ForwardedHeaders left them
+			for _, name := range []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"} {
+				if values, ok := pr.In.Header[name]; ok {
+					pr.Out.Header[name] = values
+				}
+			}
+		},
+		Transport:     &retryTransport{RoundTripper: transport, retries: tc.options.ProxyRetries},
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			if resp.StatusCode == http.StatusSwitchingProtocols || isEventStream(resp.Header) {
+				streaming()
+			}
+			if resp.StatusCode == http.StatusSwitchingProtocols {
+				// The handler never writes the header of an upgrade
+				if info, ok := resp.Request.Context().Value(infoKey{}).(*RequestInfo); ok {
+					info.StatusCode, info.ResponseHeader = resp.StatusCode, resp.Header.Clone()
+				}
+			}
+
+			setHeaders(resp.Header, tc.options.ResponseHeaders)
+			addHeaders(resp.Header, target.header)
+			body := resp.Body
+			for _, interceptor := range tc.responseInterceptors {
+				if err := interceptor.InterceptResponse(resp); err != nil {
+					resp.Body.Close()
+					return fmt.Errorf("interceptor failed: %w", err)
+				}
+			}
+			if resp.Body != body {
+				// http.Server frames the new body
+				resp.Header.Del("Content-Length")
+				if buffered, ok := resp.Body.(bufferedBody); ok {
+					resp.Header.Set("Content-Length", strconv.Itoa(buffered.Len()))
+				}
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			// A visitor that went away is no error
+			if r.Context().Err() == nil {
+				conn.reportError(fmt.Errorf("proxy failed: %w", err))
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+		ErrorLog: slog.NewLogLogger(conn.log().Handler(), slog.LevelDebug),
+	}
+	return proxy, transport
+}
+
+// retryTransport retries requests the local server couldn't be reached
+// for or dropped, when they are safe to send again
+type retryTransport struct {
+	http.RoundTripper
+	retries int
+}
+
+func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := rt.RoundTripper.RoundTrip(req)
+		if err == nil || attempt >= rt.retries || !replayable(req) {
+			return resp, err
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, err
+		case <-time.After(proxyRetryDelay):
+		}
+	}
+}
+
+// replayable reports whether req may be sent again: it's idempotent and
+// has no body to replay
+func replayable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return req.Body == nil || req.Body == http.NoBody
+	}
+	return false
+}
+
+// statusWriter records the status and headers of the response in the
+// exchange's RequestInfo
+type statusWriter struct {
+	http.ResponseWriter
+	info *RequestInfo
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	// Interim responses such as 100 Continue precede the real one
+	if w.info.StatusCode == 0 && (status >= 200 || status == http.StatusSwitchingProtocols) {
+		w.info.StatusCode, w.info.ResponseHeader = status, w.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.info.StatusCode == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController flush and hijack the connection
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// structuredConn is a visitor connection served by an http.Server. It
+// counts the bytes crossing it, so exchanges are reported with their size
+// on the wire, and reports when the server is done with it.
+type structuredConn struct {
+	net.Conn
+	owner         *TunnelConnection
+	read, written atomic.Int64
+	closed        chan struct{}
+	closeOnce     sync.Once
+	handlers      sync.WaitGroup
+
+	// pending is the exchange being served, and readAt and writtenAt the
+	// byte counts when the previous one was done
+	pending   *RequestInfo
+	readAt    int64
+	writtenAt int64
+	mutex     sync.Mutex
+}
+
+func (c *structuredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.read.Add(int64(n))
+		c.owner.bytesIn.Add(int64(n))
+		c.owner.touch()
+	}
+	return n, err
+}
+
+func (c *structuredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.written.Add(int64(n))
+		c.owner.bytesOut.Add(int64(n))
+		c.owner.touch()
+	}
+	return n, err
+}
+
+func (c *structuredConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// begin reports a request about to be forwarded
+func (c *structuredConn) begin(info *RequestInfo) {
+	c.mutex.Lock()
+	c.pending = info
+	c.mutex.Unlock()
+	c.owner.exchangeStarted(*info)
+}
+
+// finish reports the pending exchange, if any, as done
+func (c *structuredConn) finish() {
+	c.mutex.Lock()
+	info := c.pending
+	c.pending = nil
+	read, written := c.read.Load(), c.written.Load()
+	if info != nil {
+		info.BytesIn, info.BytesOut = read-c.readAt, written-c.writtenAt
+		info.Duration = time.Since(info.start)
+	}
+	c.readAt, c.writtenAt = read, written
+	c.mutex.Unlock()
+
+	if info != nil {
+		c.owner.exchangeDone(*info)
+	}
+}
+
+// connListener hands a single connection to an http.Server
+type connListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+	addr  net.Addr
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	l := &connListener{conns: make(chan net.Conn, 1), done: make(chan struct{}), addr: conn.LocalAddr()}
+	l.conns <- conn
+	return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,193 @@
+package vrata
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startStructuredTunnel opens a tunnel in ProxyStructured mode to local and
+// returns the relay side of its data connection
+func startStructuredTunnel(t *testing.T, local *httptest.Server, options TunnelOptions) (*Tunnel, net.Conn) {
+	t.Helper()
+	relay := newMockRelay(t, 1)
+
+	options.Host = relay.server.URL
+	options.LocalHost = "127.0.0.1"
+	options.ProxyMode = ProxyStructured
+	tunnel, err := ConnectAndOpen(local.Listener.Addr().(*net.TCPAddr).Port, &options)
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	t.Cleanup(func() { tunnel.Close() })
+
+	conn := <-relay.conns
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	return tunnel, conn
+}
+
+func TestStructuredProxy(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s %s", r.Host, r.Header.Get("X-Middleware"), r.Header.Get("X-Forwarded-For"), body)
+	}))
+	defer local.Close()
+	localPort := local.Listener.Addr().(*net.TCPAddr).Port
+
+	var seen atomic.Int32
+	middleware := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen.Add(1)
+			r.Header.Set("X-Middleware", "inner")
+			next.ServeHTTP(w, r)
+		})
+	}
+	outer := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Set("X-Middleware", "outer")
+			next.ServeHTTP(w, r)
+		})
+	}
+	tunnel, conn := startStructuredTunnel(t, local, TunnelOptions{
+		Middleware:      []Middleware{outer, middleware},
+		ResponseHeaders: http.Header{"X-Tunnel": {"1"}},
+	})
+	events := tunnel.Events()
+	reader := bufio.NewReader(conn)
+
+	for i, body := range []string{"", "hello"} {
+		fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: public.example\r\nX-Forwarded-For: 203.0.113.7\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Request %d: failed to read response: %v", i, err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		want := fmt.Sprintf("127.0.0.1:%d inner 203.0.113.7 %s", localPort, body)
+		if string(got) != want {
+			t.Errorf("Request %d: body = %q, want %q", i, got, want)
+		}
+		if resp.Header.Get("X-Tunnel") != "1" {
+			t.Errorf("Request %d: X-Tunnel = %q, want 1", i, resp.Header.Get("X-Tunnel"))
+		}
+
+		select {
+		case info := <-events.Response:
+			if info.StatusCode != http.StatusOK || info.BytesIn == 0 || info.BytesOut == 0 {
+				t.Errorf("Request %d: event = %d, %d bytes in, %d out", i, info.StatusCode, info.BytesIn, info.BytesOut)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Request %d: no response event", i)
+		}
+	}
+
+	if seen.Load() != 2 {
+		t.Errorf("Middleware saw %d requests, want 2", seen.Load())
+	}
+	if got := tunnel.Stats().Requests; got != 2 {
+		t.Errorf("Stats().Requests = %d, want 2", got)
+	}
+}
+
+func TestStructuredProxyChecksEveryRequest(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer local.Close()
+
+	tunnel, conn := startStructuredTunnel(t, local, TunnelOptions{DenyPaths: []string{"/admin/*"}})
+	reader := bufio.NewReader(conn)
+
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/", http.StatusOK},
+		{"/admin/users", http.StatusForbidden},
+	} {
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: public.example\r\n\r\n", tc.path)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("%s: failed to read response: %v", tc.path, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.path, resp.StatusCode, tc.want)
+		}
+	}
+	if n := tunnel.Stats().Rejected; n != 1 {
+		t.Errorf("Stats().Rejected = %d, want 1", n)
+	}
+}
+
+func TestStructuredProxyRetries(t *testing.T) {
+	defer func(delay time.Duration) { proxyRetryDelay = delay }(proxyRetryDelay)
+	proxyRetryDelay = time.Millisecond
+
+	tests := []struct {
+		name    string
+		method  string
+		retries int
+		want    int
+	}{
+		{"retried", http.MethodGet, 1, http.StatusOK},
+		{"no retries", http.MethodGet, 0, http.StatusBadGateway},
+		{"not idempotent", http.MethodPost, 1, http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The local server drops the first request
+			var calls atomic.Int32
+			local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if calls.Add(1) == 1 {
+					c, _, _ := w.(http.Hijacker).Hijack()
+					c.Close()
+				}
+			}))
+			defer local.Close()
+
+			_, conn := startStructuredTunnel(t, local, TunnelOptions{ProxyRetries: tt.retries})
+			fmt.Fprintf(conn, "%s / HTTP/1.1\r\nHost: public.example\r\nContent-Length: 0\r\n\r\n", tt.method)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Errorf("Status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateProxyMode(t *testing.T) {
+	noop := func(next http.Handler) http.Handler { return next }
+
+	tests := []struct {
+		name    string
+		options TunnelOptions
+		wantErr string
+	}{
+		{"raw", TunnelOptions{}, ""},
+		{"structured", TunnelOptions{ProxyMode: ProxyStructured, ProxyRetries: 2, Middleware: []Middleware{noop}}, ""},
+		{"negative retries", TunnelOptions{ProxyMode: ProxyStructured, ProxyRetries: -1}, "invalid proxy retries"},
+		{"middleware without structured", TunnelOptions{Middleware: []Middleware{noop}}, "need the structured proxy mode"},
+		{"recording", TunnelOptions{ProxyMode: ProxyStructured, RecordFile: "out.json"}, "recording needs the raw proxy mode"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.options.validateProxyMode()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validateProxyMode() = %v, want nil", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validateProxyMode() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package vrata
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Stub is a canned response for the requests matching Method and Path
+type Stub struct {
+	// Method matches any method when empty
+	Method string `json:"method,omitempty"`
+	// Path is a pattern like those of AllowPaths
+	Path string `json:"path"`
+	// Status defaults to 200 OK
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+	// BodyFile is read into Body by LoadStubs, relative to the stubs file
+	BodyFile string `json:"body_file,omitempty"`
+}
+
+// LoadStubs reads a JSON array of stubs from path, with the bodies of
+// their BodyFiles
+func LoadStubs(file string) ([]Stub, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var stubs []Stub
+	if err := json.Unmarshal(data, &stubs); err != nil {
+		return nil, fmt.Errorf("invalid stubs %s: %w", file, err)
+	}
+
+	for i, stub := range stubs {
+		if stub.BodyFile == "" {
+			continue
+		}
+		bodyFile := stub.BodyFile
+		if !filepath.IsAbs(bodyFile) {
+			bodyFile = filepath.Join(filepath.Dir(file), bodyFile)
+		}
+		body, err := os.ReadFile(bodyFile)
+		if err != nil {
+			return nil, fmt.Errorf("stub for %s: %w", stub.Path, err)
+		}
+		stubs[i].Body = string(body)
+	}
+	return stubs, nil
+}
+
+// validateStubs reports the first stub that can't be served
+func validateStubs(stubs []Stub) error {
+	for _, stub := range stubs {
+		if err := validatePathPatterns([]string{stub.Path}); err != nil {
+			return err
+		}
+		if stub.Status != 0 && (stub.Status < 100 || stub.Status > 999) {
+			return fmt.Errorf("%w: status %d for %s", ErrBadStub, stub.Status, stub.Path)
+		}
+	}
+	return nil
+}
+
+// serveStubs answers requests arriving on upstream with the first matching
+// stub without contacting the local server
+func serveStubs(stubs []Stub, upstream io.ReadWriter, reader *bufio.Reader, onRequest, onResponse func(RequestInfo)) error {
+	return serveCanned(upstream, reader, onRequest, onResponse, func(req *http.Request) (int, http.Header, []byte) {
+		p := path.Clean("/" + req.URL.Path)
+		for _, stub := range stubs {
+			if stub.Method != "" && !strings.EqualFold(stub.Method, req.Method) {
+				continue
+			}
+			if !matchPath(stub.Path, p) {
+				continue
+			}
+
+			status := stub.Status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			return status, stub.Header.Clone(), []byte(stub.Body)
+		}
+		return notFound(fmt.Sprintf("no stub for %s %s\n", req.Method, req.URL.RequestURI()))
+	})
+}
@@ -0,0 +1,131 @@
+package vrata
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadStubs(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "ok.json"), []byte(`{"ok":true}`), 0o644)
+	os.WriteFile(filepath.Join(dir, "stubs.json"), []byte(`[
+		{"method": "POST", "path": "/hook", "status": 202, "body": "queued"},
+		{"path": "/status", "header": {"Content-Type": ["application/json"]}, "body_file": "ok.json"}
+	]`), 0o644)
+
+	stubs, err := LoadStubs(filepath.Join(dir, "stubs.json"))
+	if err != nil {
+		t.Fatalf("LoadStubs() failed: %v", err)
+	}
+	if len(stubs) != 2 || stubs[0].Status != 202 || stubs[0].Body != "queued" {
+		t.Fatalf("Unexpected stubs %+v", stubs)
+	}
+	if stubs[1].Body != `{"ok":true}` || stubs[1].Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Body file wasn't loaded: %+v", stubs[1])
+	}
+
+	os.WriteFile(filepath.Join(dir, "missing.json"), []byte(`[{"path": "/", "body_file": "nope"}]`), 0o644)
+	if _, err := LoadStubs(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("Expected an error for a missing body file")
+	}
+}
+
+func TestNewTunnelRejectsBadStubs(t *testing.T) {
+	tests := []struct {
+		stub Stub
+		want error
+	}{
+		{Stub{Path: "hook"}, ErrBadPathPattern},
+		{Stub{Path: "/hook", Status: 42}, ErrBadStub},
+	}
+	for _, tt := range tests {
+		_, err := NewTunnel(8080, &TunnelOptions{Stubs: []Stub{tt.stub}})
+		if !errors.Is(err, tt.want) {
+			t.Errorf("Stub %+v: expected %v, got %v", tt.stub, tt.want, err)
+		}
+	}
+}
+
+func TestServeStubs(t *testing.T) {
+	stubs := []Stub{
+		{Method: "POST", Path: "/hooks/*", Status: http.StatusAccepted, Body: "queued"},
+		{Path: "/hooks/*", Status: http.StatusMethodNotAllowed},
+		{Path: "/status", Header: http.Header{"Content-Type": {"application/json"}}, Body: `{"ok":true}`},
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		defer server.Close()
+		serveStubs(stubs, server, bufio.NewReader(server), nil, nil)
+	}()
+
+	go io.WriteString(client, "POST /hooks/github HTTP/1.1\r\nHost: x\r\nContent-Length: 2\r\n\r\n{}"+
+		"GET /hooks/github HTTP/1.1\r\nHost: x\r\n\r\n"+
+		"GET /status?verbose=1 HTTP/1.1\r\nHost: x\r\n\r\n"+
+		"GET /missing HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+
+	reader := bufio.NewReader(client)
+	for _, want := range []struct {
+		status      int
+		contentType string
+		body        string
+	}{
+		{http.StatusAccepted, "", "queued"},
+		{http.StatusMethodNotAllowed, "", ""},
+		{http.StatusOK, "application/json", `{"ok":true}`},
+		{http.StatusNotFound, "text/plain; charset=utf-8", "no stub for GET /missing\n"},
+	} {
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != want.status || string(body) != want.body {
+			t.Errorf("Expected %d %q, got %d %q", want.status, want.body, resp.StatusCode, body)
+		}
+		if want.contentType != "" && resp.Header.Get("Content-Type") != want.contentType {
+			t.Errorf("Expected Content-Type %q, got %q", want.contentType, resp.Header.Get("Content-Type"))
+		}
+	}
+}
+
+func TestTunnelStubEvents(t *testing.T) {
+	relay := newMockRelay(t, 1)
+	tunnel, err := ConnectAndOpen(8080, &TunnelOptions{
+		Host:  relay.server.URL,
+		Stubs: []Stub{{Path: "/status", Body: "ok"}},
+	})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	resp := relay.roundTrip(t, "GET /status?verbose=1 HTTP/1.1\r\nHost: public.example\r\nX-Forwarded-For: 192.0.2.1\r\nConnection: close\r\n\r\n")
+	io.ReadAll(resp.Body)
+
+	select {
+	case info := <-tunnel.Events().Request:
+		if info.Method != "GET" || info.URL != "/status?verbose=1" || info.RemoteAddr != "192.0.2.1" || info.BytesIn == 0 {
+			t.Errorf("Unexpected request event: %+v", info)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("No request event emitted")
+	}
+	select {
+	case info := <-tunnel.Events().Response:
+		if info.Path != "/status" || info.StatusCode != http.StatusOK || info.BytesOut == 0 {
+			t.Errorf("Unexpected response event: %+v", info)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("No response event emitted")
+	}
+}
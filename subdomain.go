@@ -0,0 +1,93 @@
+package vrata
+
+import (
+	"crypto/rand"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	minSubdomainLength = 4
+	maxSubdomainLength = 63
+	subdomainSuffixLen = 4
+	subdomainAlphabet  = "abcdefghijklmnopqrstuvwxyz0123456789"
+)
+
+// NormalizeSubdomain lowercases a requested subdomain and checks it against
+// the rules localtunnel servers enforce: 4-63 characters of letters, digits
+// and dashes, not starting or ending with a dash
+func NormalizeSubdomain(subdomain string) (string, error) {
+	normalized := strings.ToLower(strings.TrimSpace(subdomain))
+
+	if len(normalized) < minSubdomainLength || len(normalized) > maxSubdomainLength {
+		return "", fmt.Errorf("%w %q: must be between %d and %d characters long",
+			ErrInvalidSubdomain, subdomain, minSubdomainLength, maxSubdomainLength)
+	}
+
+	for _, r := range normalized {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return "", fmt.Errorf("%w %q: only letters, digits and dashes are allowed",
+				ErrInvalidSubdomain, subdomain)
+		}
+	}
+
+	if strings.HasPrefix(normalized, "-") || strings.HasSuffix(normalized, "-") {
+		return "", fmt.Errorf("%w %q: must not start or end with a dash", ErrInvalidSubdomain, subdomain)
+	}
+
+	return normalized, nil
+}
+
+// parseSubdomains normalizes a comma-separated list of subdomains,
+// suffixing each when suffix is set
+func parseSubdomains(list string, suffix bool) ([]string, error) {
+	var subdomains []string
+	for _, name := range strings.Split(list, ",") {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		subdomain, err := NormalizeSubdomain(name)
+		if err != nil {
+			return nil, err
+		}
+		if suffix {
+			subdomain = withRandomSuffix(subdomain)
+		}
+		if !slices.Contains(subdomains, subdomain) {
+			subdomains = append(subdomains, subdomain)
+		}
+	}
+	return subdomains, nil
+}
+
+// numberedSubdomains returns count alternatives to a taken subdomain:
+// myapp-2, myapp-3 and so on, shortening the base name if needed to stay
+// within the length limit
+func numberedSubdomains(subdomain string, count int) []string {
+	numbered := make([]string, 0, count)
+	for n := 2; n < count+2; n++ {
+		suffix := fmt.Sprintf("-%d", n)
+		base := subdomain
+		if maxBase := maxSubdomainLength - len(suffix); len(base) > maxBase {
+			base = strings.TrimRight(base[:maxBase], "-")
+		}
+		numbered = append(numbered, base+suffix)
+	}
+	return numbered
+}
+
+// withRandomSuffix appends a short random token (myapp-x7k2), shortening
+// the base name if needed to stay within the length limit
+func withRandomSuffix(subdomain string) string {
+	suffix := make([]byte, subdomainSuffixLen)
+	rand.Read(suffix)
+	for i, b := range suffix {
+		suffix[i] = subdomainAlphabet[int(b)%len(subdomainAlphabet)]
+	}
+
+	if maxBase := maxSubdomainLength - subdomainSuffixLen - 1; len(subdomain) > maxBase {
+		subdomain = strings.TrimRight(subdomain[:maxBase], "-")
+	}
+	return subdomain + "-" + string(suffix)
+}
@@ -0,0 +1,193 @@
+package vrata
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeSubdomain(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{input: "myapp", want: "myapp"},
+		{input: "  MyApp-Dev ", want: "myapp-dev"},
+		{input: "app1", want: "app1"},
+		{input: "abc", wantErr: true},
+		{input: strings.Repeat("a", 64), wantErr: true},
+		{input: "my_app", wantErr: true},
+		{input: "my.app", wantErr: true},
+		{input: "-myapp", wantErr: true},
+		{input: "myapp-", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := NormalizeSubdomain(tt.input)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidSubdomain) {
+					t.Errorf("Expected ErrInvalidSubdomain, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NormalizeSubdomain() failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected '%s', got '%s'", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestWithRandomSuffix(t *testing.T) {
+	got := withRandomSuffix("myapp")
+	if !strings.HasPrefix(got, "myapp-") || len(got) != len("myapp-")+subdomainSuffixLen {
+		t.Errorf("Unexpected suffixed subdomain '%s'", got)
+	}
+	if _, err := NormalizeSubdomain(got); err != nil {
+		t.Errorf("Suffixed subdomain is invalid: %v", err)
+	}
+
+	long := withRandomSuffix(strings.Repeat("a", 57) + "-b" + "cccc")
+	if _, err := NormalizeSubdomain(long); err != nil {
+		t.Errorf("Suffixed long subdomain is invalid: %v", err)
+	}
+}
+
+func TestNewTunnelRejectsInvalidSubdomain(t *testing.T) {
+	if _, err := NewTunnel(8080, &TunnelOptions{Subdomain: "no"}); !errors.Is(err, ErrInvalidSubdomain) {
+		t.Errorf("Expected ErrInvalidSubdomain, got %v", err)
+	}
+
+	tunnel, err := NewTunnel(8080, &TunnelOptions{Subdomain: "MyApp", SubdomainSuffix: true})
+	if err != nil {
+		t.Fatalf("NewTunnel() failed: %v", err)
+	}
+	if !strings.HasPrefix(tunnel.options.Subdomain, "myapp-") {
+		t.Errorf("Expected normalized, suffixed subdomain, got '%s'", tunnel.options.Subdomain)
+	}
+}
+
+func TestParseSubdomains(t *testing.T) {
+	got, err := parseSubdomains(" MyApp, myapp2 ,,myapp,myapp-dev", false)
+	if err != nil {
+		t.Fatalf("parseSubdomains() failed: %v", err)
+	}
+	if want := []string{"myapp", "myapp2", "myapp-dev"}; !slices.Equal(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+
+	if _, err := parseSubdomains("myapp,no", false); !errors.Is(err, ErrInvalidSubdomain) {
+		t.Errorf("Expected ErrInvalidSubdomain for a bad fallback, got %v", err)
+	}
+}
+
+func TestRegisterSubdomainFallbacks(t *testing.T) {
+	var requested []string
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		requested = append(requested, name)
+		switch name {
+		case "myapp":
+			http.Error(w, `{"message": "Subdomain myapp is in use"}`, http.StatusConflict)
+		case "myapp2":
+			fmt.Fprintf(w, `{"id": %q, "url": "https://%s.example", "port": 1, "max_conn_count": 1}`, name, name)
+		default:
+			t.Errorf("Unexpected request for %q", name)
+		}
+	}))
+	defer relay.Close()
+
+	tunnel, err := NewTunnel(8080, &TunnelOptions{Host: relay.URL, Subdomain: "myapp,myapp2,myapp-dev"})
+	if err != nil {
+		t.Fatalf("NewTunnel() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	info, err := tunnel.register(tunnel.ctx)
+	if err != nil {
+		t.Fatalf("register() failed: %v", err)
+	}
+	if info.Subdomain != "myapp2" {
+		t.Errorf("Expected the first free subdomain, got %q", info.Subdomain)
+	}
+	if want := []string{"myapp", "myapp2"}; !slices.Equal(requested, want) {
+		t.Errorf("Requested %v, want %v", requested, want)
+	}
+}
+
+func TestRegisterSubdomainFallbacksStopOnOtherErrors(t *testing.T) {
+	var requests int
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, `{"message": "banned"}`, http.StatusForbidden)
+	}))
+	defer relay.Close()
+
+	tunnel, err := NewTunnel(8080, &TunnelOptions{Host: relay.URL, Subdomain: "myapp,myapp2"})
+	if err != nil {
+		t.Fatalf("NewTunnel() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	if _, err := tunnel.register(tunnel.ctx); err == nil || requests != 1 {
+		t.Errorf("Expected one failed request, got %d and %v", requests, err)
+	}
+}
+
+func TestRegisterSubdomainRetries(t *testing.T) {
+	var requested []string
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		requested = append(requested, name)
+		if name != "myapp-3" {
+			http.Error(w, `{"message": "Subdomain is in use"}`, http.StatusConflict)
+			return
+		}
+		fmt.Fprintf(w, `{"id": %q, "url": "https://%s.example", "port": 1, "max_conn_count": 1}`, name, name)
+	}))
+	defer relay.Close()
+
+	tunnel, err := NewTunnel(8080, &TunnelOptions{Host: relay.URL, Subdomain: "myapp,myapp-dev", SubdomainRetries: 5})
+	if err != nil {
+		t.Fatalf("NewTunnel() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	info, err := tunnel.register(tunnel.ctx)
+	if err != nil {
+		t.Fatalf("register() failed: %v", err)
+	}
+	if info.Subdomain != "myapp-3" {
+		t.Errorf("Expected the first free numbered subdomain, got %q", info.Subdomain)
+	}
+	if want := []string{"myapp", "myapp-dev", "myapp-2", "myapp-3"}; !slices.Equal(requested, want) {
+		t.Errorf("Requested %v, want %v", requested, want)
+	}
+
+	// Retries run out like fallbacks do
+	requested = nil
+	tunnel, err = NewTunnel(8080, &TunnelOptions{Host: relay.URL, Subdomain: "other", SubdomainRetries: 1})
+	if err != nil {
+		t.Fatalf("NewTunnel() failed: %v", err)
+	}
+	defer tunnel.Close()
+	if _, err := tunnel.register(tunnel.ctx); !errors.Is(err, ErrSubdomainTaken) {
+		t.Errorf("Expected ErrSubdomainTaken, got %v", err)
+	}
+	if want := []string{"other", "other-2"}; !slices.Equal(requested, want) {
+		t.Errorf("Requested %v, want %v", requested, want)
+	}
+
+	long := strings.Repeat("a", maxSubdomainLength)
+	if got := numberedSubdomains(long, 9)[8]; len(got) != maxSubdomainLength || !strings.HasSuffix(got, "-10") {
+		t.Errorf("numberedSubdomains() of a long name = %q", got)
+	}
+}
@@ -0,0 +1,174 @@
+package vrata
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// BalanceStrategy selects how visitors are spread over LocalTargets
+type BalanceStrategy int
+
+const (
+	// BalanceRoundRobin sends each visitor connection to the next target
+	// in turn (default)
+	BalanceRoundRobin BalanceStrategy = iota
+	// BalanceLeastConnections sends each visitor connection to the target
+	// with the fewest open connections
+	BalanceLeastConnections
+)
+
+// StickyMode selects how visitors keep reaching the same local target
+type StickyMode int
+
+const (
+	// StickyNone balances every visitor connection (default)
+	StickyNone StickyMode = iota
+	// StickyClientIP sends each client address to the same target
+	StickyClientIP
+	// StickyCookie pins each browser to the target that first served it
+	// with a vrata_target cookie
+	StickyCookie
+)
+
+// stickyCookie names the cookie holding the target of StickyCookie
+const stickyCookie = "vrata_target"
+
+// targetBalancer picks the local target of each visitor connection
+type targetBalancer struct {
+	addresses []string
+	// ids name the targets in sticky cookies without revealing addresses
+	ids      []string
+	strategy BalanceStrategy
+	next     int
+	// active counts open connections per target
+	active []int
+	mutex  sync.Mutex
+}
+
+// newTargetBalancer returns a balancer over addresses, or nil when there
+// are none and the local server is LocalHost:Port
+func newTargetBalancer(addresses []string, strategy BalanceStrategy) *targetBalancer {
+	if len(addresses) == 0 {
+		return nil
+	}
+	ids := make([]string, len(addresses))
+	for i, address := range addresses {
+		sum := sha256.Sum256([]byte(address))
+		ids[i] = hex.EncodeToString(sum[:6])
+	}
+	return &targetBalancer{
+		addresses: addresses,
+		ids:       ids,
+		strategy:  strategy,
+		active:    make([]int, len(addresses)),
+	}
+}
+
+// pick selects a target, preferred when it is a valid index, and counts a
+// connection to it until done is called with the returned index
+func (b *targetBalancer) pick(preferred int) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if preferred >= 0 && preferred < len(b.addresses) {
+		b.active[preferred]++
+		return preferred
+	}
+
+	i := b.next
+	if b.strategy == BalanceLeastConnections {
+		// Ties go to the target after the last one picked, so idle
+		// targets still take turns
+		for n := range b.addresses {
+			candidate := (b.next + n) % len(b.addresses)
+			if b.active[candidate] < b.active[i] {
+				i = candidate
+			}
+		}
+	}
+	b.next = (i + 1) % len(b.addresses)
+	b.active[i]++
+	return i
+}
+
+// done ends a connection counted by pick
+func (b *targetBalancer) done(i int) {
+	b.mutex.Lock()
+	b.active[i]--
+	b.mutex.Unlock()
+}
+
+// preferredTarget returns the target a visitor is stuck to by Sticky, or
+// -1 to let the balancer choose
+func (tc *TunnelCluster) preferredTarget(head []byte) int {
+	switch tc.options.Sticky {
+	case StickyClientIP:
+		client := headClientIP(head)
+		if client == "" {
+			return -1
+		}
+		hash := fnv.New32a()
+		hash.Write([]byte(client))
+		return int(hash.Sum32() % uint32(len(tc.targets.addresses)))
+	case StickyCookie:
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+		if err != nil {
+			return -1
+		}
+		if cookie, err := req.Cookie(stickyCookie); err == nil {
+			return slices.Index(tc.targets.ids, cookie.Value)
+		}
+	}
+	return -1
+}
+
+// stickyHeader returns the headers added to responses from target i that
+// pin the visitor to it, or nil when it is pinned already
+func (tc *TunnelCluster) stickyHeader(i, preferred int) http.Header {
+	if tc.options.Sticky != StickyCookie || i == preferred {
+		return nil
+	}
+	cookie := &http.Cookie{
+		Name:     stickyCookie,
+		Value:    tc.targets.ids[i],
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	return http.Header{"Set-Cookie": {cookie.String()}}
+}
+
+// targetConn is a connection to a balanced target, released on Close
+type targetConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *targetConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// validateTargets rejects LocalTargets that aren't host:port addresses
+func validateTargets(addresses []string) error {
+	for _, address := range addresses {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil || host == "" {
+			return fmt.Errorf("%w: %q must be host:port", ErrBadLocalTarget, address)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("%w: %q has an invalid port", ErrBadLocalTarget, address)
+		}
+	}
+	return nil
+}
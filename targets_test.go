@@ -0,0 +1,184 @@
+package vrata
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTargetBalancerRoundRobin(t *testing.T) {
+	b := newTargetBalancer([]string{"a:1", "b:1", "c:1"}, BalanceRoundRobin)
+	for n, want := range []int{0, 1, 2, 0, 1} {
+		if got := b.pick(-1); got != want {
+			t.Errorf("Pick %d: got target %d, want %d", n, got, want)
+		}
+	}
+}
+
+func TestTargetBalancerLeastConnections(t *testing.T) {
+	b := newTargetBalancer([]string{"a:1", "b:1", "c:1"}, BalanceLeastConnections)
+
+	first, second, third := b.pick(-1), b.pick(-1), b.pick(-1)
+	if first != 0 || second != 1 || third != 2 {
+		t.Fatalf("Idle targets should take turns, got %d %d %d", first, second, third)
+	}
+
+	// b finishes first, so it has the fewest connections
+	b.done(second)
+	if got := b.pick(-1); got != second {
+		t.Errorf("Expected the least busy target %d, got %d", second, got)
+	}
+}
+
+func TestNewTunnelRejectsBadLocalTargets(t *testing.T) {
+	for _, target := range []string{"localhost", ":3000", "localhost:0", "localhost:http"} {
+		_, err := NewTunnel(8080, &TunnelOptions{LocalTargets: []string{target}})
+		if !errors.Is(err, ErrBadLocalTarget) {
+			t.Errorf("Target %q: expected ErrBadLocalTarget, got %v", target, err)
+		}
+	}
+}
+
+func TestTunnelLocalTargets(t *testing.T) {
+	relay := newMockRelay(t, 4)
+
+	var targets []string
+	for _, name := range []string{"one", "two"} {
+		local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name+" "+r.Host)
+		}))
+		defer local.Close()
+		targets = append(targets, local.Listener.Addr().String())
+	}
+
+	tunnel, err := ConnectAndOpen(8080, &TunnelOptions{
+		Host:         relay.server.URL,
+		LocalTargets: targets,
+	})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	for i, want := range []string{"one " + targets[0], "two " + targets[1], "one " + targets[0]} {
+		var conn net.Conn
+		select {
+		case conn = <-relay.conns:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Tunnel client never connected to the relay")
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: public.example\r\nConnection: close\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("Request %d: failed to read response: %v", i, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		conn.Close()
+
+		if string(body) != want {
+			t.Errorf("Request %d: got %q, want %q", i, body, want)
+		}
+	}
+}
+
+func TestPreferredTargetClientIP(t *testing.T) {
+	tc := &TunnelCluster{
+		options: &TunnelOptions{Sticky: StickyClientIP},
+		targets: newTargetBalancer([]string{"a:1", "b:1", "c:1"}, BalanceRoundRobin),
+	}
+	head := []byte("GET / HTTP/1.1\r\nHost: x\r\nX-Forwarded-For: 203.0.113.7\r\n\r\n")
+
+	first := tc.preferredTarget(head)
+	if first < 0 {
+		t.Fatal("Expected a client with an address to get a target")
+	}
+	for range 5 {
+		if got := tc.preferredTarget(head); got != first {
+			t.Errorf("Same client got target %d, then %d", first, got)
+		}
+	}
+	// The entries before the relay's are the visitor's to choose
+	for i := range 10 {
+		spoofed := fmt.Appendf(nil, "GET / HTTP/1.1\r\nHost: x\r\nX-Forwarded-For: 198.51.100.%d, 203.0.113.7\r\n\r\n", i)
+		if got := tc.preferredTarget(spoofed); got != first {
+			t.Errorf("Client with a forged first hop got target %d, want %d", got, first)
+		}
+	}
+	if got := tc.preferredTarget([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n")); got != -1 {
+		t.Errorf("Expected no preference without a client address, got %d", got)
+	}
+}
+
+func TestTunnelStickyCookie(t *testing.T) {
+	relay := newMockRelay(t, 4)
+
+	var targets []string
+	for _, name := range []string{"one", "two"} {
+		local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.SetCookie(w, &http.Cookie{Name: "app", Value: name})
+			io.WriteString(w, name)
+		}))
+		defer local.Close()
+		targets = append(targets, local.Listener.Addr().String())
+	}
+
+	tunnel, err := ConnectAndOpen(8080, &TunnelOptions{
+		Host:         relay.server.URL,
+		LocalTargets: targets,
+		Sticky:       StickyCookie,
+	})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	get := func(cookie string) *http.Response {
+		t.Helper()
+		conn := <-relay.conns
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: public.example\r\nConnection: close\r\n"+cookie+"\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Header.Set("X-Body", string(body))
+		return resp
+	}
+
+	first := get("")
+	var sticky *http.Cookie
+	for _, cookie := range first.Cookies() {
+		if cookie.Name == "vrata_target" {
+			sticky = cookie
+		}
+	}
+	if sticky == nil {
+		t.Fatalf("No sticky cookie in %v", first.Header)
+	}
+	if len(first.Cookies()) != 2 {
+		t.Errorf("The app's own cookie was lost: %v", first.Header.Values("Set-Cookie"))
+	}
+
+	// Round robin would move the visitor; the cookie keeps it in place
+	for range 2 {
+		resp := get("Cookie: vrata_target=" + sticky.Value + "\r\n")
+		if got := resp.Header.Get("X-Body"); got != first.Header.Get("X-Body") {
+			t.Errorf("Sticky visitor moved from %q to %q", first.Header.Get("X-Body"), got)
+		}
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == "vrata_target" {
+				t.Error("Pinned visitor got the sticky cookie again")
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package vrata
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// TCPOptions tunes the TCP sockets of relay and local connections. Zero
+// fields keep the system's settings.
+type TCPOptions struct {
+	// KeepAlive is the keepalive period, which detects a dead peer
+	// between visitors; 15 seconds in Go by default. Negative disables
+	// keepalives.
+	KeepAlive time.Duration
+	// Nagle turns TCP_NODELAY off, so small writes are batched into fewer
+	// packets at the cost of latency. Go sets TCP_NODELAY by default.
+	Nagle bool
+	// ReadBuffer and WriteBuffer size the socket buffers in bytes, e.g.
+	// larger for high-throughput transfers over long distances
+	ReadBuffer  int
+	WriteBuffer int
+}
+
+// validate rejects negative buffer sizes
+func (o TCPOptions) validate() error {
+	if o.ReadBuffer < 0 || o.WriteBuffer < 0 {
+		return fmt.Errorf("invalid TCP buffer size %d/%d: must not be negative", o.ReadBuffer, o.WriteBuffer)
+	}
+	return nil
+}
+
+// apply tunes the TCP socket under conn, which may be wrapped in TLS or
+// buffering. Through a proxy, that's the socket to the proxy.
+func (o TCPOptions) apply(conn net.Conn) {
+	tcp := tcpConn(conn)
+	if tcp == nil {
+		return
+	}
+
+	switch {
+	case o.KeepAlive < 0:
+		tcp.SetKeepAlive(false)
+	case o.KeepAlive > 0:
+		tcp.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     o.KeepAlive,
+			Interval: o.KeepAlive,
+			Count:    3,
+		})
+	}
+	if o.Nagle {
+		tcp.SetNoDelay(false)
+	}
+	if o.ReadBuffer > 0 {
+		tcp.SetReadBuffer(o.ReadBuffer)
+	}
+	if o.WriteBuffer > 0 {
+		tcp.SetWriteBuffer(o.WriteBuffer)
+	}
+}
+
+// tcpConn unwraps conn down to its TCP connection, or returns nil
+func tcpConn(conn net.Conn) *net.TCPConn {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c
+		case *bufferedConn:
+			conn = c.Conn
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// closeWrite shuts down the writing side of conn, unwrapping it down to a
+// connection that supports half-close, or returns errors.ErrUnsupported
+func closeWrite(conn net.Conn) error {
+	for {
+		switch c := conn.(type) {
+		case interface{ CloseWrite() error }:
+			return c.CloseWrite()
+		case *bufferedConn:
+			conn = c.Conn
+		case *monitoredConn:
+			conn = c.Conn
+		case *limitedConn:
+			conn = c.Conn
+		case *recordingConn:
+			conn = c.Conn
+		case *targetConn:
+			conn = c.Conn
+		default:
+			return errors.ErrUnsupported
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package vrata
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// tcpPair returns the client side of a loopback TCP connection
+func tcpPair(t *testing.T) net.Conn {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// tcpConns returns both sides of a loopback TCP connection
+func tcpConns(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	client, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server, err = listener.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return client, server
+}
+
+func TestTCPConnUnwraps(t *testing.T) {
+	conn := tcpPair(t)
+	for name, wrapped := range map[string]net.Conn{
+		"plain":    conn,
+		"buffered": &bufferedConn{Conn: conn, reader: bufio.NewReader(conn)},
+		"tls":      tls.Client(conn, &tls.Config{}),
+	} {
+		if tcpConn(wrapped) != conn {
+			t.Errorf("%s: expected the TCP connection", name)
+		}
+	}
+	if tcpConn(&net.UnixConn{}) != nil {
+		t.Error("Expected nil for a non-TCP connection")
+	}
+}
+
+func TestCloseWriteUnwraps(t *testing.T) {
+	for name, wrap := range map[string]func(net.Conn) net.Conn{
+		"plain":     func(conn net.Conn) net.Conn { return conn },
+		"monitored": func(conn net.Conn) net.Conn { return &monitoredConn{Conn: conn} },
+		"recording": func(conn net.Conn) net.Conn { return &recordingConn{Conn: conn} },
+		"limited": func(conn net.Conn) net.Conn {
+			return &limitedConn{Conn: &targetConn{Conn: conn, release: func() {}}}
+		},
+	} {
+		client, server := tcpConns(t)
+		if err := closeWrite(wrap(client)); err != nil {
+			t.Errorf("%s: closeWrite() failed: %v", name, err)
+		}
+		// The other side sees the end of the stream
+		if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("%s: read after closeWrite() = %v, want EOF", name, err)
+		}
+	}
+
+	pipe, other := net.Pipe()
+	defer pipe.Close()
+	defer other.Close()
+	if err := closeWrite(pipe); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("closeWrite(pipe) = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestTCPOptionsValidate(t *testing.T) {
+	if _, err := NewTunnel(8080, &TunnelOptions{TCP: TCPOptions{WriteBuffer: -1}}); err == nil {
+		t.Error("Expected an error for a negative buffer size")
+	}
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+
+package vrata
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTCPOptionsApply(t *testing.T) {
+	conn := tcpPair(t)
+	TCPOptions{KeepAlive: 5 * time.Second, Nagle: true, ReadBuffer: 4096}.apply(conn)
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn() failed: %v", err)
+	}
+	var nodelay, rcvbuf int
+	raw.Control(func(fd uintptr) {
+		nodelay, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+		rcvbuf, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	})
+	if nodelay != 0 {
+		t.Error("Expected TCP_NODELAY off with Nagle")
+	}
+	// Linux doubles the size for bookkeeping; the default is far larger
+	if rcvbuf > 2*4096 {
+		t.Errorf("Expected a 4KiB receive buffer, got %d", rcvbuf)
+	}
+}
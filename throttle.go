@@ -0,0 +1,183 @@
+package vrata
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ThrottleBehavior selects how a tunnel reacts when the relay throttles its
+// data connections
+type ThrottleBehavior int
+
+const (
+	// ThrottleBackoff shrinks the connection pool and delays redials,
+	// growing the pool back once the relay stops throttling (default)
+	ThrottleBackoff ThrottleBehavior = iota
+	// ThrottleIgnore keeps redialing at the normal pace and only reports
+	// the throttling
+	ThrottleIgnore
+	// ThrottleClose closes the tunnel on the first sign of throttling
+	ThrottleClose
+)
+
+// ErrThrottled is reported when the tunnel is closed because the relay
+// throttled it
+var ErrThrottled = errors.New("tunnel throttled by the relay")
+
+// ThrottleInfo describes a throttling episode
+type ThrottleInfo struct {
+	// Reason is what gave the throttling away, e.g. "429 Too Many Requests"
+	Reason string
+	// Backoff is how long redials are paused; zero when they aren't
+	Backoff time.Duration
+	// PoolSize is the number of connections the tunnel keeps from now on
+	PoolSize int
+	// Advice suggests how to stay below the relay's limits
+	Advice string
+}
+
+const (
+	minThrottleBackoff = time.Second
+	maxThrottleBackoff = 5 * time.Minute
+
+	// quickReset is how soon after connecting a reset counts as throttling
+	quickReset = time.Second
+)
+
+// throttleAdvice is attached to every Throttled event
+const throttleAdvice = "the relay is rate limiting this tunnel; lower request concurrency " +
+	"(MaxConcurrentRequests), request fewer connections or use a less busy server"
+
+// throttleState tracks the pool limit and backoff imposed by throttling
+type throttleState struct {
+	limit   int           // connections to keep, 0 = all
+	backoff time.Duration // current backoff, doubled on each episode
+	until   time.Time     // no redials before this
+	last    time.Time     // last throttling signal
+	mutex   sync.Mutex
+}
+
+// throttle records a throttling signal and returns the resulting backoff
+// and pool limit. retryAfter, when known, is the relay's own suggestion.
+func (s *throttleState) throttle(total int, retryAfter time.Duration) (time.Duration, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.limit == 0 {
+		s.limit = total
+	}
+	s.limit = max(1, s.limit/2)
+
+	s.backoff = min(max(minThrottleBackoff, s.backoff*2, retryAfter), maxThrottleBackoff)
+	s.last = time.Now()
+	s.until = s.last.Add(s.backoff)
+	return s.backoff, s.limit
+}
+
+// allowed returns how many connections may be dialed right now: none while
+// backing off, the pool limit otherwise. After twice the backoff without
+// throttling, the pool grows back one connection per call.
+func (s *throttleState) allowed(total int) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.limit == 0 {
+		return total
+	}
+
+	now := time.Now()
+	if now.Before(s.until) {
+		return 0
+	}
+	if now.Sub(s.last) > 2*s.backoff {
+		s.limit++
+		if s.limit >= total {
+			s.limit, s.backoff = 0, 0
+			return total
+		}
+	}
+	return s.limit
+}
+
+// limited reports whether throttling holds the pool below its size
+func (s *throttleState) limited() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.limit != 0
+}
+
+// throttled reacts to the relay throttling a data connection according to
+// the configured behavior
+func (tc *TunnelCluster) throttled(reason string, retryAfter time.Duration) {
+	tc.mutex.RLock()
+	total := len(tc.connections)
+	tc.mutex.RUnlock()
+
+	info := ThrottleInfo{Reason: reason, PoolSize: total, Advice: throttleAdvice}
+	if tc.options.OnThrottle == ThrottleBackoff {
+		info.Backoff, info.PoolSize = tc.throttle.throttle(total, retryAfter)
+	}
+
+	tc.log().Warn("relay is throttling the tunnel", "reason", reason, "backoff", info.Backoff, "pool", info.PoolSize)
+	tc.lastError.store(ErrThrottled)
+
+	tc.stream.publish("throttled", map[string]any{
+		"reason":     info.Reason,
+		"backoff_ms": info.Backoff.Milliseconds(),
+		"pool_size":  info.PoolSize,
+		"advice":     info.Advice,
+	})
+
+	select {
+	case tc.events.Throttled <- info:
+	default:
+	}
+
+	if tc.options.OnThrottle == ThrottleClose && tc.stop != nil {
+		go tc.stop()
+	}
+}
+
+// throttlePreamble reports whether the relay answered a fresh data
+// connection with an HTTP response, which it does to reject it, instead
+// of forwarding a request. The reason and the relay's Retry-After are
+// returned for 429 and 503 responses.
+func throttlePreamble(reader *bufio.Reader) (reason string, retryAfter time.Duration, ok bool) {
+	if prefix, err := reader.Peek(5); err != nil || string(prefix) != "HTTP/" {
+		return "", 0, false
+	}
+
+	head, err := peekRequestHead(reader)
+	if err != nil {
+		return "", 0, false
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), nil)
+	if err != nil {
+		return "", 0, false
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return "", 0, false
+	}
+	return resp.Status, parseRetryAfter(resp.Header.Get("Retry-After")), true
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as a date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(0, time.Until(date))
+	}
+	return 0
+}
@@ -0,0 +1,125 @@
+package vrata
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThrottlePreamble(t *testing.T) {
+	tests := []struct {
+		input      string
+		ok         bool
+		retryAfter time.Duration
+	}{
+		{"HTTP/1.1 429 Too Many Requests\r\nRetry-After: 7\r\n\r\n", true, 7 * time.Second},
+		{"HTTP/1.1 503 Service Unavailable\r\n\r\n", true, 0},
+		{"HTTP/1.1 200 OK\r\n\r\n", false, 0},
+		{"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", false, 0},
+	}
+
+	for _, test := range tests {
+		reader := bufio.NewReaderSize(strings.NewReader(test.input), maxRequestHead)
+		_, retryAfter, ok := throttlePreamble(reader)
+		if ok != test.ok || retryAfter != test.retryAfter {
+			t.Errorf("throttlePreamble(%q) = %s, %v; want %s, %v", test.input, retryAfter, ok, test.retryAfter, test.ok)
+		}
+		if reader.Buffered() == 0 {
+			t.Errorf("throttlePreamble(%q) consumed the input", test.input)
+		}
+	}
+}
+
+func TestThrottleStateShrinksAndRecovers(t *testing.T) {
+	var state throttleState
+
+	if n := state.allowed(8); n != 8 {
+		t.Errorf("Expected the full pool before throttling, got %d", n)
+	}
+
+	backoff, limit := state.throttle(8, 0)
+	if backoff != minThrottleBackoff || limit != 4 {
+		t.Errorf("First episode: backoff %s, limit %d", backoff, limit)
+	}
+	backoff, limit = state.throttle(8, 10*time.Second)
+	if backoff != 10*time.Second || limit != 2 {
+		t.Errorf("Second episode: backoff %s, limit %d", backoff, limit)
+	}
+	if n := state.allowed(8); n != 0 {
+		t.Errorf("Expected no redials while backing off, got %d", n)
+	}
+
+	// Pretend the last episode is long over
+	state.until = time.Time{}
+	state.last = time.Now().Add(-time.Hour)
+	for i := 3; i < 8; i++ {
+		if n := state.allowed(8); n != i {
+			t.Errorf("Expected pool to grow to %d, got %d", i, n)
+		}
+	}
+	if n := state.allowed(8); n != 8 || state.limit != 0 {
+		t.Errorf("Expected full recovery, got %d (limit %d)", n, state.limit)
+	}
+}
+
+func TestTunnelThrottled(t *testing.T) {
+	relay := newMockRelay(t, 2)
+
+	tunnel, err := ConnectAndOpen(8080, &TunnelOptions{Host: relay.server.URL})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	conn := <-relay.conns
+	defer conn.Close()
+	io.WriteString(conn, "HTTP/1.1 429 Too Many Requests\r\nRetry-After: 3\r\n\r\n")
+
+	select {
+	case info := <-tunnel.Events().Throttled:
+		if info.PoolSize != 1 || info.Backoff != 3*time.Second || info.Advice == "" {
+			t.Errorf("Unexpected throttle event: %+v", info)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No throttle event emitted")
+	}
+
+	if err := tunnel.Stats().LastError; !errors.Is(err, ErrThrottled) {
+		t.Errorf("Expected ErrThrottled as last error, got %v", err)
+	}
+}
+
+func TestTunnelThrottleClose(t *testing.T) {
+	relay := newMockRelay(t, 1)
+
+	tunnel, err := ConnectAndOpen(8080, &TunnelOptions{Host: relay.server.URL, OnThrottle: ThrottleClose})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	conn := <-relay.conns
+	defer conn.Close()
+	io.WriteString(conn, "HTTP/1.1 429 Too Many Requests\r\n\r\n")
+
+	select {
+	case <-tunnel.Events().Close:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Tunnel was not closed")
+	}
+
+	select {
+	case err := <-tunnel.Events().Error:
+		if !errors.Is(err, ErrThrottled) {
+			t.Errorf("Expected ErrThrottled, got %v", err)
+		}
+	default:
+		t.Error("No error reported")
+	}
+	if err := tunnel.Wait(); !errors.Is(err, ErrThrottled) {
+		t.Errorf("Wait: expected ErrThrottled, got %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package vrata
+
+import (
+	"fmt"
+	"time"
+)
+
+// Default timeouts, used for zero Timeouts fields
+const (
+	defaultDialTimeout      = 10 * time.Second
+	defaultRegisterTimeout  = 10 * time.Second
+	defaultLocalDialTimeout = 10 * time.Second
+	defaultIdleTimeout      = 60 * time.Second
+)
+
+// Timeouts bounds how long the tunnel waits on the network. Zero fields
+// keep their defaults.
+type Timeouts struct {
+	// Dial bounds connecting to the relay, through a proxy or not
+	// (default 10s)
+	Dial time.Duration
+	// Register bounds the registration request (default 10s); a
+	// RegistrationClient brings its own
+	Register time.Duration
+	// LocalDial bounds connecting to the local server (default 10s)
+	LocalDial time.Duration
+	// Idle is how long a data connection waits for a visitor before it's
+	// replaced with a fresh one (default 60s); negative never replaces
+	// idle connections
+	Idle time.Duration
+	// Request bounds serving a visitor, from its first bytes until the
+	// relay connection is done (default: no limit). WebSockets and
+	// Server-Sent Events streams are exempt once open.
+	Request time.Duration
+	// Maintenance is how often dropped data connections are redialed
+	// (default 30s)
+	Maintenance time.Duration
+}
+
+func (t Timeouts) dial() time.Duration {
+	return orDefault(t.Dial, defaultDialTimeout)
+}
+
+func (t Timeouts) register() time.Duration {
+	return orDefault(t.Register, defaultRegisterTimeout)
+}
+
+func (t Timeouts) localDial() time.Duration {
+	return orDefault(t.LocalDial, defaultLocalDialTimeout)
+}
+
+// idle returns the idle timeout, or 0 when idle connections are kept
+func (t Timeouts) idle() time.Duration {
+	if t.Idle < 0 {
+		return 0
+	}
+	return orDefault(t.Idle, defaultIdleTimeout)
+}
+
+func (t Timeouts) maintenance() time.Duration {
+	return orDefault(t.Maintenance, maintenanceInterval)
+}
+
+// validate rejects negative timeouts, except for Idle
+func (t Timeouts) validate() error {
+	for name, d := range map[string]time.Duration{
+		"dial":        t.Dial,
+		"register":    t.Register,
+		"local dial":  t.LocalDial,
+		"request":     t.Request,
+		"maintenance": t.Maintenance,
+	} {
+		if d < 0 {
+			return fmt.Errorf("invalid %s timeout %s: must not be negative", name, d)
+		}
+	}
+	return nil
+}
+
+func orDefault(d, fallback time.Duration) time.Duration {
+	if d == 0 {
+		return fallback
+	}
+	return d
+}
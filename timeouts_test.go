@@ -0,0 +1,73 @@
+package vrata
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimeoutsDefaults(t *testing.T) {
+	var zero Timeouts
+	if zero.dial() != defaultDialTimeout || zero.register() != defaultRegisterTimeout ||
+		zero.localDial() != defaultLocalDialTimeout || zero.idle() != defaultIdleTimeout ||
+		zero.maintenance() != maintenanceInterval {
+		t.Errorf("Expected defaults for zero timeouts")
+	}
+
+	set := Timeouts{Dial: time.Second, Register: 2 * time.Second, LocalDial: 3 * time.Second, Idle: 4 * time.Second, Maintenance: 5 * time.Second}
+	if set.dial() != time.Second || set.register() != 2*time.Second || set.localDial() != 3*time.Second ||
+		set.idle() != 4*time.Second || set.maintenance() != 5*time.Second {
+		t.Errorf("Expected the set timeouts, got %+v", set)
+	}
+
+	if never := (Timeouts{Idle: -1}); never.idle() != 0 {
+		t.Errorf("Expected a negative idle timeout to disable it, got %s", never.idle())
+	}
+}
+
+func TestTimeoutsValidate(t *testing.T) {
+	if err := (Timeouts{Idle: -1}).validate(); err != nil {
+		t.Errorf("Negative idle timeout must be allowed: %v", err)
+	}
+	if _, err := NewTunnel(8080, &TunnelOptions{Timeouts: Timeouts{Request: -time.Second}}); err == nil {
+		t.Error("Expected an error for a negative request timeout")
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	relay := newMockRelay(t, 1)
+
+	handling := make(chan struct{}, 1)
+	release := make(chan struct{})
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handling <- struct{}{}
+		<-release
+	}))
+	defer local.Close()
+	defer close(release)
+
+	tunnel, err := ConnectAndOpen(local.Listener.Addr().(*net.TCPAddr).Port, &TunnelOptions{
+		Host:      relay.server.URL,
+		LocalHost: "127.0.0.1",
+		Timeouts:  Timeouts{Request: 100 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	conn := startSlowRequest(t, relay, handling)
+	defer conn.Close()
+
+	// The visitor is cut off instead of waiting for the local server
+	start := time.Now()
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("Expected the relay connection to be closed, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Request ran for %s", elapsed)
+	}
+}
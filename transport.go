@@ -0,0 +1,262 @@
+package vrata
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// localAddress returns the host:port of the local server
+func (o *TunnelOptions) localAddress() string {
+	host := o.LocalHost
+	if host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(o.Port))
+}
+
+// needsLocal reports whether requests reach a local server, rather than
+// being answered from a cassette or stubs
+func (o *TunnelOptions) needsLocal() bool {
+	return o.ReplayFile == "" && len(o.Stubs) == 0
+}
+
+// localPollInterval is how often waitForLocal tries the local port
+var localPollInterval = 250 * time.Millisecond
+
+// waitForLocal polls the local port until it accepts connections, for up
+// to WaitForLocal
+func (o *TunnelOptions) waitForLocal(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, o.WaitForLocal)
+	defer cancel()
+
+	ticker := time.NewTicker(localPollInterval)
+	defer ticker.Stop()
+	for {
+		if conn, err := o.dial(ctx, "tcp", o.localAddress()); err == nil {
+			conn.Close()
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("%w on %s after %s", ErrLocalNotListening, o.localAddress(), o.WaitForLocal)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// localTLSConfig returns the TLS settings used to reach a local HTTPS
+// server. ServerName is left empty for the dialed host unless
+// LocalServerName overrides it.
+func (o *TunnelOptions) localTLSConfig() *tls.Config {
+	config := &tls.Config{
+		InsecureSkipVerify: true, // For local development
+		ServerName:         o.LocalServerName,
+	}
+	if o.LocalClientCert != nil {
+		config.Certificates = []tls.Certificate{*o.LocalClientCert}
+	}
+	return config
+}
+
+// DialFunc opens a connection like net.Dialer.DialContext
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// dial opens a connection with Dial, or directly when it isn't set
+func (o *TunnelOptions) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if o.Dial != nil {
+		return o.Dial(ctx, network, address)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, address)
+}
+
+// localProtocols returns the protocols offered to a local HTTPS server
+// through ALPN, none meaning HTTP/1.1
+func (o *TunnelOptions) localProtocols() []string {
+	if o.LocalHTTP2 {
+		return []string{"h2", "http/1.1"}
+	}
+	return nil
+}
+
+// dialLocal connects to a local server address, over TLS when LocalHTTPS
+// is set, offering protocols through ALPN
+func (o *TunnelOptions) dialLocal(ctx context.Context, address string, protocols ...string) (net.Conn, error) {
+	conn, err := o.dial(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	o.TCP.apply(conn)
+	if !o.LocalHTTPS {
+		return conn, nil
+	}
+
+	config := o.localTLSConfig()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(address)
+	}
+	config.NextProtos = protocols
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// localTransport is the http.RoundTripper returned by LocalTransport
+type localTransport struct {
+	options   *TunnelOptions
+	transport *http.Transport
+}
+
+// LocalTransport returns an http.RoundTripper that delivers requests to
+// the local server exactly as tunneled traffic is delivered: the request
+// goes to LocalHost:Port whatever its URL says, its Host header is
+// rewritten the same way, and LocalHTTPS selects the same TLS settings,
+// HTTP/2 included with LocalHTTP2. Only the path and query of request URLs
+// are used.
+func LocalTransport(options *TunnelOptions) http.RoundTripper {
+	opts := *options
+
+	return &localTransport{
+		options: &opts,
+		transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				conn, err := opts.dial(ctx, "tcp", opts.localAddress())
+				if err == nil {
+					opts.TCP.apply(conn)
+				}
+				return conn, err
+			},
+			TLSClientConfig:     opts.localTLSConfig(),
+			ForceAttemptHTTP2:   opts.LocalHTTP2,
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+func (lt *localTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	local := req.Clone(req.Context())
+
+	local.URL.Scheme = "http"
+	if lt.options.LocalHTTPS {
+		local.URL.Scheme = "https"
+	}
+	local.URL.Host = lt.options.localAddress()
+	lt.options.rewriteLocalRequest(local, lt.options.hostHeader(local.URL.Host))
+
+	return lt.transport.RoundTrip(local)
+}
+
+// CloseIdleConnections closes kept-alive connections to the local server
+func (lt *localTransport) CloseIdleConnections() {
+	lt.transport.CloseIdleConnections()
+}
+
+// rewriteLocalRequest applies the header rewriting tunneled requests go
+// through before they reach the local server, with host as the Host
+// unless it's empty
+func (o *TunnelOptions) rewriteLocalRequest(req *http.Request, host string) {
+	if host != "" {
+		req.Host = host
+	}
+	for _, name := range o.StripHeaders {
+		req.Header.Del(name)
+	}
+	for name, values := range o.RequestHeaders {
+		if http.CanonicalHeaderKey(name) != "Host" {
+			req.Header[http.CanonicalHeaderKey(name)] = slices.Clone(values)
+		}
+	}
+}
+
+// HostHeaderMode selects the Host forwarded requests carry
+type HostHeaderMode int
+
+const (
+	// HostLocal rewrites Host to the local server's address, or to the
+	// Host entry of RequestHeaders (default)
+	HostLocal HostHeaderMode = iota
+	// HostPreserve keeps the public host visitors asked for, which
+	// virtual-host routers and OAuth callbacks may need
+	HostPreserve
+	// HostCustom sets Host to HostHeader
+	HostCustom
+)
+
+// validateHostHeader rejects a custom Host that is missing or can't
+// appear in a request head
+func (o *TunnelOptions) validateHostHeader() error {
+	if o.HostHeaderMode != HostCustom {
+		return nil
+	}
+	if o.HostHeader == "" {
+		return fmt.Errorf("%w: custom Host is empty", ErrInvalidHeader)
+	}
+	return validateHeaders(http.Header{"Host": {o.HostHeader}})
+}
+
+// hostHeader returns the Host tunneled requests to the local server at
+// address are rewritten to, or "" when they keep their own
+func (o *TunnelOptions) hostHeader(address string) string {
+	switch o.HostHeaderMode {
+	case HostPreserve:
+		return ""
+	case HostCustom:
+		return o.HostHeader
+	}
+	if host := o.RequestHeaders.Get("Host"); host != "" {
+		return host
+	}
+	return address
+}
+
+// headerTransformer returns the transformer applied to requests tunneled
+// to the local server at address
+func (o *TunnelOptions) headerTransformer(address string) *HeaderHostTransformer {
+	transformer := NewHeaderHostTransformer(o.hostHeader(address))
+	headers := canonicalHeaders(o.RequestHeaders)
+	var lines bytes.Buffer
+	writeHeaderLines(&lines, headers)
+	transformer.lines = lines.Bytes()
+	for name := range headers {
+		if name != "Host" {
+			transformer.drop = append(transformer.drop, name)
+		}
+	}
+	transformer.drop = append(transformer.drop, o.StripHeaders...)
+	return transformer
+}
+
+// validateHeaders rejects header names and values that would break, or
+// smuggle lines into, a request head
+func validateHeaders(header http.Header) error {
+	for name, values := range header {
+		if name == "" || strings.ContainsFunc(name, func(r rune) bool {
+			return r <= ' ' || r >= 0x7f || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", r)
+		}) {
+			return fmt.Errorf("%w: name %q", ErrInvalidHeader, name)
+		}
+		for _, value := range values {
+			if strings.ContainsAny(value, "\r\n\x00") {
+				return fmt.Errorf("%w: value of %s", ErrInvalidHeader, name)
+			}
+		}
+	}
+	return nil
+}
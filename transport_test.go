@@ -0,0 +1,324 @@
+package vrata
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLocalTransport(t *testing.T) {
+	var gotHost, gotURI string
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHost, gotURI = r.Host, r.RequestURI
+		io.WriteString(w, "local")
+	}))
+	defer local.Close()
+	port := local.Listener.Addr().(*net.TCPAddr).Port
+
+	client := &http.Client{Transport: LocalTransport(&TunnelOptions{Port: port, LocalHost: "127.0.0.1"})}
+	resp, err := client.Get("https://public.example/hook?x=1")
+	if err != nil {
+		t.Fatalf("Get() failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "local" {
+		t.Errorf("Expected local server response, got %q", body)
+	}
+	if want := local.Listener.Addr().String(); gotHost != want {
+		t.Errorf("Expected Host %q, got %q", want, gotHost)
+	}
+	if gotURI != "/hook?x=1" {
+		t.Errorf("Expected path and query to be kept, got %q", gotURI)
+	}
+}
+
+func TestLocalTransportHTTPS(t *testing.T) {
+	local := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			t.Error("Expected a TLS request")
+		}
+	}))
+	defer local.Close()
+	port := local.Listener.Addr().(*net.TCPAddr).Port
+
+	transport := LocalTransport(&TunnelOptions{Port: port, LocalHost: "127.0.0.1", LocalHTTPS: true})
+	req, _ := http.NewRequest("GET", "http://public.example/", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200, got %d", resp.StatusCode)
+	}
+	if req.URL.Host != "public.example" {
+		t.Error("RoundTrip must not modify the caller's request")
+	}
+}
+
+func TestTunnelLocalClientCert(t *testing.T) {
+	local := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.Organization[0])
+	}))
+	local.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	local.StartTLS()
+	defer local.Close()
+	port := local.Listener.Addr().(*net.TCPAddr).Port
+	// The server's own certificate will do as the client's
+	cert := local.TLS.Certificates[0]
+
+	relay := newMockRelay(t, 1)
+	tunnel, err := ConnectAndOpen(port, &TunnelOptions{
+		Host:            relay.server.URL,
+		LocalHost:       "127.0.0.1",
+		LocalHTTPS:      true,
+		LocalClientCert: &cert,
+	})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	resp := relay.roundTrip(t, "GET / HTTP/1.1\r\nHost: public.example\r\nConnection: close\r\n\r\n")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "Acme Co" {
+		t.Errorf("Got %d %q, want 200 and the test certificate's organization", resp.StatusCode, body)
+	}
+
+	// LocalTransport presents it too
+	transport := LocalTransport(&TunnelOptions{Port: port, LocalHost: "127.0.0.1", LocalHTTPS: true, LocalClientCert: &cert})
+	req, _ := http.NewRequest("GET", "http://public.example/", nil)
+	resp, err = transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("LocalTransport: expected 200, got %d", resp.StatusCode)
+	}
+
+	if _, err := NewTunnel(port, &TunnelOptions{LocalClientCert: &cert}); err == nil {
+		t.Error("Expected an error for a client certificate without LocalHTTPS")
+	}
+}
+
+func TestTunnelLocalServerName(t *testing.T) {
+	local := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.ServerName)
+	}))
+	defer local.Close()
+	port := local.Listener.Addr().(*net.TCPAddr).Port
+
+	// IPs aren't sent as server names, so the local server sees none by
+	// default
+	for _, name := range []string{"", "app.internal"} {
+		t.Run("name="+name, func(t *testing.T) {
+			relay := newMockRelay(t, 1)
+			tunnel, err := ConnectAndOpen(port, &TunnelOptions{
+				Host:            relay.server.URL,
+				LocalHost:       "127.0.0.1",
+				LocalHTTPS:      true,
+				LocalServerName: name,
+			})
+			if err != nil {
+				t.Fatalf("ConnectAndOpen() failed: %v", err)
+			}
+			defer tunnel.Close()
+
+			resp := relay.roundTrip(t, "GET / HTTP/1.1\r\nHost: public.example\r\nConnection: close\r\n\r\n")
+			if body, _ := io.ReadAll(resp.Body); string(body) != name {
+				t.Errorf("Local server saw server name %q, want %q", body, name)
+			}
+		})
+	}
+
+	// LocalTransport sends it too
+	transport := LocalTransport(&TunnelOptions{Port: port, LocalHost: "127.0.0.1", LocalHTTPS: true, LocalServerName: "app.internal"})
+	req, _ := http.NewRequest("GET", "http://public.example/", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "app.internal" {
+		t.Errorf("LocalTransport: server name = %q, want app.internal", body)
+	}
+
+	if _, err := NewTunnel(port, &TunnelOptions{LocalServerName: "app.internal"}); err == nil {
+		t.Error("Expected an error for a server name without LocalHTTPS")
+	}
+}
+
+func TestWaitForLocal(t *testing.T) {
+	defer func(interval time.Duration) { localPollInterval = interval }(localPollInterval)
+	localPollInterval = 10 * time.Millisecond
+
+	port := closedPort(t)
+	options := &TunnelOptions{Port: port, LocalHost: "127.0.0.1", WaitForLocal: 50 * time.Millisecond}
+	if err := options.waitForLocal(context.Background()); !errors.Is(err, ErrLocalNotListening) {
+		t.Fatalf("Expected ErrLocalNotListening, got %v", err)
+	}
+
+	// The app comes up while the tunnel waits
+	options.WaitForLocal = 2 * time.Second
+	listening := make(chan net.Listener, 1)
+	time.AfterFunc(50*time.Millisecond, func() {
+		listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err != nil {
+			t.Errorf("Failed to listen on %d: %v", port, err)
+		}
+		listening <- listener
+	})
+	if err := options.waitForLocal(context.Background()); err != nil {
+		t.Errorf("Expected the wait to end once the port listens, got %v", err)
+	}
+	if listener := <-listening; listener != nil {
+		listener.Close()
+	}
+}
+
+func TestCustomDial(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "local")
+	}))
+	defer local.Close()
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"id": "abc", "url": "https://abc.example", "port": 1, "max_conn_count": 1}`)
+	}))
+	defer relay.Close()
+
+	// Names that only resolve through the custom dial
+	routes := map[string]string{
+		"app.internal:80":   local.Listener.Addr().String(),
+		"relay.internal:80": relay.Listener.Addr().String(),
+	}
+	var mutex sync.Mutex
+	var dialed []string
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		mutex.Lock()
+		dialed = append(dialed, address)
+		mutex.Unlock()
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, routes[address])
+	}
+
+	options := &TunnelOptions{Port: 80, LocalHost: "app.internal", Dial: dial}
+	client := &http.Client{Transport: LocalTransport(options)}
+	resp, err := client.Get("http://public.example/")
+	if err != nil {
+		t.Fatalf("Get() failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "local" {
+		t.Errorf("Expected local server response, got %q", body)
+	}
+
+	tunnel, err := NewTunnel(80, &TunnelOptions{Host: "http://relay.internal", Dial: dial})
+	if err != nil {
+		t.Fatalf("NewTunnel() failed: %v", err)
+	}
+	defer tunnel.Close()
+	if _, err := tunnel.register(tunnel.ctx); err != nil {
+		t.Fatalf("register() failed: %v", err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(dialed) != 2 || dialed[0] != "app.internal:80" || dialed[1] != "relay.internal:80" {
+		t.Errorf("Expected both dials through the custom dial, got %v", dialed)
+	}
+}
+
+func TestHostHeaderModes(t *testing.T) {
+	tests := []struct {
+		name    string
+		options TunnelOptions
+		want    string
+	}{
+		{"local", TunnelOptions{}, "localhost:8080"},
+		{"local with configured Host", TunnelOptions{RequestHeaders: http.Header{"Host": {"app.test"}}}, "app.test"},
+		{"preserve", TunnelOptions{HostHeaderMode: HostPreserve}, "abc123.loca.lt"},
+		{"preserve ignores configured Host", TunnelOptions{
+			HostHeaderMode: HostPreserve,
+			RequestHeaders: http.Header{"Host": {"app.test"}},
+		}, "abc123.loca.lt"},
+		{"custom", TunnelOptions{HostHeaderMode: HostCustom, HostHeader: "app.test"}, "app.test"},
+	}
+
+	const head = "GET / HTTP/1.1\r\nHost: abc123.loca.lt\r\nAccept: */*\r\n\r\n"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			tt.options.headerTransformer("localhost:8080").rewriteHead([]byte(head), &out)
+			rewritten := out.String()
+			req, err := http.ReadRequest(bufio.NewReader(&out))
+			if err != nil {
+				t.Fatalf("Rewritten head %q doesn't parse: %v", rewritten, err)
+			}
+			if req.Host != tt.want || strings.Count(rewritten, "Host:") != 1 {
+				t.Errorf("Raw: head = %q, want a single Host %s", rewritten, tt.want)
+			}
+
+			req, _ = http.ReadRequest(bufio.NewReader(strings.NewReader(head)))
+			tt.options.rewriteLocalRequest(req, tt.options.hostHeader("localhost:8080"))
+			if req.Host != tt.want {
+				t.Errorf("Parsed: Host = %q, want %q", req.Host, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTunnelRejectsBadHostHeader(t *testing.T) {
+	for _, host := range []string{"", "app.test\r\nX-Injected: 1"} {
+		_, err := NewTunnel(8080, &TunnelOptions{HostHeaderMode: HostCustom, HostHeader: host})
+		if !errors.Is(err, ErrInvalidHeader) {
+			t.Errorf("Host %q: expected ErrInvalidHeader, got %v", host, err)
+		}
+	}
+}
+
+func TestTunnelPreservesHost(t *testing.T) {
+	for name, mode := range map[string]ProxyMode{"raw": ProxyRaw, "structured": ProxyStructured} {
+		t.Run(name, func(t *testing.T) {
+			relay := newMockRelay(t, 1)
+			hosts := make(chan string, 1)
+			local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hosts <- r.Host
+			}))
+			defer local.Close()
+
+			tunnel, err := ConnectAndOpen(local.Listener.Addr().(*net.TCPAddr).Port, &TunnelOptions{
+				Host:           relay.server.URL,
+				LocalHost:      "127.0.0.1",
+				ProxyMode:      mode,
+				HostHeaderMode: HostPreserve,
+			})
+			if err != nil {
+				t.Fatalf("ConnectAndOpen() failed: %v", err)
+			}
+			defer tunnel.Close()
+
+			resp := relay.roundTrip(t, "GET / HTTP/1.1\r\nHost: abc123.loca.lt\r\nConnection: close\r\n\r\n")
+			resp.Body.Close()
+			if host := <-hosts; host != "abc123.loca.lt" {
+				t.Errorf("Local server got Host %q, want abc123.loca.lt", host)
+			}
+		})
+	}
+}
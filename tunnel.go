@@ -1,15 +1,20 @@
 package vrata
 
 import (
-	"bufio"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"maps"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os/exec"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -17,11 +22,305 @@ import (
 
 // TunnelOptions holds configuration for creating a tunnel
 type TunnelOptions struct {
-	Port       int
-	Host       string
+	Port int
+	Host string
+	// Subdomain is the requested subdomain. A comma-separated list such as
+	// "myapp,myapp2" is tried in order while the relay says they are taken.
 	Subdomain  string
 	LocalHost  string
 	LocalHTTPS bool
+	// LocalClientCert is presented to local HTTPS servers that require
+	// mutual TLS, e.g. Kubernetes API proxies. It needs LocalHTTPS.
+	LocalClientCert *tls.Certificate
+	// LocalServerName is sent as the TLS server name (SNI) to local HTTPS
+	// servers instead of the dialed host, e.g. when LocalHost is an IP or
+	// a port-forward whose certificate names another host. It needs
+	// LocalHTTPS.
+	LocalServerName string
+	// LocalHTTP2 speaks HTTP/2 to local servers that support it, e.g. gRPC
+	// servers: cleartext (h2c) servers are detected once per address, and
+	// HTTPS ones through ALPN. Others, and upgraded requests such as
+	// WebSockets, keep HTTP/1.1.
+	LocalHTTP2 bool
+
+	// LocalTargets, when set, are host:port addresses visitor connections
+	// are spread over instead of LocalHost:Port, e.g. several instances of
+	// a service under load testing. Every request on a kept-alive
+	// connection goes to the same target, and Host is rewritten to it.
+	LocalTargets []string
+	// Balance selects how LocalTargets share visitor connections
+	Balance BalanceStrategy
+	// Sticky keeps visitors on the LocalTargets that first served them,
+	// for local apps that keep session state in memory
+	Sticky StickyMode
+	// LocalFallback, when set, is a host:port address that takes visitor
+	// connections whenever LocalHost:Port or their target can't be
+	// reached. Failing over and back fires Failover events.
+	LocalFallback string
+
+	// RestartGrace, when set, holds visitors for up to this long while the
+	// local server refuses connections, e.g. while a file watcher such as
+	// air or nodemon rebuilds it, and forwards them once it is back. The
+	// restart is logged once instead of failing every visitor.
+	RestartGrace time.Duration
+
+	// SubdomainSuffix appends a random token to Subdomain (myapp-x7k2) so
+	// the requested name is unlikely to collide with other clients
+	SubdomainSuffix bool
+	// SubdomainRetries, when every requested subdomain is taken, tries
+	// the first one with numeric suffixes (myapp-2, myapp-3, ...) up to
+	// this many times instead of failing
+	SubdomainRetries int
+
+	// Token, when set, is sent on registration as a bearer token, for
+	// relays that reserve subdomains to accounts
+	Token string
+	// ReservationFile, when set, keeps Token and the subdomain granted to
+	// each port per relay, so later tunnels without a Token or Subdomain
+	// send the same token and reclaim the same subdomain. It falls back to
+	// a random subdomain when the reserved one is taken.
+	ReservationFile string
+
+	// RegistrationHeaders are sent with the registration request, e.g.
+	// the credentials of a gateway such as Cloudflare Access in front of
+	// the relay. A Token replaces their Authorization.
+	RegistrationHeaders http.Header
+	// RegistrationClient sends the registration request, e.g. through a
+	// proxy or with custom TLS roots; defaults to a client with a 10s
+	// timeout
+	RegistrationClient *http.Client
+	// RelayTLS secures registration and data connections with a relay
+	// that authenticates clients with certificates, e.g. one loaded by
+	// LoadRelayTLS. Data connections, plain TCP with localtunnel.me, use
+	// TLS too when it's set. A RegistrationClient isn't changed.
+	RelayTLS *tls.Config
+	// Proxy routes registration and data connections to the relay through
+	// an http://, https:// or socks5:// proxy, e.g. an SSH dynamic forward.
+	// By default HTTPS_PROXY, HTTP_PROXY and NO_PROXY decide.
+	Proxy string
+	// Dial, when set, opens every connection to the relay, a proxy or the
+	// local server, e.g. to pin an interface or in tests
+	Dial DialFunc
+
+	// RecordFile, when set, records every proxied request and the local
+	// server's response to a cassette file as each exchange completes.
+	// Bodies are recorded up to 1 MiB.
+	RecordFile string
+
+	// ReplayFile, when set, answers requests from a previously recorded
+	// cassette instead of forwarding them to the local server
+	ReplayFile string
+
+	// Stubs, when set, answer requests with canned responses instead of
+	// forwarding them to the local server, e.g. to give a webhook
+	// provider a fake endpoint. Requests no stub matches get a 404.
+	Stubs []Stub
+
+	// E2EKey, when set, encrypts traffic end to end with this
+	// E2EKeySize-byte key: the tunnel only answers requests sealed by the
+	// viewer NewE2EViewer returns, so the relay never sees plaintext.
+	// Bodies are buffered, and upgrades aren't supported.
+	E2EKey []byte
+
+	// MaxConcurrentRequests limits how many visitors are forwarded to the
+	// local server at once; excess visitors wait in a FIFO queue. Zero
+	// means unlimited.
+	MaxConcurrentRequests int
+
+	// MaxRequestsPerClient caps concurrent requests from a single client
+	// address so one client can't monopolize the queue. Zero means no cap.
+	MaxRequestsPerClient int
+
+	// MaxConnections caps the connection pool below the relay's
+	// max_conn_count. Zero means use what the relay allows.
+	MaxConnections int
+
+	// MinConnections makes the pool autoscale: it starts with this many
+	// connections and dials more, up to MaxConnections, while they're
+	// busy, dropping them again once they idle. Zero keeps the whole
+	// pool open.
+	MinConnections int
+
+	// Timeouts bounds dialing, registering, idle data connections and
+	// serving visitors
+	Timeouts Timeouts
+
+	// TCP tunes the sockets of relay and local connections: keepalives,
+	// Nagle's algorithm and buffer sizes
+	TCP TCPOptions
+
+	// Lazy opens a single data connection and dials another as soon as
+	// every open one is busy, for long-lived tunnels that see little
+	// traffic. It's MinConnections 1 unless that's set.
+	Lazy bool
+
+	// BandwidthLimit caps the combined traffic to and from the local
+	// server in bytes per second. Zero means unlimited.
+	BandwidthLimit int64
+
+	// MaxCaptureBytes bounds the memory used to buffer traffic copies for
+	// request monitoring across all connections. Monitoring of a
+	// connection is abandoned when the budget runs out. Zero means only
+	// the per-connection limit applies.
+	MaxCaptureBytes int64
+
+	// Labels are attached to the tunnel's metrics and logs, e.g. to
+	// attribute resource usage to a tenant
+	Labels map[string]string
+
+	// WaitForLocal makes Open poll the local port until something listens
+	// on it, for up to this long, before registering with the relay, so the
+	// tunnel can start before the app does. Zero means don't wait.
+	WaitForLocal time.Duration
+
+	// RegisterRetries is how many times Open retries registering with the
+	// relay after network errors and 5xx or 429 responses. Waits start at
+	// RegisterBackoff (default 1s) and double, with jitter, up to 30s.
+	// Zero means fail on the first error.
+	RegisterRetries int
+	RegisterBackoff time.Duration
+
+	// ReregisterAfter is how long the tunnel may fail to redial every data
+	// connection before it registers again, as when the relay expired it.
+	// The URL may change; see TunnelEvents.URLChanged. Zero means one
+	// minute, a negative value never registers again.
+	ReregisterAfter time.Duration
+
+	// OnThrottle selects how the tunnel reacts when the relay throttles
+	// its data connections (429 responses, immediate resets). The default
+	// shrinks the pool and backs off.
+	OnThrottle ThrottleBehavior
+
+	// RequestHeaders are set on every forwarded request, replacing any
+	// values the visitor sent. A Host entry replaces the local address in
+	// the Host rewrite.
+	RequestHeaders http.Header
+
+	// HostHeaderMode selects the Host of forwarded requests: the local
+	// address (default), the public host visitors asked for, or
+	// HostHeader
+	HostHeaderMode HostHeaderMode
+	// HostHeader is the Host sent with HostCustom
+	HostHeader string
+
+	// ResponseHeaders are set on every response sent back to visitors,
+	// replacing any values the local server set, e.g. CORS headers
+	ResponseHeaders http.Header
+
+	// StripHeaders are removed from forwarded requests, so cookies or
+	// credentials meant for the public site never reach the local server
+	StripHeaders []string
+
+	// ForwardedHeaders selects whether the X-Forwarded-* headers of
+	// forwarded requests are trusted as they come, replaced with what the
+	// relay and the tunnel URL tell, or stripped. RequestHeaders and
+	// StripHeaders still apply to them.
+	ForwardedHeaders ForwardedMode
+
+	// RedactHeaders have their values replaced with [REDACTED] in
+	// everything vrata captures: request events, the event stream, access
+	// logs and recorded cassettes. Forwarded traffic is not changed.
+	RedactHeaders []string
+
+	// RequestInterceptors and ResponseInterceptors run, in order, on every
+	// request and response passing through the tunnel, after the access
+	// checks and header options. With interceptors, requests on a
+	// connection are parsed and forwarded one at a time, and every one
+	// gets its Host rewritten.
+	RequestInterceptors  []RequestInterceptor
+	ResponseInterceptors []ResponseInterceptor
+
+	// RewriteLocalURLs replaces links to the local server, such as
+	// http://localhost:8080, with the tunnel URL in text response bodies
+	// and Location headers, before the ResponseInterceptors run. It
+	// forwards requests the way interceptors do.
+	RewriteLocalURLs bool
+
+	// ProxyMode selects how requests are forwarded: ProxyRaw copies bytes,
+	// ProxyStructured parses every request and forwards it through an
+	// httputil.ReverseProxy, which Middleware can wrap. Recording needs
+	// ProxyRaw.
+	ProxyMode ProxyMode
+	// Middleware wraps the forwarding of every request in ProxyStructured
+	// mode, the first outermost; it sees requests after the access checks
+	// and header options
+	Middleware []Middleware
+	// ProxyRetries is how many times ProxyStructured mode retries GET,
+	// HEAD, OPTIONS and TRACE requests the local server couldn't be reached
+	// for or dropped
+	ProxyRetries int
+
+	// ErrorPage is the HTML sent with 502 Bad Gateway to visitors when the
+	// local server can't be reached. It is an html/template executed with
+	// .Port and .Address of the local server and the dial .Error. Empty
+	// means a built-in page saying no app is running on the port.
+	ErrorPage string
+
+	// HealthCheck, when set, probes the local server periodically. Health
+	// changes fire Health events, and WhenUnhealthy can keep visitors away
+	// from an unhealthy server.
+	HealthCheck *HealthCheck
+
+	// AccessLog, when set, receives one Apache combined format line per
+	// proxied request, with the duration in microseconds appended
+	AccessLog io.Writer
+
+	// AllowIPs, when not empty, admits only clients in these prefixes;
+	// DenyIPs blocks clients in these prefixes even if allowed. Blocked
+	// clients get 403 before reaching the local server.
+	AllowIPs []netip.Prefix
+	DenyIPs  []netip.Prefix
+
+	// GeoIP resolves client countries for AllowCountries and
+	// DenyCountries, lists of ISO 3166 codes that work like AllowIPs and
+	// DenyIPs. Clients of unknown country are blocked by an allow list.
+	GeoIP          *GeoIPDB
+	AllowCountries []string
+	DenyCountries  []string
+
+	// AllowPaths and DenyPaths work like AllowIPs and DenyIPs on request
+	// paths, with path.Match patterns; a trailing /* matches a whole
+	// subtree, so "/admin/*" covers /admin and everything below it
+	AllowPaths []string
+	DenyPaths  []string
+
+	// BasicAuth, when set, requires visitors to send these credentials;
+	// other requests are answered with 401 before reaching the local
+	// server
+	BasicAuth *BasicAuth
+
+	// JWTAuth, when set, requires visitors to send a valid bearer token;
+	// other requests are answered with 401
+	JWTAuth *JWTAuth
+
+	// OIDCAuth, when set, sends visitors through an OpenID Connect login
+	// before their requests are forwarded
+	OIDCAuth *OIDCAuth
+
+	// ShareLinks, when set, only admits visitors holding an unexpired link
+	// it signed; others get 403
+	ShareLinks *ShareLinks
+
+	// Logger receives connection lifecycle, reconnect and proxy error
+	// logs. Nothing is logged when nil.
+	Logger *slog.Logger
+}
+
+// logger returns the configured logger, tagged with the tunnel's labels,
+// or one that discards everything
+func (o *TunnelOptions) logger() *slog.Logger {
+	if o.Logger == nil {
+		return slog.New(slog.DiscardHandler)
+	}
+	if len(o.Labels) == 0 {
+		return o.Logger
+	}
+
+	attrs := make([]any, 0, len(o.Labels))
+	for _, key := range slices.Sorted(maps.Keys(o.Labels)) {
+		attrs = append(attrs, slog.String(key, o.Labels[key]))
+	}
+	return o.Logger.With(slog.Group("labels", attrs...))
 }
 
 // TunnelInfo represents the server response for tunnel creation
@@ -30,6 +329,21 @@ type TunnelInfo struct {
 	URL     string `json:"url"`
 	Port    int    `json:"port"`
 	MaxConn int    `json:"max_conn_count"`
+
+	// Features lists capabilities advertised by the relay, if it supports
+	// capability negotiation
+	Features []string `json:"features,omitempty"`
+
+	// RegisteredAt is when the relay accepted the registration
+	RegisteredAt time.Time `json:"-"`
+	// RTT is the observed round trip time to the relay, smoothed over
+	// data connection handshakes. Until a data connection is made it is
+	// the duration of the registration request.
+	RTT time.Duration `json:"-"`
+
+	// Subdomain is the requested subdomain the relay granted, one of the
+	// fallbacks when earlier ones were taken; empty when none was requested
+	Subdomain string `json:"-"`
 }
 
 // RequestInfo contains information about proxied requests
@@ -37,26 +351,82 @@ type RequestInfo struct {
 	Method string
 	Path   string
 	URL    string
+
+	// RemoteAddr is the visitor address reported by the tunnel server
+	RemoteAddr string
+	// Header holds the request headers as forwarded to the local server
+	Header http.Header
+
+	StatusCode     int
+	ResponseHeader http.Header
+	Duration       time.Duration
+
+	// BytesIn and BytesOut count the request and response sizes on the
+	// wire, including headers
+	BytesIn  int64
+	BytesOut int64
+
+	start time.Time
+	proto string
 }
 
 // TunnelEvents provides channels for tunnel events
 type TunnelEvents struct {
-	URL     chan string
-	Error   chan error
+	URL   chan string
+	Error chan error
+	// Request fires when a request is forwarded to the local server, or
+	// answered from a cassette or stubs; response fields are not yet
+	// populated
 	Request chan RequestInfo
-	Close   chan struct{}
+	// Response fires when the response has been sent back and carries
+	// the complete exchange
+	Response chan RequestInfo
+	// Throttled fires when the relay throttles the tunnel
+	Throttled chan ThrottleInfo
+	// Health fires when the local server passes or fails its HealthCheck
+	// after doing the opposite
+	Health chan HealthInfo
+	// Failover fires when visitors are sent to LocalFallback because a
+	// local address is down, and when it is back
+	Failover chan FailoverInfo
+	// Ready fires once the first data connection to the relay is up, so
+	// visitors of the URL reach the tunnel
+	Ready chan struct{}
+	// State fires when the tunnel moves to another TunnelState
+	State chan StateChange
+	// URLChanged fires when the tunnel registered again, after the relay
+	// dropped it, and got another URL
+	URLChanged chan URLChange
+	// Reconnect fires when a data connection is redialed after it
+	// dropped, so flapping connections can be spotted
+	Reconnect chan ReconnectInfo
+	Close     chan struct{}
 }
 
 // Tunnel represents a localtunnel connection
 type Tunnel struct {
 	options *TunnelOptions
-	info    *TunnelInfo
-	events  *TunnelEvents
-	cluster *TunnelCluster
-	ctx     context.Context
-	cancel  context.CancelFunc
-	closed  bool
-	mutex   sync.RWMutex
+	// subdomains are the requested subdomains, in order of preference;
+	// reclaim is set when they come from the ReservationFile
+	subdomains []string
+	reclaim    bool
+	info       *TunnelInfo
+	events     *TunnelEvents
+	cluster    *TunnelCluster
+	logger     *slog.Logger
+	stream     *EventStream
+	opened     time.Time
+	registered chan struct{} // closed once the URL is known
+	connected  chan struct{} // closed once traffic can flow
+	ctx        context.Context
+	cancel     context.CancelFunc
+	closed     bool
+	fatal      error // why the tunnel closed itself, reported by Wait
+	state      TunnelState
+	mutex      sync.RWMutex
+
+	// reregistration registers again when reconnecting takes too long
+	reregistration *time.Timer
 }
 
 // NewTunnel creates a new tunnel instance
@@ -73,75 +443,228 @@ func NewTunnel(port int, options *TunnelOptions) (*Tunnel, error) {
 		options.LocalHost = "localhost"
 	}
 
+	reclaim, err := options.applyReservation()
+	if err != nil {
+		return nil, err
+	}
+	// A reclaimed subdomain was suffixed when it was first granted
+	subdomains, err := parseSubdomains(options.Subdomain, options.SubdomainSuffix && !reclaim)
+	if err != nil {
+		return nil, err
+	}
+	if options.SubdomainRetries < 0 {
+		return nil, fmt.Errorf("invalid subdomain retries %d: must not be negative", options.SubdomainRetries)
+	}
+	if len(subdomains) > 0 {
+		options.Subdomain = subdomains[0]
+		// A reclaimed subdomain falls back to a random one instead
+		if !reclaim {
+			for _, numbered := range numberedSubdomains(subdomains[0], options.SubdomainRetries) {
+				if !slices.Contains(subdomains, numbered) {
+					subdomains = append(subdomains, numbered)
+				}
+			}
+		}
+	}
+
+	// Silently skipping country rules would expose the tunnel
+	if options.GeoIP == nil && (len(options.AllowCountries) > 0 || len(options.DenyCountries) > 0) {
+		return nil, ErrNoGeoIP
+	}
+	if err := validatePathPatterns(options.AllowPaths, options.DenyPaths); err != nil {
+		return nil, err
+	}
+	if options.MaxConnections < 0 {
+		return nil, fmt.Errorf("invalid max connections %d: must not be negative", options.MaxConnections)
+	}
+	if err := options.Timeouts.validate(); err != nil {
+		return nil, err
+	}
+	if err := options.TCP.validate(); err != nil {
+		return nil, err
+	}
+	if options.MinConnections < 0 || (options.MaxConnections > 0 && options.MinConnections > options.MaxConnections) {
+		return nil, fmt.Errorf("invalid min connections %d: must be between 0 and max connections", options.MinConnections)
+	}
+	if _, err := parseProxy(options.Proxy); err != nil {
+		return nil, err
+	}
+	if err := validateHeaders(options.RegistrationHeaders); err != nil {
+		return nil, err
+	}
+	if err := validateHeaders(options.RequestHeaders); err != nil {
+		return nil, err
+	}
+	if err := validateHeaders(options.ResponseHeaders); err != nil {
+		return nil, err
+	}
+	if err := options.validateHostHeader(); err != nil {
+		return nil, err
+	}
+	if options.LocalClientCert != nil && !options.LocalHTTPS {
+		return nil, errors.New("a local client certificate needs LocalHTTPS")
+	}
+	if options.LocalServerName != "" && !options.LocalHTTPS {
+		return nil, errors.New("a local server name needs LocalHTTPS")
+	}
+	if _, err := options.parseErrorPage(); err != nil {
+		return nil, err
+	}
+	if err := validateStubs(options.Stubs); err != nil {
+		return nil, err
+	}
+	if options.E2EKey != nil {
+		if len(options.E2EKey) != E2EKeySize {
+			return nil, ErrBadE2EKey
+		}
+		if options.ReplayFile != "" || options.RecordFile != "" || len(options.Stubs) > 0 {
+			return nil, errors.New("end-to-end encryption cannot be used with recording, replay or stubs")
+		}
+	}
+	if err := validateTargets(options.LocalTargets); err != nil {
+		return nil, err
+	}
+	if err := options.validateProxyMode(); err != nil {
+		return nil, err
+	}
+	if options.LocalFallback != "" {
+		if err := validateTargets([]string{options.LocalFallback}); err != nil {
+			return nil, err
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	events := &TunnelEvents{
-		URL:     make(chan string, 1),
-		Error:   make(chan error, 10),
-		Request: make(chan RequestInfo, 100),
-		Close:   make(chan struct{}, 1),
+		URL:        make(chan string, 1),
+		Error:      make(chan error, 10),
+		Request:    make(chan RequestInfo, 100),
+		Response:   make(chan RequestInfo, 100),
+		Throttled:  make(chan ThrottleInfo, 10),
+		Health:     make(chan HealthInfo, 10),
+		Failover:   make(chan FailoverInfo, 10),
+		Ready:      make(chan struct{}, 1),
+		State:      make(chan StateChange, 10),
+		URLChanged: make(chan URLChange, 1),
+		Reconnect:  make(chan ReconnectInfo, 10),
+		Close:      make(chan struct{}, 1),
 	}
 
 	return &Tunnel{
-		options: options,
-		events:  events,
-		ctx:     ctx,
-		cancel:  cancel,
+		options:    options,
+		subdomains: subdomains,
+		reclaim:    reclaim,
+		events:     events,
+		logger:     options.logger(),
+		stream:     newEventStream(),
+		registered: make(chan struct{}),
+		connected:  make(chan struct{}),
+		ctx:        ctx,
+		cancel:     cancel,
 	}, nil
 }
 
 // Open establishes the tunnel connection
 func (t *Tunnel) Open() error {
+	return t.OpenContext(context.Background())
+}
+
+// OpenContext establishes the tunnel connection. ctx bounds waiting for
+// the local server, registration and the start of the connection pool;
+// once OpenContext returns, the tunnel stays open until Close.
+func (t *Tunnel) OpenContext(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(t.ctx, cancel)
+	defer stop()
+
+	if t.options.WaitForLocal > 0 && t.options.needsLocal() {
+		t.logger.Debug("waiting for the local server", "address", t.options.localAddress())
+		if err := t.options.waitForLocal(ctx); err != nil {
+			if ctx.Err() != nil {
+				return t.openError(ctx)
+			}
+			return err
+		}
+	}
+
 	// Register with the localtunnel server
-	info, err := t.requestTunnel()
+	t.logger.Debug("registering tunnel", "host", t.options.Host, "subdomain", t.options.Subdomain)
+	t.setState(StateRegistering)
+	info, err := t.register(ctx)
 	if err != nil {
+		t.logger.Error("tunnel registration failed", "error", err)
+		t.setState(StateCreated)
 		return fmt.Errorf("failed to request tunnel: %w", err)
 	}
 
+	t.mutex.Lock()
 	t.info = info
+	t.mutex.Unlock()
+	t.logger.Info("tunnel registered", "id", info.ID, "url", info.URL, "max_conn", info.MaxConn)
+	if err := t.options.saveReservation(info.ID); err != nil {
+		t.logger.Warn("failed to save the subdomain reservation", "file", t.options.ReservationFile, "error", err)
+	}
 
 	// Create the tunnel cluster for connection management
-	cluster, err := NewTunnelCluster(t.info, t.options, t.events)
+	cluster, err := t.newCluster(info)
 	if err != nil {
-		return fmt.Errorf("failed to create tunnel cluster: %w", err)
+		t.setState(StateCreated)
+		return err
 	}
 
+	t.mutex.Lock()
 	t.cluster = cluster
+	t.opened = time.Now()
+	select {
+	case <-t.registered:
+	default:
+		close(t.registered)
+	}
+	t.mutex.Unlock()
 
-	// Start the cluster
-	go func() {
-		if err := t.cluster.Start(t.ctx); err != nil {
-			select {
-			case t.events.Error <- err:
-			case <-t.ctx.Done():
-			}
-		}
-	}()
+	publishExpvar(t)
+	t.startCluster(cluster)
 
 	// Send the URL event
+	t.stream.publish("url", map[string]string{"url": t.info.URL})
 	select {
 	case t.events.URL <- t.info.URL:
-	case <-t.ctx.Done():
-		return t.ctx.Err()
+	case <-ctx.Done():
+		return t.openError(ctx)
 	}
 
 	return nil
 }
 
-// Close shuts down the tunnel
+// Close shuts down the tunnel. It returns once the connection pool's
+// goroutines, visitors being served included, have stopped.
 func (t *Tunnel) Close() error {
 	t.mutex.Lock()
-	defer t.mutex.Unlock()
-
 	if t.closed {
+		t.mutex.Unlock()
 		return nil
 	}
 
 	t.closed = true
 	t.cancel()
-
-	if t.cluster != nil {
-		t.cluster.Close()
+	unpublishExpvar(t)
+	if t.reregistration != nil {
+		t.reregistration.Stop()
+		t.reregistration = nil
+	}
+	if from := t.state; from != StateClosed {
+		t.state = StateClosed
+		t.stateChanged(StateChange{From: from, To: StateClosed, At: time.Now()})
+	}
+	t.stream.publish("close", struct{}{})
+	t.logger.Info("tunnel closed")
+	cluster := t.cluster
+	t.mutex.Unlock()
+
+	// The pool's goroutines may take the tunnel's lock on their way out
+	if cluster != nil {
+		cluster.Close()
 	}
 
 	select {
@@ -152,16 +675,129 @@ func (t *Tunnel) Close() error {
 	return nil
 }
 
-// URL returns the tunnel URL (blocking until available)
+// newCluster creates the connection pool for a registration, wired to the
+// tunnel's events
+func (t *Tunnel) newCluster(info *TunnelInfo) (*TunnelCluster, error) {
+	cluster, err := NewTunnelCluster(info, t.options, t.events)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tunnel cluster: %w", err)
+	}
+
+	cluster.stream = t.stream
+	cluster.stop = func() {
+		select {
+		case t.events.Error <- ErrThrottled:
+		default:
+		}
+		t.fail(ErrThrottled)
+	}
+	cluster.ready = t.markConnected
+	cluster.state = t.setState
+	return cluster, nil
+}
+
+// startCluster starts the connection pool in the background; a pool that
+// can't start closes the tunnel
+func (t *Tunnel) startCluster(cluster *TunnelCluster) {
+	go func() {
+		if err := cluster.Start(t.ctx); err != nil {
+			t.logger.Error("failed to start connection pool", "error", err)
+			cluster.lastError.store(err)
+			t.stream.publish("error", map[string]string{"error": err.Error()})
+			select {
+			case t.events.Error <- err:
+			case <-t.ctx.Done():
+			}
+			t.fail(err)
+		}
+	}()
+}
+
+// markConnected announces that the first data connection is up
+func (t *Tunnel) markConnected() {
+	select {
+	case <-t.connected:
+		return // a new registration's pool came up
+	default:
+	}
+	close(t.connected)
+	t.logger.Info("tunnel ready")
+	t.stream.publish("ready", struct{}{})
+	select {
+	case t.events.Ready <- struct{}{}:
+	default:
+	}
+}
+
+// Ready returns a channel that's closed once the first data connection
+// to the relay is up. Until then, the URL is registered but visitors get
+// an error from the relay.
+func (t *Tunnel) Ready() <-chan struct{} {
+	return t.connected
+}
+
+// fail records why the tunnel can't go on and closes it
+func (t *Tunnel) fail(err error) {
+	t.mutex.Lock()
+	if !t.closed && t.fatal == nil {
+		t.fatal = err
+	}
+	t.mutex.Unlock()
+	t.Close()
+}
+
+// Done returns a channel that's closed when the tunnel closes
+func (t *Tunnel) Done() <-chan struct{} {
+	return t.ctx.Done()
+}
+
+// Wait blocks until the tunnel closes. It returns nil when the tunnel was
+// closed by Close or its context, or the error that made it close itself,
+// such as ErrThrottled.
+func (t *Tunnel) Wait() error {
+	<-t.ctx.Done()
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.fatal
+}
+
+// closedError explains an operation cut short by Close or the context
+func (t *Tunnel) closedError() error {
+	return fmt.Errorf("%w: %w", ErrTunnelClosed, t.ctx.Err())
+}
+
+// openError explains why an open bounded by ctx stopped: the tunnel was
+// closed, or the caller's ctx ended first
+func (t *Tunnel) openError(ctx context.Context) error {
+	if t.ctx.Err() != nil {
+		return t.closedError()
+	}
+	return ctx.Err()
+}
+
+// URL returns the tunnel URL, blocking until Open registers the tunnel.
+// It can be called any number of times.
 func (t *Tunnel) URL() (string, error) {
+	return t.URLContext(context.Background())
+}
+
+// URLContext returns the tunnel URL, waiting until Open registers the
+// tunnel or ctx is done
+func (t *Tunnel) URLContext(ctx context.Context) (string, error) {
 	select {
-	case url := <-t.events.URL:
-		return url, nil
-	case err := <-t.events.Error:
-		return "", err
+	case <-t.registered:
 	case <-t.ctx.Done():
-		return "", t.ctx.Err()
+	case <-ctx.Done():
+		return "", ctx.Err()
 	}
+	if t.ctx.Err() != nil {
+		return "", t.closedError()
+	}
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.info.URL, nil
 }
 
 // Events returns the events channels
@@ -169,8 +805,80 @@ func (t *Tunnel) Events() *TunnelEvents {
 	return t.events
 }
 
+// Info returns what is known about the current relay session: the
+// registration response, when it happened and the observed round trip
+// time. It returns nil before the tunnel is opened.
+func (t *Tunnel) Info() *TunnelInfo {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if t.info == nil {
+		return nil
+	}
+
+	info := *t.info
+	info.Features = slices.Clone(t.info.Features)
+	if t.cluster != nil {
+		if rtt := t.cluster.rtt.Load(); rtt > 0 {
+			info.RTT = time.Duration(rtt)
+		}
+	}
+	return &info
+}
+
+// Subdomain returns the subdomain visitors use, the first label of the
+// tunnel URL's host, or an empty string before the tunnel is opened
+func (t *Tunnel) Subdomain() string {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if t.info == nil {
+		return ""
+	}
+	if u, err := url.Parse(t.info.URL); err == nil && u.Hostname() != "" {
+		label, _, _ := strings.Cut(u.Hostname(), ".")
+		return label
+	}
+	return t.info.ID
+}
+
+// MaxConnections returns how many data connections the relay allows, or
+// 0 before the tunnel is opened
+func (t *Tunnel) MaxConnections() int {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if t.info == nil {
+		return 0
+	}
+	return t.info.MaxConn
+}
+
+// DataPort returns the relay port data connections are made to, or 0
+// before the tunnel is opened
+func (t *Tunnel) DataPort() int {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if t.info == nil {
+		return 0
+	}
+	return t.info.Port
+}
+
+// QueueStats returns admission queue counters for the running tunnel
+func (t *Tunnel) QueueStats() QueueStats {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if t.cluster == nil {
+		return QueueStats{}
+	}
+	return t.cluster.queue.Stats()
+}
+
 // requestTunnel makes an HTTP request to get tunnel info from the server
-func (t *Tunnel) requestTunnel() (*TunnelInfo, error) {
+func (t *Tunnel) requestTunnel(ctx context.Context) (*TunnelInfo, error) {
 	reqURL := t.options.Host
 	if t.options.Subdomain != "" {
 		reqURL += "/" + t.options.Subdomain
@@ -185,28 +893,63 @@ func (t *Tunnel) requestTunnel() (*TunnelInfo, error) {
 		reqURL += "?new="
 	}
 
-	client := &http.Client{
-		Timeout: 10 * time.Second,
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	setHeaders(req.Header, t.options.RegistrationHeaders)
+	if t.options.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.options.Token)
 	}
 
-	resp, err := client.Get(reqURL)
+	start := time.Now()
+	resp, err := t.options.registrationClient().Do(req)
 	if err != nil {
-		return nil, err
+		if ctx.Err() != nil {
+			return nil, t.openError(ctx)
+		}
+		return nil, fmt.Errorf("%w: %w", ErrServerUnavailable, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("server responded with status %d", resp.StatusCode)
+		return nil, parseServerError(resp)
 	}
 
 	var info TunnelInfo
 	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
 		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
+	info.RegisteredAt = time.Now()
+	info.RTT = info.RegisteredAt.Sub(start)
 
 	return &info, nil
 }
 
+func (o *TunnelOptions) registrationClient() *http.Client {
+	if o.RegistrationClient != nil {
+		return o.RegistrationClient
+	}
+	client := &http.Client{Timeout: o.Timeouts.register()}
+	proxy, _ := parseProxy(o.Proxy)
+	if proxy == nil && o.Dial == nil && o.RelayTLS == nil {
+		return client
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if o.Dial != nil {
+		transport.DialContext = o.Dial
+	}
+	if o.RelayTLS != nil {
+		transport.TLSClientConfig = o.RelayTLS.Clone()
+	}
+	client.Transport = transport
+	return client
+}
+
 // OpenURL opens a URL in the default browser
 func OpenURL(url string) error {
 	var cmd string
@@ -224,45 +967,3 @@ func OpenURL(url string) error {
 	args = append(args, url)
 	return exec.Command(cmd, args...).Start()
 }
-
-// HeaderHostTransformer modifies HTTP headers to use localhost
-type HeaderHostTransformer struct {
-	host string
-}
-
-// NewHeaderHostTransformer creates a new header transformer
-func NewHeaderHostTransformer(host string) *HeaderHostTransformer {
-	return &HeaderHostTransformer{host: host}
-}
-
-// Transform modifies the request headers
-func (h *HeaderHostTransformer) Transform(reader io.Reader, writer io.Writer) error {
-	scanner := bufio.NewScanner(reader)
-
-	// Read and transform the first line (HTTP request line)
-	if !scanner.Scan() {
-		return scanner.Err()
-	}
-
-	firstLine := scanner.Text()
-	fmt.Fprintf(writer, "%s\r\n", firstLine)
-
-	// Read and transform headers
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
-			fmt.Fprintf(writer, "\r\n")
-			break
-		}
-
-		if strings.HasPrefix(strings.ToLower(line), "host:") {
-			fmt.Fprintf(writer, "Host: %s\r\n", h.host)
-		} else {
-			fmt.Fprintf(writer, "%s\r\n", line)
-		}
-	}
-
-	// Copy the rest of the body
-	_, err := io.Copy(writer, reader)
-	return err
-}
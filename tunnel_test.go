@@ -1,9 +1,17 @@
 package vrata
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -150,7 +158,7 @@ func TestRequestTunnelMockServer(t *testing.T) {
 	}
 
 	// Test requestTunnel
-	info, err := tunnel.requestTunnel()
+	info, err := tunnel.requestTunnel(tunnel.ctx)
 	if err != nil {
 		t.Fatalf("requestTunnel() failed: %v", err)
 	}
@@ -198,7 +206,7 @@ func TestRequestTunnelWithSubdomain(t *testing.T) {
 		t.Fatalf("NewTunnel() failed: %v", err)
 	}
 
-	info, err := tunnel.requestTunnel()
+	info, err := tunnel.requestTunnel(tunnel.ctx)
 	if err != nil {
 		t.Fatalf("requestTunnel() failed: %v", err)
 	}
@@ -225,7 +233,7 @@ func TestTunnelTimeout(t *testing.T) {
 	}
 
 	// This should timeout
-	_, err = tunnel.requestTunnel()
+	_, err = tunnel.requestTunnel(tunnel.ctx)
 	if err == nil {
 		t.Error("Expected timeout error, got nil")
 	}
@@ -264,12 +272,547 @@ func TestTunnelWithContext(t *testing.T) {
 	}
 }
 
-func TestHeaderHostTransformer(t *testing.T) {
-	transformer := NewHeaderHostTransformer("localhost:8080")
-	if transformer == nil {
-		t.Fatal("NewHeaderHostTransformer() returned nil")
+func TestNewTunnelRejectsInvalidHeaders(t *testing.T) {
+	for _, header := range []http.Header{
+		{"X-Bad\r\nInjected": {"1"}},
+		{"X Space": {"1"}},
+		{"X-Value": {"ok\r\nInjected: 1"}},
+	} {
+		if _, err := NewTunnel(8080, &TunnelOptions{RequestHeaders: header}); !errors.Is(err, ErrInvalidHeader) {
+			t.Errorf("Header %q: expected ErrInvalidHeader, got %v", header, err)
+		}
+	}
+}
+
+func TestNewTunnelRejectsNegativeMaxConnections(t *testing.T) {
+	if _, err := NewTunnel(8080, &TunnelOptions{MaxConnections: -1}); err == nil {
+		t.Error("Expected an error for a negative pool size")
+	}
+}
+
+func TestTunnelRequestHeaders(t *testing.T) {
+	relay := newMockRelay(t, 1)
+
+	seen := make(chan string, 2)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Get("X-Tunnel")
+	}))
+	defer local.Close()
+	localPort := local.Listener.Addr().(*net.TCPAddr).Port
+
+	tunnel, err := ConnectAndOpen(localPort, &TunnelOptions{
+		Host:           relay.server.URL,
+		LocalHost:      "127.0.0.1",
+		RequestHeaders: http.Header{"X-Tunnel": {"vrata"}},
+	})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	var conn net.Conn
+	select {
+	case conn = <-relay.conns:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Tunnel client never connected to the relay")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	// Both requests on the kept-alive connection get the header
+	for i, forged := range []string{"", "X-Tunnel: forged\r\n"} {
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: public.example\r\n"+forged+"\r\n")
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Request %d: failed to read response: %v", i, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		if got := <-seen; got != "vrata" {
+			t.Errorf("Request %d: local server saw X-Tunnel %q, want vrata", i, got)
+		}
+	}
+}
+
+func TestTunnelKeepAliveRewritesEveryRequest(t *testing.T) {
+	relay := newMockRelay(t, 1)
+
+	seen := make(chan string, 3)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		seen <- r.Host + " " + string(body)
+	}))
+	defer local.Close()
+	localPort := local.Listener.Addr().(*net.TCPAddr).Port
+
+	tunnel, err := ConnectAndOpen(localPort, &TunnelOptions{Host: relay.server.URL, LocalHost: "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	conn := <-relay.conns
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	want := fmt.Sprintf("127.0.0.1:%d", localPort)
+	for i, body := range []string{"", "one", "two"} {
+		fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: public.example\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Request %d: failed to read response: %v", i, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		if got := <-seen; got != want+" "+body {
+			t.Errorf("Request %d: local server saw %q, want %q", i, got, want+" "+body)
+		}
+	}
+
+	// Every exchange on the connection is counted
+	waitFor(t, func() bool { return tunnel.Stats().Requests == 3 })
+}
+
+// echoUpgradeHandler switches every request to a protocol echoing back
+// what it reads
+func echoUpgradeHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			t.Errorf("Local server got Upgrade %q, want websocket", r.Header.Get("Upgrade"))
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Hijack() failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	})
+}
+
+// openWebSocket sends a WebSocket handshake from the relay side and returns
+// the reader for what follows the 101 response
+func openWebSocket(t *testing.T, conn net.Conn) *bufio.Reader {
+	t.Helper()
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: public.example\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read handshake response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Handshake status = %d, want 101", resp.StatusCode)
+	}
+	return reader
+}
+
+func TestTunnelWebSocket(t *testing.T) {
+	tests := []struct {
+		name    string
+		options TunnelOptions
+	}{
+		{"plain", TunnelOptions{}},
+		{"response headers", TunnelOptions{ResponseHeaders: http.Header{"X-Tunnel": {"1"}}}},
+		{"interceptors", TunnelOptions{RewriteLocalURLs: true}},
+		{"request timeout", TunnelOptions{Timeouts: Timeouts{Request: 100 * time.Millisecond}}},
+		{"structured", TunnelOptions{ProxyMode: ProxyStructured, Timeouts: Timeouts{Request: 100 * time.Millisecond}}},
 	}
-	if transformer.host != "localhost:8080" {
-		t.Errorf("Expected host 'localhost:8080', got '%s'", transformer.host)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := newMockRelay(t, 1)
+			local := httptest.NewServer(echoUpgradeHandler(t))
+			defer local.Close()
+
+			options := tt.options
+			options.Host = relay.server.URL
+			options.LocalHost = "127.0.0.1"
+			tunnel, err := ConnectAndOpen(local.Listener.Addr().(*net.TCPAddr).Port, &options)
+			if err != nil {
+				t.Fatalf("ConnectAndOpen() failed: %v", err)
+			}
+			defer tunnel.Close()
+
+			conn := <-relay.conns
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			reader := openWebSocket(t, conn)
+
+			// Frames flow both ways, even ones that look like HTTP, and
+			// outlive the request timeout
+			for _, frame := range []string{"hello", "GET / HTTP/1.1\r\n\r\n", "world"} {
+				io.WriteString(conn, frame)
+				got := make([]byte, len(frame))
+				if _, err := io.ReadFull(reader, got); err != nil {
+					t.Fatalf("Failed to read echo of %q: %v", frame, err)
+				}
+				if string(got) != frame {
+					t.Errorf("Echo = %q, want %q", got, frame)
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestTunnelEventStream(t *testing.T) {
+	upper := func(resp *http.Response, body []byte) ([]byte, error) {
+		return bytes.ToUpper(body), nil
+	}
+
+	tests := []struct {
+		name    string
+		options TunnelOptions
+	}{
+		{"plain", TunnelOptions{}},
+		{"response headers", TunnelOptions{ResponseHeaders: http.Header{"X-Tunnel": {"1"}}}},
+		{"interceptors", TunnelOptions{
+			RewriteLocalURLs:     true,
+			ResponseInterceptors: []ResponseInterceptor{RewriteBodies(upper, "text/*")},
+		}},
+		{"request timeout", TunnelOptions{Timeouts: Timeouts{Request: 100 * time.Millisecond}}},
+		{"structured", TunnelOptions{
+			ProxyMode:            ProxyStructured,
+			Timeouts:             Timeouts{Request: 100 * time.Millisecond},
+			ResponseInterceptors: []ResponseInterceptor{RewriteBodies(upper, "text/*")},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := newMockRelay(t, 1)
+
+			// Each event is sent once the previous one has been received
+			next, done := make(chan struct{}), make(chan struct{})
+			local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				for i := range 3 {
+					fmt.Fprintf(w, "data: event %d\n\n", i)
+					w.(http.Flusher).Flush()
+					select {
+					case <-next:
+					case <-done:
+						return
+					}
+				}
+			}))
+			defer local.Close()
+			defer close(done)
+
+			options := tt.options
+			options.Host = relay.server.URL
+			options.LocalHost = "127.0.0.1"
+			tunnel, err := ConnectAndOpen(local.Listener.Addr().(*net.TCPAddr).Port, &options)
+			if err != nil {
+				t.Fatalf("ConnectAndOpen() failed: %v", err)
+			}
+			defer tunnel.Close()
+
+			conn := <-relay.conns
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			io.WriteString(conn, "GET /events HTTP/1.1\r\nHost: public.example\r\nAccept: text/event-stream\r\n\r\n")
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			defer resp.Body.Close()
+
+			// Events arrive one by one, and keep coming past the request
+			// timeout
+			events := bufio.NewReader(resp.Body)
+			for i := range 3 {
+				line, err := events.ReadString('\n')
+				if err != nil {
+					t.Fatalf("Failed to read event %d: %v", i, err)
+				}
+				if want := fmt.Sprintf("data: event %d\n", i); line != want {
+					t.Errorf("Event %d = %q, want %q", i, line, want)
+				}
+				events.ReadString('\n')
+				time.Sleep(50 * time.Millisecond)
+				next <- struct{}{}
+			}
+		})
+	}
+}
+
+func TestTunnelSlowChunkedResponse(t *testing.T) {
+	relay := newMockRelay(t, 1)
+
+	next, done := make(chan struct{}), make(chan struct{})
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, part := range []string{"first ", "second ", "third"} {
+			io.WriteString(w, part)
+			w.(http.Flusher).Flush()
+			select {
+			case <-next:
+			case <-done:
+				return
+			}
+		}
+	}))
+	defer local.Close()
+	defer close(done)
+
+	tunnel, err := ConnectAndOpen(local.Listener.Addr().(*net.TCPAddr).Port, &TunnelOptions{
+		Host:            relay.server.URL,
+		LocalHost:       "127.0.0.1",
+		ResponseHeaders: http.Header{"X-Tunnel": {"1"}},
+	})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	conn := <-relay.conns
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	io.WriteString(conn, "GET /download HTTP/1.1\r\nHost: public.example\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	defer resp.Body.Close()
+	if len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Fatalf("Transfer-Encoding = %v, want chunked", resp.TransferEncoding)
+	}
+
+	// Each part is forwarded before the local server writes the next
+	for _, want := range []string{"first ", "second ", "third"} {
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(resp.Body, got); err != nil {
+			t.Fatalf("Failed to read %q: %v", want, err)
+		}
+		if string(got) != want {
+			t.Errorf("Got %q, want %q", got, want)
+		}
+		next <- struct{}{}
+	}
+}
+
+func TestTunnelHalfClose(t *testing.T) {
+	const chunks, chunkSize = 64, 16 << 10
+	slowHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := bytes.Repeat([]byte("x"), chunkSize)
+		for range chunks {
+			w.Write(chunk)
+			w.(http.Flusher).Flush()
+			time.Sleep(2 * time.Millisecond)
+		}
+	})
+
+	tests := []struct {
+		name    string
+		server  func(http.Handler) *httptest.Server
+		options TunnelOptions
+	}{
+		{"plain", httptest.NewServer, TunnelOptions{}},
+		{"response headers", httptest.NewServer, TunnelOptions{ResponseHeaders: http.Header{"X-Tunnel": {"1"}}}},
+		{"interceptors", httptest.NewServer, TunnelOptions{RewriteLocalURLs: true}},
+		{"http2", newH2CServer, TunnelOptions{LocalHTTP2: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := newMockRelay(t, 1)
+			local := tt.server(slowHandler)
+			defer local.Close()
+
+			options := tt.options
+			options.Host = relay.server.URL
+			options.LocalHost = "127.0.0.1"
+			tunnel, err := ConnectAndOpen(local.Listener.Addr().(*net.TCPAddr).Port, &options)
+			if err != nil {
+				t.Fatalf("ConnectAndOpen() failed: %v", err)
+			}
+			defer tunnel.Close()
+
+			conn := <-relay.conns
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			// The visitor sends its request and half-closes, like the relay
+			// does when a visitor is done sending
+			io.WriteString(conn, "GET /download HTTP/1.1\r\nHost: public.example\r\n\r\n")
+			if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+				t.Fatalf("CloseWrite() failed: %v", err)
+			}
+
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			defer resp.Body.Close()
+			n, err := io.Copy(io.Discard, resp.Body)
+			if err != nil || n != chunks*chunkSize {
+				t.Errorf("Read %d bytes, %v; want %d", n, err, chunks*chunkSize)
+			}
+		})
+	}
+}
+
+func TestTunnelLogger(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"logged","url":"https://logged.localtunnel.me","port":1,"max_conn_count":1}`))
+	}))
+	defer server.Close()
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	tunnel, err := ConnectAndOpen(8080, &TunnelOptions{Host: server.URL, Logger: logger})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	tunnel.Close()
+
+	output := logs.String()
+	for _, want := range []string{"tunnel registered", "id=logged", "tunnel closed"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected logs to contain %q, got:\n%s", want, output)
+		}
+	}
+}
+
+func TestOpenContextDeadline(t *testing.T) {
+	release := make(chan struct{})
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer relay.Close()
+	defer close(release)
+
+	tunnel, err := NewTunnel(8080, &TunnelOptions{Host: relay.URL})
+	if err != nil {
+		t.Fatalf("NewTunnel() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	err = tunnel.OpenContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if errors.Is(err, ErrTunnelClosed) {
+		t.Error("A caller deadline isn't a closed tunnel")
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("OpenContext took %s past its deadline", elapsed)
+	}
+}
+
+func TestURLIsIdempotent(t *testing.T) {
+	relay := newMockRelay(t, 1)
+	tunnel, err := NewTunnel(8080, &TunnelOptions{Host: relay.server.URL})
+	if err != nil {
+		t.Fatalf("NewTunnel() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	// Nothing to return before Open
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := tunnel.URLContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded before Open, got %v", err)
+	}
+
+	if err := tunnel.Open(); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		url, err := tunnel.URL()
+		if err != nil || url != "http://127.0.0.1" {
+			t.Fatalf("URL() call %d = %q, %v", i+1, url, err)
+		}
+	}
+	// The URL event is still there for event consumers
+	select {
+	case url := <-tunnel.Events().URL:
+		if url != "http://127.0.0.1" {
+			t.Errorf("Unexpected URL event %q", url)
+		}
+	default:
+		t.Error("URL() consumed the URL event")
+	}
+}
+
+func TestWaitUntilClosed(t *testing.T) {
+	relay := newMockRelay(t, 1)
+	tunnel, err := ConnectAndOpen(8080, &TunnelOptions{Host: relay.server.URL})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+
+	waited := make(chan error, 1)
+	go func() { waited <- tunnel.Wait() }()
+	select {
+	case <-tunnel.Done():
+		t.Fatal("Done before Close")
+	case <-waited:
+		t.Fatal("Wait returned before Close")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	tunnel.Close()
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Errorf("Expected nil after Close, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Wait didn't return after Close")
+	}
+	<-tunnel.Done()
+}
+
+func TestReadyAfterFirstConnection(t *testing.T) {
+	relay := newMockRelay(t, 1)
+	tunnel, err := ConnectAndOpen(8080, &TunnelOptions{Host: relay.server.URL})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	select {
+	case <-tunnel.Ready():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Ready never closed")
+	}
+	select {
+	case <-tunnel.Events().Ready:
+	default:
+		t.Error("No Ready event")
+	}
+}
+
+func TestNotReadyWithoutConnection(t *testing.T) {
+	port := closedPort(t)
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id":"down","url":"http://127.0.0.1","port":%d,"max_conn_count":1}`, port)
+	}))
+	defer relay.Close()
+
+	tunnel, err := ConnectAndOpen(8080, &TunnelOptions{Host: relay.URL})
+	if err != nil {
+		t.Fatalf("ConnectAndOpen() failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	if _, err := tunnel.URL(); err != nil {
+		t.Fatalf("URL() failed: %v", err)
+	}
+	select {
+	case <-tunnel.Ready():
+		t.Error("Ready although no data connection was made")
+	case <-time.After(200 * time.Millisecond):
 	}
 }
@@ -0,0 +1,78 @@
+package vrata
+
+// Event is emitted by a tunnel. The concrete types are RequestEvent,
+// ResponseEvent, ErrorEvent, ThrottledEvent, HealthEvent, FailoverEvent,
+// ReadyEvent, StateChangeEvent, URLChangedEvent, ReconnectEvent and
+// ClosedEvent.
+type Event interface {
+	event()
+}
+
+// RequestEvent fires when a request is forwarded to the local server
+type RequestEvent struct {
+	RequestInfo
+}
+
+// ResponseEvent fires when the local server finishes responding
+type ResponseEvent struct {
+	RequestInfo
+}
+
+// ErrorEvent reports a non-fatal tunnel error
+type ErrorEvent struct {
+	Err error
+}
+
+// ThrottledEvent reports that the relay is throttling the tunnel
+type ThrottledEvent struct {
+	ThrottleInfo
+}
+
+// HealthEvent reports that the local server passed or failed its health
+// check after doing the opposite
+type HealthEvent struct {
+	HealthInfo
+}
+
+// FailoverEvent reports that visitors were sent to the fallback because a
+// local address is down, or back to it
+type FailoverEvent struct {
+	FailoverInfo
+}
+
+// ReadyEvent fires once the first data connection to the relay is up, so
+// visitors of the URL get through
+type ReadyEvent struct{}
+
+// StateChangeEvent reports that the connection to the relay moved to
+// another TunnelState, e.g. degraded or reconnecting
+type StateChangeEvent struct {
+	StateChange
+}
+
+// URLChangedEvent reports that the relay dropped the tunnel and it was
+// registered again under another URL
+type URLChangedEvent struct {
+	URLChange
+}
+
+// ReconnectEvent reports that a data connection was redialed after it
+// dropped
+type ReconnectEvent struct {
+	ReconnectInfo
+}
+
+// ClosedEvent is the last event of a tunnel
+type ClosedEvent struct{}
+
+func (RequestEvent) event()     {}
+func (ResponseEvent) event()    {}
+func (ErrorEvent) event()       {}
+func (ThrottledEvent) event()   {}
+func (HealthEvent) event()      {}
+func (FailoverEvent) event()    {}
+func (ReadyEvent) event()       {}
+func (StateChangeEvent) event() {}
+func (URLChangedEvent) event()  {}
+func (ReconnectEvent) event()   {}
+func (ClosedEvent) event()      {}
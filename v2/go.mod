@@ -0,0 +1,7 @@
+module github.com/korya/vrata/v2
+
+go 1.24.3
+
+require github.com/korya/vrata v1.1.0
+
+replace github.com/korya/vrata => ../
@@ -0,0 +1,444 @@
+package vrata
+
+import (
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	v1 "github.com/korya/vrata"
+)
+
+// Option configures a tunnel
+type Option func(*v1.TunnelOptions)
+
+// WithHost sets the tunnel server URL (default https://localtunnel.me)
+func WithHost(host string) Option {
+	return func(o *v1.TunnelOptions) { o.Host = host }
+}
+
+// WithSubdomain requests a specific subdomain
+func WithSubdomain(subdomain string) Option {
+	return func(o *v1.TunnelOptions) { o.Subdomain = subdomain }
+}
+
+// WithSubdomains requests the first of these subdomains the relay hasn't
+// given to another client; Info().Subdomain tells which one was granted
+func WithSubdomains(subdomains ...string) Option {
+	return func(o *v1.TunnelOptions) { o.Subdomain = strings.Join(subdomains, ",") }
+}
+
+// WithToken sends an account token on registration, for relays that
+// reserve subdomains to accounts
+func WithToken(token string) Option {
+	return func(o *v1.TunnelOptions) { o.Token = token }
+}
+
+// WithReservationFile remembers the token and the granted subdomain in
+// path, so later tunnels reclaim the same subdomain
+func WithReservationFile(path string) Option {
+	return func(o *v1.TunnelOptions) { o.ReservationFile = path }
+}
+
+// WithRandomSuffix appends a random token to the requested subdomain
+func WithRandomSuffix() Option {
+	return func(o *v1.TunnelOptions) { o.SubdomainSuffix = true }
+}
+
+// WithSubdomainRetries tries the requested subdomain with numeric
+// suffixes (myapp-2, myapp-3, ...) up to n times when it is taken
+func WithSubdomainRetries(n int) Option {
+	return func(o *v1.TunnelOptions) { o.SubdomainRetries = n }
+}
+
+// WithLocalHost forwards traffic to a host other than localhost
+func WithLocalHost(host string) Option {
+	return func(o *v1.TunnelOptions) { o.LocalHost = host }
+}
+
+// WithLocalHTTPS connects to the local server over TLS
+func WithLocalHTTPS() Option {
+	return func(o *v1.TunnelOptions) { o.LocalHTTPS = true }
+}
+
+// WithLocalClientCert connects to the local server over TLS, presenting
+// cert to servers that require mutual TLS
+func WithLocalClientCert(cert tls.Certificate) Option {
+	return func(o *v1.TunnelOptions) {
+		o.LocalHTTPS = true
+		o.LocalClientCert = &cert
+	}
+}
+
+// WithLocalServerName connects to the local server over TLS, sending name
+// as the server name instead of the dialed host
+func WithLocalServerName(name string) Option {
+	return func(o *v1.TunnelOptions) {
+		o.LocalHTTPS = true
+		o.LocalServerName = name
+	}
+}
+
+// WithLocalHTTP2 speaks HTTP/2 to local servers that support it, cleartext
+// or over TLS
+func WithLocalHTTP2() Option {
+	return func(o *v1.TunnelOptions) { o.LocalHTTP2 = true }
+}
+
+// WithLocalTargets spreads visitor connections over these host:port
+// addresses instead of the local port
+func WithLocalTargets(addresses ...string) Option {
+	return func(o *v1.TunnelOptions) { o.LocalTargets = append(o.LocalTargets, addresses...) }
+}
+
+// WithBalance selects how local targets share visitor connections
+func WithBalance(strategy BalanceStrategy) Option {
+	return func(o *v1.TunnelOptions) { o.Balance = strategy }
+}
+
+// WithSticky keeps visitors on the local target that first served them
+func WithSticky(mode StickyMode) Option {
+	return func(o *v1.TunnelOptions) { o.Sticky = mode }
+}
+
+// WithFallback sends visitors to a host:port address while the local
+// server can't be reached
+func WithFallback(address string) Option {
+	return func(o *v1.TunnelOptions) { o.LocalFallback = address }
+}
+
+// WithRegisterRetries retries failed registrations with the relay, waiting
+// backoff before the first retry and doubling it, with jitter, up to 30s
+func WithRegisterRetries(retries int, backoff time.Duration) Option {
+	return func(o *v1.TunnelOptions) {
+		o.RegisterRetries = retries
+		o.RegisterBackoff = backoff
+	}
+}
+
+// WithRestartGrace holds visitors for up to grace while the local server
+// refuses connections, so restarts don't fail them
+func WithRestartGrace(grace time.Duration) Option {
+	return func(o *v1.TunnelOptions) { o.RestartGrace = grace }
+}
+
+// WithRecord records proxied traffic to a cassette file
+func WithRecord(path string) Option {
+	return func(o *v1.TunnelOptions) { o.RecordFile = path }
+}
+
+// WithReplay answers requests from a cassette file instead of the local
+// server
+func WithReplay(path string) Option {
+	return func(o *v1.TunnelOptions) { o.ReplayFile = path }
+}
+
+// WithStubs answers requests with canned responses instead of forwarding
+// them to the local server
+func WithStubs(stubs ...Stub) Option {
+	return func(o *v1.TunnelOptions) { o.Stubs = append(o.Stubs, stubs...) }
+}
+
+// WithE2E encrypts traffic end to end with key, so the relay never sees
+// it: the tunnel only answers requests sealed by NewE2EViewer
+func WithE2E(key []byte) Option {
+	return func(o *v1.TunnelOptions) { o.E2EKey = key }
+}
+
+// WithMaxConcurrentRequests queues visitors beyond n concurrent requests
+func WithMaxConcurrentRequests(n int) Option {
+	return func(o *v1.TunnelOptions) { o.MaxConcurrentRequests = n }
+}
+
+// WithMaxRequestsPerClient caps concurrent requests from one client
+func WithMaxRequestsPerClient(n int) Option {
+	return func(o *v1.TunnelOptions) { o.MaxRequestsPerClient = n }
+}
+
+// WithLogger sets the logger used for connection lifecycle and proxy errors
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *v1.TunnelOptions) { o.Logger = logger }
+}
+
+// WithThrottleBehavior selects how the tunnel reacts when the relay
+// throttles it
+func WithThrottleBehavior(behavior ThrottleBehavior) Option {
+	return func(o *v1.TunnelOptions) { o.OnThrottle = behavior }
+}
+
+// WithHostHeaderMode selects the Host of forwarded requests: the local
+// address, or the public host visitors asked for with HostPreserve
+func WithHostHeaderMode(mode HostHeaderMode) Option {
+	return func(o *v1.TunnelOptions) { o.HostHeaderMode = mode }
+}
+
+// WithHostHeader sends host as the Host of forwarded requests
+func WithHostHeader(host string) Option {
+	return func(o *v1.TunnelOptions) {
+		o.HostHeaderMode = v1.HostCustom
+		o.HostHeader = host
+	}
+}
+
+// WithRequestHeader sets a header on every forwarded request, replacing
+// the value the visitor sent
+func WithRequestHeader(name, value string) Option {
+	return func(o *v1.TunnelOptions) {
+		if o.RequestHeaders == nil {
+			o.RequestHeaders = make(http.Header)
+		}
+		o.RequestHeaders.Add(name, value)
+	}
+}
+
+// WithRegistrationHeader sends a header with the registration request,
+// e.g. for a gateway in front of the relay
+func WithRegistrationHeader(name, value string) Option {
+	return func(o *v1.TunnelOptions) {
+		if o.RegistrationHeaders == nil {
+			o.RegistrationHeaders = make(http.Header)
+		}
+		o.RegistrationHeaders.Add(name, value)
+	}
+}
+
+// WithRegistrationClient sends the registration request with client, e.g.
+// to go through a proxy or trust custom TLS roots
+func WithRegistrationClient(client *http.Client) Option {
+	return func(o *v1.TunnelOptions) {
+		o.RegistrationClient = client
+	}
+}
+
+// WithRelayTLS secures registration and data connections with a relay
+// that authenticates clients with certificates, e.g. with a config loaded
+// by LoadRelayTLS
+func WithRelayTLS(config *tls.Config) Option {
+	return func(o *v1.TunnelOptions) { o.RelayTLS = config }
+}
+
+// WithProxy reaches the relay through an http://, https:// or socks5://
+// proxy, e.g. WithProxy("socks5://127.0.0.1:1080") over an SSH dynamic
+// forward
+func WithProxy(proxy string) Option {
+	return func(o *v1.TunnelOptions) {
+		o.Proxy = proxy
+	}
+}
+
+// WithDialer opens every connection to the relay, a proxy or the local
+// server with dial, e.g. to pin a VPN interface or in tests
+func WithDialer(dial DialFunc) Option {
+	return func(o *v1.TunnelOptions) {
+		o.Dial = dial
+	}
+}
+
+// WithReregisterAfter registers the tunnel again, possibly under a new URL,
+// when its data connections fail to redial for this long; a negative value
+// never does
+func WithReregisterAfter(after time.Duration) Option {
+	return func(o *v1.TunnelOptions) {
+		o.ReregisterAfter = after
+	}
+}
+
+// WithResponseHeader sets a header on every response sent back to
+// visitors, replacing the value the local server set
+func WithResponseHeader(name, value string) Option {
+	return func(o *v1.TunnelOptions) {
+		if o.ResponseHeaders == nil {
+			o.ResponseHeaders = make(http.Header)
+		}
+		o.ResponseHeaders.Add(name, value)
+	}
+}
+
+// WithStripHeaders removes the named headers from forwarded requests
+func WithStripHeaders(names ...string) Option {
+	return func(o *v1.TunnelOptions) { o.StripHeaders = append(o.StripHeaders, names...) }
+}
+
+// WithForwardedHeaders selects whether the X-Forwarded-* headers of
+// forwarded requests are trusted, replaced or stripped
+func WithForwardedHeaders(mode ForwardedMode) Option {
+	return func(o *v1.TunnelOptions) { o.ForwardedHeaders = mode }
+}
+
+// WithRedactHeaders masks the named headers in events, logs and recordings
+func WithRedactHeaders(names ...string) Option {
+	return func(o *v1.TunnelOptions) { o.RedactHeaders = append(o.RedactHeaders, names...) }
+}
+
+// WithRequestInterceptor adds an interceptor run on every request before
+// it is forwarded
+func WithRequestInterceptor(interceptor v1.RequestInterceptor) Option {
+	return func(o *v1.TunnelOptions) {
+		o.RequestInterceptors = append(o.RequestInterceptors, interceptor)
+	}
+}
+
+// WithResponseInterceptor adds an interceptor run on every response before
+// it reaches the visitor
+func WithResponseInterceptor(interceptor v1.ResponseInterceptor) Option {
+	return func(o *v1.TunnelOptions) {
+		o.ResponseInterceptors = append(o.ResponseInterceptors, interceptor)
+	}
+}
+
+// WithLocalURLRewriting replaces links to the local server with the tunnel
+// URL in text responses and redirects
+func WithLocalURLRewriting() Option {
+	return func(o *v1.TunnelOptions) { o.RewriteLocalURLs = true }
+}
+
+// WithStructuredProxy parses every request and forwards it through an
+// httputil.ReverseProxy wrapped in middleware, the first outermost
+func WithStructuredProxy(middleware ...Middleware) Option {
+	return func(o *v1.TunnelOptions) {
+		o.ProxyMode = v1.ProxyStructured
+		o.Middleware = append(o.Middleware, middleware...)
+	}
+}
+
+// WithProxyRetries retries idempotent requests the local server couldn't be
+// reached for or dropped; it needs WithStructuredProxy
+func WithProxyRetries(retries int) Option {
+	return func(o *v1.TunnelOptions) { o.ProxyRetries = retries }
+}
+
+// WithErrorPage sets the html/template sent with 502 when the local server
+// can't be reached
+func WithErrorPage(html string) Option {
+	return func(o *v1.TunnelOptions) { o.ErrorPage = html }
+}
+
+// WithHealthCheck probes the local server and reports health changes as
+// HealthEvents
+func WithHealthCheck(check HealthCheck) Option {
+	return func(o *v1.TunnelOptions) { o.HealthCheck = &check }
+}
+
+// WithWaitForLocal makes Open wait up to timeout for the local port to
+// listen before registering the tunnel
+func WithWaitForLocal(timeout time.Duration) Option {
+	return func(o *v1.TunnelOptions) { o.WaitForLocal = timeout }
+}
+
+// WithAccessLog writes an Apache combined format line per request to w
+func WithAccessLog(w io.Writer) Option {
+	return func(o *v1.TunnelOptions) { o.AccessLog = w }
+}
+
+// WithMaxConnections caps the connection pool below the relay's limit
+func WithMaxConnections(n int) Option {
+	return func(o *v1.TunnelOptions) { o.MaxConnections = n }
+}
+
+// WithMinConnections makes the connection pool autoscale, starting with n
+// connections and dialing more while they're busy
+func WithMinConnections(n int) Option {
+	return func(o *v1.TunnelOptions) { o.MinConnections = n }
+}
+
+// WithLazyConnections opens a single data connection and dials more only
+// when every open one is busy
+func WithLazyConnections() Option {
+	return func(o *v1.TunnelOptions) { o.Lazy = true }
+}
+
+// WithTimeouts sets the dial, registration, idle and request timeouts;
+// zero fields keep their defaults
+func WithTimeouts(timeouts Timeouts) Option {
+	return func(o *v1.TunnelOptions) { o.Timeouts = timeouts }
+}
+
+// WithIdleTimeout replaces data connections that waited this long for a
+// visitor; negative never replaces them
+func WithIdleTimeout(d time.Duration) Option {
+	return func(o *v1.TunnelOptions) { o.Timeouts.Idle = d }
+}
+
+// WithTCPOptions tunes the sockets of relay and local connections
+func WithTCPOptions(tcp TCPOptions) Option {
+	return func(o *v1.TunnelOptions) { o.TCP = tcp }
+}
+
+// WithKeepAlive sets the TCP keepalive period of relay and local
+// connections; negative disables keepalives
+func WithKeepAlive(d time.Duration) Option {
+	return func(o *v1.TunnelOptions) { o.TCP.KeepAlive = d }
+}
+
+// WithBandwidthLimit caps local traffic in bytes per second
+func WithBandwidthLimit(bytesPerSecond int64) Option {
+	return func(o *v1.TunnelOptions) { o.BandwidthLimit = bytesPerSecond }
+}
+
+// WithMaxCaptureBytes bounds memory buffered for request monitoring
+func WithMaxCaptureBytes(n int64) Option {
+	return func(o *v1.TunnelOptions) { o.MaxCaptureBytes = n }
+}
+
+// WithBasicAuth requires visitors to authenticate with HTTP Basic
+// credentials; others get 401 before reaching the local server
+func WithBasicAuth(username, password string) Option {
+	return func(o *v1.TunnelOptions) { o.BasicAuth = &v1.BasicAuth{Username: username, Password: password} }
+}
+
+// WithJWTAuth requires visitors to send a bearer token that auth accepts;
+// others get 401 before reaching the local server
+func WithJWTAuth(auth *v1.JWTAuth) Option {
+	return func(o *v1.TunnelOptions) { o.JWTAuth = auth }
+}
+
+// WithOIDCAuth sends visitors through an OpenID Connect login before their
+// requests are forwarded
+func WithOIDCAuth(auth *v1.OIDCAuth) Option {
+	return func(o *v1.TunnelOptions) { o.OIDCAuth = auth }
+}
+
+// WithShareLinks only admits visitors holding an unexpired link signed by
+// links
+func WithShareLinks(links *v1.ShareLinks) Option {
+	return func(o *v1.TunnelOptions) { o.ShareLinks = links }
+}
+
+// WithAllowPaths only serves request paths matching these patterns
+func WithAllowPaths(patterns ...string) Option {
+	return func(o *v1.TunnelOptions) { o.AllowPaths = append(o.AllowPaths, patterns...) }
+}
+
+// WithDenyPaths never serves request paths matching these patterns
+func WithDenyPaths(patterns ...string) Option {
+	return func(o *v1.TunnelOptions) { o.DenyPaths = append(o.DenyPaths, patterns...) }
+}
+
+// WithAllowIPs admits only clients in the given prefixes; others get 403
+// before reaching the local server
+func WithAllowIPs(prefixes ...netip.Prefix) Option {
+	return func(o *v1.TunnelOptions) { o.AllowIPs = append(o.AllowIPs, prefixes...) }
+}
+
+// WithDenyIPs blocks clients in the given prefixes, even allowed ones
+func WithDenyIPs(prefixes ...netip.Prefix) Option {
+	return func(o *v1.TunnelOptions) { o.DenyIPs = append(o.DenyIPs, prefixes...) }
+}
+
+// WithCountries admits clients by the country db resolves their address
+// to: only allowed countries when allow is not empty, never denied ones
+func WithCountries(db *v1.GeoIPDB, allow, deny []string) Option {
+	return func(o *v1.TunnelOptions) {
+		o.GeoIP = db
+		o.AllowCountries = allow
+		o.DenyCountries = deny
+	}
+}
+
+// WithLabels attaches labels to the tunnel's metrics and logs
+func WithLabels(labels map[string]string) Option {
+	return func(o *v1.TunnelOptions) { o.Labels = labels }
+}
@@ -0,0 +1,19 @@
+package vrata
+
+import (
+	"net/http"
+
+	v1 "github.com/korya/vrata"
+)
+
+// LocalTransport returns an http.RoundTripper that reaches the local
+// server on port exactly as tunneled traffic does
+func LocalTransport(port int, opts ...Option) http.RoundTripper {
+	options := &v1.TunnelOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	options.Port = port
+
+	return v1.LocalTransport(options)
+}
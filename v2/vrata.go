@@ -0,0 +1,535 @@
+// Package vrata exposes localhost to the world through a localtunnel
+// compatible server.
+//
+// This is the v2 API: context-first methods, functional options and a single
+// typed event stream. It is built on top of github.com/korya/vrata (v1); see
+// MIGRATION.md for upgrading.
+package vrata
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	v1 "github.com/korya/vrata"
+)
+
+// Types shared with v1, aliased to ease migration
+type (
+	RequestInfo   = v1.RequestInfo
+	RequestFormat = v1.RequestFormat
+	QueueStats    = v1.QueueStats
+	Stats         = v1.Stats
+	Connection    = v1.ConnectionInfo
+	Info          = v1.TunnelInfo
+
+	LatencyHistogram = v1.LatencyHistogram
+	ServerError      = v1.ServerError
+
+	ThrottleInfo     = v1.ThrottleInfo
+	ThrottleBehavior = v1.ThrottleBehavior
+	ForwardedMode    = v1.ForwardedMode
+	HostHeaderMode   = v1.HostHeaderMode
+
+	BalanceStrategy   = v1.BalanceStrategy
+	StickyMode        = v1.StickyMode
+	HealthCheck       = v1.HealthCheck
+	HealthInfo        = v1.HealthInfo
+	FailoverInfo      = v1.FailoverInfo
+	TunnelState       = v1.TunnelState
+	StateChange       = v1.StateChange
+	URLChange         = v1.URLChange
+	ReconnectInfo     = v1.ReconnectInfo
+	Timeouts          = v1.Timeouts
+	TCPOptions        = v1.TCPOptions
+	UnhealthyBehavior = v1.UnhealthyBehavior
+
+	RequestInterceptor      = v1.RequestInterceptor
+	ResponseInterceptor     = v1.ResponseInterceptor
+	RequestInterceptorFunc  = v1.RequestInterceptorFunc
+	ResponseInterceptorFunc = v1.ResponseInterceptorFunc
+	BodyRewriter            = v1.BodyRewriter
+	Middleware              = v1.Middleware
+
+	Stub     = v1.Stub
+	DialFunc = v1.DialFunc
+
+	GeoIPDB    = v1.GeoIPDB
+	JWTAuth    = v1.JWTAuth
+	OIDCAuth   = v1.OIDCAuth
+	ShareLinks = v1.ShareLinks
+)
+
+// RewriteBodies returns a response interceptor passing response bodies of
+// the given media types through rewrite, for WithResponseInterceptor
+func RewriteBodies(rewrite BodyRewriter, types ...string) ResponseInterceptor {
+	return v1.RewriteBodies(rewrite, types...)
+}
+
+// DefaultRequestFormat is the format of the lines varta --print-requests
+// prints
+const DefaultRequestFormat = v1.DefaultRequestFormat
+
+// ParseRequestFormat parses a text/template formatting the RequestInfo of
+// response events as lines of text
+func ParseRequestFormat(format string) (*RequestFormat, error) {
+	return v1.ParseRequestFormat(format)
+}
+
+// WriteQR draws text, e.g. a tunnel URL, as a QR code on a terminal
+func WriteQR(w io.Writer, text string) error {
+	return v1.WriteQR(w, text)
+}
+
+// ErrQRTooLong is returned by WriteQR for text over 213 bytes
+var ErrQRTooLong = v1.ErrQRTooLong
+
+// CopyToClipboard places text on the system clipboard
+func CopyToClipboard(text string) error {
+	return v1.CopyToClipboard(text)
+}
+
+// ErrNoClipboard is returned by CopyToClipboard when no clipboard tool is
+// installed
+var ErrNoClipboard = v1.ErrNoClipboard
+
+// LoadStubs reads a JSON file of stubs for WithStubs
+func LoadStubs(path string) ([]Stub, error) {
+	return v1.LoadStubs(path)
+}
+
+// ErrBadStub is returned for stubs that can't be served
+var ErrBadStub = v1.ErrBadStub
+
+// LoadRelayTLS reads a client certificate and a relay CA for WithRelayTLS
+func LoadRelayTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	return v1.LoadRelayTLS(certFile, keyFile, caFile)
+}
+
+// ErrBadRelayCA is returned by LoadRelayTLS for a CA file without any PEM
+// certificate
+var ErrBadRelayCA = v1.ErrBadRelayCA
+
+// E2EKeySize is the size of keys for WithE2E
+const E2EKeySize = v1.E2EKeySize
+
+// GenerateE2EKey returns a new random key for WithE2E
+func GenerateE2EKey() ([]byte, error) {
+	return v1.GenerateE2EKey()
+}
+
+// EncodeE2EKey returns key as text for sharing with viewers
+func EncodeE2EKey(key []byte) string {
+	return v1.EncodeE2EKey(key)
+}
+
+// ParseE2EKey decodes a key written by EncodeE2EKey
+func ParseE2EKey(s string) ([]byte, error) {
+	return v1.ParseE2EKey(s)
+}
+
+// ErrBadE2EKey is returned for keys that aren't E2EKeySize bytes
+var ErrBadE2EKey = v1.ErrBadE2EKey
+
+// NewE2EViewer returns the proxy visitors open a WithE2E tunnel through:
+// it seals requests with key, sends them to tunnelURL and answers with the
+// decrypted responses
+func NewE2EViewer(tunnelURL string, key []byte) (http.Handler, error) {
+	return v1.NewE2EViewer(tunnelURL, key)
+}
+
+// DefaultReservationFile returns the per-user file for
+// WithReservationFile, or an empty string when there is none
+func DefaultReservationFile() string {
+	return v1.DefaultReservationFile()
+}
+
+// OpenGeoIP loads a MaxMind database for WithCountries
+func OpenGeoIP(path string) (*GeoIPDB, error) {
+	return v1.OpenGeoIP(path)
+}
+
+// ErrNoGeoIP is returned when country rules are set without a database
+var ErrNoGeoIP = v1.ErrNoGeoIP
+
+// ErrBadPathPattern is returned for malformed path rules
+var ErrBadPathPattern = v1.ErrBadPathPattern
+
+// ErrInvalidHeader is returned for configured headers that can't be sent
+var ErrInvalidHeader = v1.ErrInvalidHeader
+
+// ErrLocalNotListening is returned by Open when the local port doesn't
+// listen within the WithWaitForLocal timeout
+var ErrLocalNotListening = v1.ErrLocalNotListening
+
+// ErrBadErrorPage is returned when the error page isn't a valid template
+var ErrBadErrorPage = v1.ErrBadErrorPage
+
+// ErrInvalidSubdomain is returned when a requested subdomain can't be used
+var ErrInvalidSubdomain = v1.ErrInvalidSubdomain
+
+// Throttle behaviors, see WithThrottleBehavior
+const (
+	ThrottleBackoff = v1.ThrottleBackoff
+	ThrottleIgnore  = v1.ThrottleIgnore
+	ThrottleClose   = v1.ThrottleClose
+)
+
+// Balance strategies, see WithBalance
+const (
+	BalanceRoundRobin       = v1.BalanceRoundRobin
+	BalanceLeastConnections = v1.BalanceLeastConnections
+)
+
+// Host header modes, see WithHostHeaderMode
+const (
+	HostLocal    = v1.HostLocal
+	HostPreserve = v1.HostPreserve
+	HostCustom   = v1.HostCustom
+)
+
+// Forwarded header modes, see WithForwardedHeaders
+const (
+	ForwardedTrust   = v1.ForwardedTrust
+	ForwardedReplace = v1.ForwardedReplace
+	ForwardedStrip   = v1.ForwardedStrip
+)
+
+// Sticky modes, see WithSticky
+const (
+	StickyNone     = v1.StickyNone
+	StickyClientIP = v1.StickyClientIP
+	StickyCookie   = v1.StickyCookie
+)
+
+// ErrBadProxy is returned for a proxy that isn't an http, https or socks5
+// URL
+var ErrBadProxy = v1.ErrBadProxy
+
+// ErrBadLocalTarget is returned for local targets that aren't host:port
+var ErrBadLocalTarget = v1.ErrBadLocalTarget
+
+// Unhealthy behaviors, see HealthCheck
+const (
+	UnhealthyForward   = v1.UnhealthyForward
+	UnhealthyErrorPage = v1.UnhealthyErrorPage
+	UnhealthyPause     = v1.UnhealthyPause
+)
+
+// ErrThrottled is reported when the tunnel gives up because the relay
+// throttled it
+var ErrThrottled = v1.ErrThrottled
+
+// ErrClosed is returned when the tunnel was closed before it could open;
+// it is v1's ErrTunnelClosed
+var ErrClosed = v1.ErrTunnelClosed
+
+// ErrSubdomainTaken is matched by ServerErrors saying that another client
+// holds the requested subdomain
+var ErrSubdomainTaken = v1.ErrSubdomainTaken
+
+// ErrServerUnavailable is matched by registration failures that may pass on
+// their own
+var ErrServerUnavailable = v1.ErrServerUnavailable
+
+// ErrLocalUnreachable wraps failures to connect to the local server, as
+// delivered in ErrorEvents
+var ErrLocalUnreachable = v1.ErrLocalUnreachable
+
+// State describes where a tunnel is in its lifecycle
+type State int
+
+const (
+	StateCreated State = iota
+	StateOpening
+	StateOpen
+	StateClosed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateCreated:
+		return "created"
+	case StateOpening:
+		return "opening"
+	case StateOpen:
+		return "open"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// TunnelState values, reported by Tunnel.TunnelState and StateChangeEvents
+const (
+	TunnelCreated      = v1.StateCreated
+	TunnelRegistering  = v1.StateRegistering
+	TunnelConnected    = v1.StateConnected
+	TunnelDegraded     = v1.StateDegraded
+	TunnelReconnecting = v1.StateReconnecting
+	TunnelClosed       = v1.StateClosed
+)
+
+// Tunnel is a tunnel to a local port
+type Tunnel struct {
+	tunnel *v1.Tunnel
+	events chan Event
+	url    string
+	state  State
+	done   chan struct{}
+	mutex  sync.RWMutex
+}
+
+// New creates a tunnel to the local port without opening it
+func New(port int, opts ...Option) (*Tunnel, error) {
+	options := &v1.TunnelOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	tunnel, err := v1.NewTunnel(port, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tunnel{
+		tunnel: tunnel,
+		events: make(chan Event, 100),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// Open creates a tunnel and opens it in one call
+func Open(ctx context.Context, port int, opts ...Option) (*Tunnel, error) {
+	t, err := New(port, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.Open(ctx); err != nil {
+		t.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// Open registers the tunnel and starts forwarding traffic. ctx bounds the
+// registration only; the tunnel stays open until Close.
+func (t *Tunnel) Open(ctx context.Context) error {
+	t.mutex.Lock()
+	if t.state != StateCreated {
+		t.mutex.Unlock()
+		return errors.New("tunnel was already opened")
+	}
+	t.state = StateOpening
+	t.mutex.Unlock()
+
+	if err := t.tunnel.OpenContext(ctx); err != nil {
+		if ctx.Err() != nil {
+			t.Close()
+			return ctx.Err()
+		}
+		return err
+	}
+	url, err := t.tunnel.URL()
+	if err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	t.url = url
+	if t.state == StateClosed {
+		t.mutex.Unlock()
+		return ErrClosed
+	}
+	t.state = StateOpen
+	t.mutex.Unlock()
+
+	go t.forwardEvents()
+	return nil
+}
+
+// URL returns the public URL, or an empty string before Open succeeds
+func (t *Tunnel) URL() string {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.url
+}
+
+// State returns the current lifecycle state
+func (t *Tunnel) State() State {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.state
+}
+
+// Events returns the stream of tunnel events. It is closed after the
+// ClosedEvent.
+func (t *Tunnel) Events() <-chan Event {
+	return t.events
+}
+
+// QueueStats returns admission queue counters
+func (t *Tunnel) QueueStats() QueueStats {
+	return t.tunnel.QueueStats()
+}
+
+// Stats returns a snapshot of the connection pool, traffic and errors
+func (t *Tunnel) Stats() Stats {
+	return t.tunnel.Stats()
+}
+
+// Info returns what is known about the relay session, or nil before the
+// tunnel is open
+func (t *Tunnel) Info() *Info {
+	return t.tunnel.Info()
+}
+
+// Subdomain returns the subdomain visitors use, or an empty string before
+// the tunnel is open
+func (t *Tunnel) Subdomain() string {
+	return t.tunnel.Subdomain()
+}
+
+// MaxConnections returns how many data connections the relay allows
+func (t *Tunnel) MaxConnections() int {
+	return t.tunnel.MaxConnections()
+}
+
+// DataPort returns the relay port data connections are made to
+func (t *Tunnel) DataPort() int {
+	return t.tunnel.DataPort()
+}
+
+// EventStream returns an http.Handler serving tunnel events as
+// Server-Sent Events
+func (t *Tunnel) EventStream() *v1.EventStream {
+	return t.tunnel.EventStream()
+}
+
+// Connections returns the state of every connection in the pool
+func (t *Tunnel) Connections() []Connection {
+	return t.tunnel.Connections()
+}
+
+// Done is closed once the tunnel has been closed
+func (t *Tunnel) Done() <-chan struct{} {
+	return t.done
+}
+
+// TunnelState returns the state of the connection to the relay, finer
+// than the lifecycle State
+func (t *Tunnel) TunnelState() TunnelState {
+	return t.tunnel.State()
+}
+
+// Ready is closed once the first data connection to the relay is up
+func (t *Tunnel) Ready() <-chan struct{} {
+	return t.tunnel.Ready()
+}
+
+// Wait blocks until the tunnel closes. It returns nil after Close, or the
+// error that made the tunnel close itself, such as ErrThrottled.
+func (t *Tunnel) Wait() error {
+	return t.tunnel.Wait()
+}
+
+// Close shuts the tunnel down; calling it more than once is safe
+func (t *Tunnel) Close() error {
+	t.mutex.Lock()
+	if t.state == StateClosed {
+		t.mutex.Unlock()
+		return nil
+	}
+	wasOpen := t.state == StateOpen
+	t.state = StateClosed
+	t.mutex.Unlock()
+
+	err := t.tunnel.Close()
+	close(t.done)
+	if !wasOpen {
+		// No forwarder is running to finish the event stream
+		t.events <- ClosedEvent{}
+		close(t.events)
+	}
+	return err
+}
+
+// CloseWithTimeout stops taking new visitors, waits up to timeout for the
+// ones being served, then closes the tunnel. The error wraps
+// context.DeadlineExceeded when visitors were cut off.
+func (t *Tunnel) CloseWithTimeout(timeout time.Duration) error {
+	t.mutex.RLock()
+	open := t.state == StateOpen
+	t.mutex.RUnlock()
+
+	var err error
+	if open {
+		err = t.tunnel.CloseWithTimeout(timeout)
+	}
+	if closeErr := t.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ForceClose closes the tunnel right away, cutting off visitors being
+// served. It's the same as Close.
+func (t *Tunnel) ForceClose() error {
+	return t.Close()
+}
+
+// forwardEvents translates v1 event channels into the typed stream
+func (t *Tunnel) forwardEvents() {
+	defer close(t.events)
+
+	events := t.tunnel.Events()
+	for {
+		var event Event
+		select {
+		case info := <-events.Request:
+			event = RequestEvent{info}
+		case info := <-events.Response:
+			event = ResponseEvent{info}
+		case err := <-events.Error:
+			event = ErrorEvent{err}
+		case info := <-events.Throttled:
+			event = ThrottledEvent{info}
+		case info := <-events.Health:
+			event = HealthEvent{info}
+		case info := <-events.Failover:
+			event = FailoverEvent{info}
+		case <-events.Ready:
+			event = ReadyEvent{}
+		case change := <-events.State:
+			event = StateChangeEvent{change}
+		case change := <-events.URLChanged:
+			t.mutex.Lock()
+			t.url = change.URL
+			t.mutex.Unlock()
+			event = URLChangedEvent{change}
+		case info := <-events.Reconnect:
+			event = ReconnectEvent{info}
+		case <-t.tunnel.Done():
+			// The tunnel closed itself; Close finishes the stream
+			t.Close()
+			continue
+		case <-t.done:
+			select {
+			case t.events <- ClosedEvent{}:
+			default:
+			}
+			return
+		}
+
+		select {
+		case t.events <- event:
+		default:
+			// Drop events nobody keeps up with rather than stall the tunnel
+		}
+	}
+}
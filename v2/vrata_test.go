@@ -0,0 +1,88 @@
+package vrata
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newRegistrationServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"v2","url":"https://v2.localtunnel.me","port":1,"max_conn_count":1}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestOpen(t *testing.T) {
+	server := newRegistrationServer(t)
+
+	tunnel, err := Open(context.Background(), 8080, WithHost(server.URL), WithSubdomain("MyApp"))
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+
+	if tunnel.URL() != "https://v2.localtunnel.me" {
+		t.Errorf("Expected URL 'https://v2.localtunnel.me', got '%s'", tunnel.URL())
+	}
+	// URL is stored, so repeated calls are fine
+	if tunnel.URL() != tunnel.URL() {
+		t.Error("URL() should be idempotent")
+	}
+	if tunnel.State() != StateOpen {
+		t.Errorf("Expected state open, got %s", tunnel.State())
+	}
+
+	tunnel.Close()
+	tunnel.Close()
+
+	if tunnel.State() != StateClosed {
+		t.Errorf("Expected state closed, got %s", tunnel.State())
+	}
+	select {
+	case <-tunnel.Done():
+	default:
+		t.Error("Done() should be closed after Close()")
+	}
+	if err := tunnel.Wait(); err != nil {
+		t.Errorf("Wait() after Close() = %v, want nil", err)
+	}
+
+	var sawClosed bool
+	for event := range tunnel.Events() {
+		if _, ok := event.(ClosedEvent); ok {
+			sawClosed = true
+		}
+	}
+	if !sawClosed {
+		t.Error("Expected a ClosedEvent before the stream ends")
+	}
+}
+
+func TestOpenContextDeadline(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := Open(ctx, 8080, WithHost(server.URL))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestNewInvalidSubdomain(t *testing.T) {
+	if _, err := New(8080, WithSubdomain("a!")); !errors.Is(err, ErrInvalidSubdomain) {
+		t.Errorf("Expected ErrInvalidSubdomain, got %v", err)
+	}
+}